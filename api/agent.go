@@ -7,10 +7,12 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/VictorLowther/jsonpatch2/utils"
 	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
 )
 
 // This implements a new machine agent structured as a finite state
@@ -57,6 +59,7 @@ type MachineAgent struct {
 	doPower, exitOnNotRunnable, exitOnFailure bool
 	logger                                    io.Writer
 	err                                       error
+	inventory                                 func() (*models.Inventory, error)
 }
 
 // NewAgent creates a new FSM based Machine Agent that starts out in
@@ -98,6 +101,31 @@ func (a *MachineAgent) Timeout(t time.Duration) *MachineAgent {
 	return a
 }
 
+// Inventory makes the Agent upload the hardware inventory returned
+// by collect for the Machine when it starts.
+func (a *MachineAgent) Inventory(collect func() (*models.Inventory, error)) *MachineAgent {
+	a.inventory = collect
+	return a
+}
+
+// uploadInventory collects and uploads the hardware inventory of the
+// Machine, if the Agent was asked to.  Failures are logged, but do not
+// stop the Agent.
+func (a *MachineAgent) uploadInventory() {
+	if a.inventory == nil {
+		return
+	}
+	inv, err := a.inventory()
+	if err == nil {
+		_, err = a.client.UploadInventory(a.machine, inv)
+	}
+	if err != nil {
+		a.Logf("MachineAgent: unable to upload hardware inventory: %v\n", err)
+		return
+	}
+	a.inventory = nil
+}
+
 func (a *MachineAgent) power(cmdLine string) error {
 	if !a.doPower {
 		return nil
@@ -147,8 +175,12 @@ func (a *MachineAgent) Init() {
 		a.events = nil
 	}
 	var err error
-	currentJob := &models.Job{Uuid: a.machine.CurrentJob}
-	if a.client.Req().Fill(currentJob) == nil {
+	currentJobs := append([]uuid.UUID{a.machine.CurrentJob}, a.machine.CurrentJobs...)
+	for _, id := range currentJobs {
+		currentJob := &models.Job{Uuid: id}
+		if a.client.Req().Fill(currentJob) != nil {
+			continue
+		}
 		if currentJob.State == "running" || currentJob.State == "created" {
 			cj := models.Clone(currentJob).(*models.Job)
 			cj.State = "failed"
@@ -158,6 +190,7 @@ func (a *MachineAgent) Init() {
 			}
 		}
 	}
+	a.uploadInventory()
 	a.events, a.err = a.client.Events()
 	if a.err != nil {
 		a.Logf("MachineAgent: error attaching to event stream: %v", err)
@@ -184,9 +217,9 @@ func (a *MachineAgent) rebootOrExit() {
 //
 // * AGENT_REBOOT if the machine wants to change bootenvs
 //
-// * AGENT_RUN_TASK if the machine is runnable.
+// * AGENT_RUN_TASK if the machine is runnable and not paused.
 //
-// * AGENT_WAIT_FOR_RUNNABLE if the machine is not runnable.
+// * AGENT_WAIT_FOR_RUNNABLE if the machine is not runnable or paused.
 func (a *MachineAgent) waitOn(m *models.Machine, cond TestFunc) {
 	found, err := a.events.WaitFor(m, AndItems(EqualItem("Available", true), cond), a.waitTimeout)
 	if err != nil {
@@ -206,7 +239,7 @@ func (a *MachineAgent) waitOn(m *models.Machine, cond TestFunc) {
 	case "complete":
 		if m.BootEnv != a.machine.BootEnv {
 			a.rebootOrExit()
-		} else if m.Runnable {
+		} else if m.Runnable && !m.Paused && !m.Locked {
 			a.state = AGENT_RUN_TASK
 		} else {
 			a.state = AGENT_WAIT_FOR_RUNNABLE
@@ -224,27 +257,98 @@ func (a *MachineAgent) waitOn(m *models.Machine, cond TestFunc) {
 	a.machine = m
 }
 
-// WaitRunnable has waitOn wait for the Machine to become runnable.
+// WaitRunnable has waitOn wait for the Machine to become runnable,
+// and to not be paused or locked.
 func (a *MachineAgent) WaitRunnable() {
 	m := models.Clone(a.machine).(*models.Machine)
-	a.Logf("Waiting on machine to become runnable\n")
-	a.waitOn(m, EqualItem("Runnable", true))
+	if m.Paused {
+		a.Logf("Machine is paused, waiting for it to be resumed\n")
+	} else if m.Locked {
+		a.Logf("Machine is locked by %s (%s), waiting for it to be unlocked\n", m.LockOwner, m.LockReason)
+	} else {
+		a.Logf("Waiting on machine to become runnable\n")
+	}
+	a.waitOn(m, AndItems(EqualItem("Runnable", true), EqualItem("Paused", false), EqualItem("Locked", false)))
+}
+
+// watchCancel kills runners when the Machine is cancelled.  The
+// returned func stops watching.
+func (a *MachineAgent) watchCancel(runners []*TaskRunner) func() {
+	handle, cancels, err := a.events.Register("machines.cancel." + a.machine.Key())
+	if err != nil {
+		a.Logf("Unable to watch for cancellation: %v\n", err)
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case _, ok := <-cancels:
+			if !ok {
+				return
+			}
+			a.Logf("Machine cancelled, stopping running tasks\n")
+			for _, runner := range runners {
+				runner.Cancel()
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		a.events.Deregister(handle)
+	}
+}
+
+// groupRunners creates TaskRunners for the rest of the members of
+// the task group that first is running a member of.  It returns just
+// first if first is not part of a task group.
+func (a *MachineAgent) groupRunners(first *TaskRunner) []*TaskRunner {
+	runners := []*TaskRunner{first}
+	idx := first.j.CurrentIndex
+	if idx < 0 || idx >= len(a.machine.Tasks) {
+		return runners
+	}
+	members := models.TaskGroupMembers(a.machine.Tasks[idx])
+	seen := map[string]bool{first.j.Key(): true}
+	for len(runners) < len(members) {
+		runner, err := NewTaskRunner(a.client, models.Clone(a.machine).(*models.Machine), a.runnerDir, a.logger)
+		if err != nil {
+			a.Logf("Unable to start the rest of task group %s: %v\n", a.machine.Tasks[idx], err)
+			break
+		}
+		if runner == nil || seen[runner.j.Key()] || runner.j.CurrentIndex != idx {
+			break
+		}
+		seen[runner.j.Key()] = true
+		runners = append(runners, runner)
+	}
+	return runners
 }
 
-// RunTask attempts to run the next task on the Machine.  It may
-// transition to the following states:
+// RunTask attempts to run the next task on the Machine.  If the next
+// task is a task group, the Jobs for all of the members of the group
+// are run at the same time, and if one of them fails the rest are
+// cancelled.  It may transition to the following
+// states:
 //
 // * AGENT_CHANGE_STAGE if there are no tasks to run.
 //
-// * AGENT_REBOOT if the task signalled that the machine should reboot
+// * AGENT_WAIT_FOR_RUNNABLE if the machine is paused or locked, or the
+//   running tasks were cancelled.
+//
+// * AGENT_REBOOT if a task signalled that the machine should reboot
 //
-// * AGENT_POWEROFF if the task signalled that the machine should shut down
+// * AGENT_POWEROFF if a task signalled that the machine should shut down
 //
-// * AGENT_EXIT if the task signalled that the agent should stop.
+// * AGENT_EXIT if a task signalled that the agent should stop.
 //
 // * AGENT_WAIT_FOR_RUNNABLE if no other conditions were met.
 func (a *MachineAgent) RunTask() {
-	runner, err := NewTaskRunner(a.client, a.machine, a.runnerDir, a.logger)
+	if a.machine.Paused || a.machine.Locked {
+		a.state = AGENT_WAIT_FOR_RUNNABLE
+		return
+	}
+	runner, err := NewTaskRunner(a.client, models.Clone(a.machine).(*models.Machine), a.runnerDir, a.logger)
 	if err != nil {
 		a.err = err
 		a.initOrExit()
@@ -261,37 +365,89 @@ func (a *MachineAgent) RunTask() {
 			return
 		}
 	}
-	a.Logf("Runner created for task %s:%s (%d:%d)",
-		runner.j.Uuid.String(),
-		runner.j.Task,
-		runner.j.CurrentIndex,
-		runner.j.NextIndex)
-	if err := runner.Run(); err != nil {
-		a.err = err
-		a.initOrExit()
-		return
+	runners := a.groupRunners(runner)
+	stopWatching := a.watchCancel(runners)
+	errs := make([]error, len(runners))
+	wg := &sync.WaitGroup{}
+	// The group is finished once every member has finished or any
+	// member has failed, so the first failure stops the rest.
+	stopGroup := &sync.Once{}
+	for i := range runners {
+		a.Logf("Runner created for task %s:%s (%d:%d)",
+			runners[i].j.Uuid.String(),
+			runners[i].j.Task,
+			runners[i].j.CurrentIndex,
+			runners[i].j.NextIndex)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = runners[i].Run()
+			if len(runners) == 1 || (errs[i] == nil && !runners[i].failed) {
+				return
+			}
+			stopGroup.Do(func() {
+				a.Logf("Task %s failed, stopping the rest of its task group\n", runners[i].j.Task)
+				for j := range runners {
+					if j != i {
+						runners[j].Abort()
+					}
+				}
+			})
+		}(i)
+	}
+	wg.Wait()
+	stopWatching()
+	for i := range runners {
+		defer runners[i].Close()
+	}
+	for _, runner := range runners {
+		if runner.Cancelled() && !runner.Aborted() {
+			// The machine was paused when the jobs were cancelled.
+			a.state = AGENT_WAIT_FOR_RUNNABLE
+			return
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			a.err = err
+			a.initOrExit()
+			return
+		}
 	}
 	a.state = AGENT_WAIT_FOR_RUNNABLE
-	defer runner.Close()
-	if runner.reboot {
-		runner.Log("Task signalled runner to reboot")
+	reboot, poweroff, stop := false, false, false
+	for _, runner := range runners {
+		if runner.Aborted() {
+			runner.Log("Task stopped because another member of its task group failed")
+			continue
+		}
+		if runner.reboot {
+			runner.Log("Task signalled runner to reboot")
+			reboot = true
+		} else if runner.poweroff {
+			runner.Log("Task signalled runner to poweroff")
+			poweroff = true
+		} else if runner.stop {
+			runner.Log("Task signalled runner to stop")
+			stop = true
+		} else if runner.failed {
+			runner.Log("Task signalled that it failed")
+			if a.exitOnFailure {
+				stop = true
+			}
+		}
+		if runner.incomplete {
+			runner.Log("Task signalled that it was incomplete")
+		} else if !runner.failed {
+			runner.Log("Task signalled that it finished normally")
+		}
+	}
+	if reboot {
 		a.rebootOrExit()
-	} else if runner.poweroff {
-		runner.Log("Task signalled runner to poweroff")
+	} else if poweroff {
 		a.state = AGENT_POWEROFF
-	} else if runner.stop {
-		runner.Log("Task signalled runner to stop")
+	} else if stop {
 		a.state = AGENT_EXIT
-	} else if runner.failed {
-		runner.Log("Task signalled that it failed")
-		if a.exitOnFailure {
-			a.state = AGENT_EXIT
-		}
-	}
-	if runner.incomplete {
-		runner.Log("Task signalled that it was incomplete")
-	} else if !runner.failed {
-		runner.Log("Task signalled that it finished normally")
 	}
 }
 
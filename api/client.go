@@ -719,6 +719,119 @@ func (c *Client) PutModel(obj models.Model) error {
 	return c.Req().Put(obj).UrlForM(obj).Do(&obj)
 }
 
+// Bulk applies a patch to, or runs an action on, every object of
+// type prefix that matches the Filter of req, and returns the outcome
+// for each of them.
+func (c *Client) Bulk(prefix string, req *models.BulkRequest) (*models.BulkResponse, error) {
+	res := &models.BulkResponse{}
+	return res, c.Req().Post(req).UrlFor("bulk", prefix).Do(res)
+}
+
+// AllocateMachines allocates req.Count Machines from the Pool pool.
+func (c *Client) AllocateMachines(pool string, req *models.PoolAllocation) ([]*models.Machine, error) {
+	res := []*models.Machine{}
+	return res, c.Req().Post(req).UrlFor("pools", pool, "allocate").Do(&res)
+}
+
+// ReleaseMachines releases Machines back to the Pool pool.
+func (c *Client) ReleaseMachines(pool string, req *models.PoolRelease) ([]*models.Machine, error) {
+	res := []*models.Machine{}
+	return res, c.Req().Post(req).UrlFor("pools", pool, "release").Do(&res)
+}
+
+// UploadInventory saves inv as the new hardware inventory of the
+// Machine m.
+func (c *Client) UploadInventory(m *models.Machine, inv *models.Inventory) (*models.Inventory, error) {
+	res := &models.Inventory{}
+	return res, c.Req().Post(inv).UrlForM(m, "inventory").Do(res)
+}
+
+// MachineDuplicates returns the sets of Machines that appear to be
+// the same system.
+func (c *Client) MachineDuplicates() ([]*models.MachineDuplicate, error) {
+	res := []*models.MachineDuplicate{}
+	return res, c.Req().UrlFor("machine_duplicates").Do(&res)
+}
+
+// MergeMachines folds the Machine dup into the Machine m, deletes
+// dup, and returns the updated m.
+func (c *Client) MergeMachines(m, dup *models.Machine) (*models.Machine, error) {
+	res := &models.Machine{}
+	return res, c.Req().Post(nil).UrlForM(m, "merge", dup.Key()).Do(res)
+}
+
+func (c *Client) machineControl(m *models.Machine, cmd string) (*models.Machine, error) {
+	res := &models.Machine{}
+	return res, c.Req().Post(map[string]interface{}{}).UrlForM(m, "actions", cmd).Do(res)
+}
+
+// PauseMachine pauses the Machine m.  The Job m is running is allowed
+// to finish, but no new Jobs will be created until m is resumed.
+func (c *Client) PauseMachine(m *models.Machine) (*models.Machine, error) {
+	return c.machineControl(m, "pause")
+}
+
+// ResumeMachine lets a paused Machine m continue with its Tasks.
+func (c *Client) ResumeMachine(m *models.Machine) (*models.Machine, error) {
+	return c.machineControl(m, "resume")
+}
+
+// CancelMachine cancels the Jobs the Machine m is running, and pauses
+// m.
+func (c *Client) CancelMachine(m *models.Machine) (*models.Machine, error) {
+	return c.machineControl(m, "cancel")
+}
+
+// RenameMachine renames the Machine m with the name template for
+// it, and updates the hostname of its Reservations.
+func (c *Client) RenameMachine(m *models.Machine) (*models.Machine, error) {
+	return c.machineControl(m, "rename")
+}
+
+// LockMachine locks the Machine m for reason.  The Stage, BootEnv,
+// Workflow, Tasks, and Params of m cannot be changed, and no new Jobs
+// are created for it, until it is unlocked.
+func (c *Client) LockMachine(m *models.Machine, reason string) (*models.Machine, error) {
+	res := &models.Machine{}
+	return res, c.Req().Post(map[string]interface{}{"reason": reason}).UrlForM(m, "actions", "lock").Do(res)
+}
+
+// UnlockMachine removes the lock from the Machine m.
+func (c *Client) UnlockMachine(m *models.Machine) (*models.Machine, error) {
+	return c.machineControl(m, "unlock")
+}
+
+func (c *Client) rolloutControl(r *models.Rollout, cmd string) (*models.Rollout, error) {
+	res := &models.Rollout{}
+	return res, c.Req().Post(map[string]interface{}{}).UrlForM(r, "actions", cmd).Do(res)
+}
+
+// PauseRollout stops the Rollout r from starting more Machines.
+func (c *Client) PauseRollout(r *models.Rollout) (*models.Rollout, error) {
+	return c.rolloutControl(r, "pause")
+}
+
+// ResumeRollout lets a paused or halted Rollout r carry on.  Resuming
+// a halted Rollout lets its current wave finish regardless of how
+// many of its Machines fail.
+func (c *Client) ResumeRollout(r *models.Rollout) (*models.Rollout, error) {
+	return c.rolloutControl(r, "resume")
+}
+
+// CheckWorkflow checks whether the Workflow workflow would work on
+// the Machine m, without changing m.
+func (c *Client) CheckWorkflow(m *models.Machine, workflow string) (*models.WorkflowCheck, error) {
+	res := &models.WorkflowCheck{}
+	return res, c.Req().Post(map[string]interface{}{"workflow": workflow}).UrlForM(m, "actions", "checkWorkflow").Do(res)
+}
+
+// WorkflowGraph fetches the expanded structure of the Workflow name.
+// Use (*models.WorkflowGraph).Dot to render it for Graphviz.
+func (c *Client) WorkflowGraph(name string) (*models.WorkflowGraph, error) {
+	res := &models.WorkflowGraph{}
+	return res, c.Req().UrlFor("workflows", name, "graph").Do(res)
+}
+
 // TokenSession creates a new api.Client that will use the passed-in Token for authentication.
 // It should be used whenever the API is not acting on behalf of a user.
 func TokenSession(endpoint, token string) (*Client, error) {
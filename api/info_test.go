@@ -57,6 +57,11 @@ func TestInfo(t *testing.T) {
 				"secure-params",
 				"seperate-meta-api",
 				"slim-objects",
+				"machine-pools",
+				"schedules",
+				"rollouts",
+				"rules",
+				"policies",
 			},
 			License: models.LicenseBundle{Licenses: []models.License{}},
 			Scopes: map[string]map[string]struct{}{
@@ -159,6 +164,26 @@ func TestInfo(t *testing.T) {
 					"update":       {},
 					"updateSecure": {},
 				},
+				"policies": {
+					"action":  {},
+					"actions": {},
+					"create":  {},
+					"delete":  {},
+					"get":     {},
+					"list":    {},
+					"update":  {},
+				},
+				"pools": {
+					"action":   {},
+					"actions":  {},
+					"allocate": {},
+					"create":   {},
+					"delete":   {},
+					"get":      {},
+					"list":     {},
+					"release":  {},
+					"update":   {},
+				},
 				"preferences": {
 					"list": {},
 					"post": {},
@@ -192,6 +217,33 @@ func TestInfo(t *testing.T) {
 					"list":    {},
 					"update":  {},
 				},
+				"rollouts": {
+					"action":  {},
+					"actions": {},
+					"create":  {},
+					"delete":  {},
+					"get":     {},
+					"list":    {},
+					"update":  {},
+				},
+				"rules": {
+					"action":  {},
+					"actions": {},
+					"create":  {},
+					"delete":  {},
+					"get":     {},
+					"list":    {},
+					"update":  {},
+				},
+				"schedules": {
+					"action":  {},
+					"actions": {},
+					"create":  {},
+					"delete":  {},
+					"get":     {},
+					"list":    {},
+					"update":  {},
+				},
 				"stages": {
 					"action":  {},
 					"actions": {},
@@ -3,6 +3,7 @@ package api
 // Come back to processJobs later
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -37,6 +39,8 @@ func (c *Client) JobActions(j *models.Job) ([]*models.JobAction, error) {
 type TaskRunner struct {
 	// Status codes that may be returned when a script exits.
 	failed, incomplete, reboot, poweroff, stop bool
+	// The exit code of the last script that was run.
+	exitCode int
 	// Client that the TaskRunner will use to communicate with the API
 	c *Client
 	// The Job that the TaskRunner will log to and update the status of.
@@ -53,6 +57,11 @@ type TaskRunner struct {
 	pipeWriter       net.Conn
 	agentDir, jobDir string
 	logger           io.Writer
+	// The script that is running, whether the Job was cancelled, and
+	// whether the agent aborted it before it finished.
+	mux                       sync.Mutex
+	cmd                       *exec.Cmd
+	cancelled, aborted, ended bool
 }
 
 // NewTaskRunner creates a new TaskRunner for the passed-in machine.
@@ -118,6 +127,49 @@ func (r *TaskRunner) Close() {
 	}
 }
 
+// Cancel kills the script the TaskRunner is running, and keeps it
+// from running the rest of the actions of the Job.  The server has
+// already marked the Job as cancelled, so the TaskRunner leaves its
+// state alone.
+func (r *TaskRunner) Cancel() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cancelled = true
+	if r.cmd != nil && r.cmd.Process != nil {
+		r.cmd.Process.Kill()
+	}
+}
+
+// Abort stops the TaskRunner like Cancel, for when the agent rather
+// than the server decides the Job should stop, such as when another
+// member of its task group has failed.  The TaskRunner marks the Job
+// as cancelled when it stops.  Abort does nothing if the Job has
+// already reached its final state.
+func (r *TaskRunner) Abort() {
+	r.mux.Lock()
+	if r.ended {
+		r.mux.Unlock()
+		return
+	}
+	r.aborted = true
+	r.mux.Unlock()
+	r.Cancel()
+}
+
+// Aborted returns true if the agent aborted the Job.
+func (r *TaskRunner) Aborted() bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.aborted
+}
+
+// Cancelled returns true if the Job was cancelled.
+func (r *TaskRunner) Cancelled() bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.cancelled
+}
+
 // Log writes the string (with a timestamp) to stderr and to the
 // server-side log for the current job.
 func (r *TaskRunner) Log(s string, items ...interface{}) {
@@ -158,14 +210,30 @@ func (r *TaskRunner) Perform(action *models.JobAction, taskDir string) error {
 	cmd := exec.Command(cmdArray[0], cmdArray[1:]...)
 
 	cmd.Dir = taskDir
-	cmd.Env = append(os.Environ(), "RS_TASK_DIR="+taskDir, "RS_RUNNER_DIR="+r.agentDir)
+	cmd.Env = append(os.Environ(),
+		"RS_TASK_DIR="+taskDir,
+		"RS_RUNNER_DIR="+r.agentDir,
+		"RS_RESULT_FILE="+resultFile(taskDir))
 	cmd.Stdout = r.in
 	cmd.Stderr = r.in
 	r.Log("Starting command %s\n\n", cmd.Path)
+	r.mux.Lock()
+	if r.cancelled {
+		r.mux.Unlock()
+		return nil
+	}
 	if err := cmd.Start(); err != nil {
+		r.mux.Unlock()
 		r.Log("Command failed to start: %v", err)
 		return err
 	}
+	r.cmd = cmd
+	r.mux.Unlock()
+	defer func() {
+		r.mux.Lock()
+		r.cmd = nil
+		r.mux.Unlock()
+	}()
 	// Wait on the process, not the command to exit.
 	// We don't want to auto-close stdout and stderr,
 	// as we will continue to use them.
@@ -178,6 +246,7 @@ func (r *TaskRunner) Perform(action *models.JobAction, taskDir string) error {
 		sane = err == nil && st.Mode().IsRegular()
 	}
 	code := uint(status.ExitStatus())
+	r.exitCode = int(code)
 	r.Log("Command exited with status %d", code)
 	if sane {
 		// codes can be between 0 and 255
@@ -209,6 +278,29 @@ func (r *TaskRunner) Perform(action *models.JobAction, taskDir string) error {
 	return nil
 }
 
+// resultFile is where the scripts of a task write the JSON object
+// that becomes the Result of the Job.
+func resultFile(taskDir string) string {
+	return path.Join(taskDir, "result.json")
+}
+
+// readResult reads the Result the scripts of the task left behind.
+// It returns nil if they did not leave one.
+func (r *TaskRunner) readResult(taskDir string) (map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(resultFile(taskDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Run loops over all of the actions for a particular job,
 // placing files and executing scripts as appropriate.
 // It also arranges for all logging output for the actions
@@ -271,6 +363,26 @@ func (r *TaskRunner) Run() error {
 	// to an appropriate final state.
 	defer os.RemoveAll(taskDir)
 	defer func() {
+		r.mux.Lock()
+		r.ended = true
+		cancelled, aborted := r.cancelled, r.aborted
+		r.mux.Unlock()
+		if cancelled {
+			r.Log("Job %s was cancelled", r.j.Key())
+			if aborted {
+				cancelPatch := jsonpatch2.Patch{{Op: "replace", Path: "/State", Value: "cancelled"}}
+				if err := r.c.Req().Patch(cancelPatch).UrlForM(r.j).Do(&r.j); err != nil {
+					r.Log("Failed to mark job %s as cancelled: %v", r.j.Key(), err)
+				}
+			}
+			return
+		}
+		result, err := r.readResult(taskDir)
+		if err != nil {
+			r.Log("Failed to read the job result: %v", err)
+			r.failed = true
+			finalState = "failed"
+		}
 		if r.failed || r.reboot || r.stop || r.poweroff || r.incomplete {
 			newM := models.Clone(r.m).(*models.Machine)
 			newM.Runnable = false
@@ -296,6 +408,12 @@ func (r *TaskRunner) Run() error {
 			{Op: "test", Path: "/State", Value: "running"},
 			{Op: "replace", Path: "/State", Value: finalState},
 			{Op: "replace", Path: "/ExitState", Value: exitState},
+			// add rather than replace, so older servers without
+			// ExitCode ignore it.
+			{Op: "add", Path: "/ExitCode", Value: r.exitCode},
+		}
+		if result != nil {
+			finalPatch = append(finalPatch, jsonpatch2.Operation{Op: "add", Path: "/Result", Value: result})
 		}
 		if err := r.c.Req().Patch(finalPatch).UrlForM(r.j).Do(&r.j); err != nil {
 			r.Log("Failed to update job %s to its final state %s", r.j.Key(), finalState)
@@ -318,6 +436,9 @@ func (r *TaskRunner) Run() error {
 		return finalErr
 	}
 	for i, action := range actions {
+		if r.Cancelled() {
+			break
+		}
 		final := len(actions)-1 == i
 		r.failed = false
 		r.incomplete = false
@@ -366,6 +487,10 @@ func (r *TaskRunner) Run() error {
 			break
 		}
 	}
+	if r.Cancelled() {
+		r.Log("Task %s cancelled", r.j.Task)
+		return nil
+	}
 	if !r.failed && !r.incomplete {
 		finalState = "finished"
 	}
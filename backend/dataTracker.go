@@ -260,6 +260,26 @@ func Fill(t store.KeySaver) {
 		if obj.Tenant == nil {
 			obj.Tenant = &models.Tenant{}
 		}
+	case *Pool:
+		if obj.Pool == nil {
+			obj.Pool = &models.Pool{}
+		}
+	case *Schedule:
+		if obj.Schedule == nil {
+			obj.Schedule = &models.Schedule{}
+		}
+	case *Rollout:
+		if obj.Rollout == nil {
+			obj.Rollout = &models.Rollout{}
+		}
+	case *Rule:
+		if obj.Rule == nil {
+			obj.Rule = &models.Rule{}
+		}
+	case *Policy:
+		if obj.Policy == nil {
+			obj.Policy = &models.Policy{}
+		}
 	default:
 		panic(fmt.Sprintf("Unknown backend model %T", t))
 	}
@@ -303,6 +323,16 @@ func ModelToBackend(m models.Model) store.KeySaver {
 		return &Role{Role: obj}
 	case *models.Tenant:
 		return &Tenant{Tenant: obj}
+	case *models.Pool:
+		return &Pool{Pool: obj}
+	case *models.Schedule:
+		return &Schedule{Schedule: obj}
+	case *models.Rollout:
+		return &Rollout{Rollout: obj}
+	case *models.Rule:
+		return &Rule{Rule: obj}
+	case *models.Policy:
+		return &Policy{Policy: obj}
 	default:
 		return nil
 	}
@@ -498,6 +528,56 @@ func toBackend(m models.Model, rt *RequestTracker) store.KeySaver {
 		res.Tenant = obj
 		res.rt = rt
 		return &res
+	case *models.Pool:
+		var res Pool
+		if ours != nil {
+			res = *ours.(*Pool)
+		} else {
+			res = Pool{}
+		}
+		res.Pool = obj
+		res.rt = rt
+		return &res
+	case *models.Schedule:
+		var res Schedule
+		if ours != nil {
+			res = *ours.(*Schedule)
+		} else {
+			res = Schedule{}
+		}
+		res.Schedule = obj
+		res.rt = rt
+		return &res
+	case *models.Rollout:
+		var res Rollout
+		if ours != nil {
+			res = *ours.(*Rollout)
+		} else {
+			res = Rollout{}
+		}
+		res.Rollout = obj
+		res.rt = rt
+		return &res
+	case *models.Rule:
+		var res Rule
+		if ours != nil {
+			res = *ours.(*Rule)
+		} else {
+			res = Rule{}
+		}
+		res.Rule = obj
+		res.rt = rt
+		return &res
+	case *models.Policy:
+		var res Policy
+		if ours != nil {
+			res = *ours.(*Policy)
+		} else {
+			res = Policy{}
+		}
+		res.Policy = obj
+		res.rt = rt
+		return &res
 
 	default:
 		log.Panicf("Unknown model %T", m)
@@ -559,7 +639,10 @@ type DataTracker struct {
 	StaticPort, ApiPort int
 	FS                  *FileSystem
 	Backend, Secrets    store.Store
+	ExternalSecrets     *SecretStore
 	secretsMux          *sync.Mutex
+	keyRotation         *models.KeyRotation
+	keyRotationMux      *sync.Mutex
 	objs                map[string]*Store
 	defaultPrefs        map[string]string
 	runningPrefs        map[string]string
@@ -574,6 +657,8 @@ type DataTracker struct {
 	publishers          *Publishers
 	macAddrMap          map[string]string
 	macAddrMux          *sync.RWMutex
+	policies            map[string]*Policy
+	policyMux           *sync.RWMutex
 	licenses            models.LicenseBundle
 }
 
@@ -606,6 +691,11 @@ func allKeySavers() []models.Model {
 		&Plugin{},
 		&Job{},
 		&Tenant{},
+		&Pool{},
+		&Schedule{},
+		&Rollout{},
+		&Rule{},
+		&Policy{},
 	}
 }
 
@@ -748,6 +838,27 @@ func (p *DataTracker) rebuildCache(loadRT *RequestTracker) (hard, soft *models.E
 				benv.rt = nil
 			}
 		}
+		if prefix == "profiles" {
+			// Profiles can include other profiles, which may not have
+			// been loaded when the including profile was validated.
+			for _, thing := range p.objs[prefix].Items() {
+				profile := AsProfile(thing)
+				profile.rt = loadRT
+				profile.ClearValidation()
+				profile.Validate()
+				profile.rt = nil
+			}
+		}
+
+		if prefix == "policies" {
+			p.policyMux.Lock()
+			p.policies = map[string]*Policy{}
+			for _, thing := range p.objs[prefix].Items() {
+				policy := AsPolicy(thing)
+				p.policies[policy.Name] = policy
+			}
+			p.policyMux.Unlock()
+		}
 
 		if prefix == "templates" {
 			buf := &bytes.Buffer{}
@@ -791,7 +902,10 @@ func ValidateDataTrackerStore(fileRoot string, backend, secrets store.Store, log
 		publishers:        &Publishers{},
 		macAddrMap:        map[string]string{},
 		macAddrMux:        &sync.RWMutex{},
+		policies:          map[string]*Policy{},
+		policyMux:         &sync.RWMutex{},
 		secretsMux:        &sync.Mutex{},
+		keyRotationMux:    &sync.Mutex{},
 	}
 
 	// Load stores.
@@ -833,7 +947,10 @@ func NewDataTracker(backend, secrets store.Store,
 		publishers:        publishers,
 		macAddrMap:        map[string]string{},
 		macAddrMux:        &sync.RWMutex{},
+		policies:          map[string]*Policy{},
+		policyMux:         &sync.RWMutex{},
 		secretsMux:        &sync.Mutex{},
+		keyRotationMux:    &sync.Mutex{},
 	}
 
 	// Make sure incoming writable backend has all stores created
@@ -1073,10 +1190,19 @@ func (p *DataTracker) SetPrefs(rt *RequestTracker, prefs map[string]string) erro
 				err.AddError(p.RenderUnknown(rt))
 			}
 		case "unknownTokenTimeout",
-			"knownTokenTimeout":
+			"knownTokenTimeout",
+			"jobRetentionCount",
+			"jobRetentionDays",
+			"jobArchiveDays":
 			if intCheck(name, val) {
 				savePref(name, val)
 			}
+		case "machineNameTemplate":
+			if _, e := template.New(name).Parse(val); e != nil {
+				err.Errorf("%s: %v", name, e)
+			} else {
+				savePref(name, val)
+			}
 		case "debugDhcp",
 			"debugRenderer",
 			"debugBootEnv",
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/digitalrebar/store"
+)
+
+// ConvertValueToFilter processes the value into a function, if
+// function not specified, assume Eq.
+// Supported Forms:
+//
+//   Eq(value)
+//   Lt(value)
+//   Lte(value)
+//   Gt(value)
+//   Gte(value)
+//   Ne(value)
+//   Between(valueLower, valueHigher)
+//   Except(valueLower, valueHigher)
+//
+func ConvertValueToFilter(v string) (index.Filter, error) {
+	args := strings.SplitN(v, "(", 2)
+	if len(args) != 2 {
+		return index.Eq(v), nil
+	}
+	switch args[0] {
+	case "Eq":
+		subargs := strings.SplitN(args[1], ")", 2)
+		return index.Eq(subargs[0]), nil
+	case "Lt":
+		subargs := strings.SplitN(args[1], ")", 2)
+		return index.Lt(subargs[0]), nil
+	case "Lte":
+		subargs := strings.SplitN(args[1], ")", 2)
+		return index.Lte(subargs[0]), nil
+	case "Gt":
+		subargs := strings.SplitN(args[1], ")", 2)
+		return index.Gt(subargs[0]), nil
+	case "Gte":
+		subargs := strings.SplitN(args[1], ")", 2)
+		return index.Gte(subargs[0]), nil
+	case "Ne":
+		subargs := strings.SplitN(args[1], ")", 2)
+		return index.Ne(subargs[0]), nil
+	case "Between":
+		subargs := strings.SplitN(args[1], ")", 2)
+		parts := strings.Split(subargs[0], ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Between requires 2 values: %s", v)
+		}
+		return index.Between(parts[0], parts[1]), nil
+	case "Except":
+		subargs := strings.SplitN(args[1], ")", 2)
+		parts := strings.Split(subargs[0], ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Except requires 2 values: %s", v)
+		}
+		return index.Except(parts[0], parts[1]), nil
+	default:
+		return index.Eq(v), nil
+	}
+}
+
+type parameterMaker interface {
+	ParameterMaker(*RequestTracker, string) (index.Maker, error)
+}
+
+// metaMaker makes an index on a single key in the Meta of
+// objects that have one.
+func metaMaker(ref store.KeySaver, key string) index.Maker {
+	fix := func(m models.Model) string {
+		return m.(models.MetaHaver).GetMeta()[key]
+	}
+	return index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool { return fix(i) < fix(j) },
+		func(ref models.Model) (gte, gt index.Test) {
+			refVal := fix(ref)
+			return func(s models.Model) bool {
+					return fix(s) >= refVal
+				},
+				func(s models.Model) bool {
+					return fix(s) > refVal
+				}
+		},
+		func(s string) (models.Model, error) {
+			res := ref.New().(models.MetaHaver)
+			res.SetMeta(models.Meta{key: s})
+			return res, nil
+		})
+}
+
+// FilterFor returns the filters that select the objects of ref's
+// type whose index name matches any of vals.  name can be a static
+// index, Meta.<key> for objects with Meta, Result.<key> for Jobs,
+// Inventory.<fact> for Machines, or a parameter for objects that
+// support parameter indexes.  vals use the same syntax as the query
+// parameters of the list API.
+//
+// The params store must be locked if name refers to a parameter.
+func (rt *RequestTracker) FilterFor(ref models.Model, name string, vals []string) ([]index.Filter, error) {
+	var indexes map[string]index.Maker
+	if indexer, ok := ref.(index.Indexer); ok {
+		indexes = indexer.Indexes()
+	} else {
+		indexes = map[string]index.Maker{}
+	}
+	maker, ok := indexes[name]
+	if !ok {
+		_, isMeta := ref.(models.MetaHaver)
+		saver, isSaver := ref.(store.KeySaver)
+		pMaker, isParam := ref.(parameterMaker)
+		job, isJob := ref.(*Job)
+		machine, isMachine := ref.(*Machine)
+		switch {
+		case strings.HasPrefix(name, "Meta.") && isMeta && isSaver:
+			maker = metaMaker(saver, strings.TrimPrefix(name, "Meta."))
+		case strings.HasPrefix(name, "Result.") && isJob:
+			maker = job.ResultMaker(strings.TrimPrefix(name, "Result."))
+		case strings.HasPrefix(name, "Inventory.") && isMachine:
+			maker = machine.InventoryMaker(strings.TrimPrefix(name, "Inventory."))
+		case isParam:
+			var err error
+			maker, err = pMaker.ParameterMaker(rt, name)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Filter not found: %s", name)
+		}
+	}
+	subfilters := []index.Filter{}
+	for _, v := range vals {
+		f, err := ConvertValueToFilter(v)
+		if err != nil {
+			return nil, err
+		}
+		if machine, ok := ref.(*Machine); ok && strings.HasPrefix(name, "Inventory.") {
+			if vf := machine.InventoryValueFilter(strings.TrimPrefix(name, "Inventory."), f); vf != nil {
+				f = vf
+			}
+		}
+		subfilters = append(subfilters, f)
+	}
+	return []index.Filter{index.Sort(maker), index.Any(subfilters...)}, nil
+}
@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/models"
+)
+
+// jobPruneBatch is how many Jobs are archived or deleted in a single
+// transaction, so that pruning a large job store does not keep the
+// jobs locked for long.
+const jobPruneBatch = 100
+
+// ArchivedLogPath returns the path of the compressed log of an
+// archived Job.
+func (j *Job) ArchivedLogPath(rt *RequestTracker) string {
+	return j.LogPath(rt) + ".gz"
+}
+
+// OpenLog opens the log of j for reading.  The logs of archived Jobs
+// are decompressed on the fly.
+func (j *Job) OpenLog(rt *RequestTracker) (io.ReadCloser, error) {
+	f, err := os.Open(j.LogPath(rt))
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	gzf, err := os.Open(j.ArchivedLogPath(rt))
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(gzf)
+	if err != nil {
+		gzf.Close()
+		return nil, err
+	}
+	return &gzipLog{Reader: gz, f: gzf}, nil
+}
+
+type gzipLog struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipLog) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// compressLog replaces the log of j with a gzip compressed copy.
+func (j *Job) compressLog(rt *RequestTracker) error {
+	src, err := os.Open(j.LogPath(rt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+	tmpName := j.ArchivedLogPath(rt) + ".tmp"
+	dst, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, j.ArchivedLogPath(rt))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Remove(j.LogPath(rt))
+}
+
+// jobRetention returns the job retention preferences.  A value of 0
+// means that limit is not in effect.
+func (p *DataTracker) jobRetention() (count int, age, archiveAge time.Duration) {
+	count, _ = strconv.Atoi(p.pref("jobRetentionCount"))
+	days, _ := strconv.Atoi(p.pref("jobRetentionDays"))
+	archiveDays, _ := strconv.Atoi(p.pref("jobArchiveDays"))
+	day := 24 * time.Hour
+	return count, time.Duration(days) * day, time.Duration(archiveDays) * day
+}
+
+// jobsToPrune works out which Jobs are no longer retained and should
+// be archived, and which archived Jobs are old enough to be deleted.
+// A Job is retained if it is one of the last jobRetentionCount Jobs
+// for its Machine, or it is younger than jobRetentionDays.  Archived
+// Jobs are deleted jobArchiveDays after they finished.
+func (p *DataTracker) jobsToPrune(l logger.Logger, now time.Time) (toArchive, toDelete []string) {
+	count, age, archiveAge := p.jobRetention()
+	retainAll := count == 0 && age == 0
+	if retainAll && archiveAge == 0 {
+		return
+	}
+	rt := p.Request(l, "jobs")
+	rt.Do(func(d Stores) {
+		byMachine := map[string][]*Job{}
+		for _, obj := range d("jobs").Items() {
+			j := AsJob(obj)
+			byMachine[j.Machine.String()] = append(byMachine[j.Machine.String()], j)
+		}
+		for _, jobs := range byMachine {
+			sort.Slice(jobs, func(a, b int) bool { return jobs[a].StartTime.After(jobs[b].StartTime) })
+			for i, j := range jobs {
+				if j.Archived {
+					if archiveAge > 0 && now.Sub(j.EndTime) > archiveAge {
+						toDelete = append(toDelete, j.Key())
+					}
+					continue
+				}
+				if retainAll || j.Current || (j.State != "finished" && j.State != "failed" && j.State != "cancelled") {
+					continue
+				}
+				if (count > 0 && i < count) || (age > 0 && now.Sub(j.StartTime) < age) {
+					continue
+				}
+				toArchive = append(toArchive, j.Key())
+			}
+		}
+	})
+	return
+}
+
+// PruneJobs applies the job retention preferences.  Jobs that are no
+// longer retained are archived and their logs are compressed, and
+// archived Jobs that have been kept long enough are deleted.  Jobs
+// that cannot be deleted, as decided by Job.BeforeDelete, are left
+// alone.  The work is done in small batches, each in its own
+// transaction.
+func (p *DataTracker) PruneJobs(l logger.Logger) (archived, deleted int) {
+	toArchive, toDelete := p.jobsToPrune(l, time.Now())
+	for len(toArchive) > 0 {
+		batch := toArchive
+		if len(batch) > jobPruneBatch {
+			batch = batch[:jobPruneBatch]
+		}
+		toArchive = toArchive[len(batch):]
+		rt := p.Request(l, "jobs")
+		rt.Do(func(d Stores) {
+			for _, key := range batch {
+				obj := rt.find("jobs", key)
+				if obj == nil {
+					continue
+				}
+				j := AsJob(obj)
+				if err := j.compressLog(rt); err != nil {
+					rt.Errorf("Unable to compress log for job %s: %v", key, err)
+					continue
+				}
+				aj := models.Clone(j.Job).(*models.Job)
+				aj.Archived = true
+				if _, err := rt.Update(aj); err != nil {
+					rt.Errorf("Unable to archive job %s: %v", key, err)
+					continue
+				}
+				archived++
+			}
+		})
+	}
+	for len(toDelete) > 0 {
+		batch := toDelete
+		if len(batch) > jobPruneBatch {
+			batch = batch[:jobPruneBatch]
+		}
+		toDelete = toDelete[len(batch):]
+		rt := p.Request(l, jobLockMap["delete"]...)
+		rt.Do(func(d Stores) {
+			for _, key := range batch {
+				obj := rt.find("jobs", key)
+				if obj == nil {
+					continue
+				}
+				if _, err := rt.Remove(obj); err != nil {
+					rt.Debugf("Not pruning job %s: %v", key, err)
+					continue
+				}
+				deleted++
+			}
+		})
+	}
+	if archived > 0 || deleted > 0 {
+		l.Infof("Job pruning archived %d jobs and deleted %d jobs", archived, deleted)
+	}
+	return
+}
+
+// StartJobPruner runs PruneJobs every interval in the background.
+func (p *DataTracker) StartJobPruner(l logger.Logger, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			p.PruneJobs(l)
+		}
+	}()
+}
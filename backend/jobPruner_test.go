@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestPruneJobs(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	machineUUID := uuid.NewRandom()
+	jobs := []uuid.UUID{uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()}
+	tests := []crudTest{
+		{"Create Task", rt.Create, &models.Task{Name: "logger"}, true},
+		{"Create Stage", rt.Create, &models.Stage{Name: "logger", BootEnv: "local", Tasks: []string{"logger"}}, true},
+		{"Create Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "prune.example.com", Stage: "logger"}, true},
+	}
+	prev := uuid.Parse("00000000-0000-0000-0000-000000000000")
+	for _, id := range jobs {
+		tests = append(tests, crudTest{"Create Job", rt.Create, &models.Job{Uuid: id, Previous: prev, Machine: machineUUID, Task: "logger", Stage: "logger", State: "created"}, true})
+		prev = id
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		for i, id := range jobs {
+			j := AsJob(rt.find("jobs", id.String()))
+			j.State = "finished"
+			j.StartTime = time.Now().Add(time.Duration(i-len(jobs)) * time.Hour)
+			j.EndTime = j.StartTime
+			if err := j.Log(rt, bytes.NewBufferString("job "+id.String()+"\n")); err != nil {
+				t.Errorf("Failed to log to job %s: %v", id, err)
+			}
+		}
+	})
+	if archived, deleted := dt.PruneJobs(dt.Logger); archived != 0 || deleted != 0 {
+		t.Errorf("Expected nothing to be pruned without retention prefs, got %d archived, %d deleted", archived, deleted)
+	}
+	dt.runningPrefs["jobRetentionCount"] = "1"
+	if archived, deleted := dt.PruneJobs(dt.Logger); archived != 2 || deleted != 0 {
+		t.Errorf("Expected 2 jobs to be archived, got %d archived, %d deleted", archived, deleted)
+	}
+	rt.Do(func(d Stores) {
+		for i, id := range jobs {
+			j := AsJob(rt.Find("jobs", id.String()))
+			if j.Archived != (i < 2) {
+				t.Errorf("Job %d: expected archived to be %v", i, i < 2)
+			}
+			log, err := j.OpenLog(rt)
+			if err != nil {
+				t.Errorf("Failed to open log for job %d: %v", i, err)
+				continue
+			}
+			buf, _ := ioutil.ReadAll(log)
+			log.Close()
+			if string(buf) != "Log for Job: "+id.String()+"\njob "+id.String()+"\n" {
+				t.Errorf("Job %d: unexpected log contents %q", i, string(buf))
+			}
+			if _, err := os.Stat(j.LogPath(rt)); j.Archived && err == nil {
+				t.Errorf("Job %d: expected uncompressed log to be removed", i)
+			}
+		}
+		if err := AsJob(rt.Find("jobs", jobs[0].String())).Log(rt, bytes.NewBufferString("more\n")); err == nil {
+			t.Errorf("Expected logging to an archived job to fail")
+		}
+	})
+	dt.runningPrefs["jobArchiveDays"] = "1"
+	if archived, deleted := dt.PruneJobs(dt.Logger); archived != 0 || deleted != 0 {
+		t.Errorf("Expected recently archived jobs to be kept, got %d archived, %d deleted", archived, deleted)
+	}
+	rt.Do(func(d Stores) {
+		AsJob(rt.find("jobs", jobs[0].String())).EndTime = time.Now().Add(-48 * time.Hour)
+	})
+	if archived, deleted := dt.PruneJobs(dt.Logger); archived != 0 || deleted != 1 {
+		t.Errorf("Expected 1 old archived job to be deleted, got %d archived, %d deleted", archived, deleted)
+	}
+	rt.Do(func(d Stores) {
+		if rt.Find("jobs", jobs[0].String()) != nil {
+			t.Errorf("Expected old archived job to be deleted")
+		}
+	})
+}
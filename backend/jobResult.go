@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+)
+
+// checkResult works out the changes to the Params and Meta of m that
+// the Task of j maps the Result of j to.  Every mapped value is
+// validated, and the changes are checked against m the same way any
+// other change to the Machine would be, but nothing is saved.  It
+// returns the patch for applyResult to save once j has been saved,
+// which is empty if the Result does not change m.
+//
+// Assumes locks are held as appropriate.
+func (j *Job) checkResult(m *Machine, t *Task) (jsonpatch2.Patch, error) {
+	if len(j.Result) == 0 || (len(t.ResultParams) == 0 && len(t.ResultMeta) == 0) {
+		return nil, nil
+	}
+	e := &models.Error{Code: 422, Type: ValidationError, Model: j.Prefix(), Key: j.Key()}
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	if nm.Params == nil {
+		nm.Params = map[string]interface{}{}
+	}
+	if nm.Meta == nil {
+		nm.Meta = models.Meta{}
+	}
+	changed := false
+	for key, name := range t.ResultParams {
+		val, ok := j.Result[key]
+		if !ok {
+			continue
+		}
+		if po := j.rt.find("params", name); po != nil {
+			param := AsParam(po)
+			var privKey []byte
+			if param.Secure {
+				pubKey, err := j.rt.PublicKeyFor(m)
+				if err == nil {
+					privKey, err = j.rt.PrivateKeyFor(m)
+				}
+				sd := &models.SecureData{}
+				if err == nil {
+					err = sd.Marshal(pubKey, val)
+				}
+				if err != nil {
+					e.Errorf("Result %s: unable to seal secure param %s: %v", key, name, err)
+					continue
+				}
+				val = sd
+			}
+			if err := param.ValidateValue(val, privKey); err != nil {
+				e.Errorf("Result %s: invalid value for param %s: %v", key, name, err)
+				continue
+			}
+		}
+		if !reflect.DeepEqual(nm.Params[name], val) {
+			nm.Params[name] = val
+			changed = true
+		}
+	}
+	for key, name := range t.ResultMeta {
+		val, ok := j.Result[key]
+		if !ok {
+			continue
+		}
+		s, ok := val.(string)
+		if !ok {
+			buf, err := json.Marshal(val)
+			if err != nil {
+				e.Errorf("Result %s: unable to save as meta %s: %v", key, name, err)
+				continue
+			}
+			s = string(buf)
+		}
+		if nm.Meta[name] != s {
+			nm.Meta[name] = s
+			changed = true
+		}
+	}
+	if e.ContainsError() {
+		return nil, e
+	}
+	if !changed {
+		return nil, nil
+	}
+	patch, err := models.GenPatch(m, nm, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := j.rt.DryRunPatch(nm, nm.Key(), patch); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// applyResult saves the changes checkResult found to the Machine of
+// j.  It is called after j has been saved, so that neither a dry run
+// of the Job nor a failure to save it changes the Machine.  The patch
+// goes through the same checks as any other change to the Machine.
+//
+// Assumes locks are held as appropriate.
+func (j *Job) applyResult(patch jsonpatch2.Patch) {
+	if _, err := j.rt.Patch(&models.Machine{Uuid: j.Machine}, j.Machine.String(), patch); err != nil {
+		j.rt.Errorf("Unable to save the result of job %s to machine %s: %v", j.UUID(), j.Machine, err)
+	}
+}
+
+// resultOrder orders the kinds of values a Result can hold when
+// comparing values of different kinds.
+func resultOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64, int:
+		return 2
+	case string:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func resultNumber(v interface{}) float64 {
+	if i, ok := v.(int); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+// resultLess compares two values from Job Results.  Values of
+// different kinds sort by kind, and values that are not scalars are
+// compared by their JSON encoding.
+func resultLess(a, b interface{}) bool {
+	ao, bo := resultOrder(a), resultOrder(b)
+	if ao != bo {
+		return ao < bo
+	}
+	switch ao {
+	case 1:
+		return !a.(bool) && b.(bool)
+	case 2:
+		return resultNumber(a) < resultNumber(b)
+	case 3:
+		return a.(string) < b.(string)
+	case 4:
+		ab, _ := json.Marshal(a)
+		bb, _ := json.Marshal(b)
+		return string(ab) < string(bb)
+	}
+	return false
+}
+
+// ResultMaker makes an index on a single key in the Result of Jobs.
+// Filter values are parsed as JSON, and are used as strings if they
+// are not valid JSON.
+func (j *Job) ResultMaker(key string) index.Maker {
+	fix := func(m models.Model) interface{} {
+		return AsJob(m).Result[key]
+	}
+	return index.Make(
+		false,
+		"result",
+		func(i, j models.Model) bool { return resultLess(fix(i), fix(j)) },
+		func(ref models.Model) (gte, gt index.Test) {
+			refVal := fix(ref)
+			return func(s models.Model) bool {
+					return !resultLess(fix(s), refVal)
+				},
+				func(s models.Model) bool {
+					return resultLess(refVal, fix(s))
+				}
+		},
+		func(s string) (models.Model, error) {
+			var val interface{}
+			if err := json.Unmarshal([]byte(s), &val); err != nil {
+				val = s
+			}
+			if resultOrder(val) == 0 {
+				return nil, fmt.Errorf("Invalid Result filter value: %s", s)
+			}
+			res := AsJob(j.New())
+			res.Result = map[string]interface{}{key: val}
+			return res, nil
+		})
+}
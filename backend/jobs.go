@@ -13,6 +13,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/logger"
 	"github.com/digitalrebar/provision/backend/index"
 	"github.com/digitalrebar/provision/models"
 	"github.com/digitalrebar/store"
@@ -36,6 +38,16 @@ import (
 //   and the machine's CurrentJob is updated with the UUID of the new
 //   job.
 //
+// * If CurrentTask is a task group, each POST creates a Job for the
+//   next member of the group that does not have one yet, and the
+//   machine's CurrentJobs tracks all of them.  The group as a whole
+//   is "failed" if any member failed, "finished" once every member
+//   has finished, and running otherwise.
+//
+// * If the current job is "cancelled", a new job is created for the
+//   Task indexed by CurrentTask, so a cancelled Task is run again when
+//   the machine is resumed.
+//
 // * When a new Job is created, it makes a RenderData for the
 //   templates contained in the Task the job was created against.  The
 //   client will be able to retrieve the rendered templates via GET
@@ -56,6 +68,14 @@ type Job struct {
 	*models.Job
 	validate
 	oldState string
+	// retry is set by Validate when the Job has just failed and its
+	// Task wants it retried.
+	retry bool
+	// The changes to the Machine that Validate found, which AfterSave
+	// makes once the Job has been saved: the Result of a finished Job,
+	// and Runnable after a failed one.
+	resultPatch           jsonpatch2.Patch
+	setRunnable, runnable bool
 }
 
 func (j *Job) SetReadOnly(b bool) {
@@ -371,6 +391,9 @@ func (j *Job) Indexes() map[string]index.Maker {
 
 func (j *Job) OnCreate() error {
 	j.Current = true
+	if j.Attempt == 0 {
+		j.Attempt = 1
+	}
 	if _, err := os.Stat(j.LogPath(j.rt)); err != nil {
 		if f, err := os.Create(j.LogPath(j.rt)); err != nil {
 			j.AddError(err)
@@ -397,6 +420,13 @@ func (j *Job) OnChange(oldThing store.KeySaver) error {
 	ot := AsJob(oldThing)
 	j.Current = ot.Current
 	j.oldState = ot.State
+	// A cancelled Job stays cancelled, even if the agent that was
+	// running it reports it failed or finished before it noticed.
+	if ot.State == "cancelled" && j.State != "cancelled" {
+		e := &models.Error{Code: 422, Type: ValidationError, Model: j.Prefix(), Key: j.Key()}
+		e.Errorf("Job was cancelled, its State cannot be changed to %s", j.State)
+		return e
+	}
 	return nil
 }
 
@@ -407,7 +437,7 @@ func (j *Job) Validate() {
 	if j.Previous == nil {
 		j.Errorf("Job %s does not have a Previous job", j.UUID())
 	}
-	if j.State == "finished" || j.State == "failed" {
+	if j.State == "finished" || j.State == "failed" || j.State == "cancelled" {
 		if j.oldState != j.State {
 			j.EndTime = time.Now()
 		}
@@ -429,12 +459,35 @@ func (j *Job) Validate() {
 		j.Errorf("Machine %s does not exist", j.Machine.String())
 	} else {
 		m = AsMachine(om)
+		if j.oldState != j.State && j.State == "finished" {
+			if t := tasks.Find(j.Task); t != nil {
+				patch, err := j.checkResult(m, AsTask(t))
+				if err != nil {
+					// A result that cannot be saved means the job did
+					// not do what it was supposed to.
+					j.State = "failed"
+					j.ExitState = "failed"
+					j.Log(j.rt, strings.NewReader(fmt.Sprintf("Unable to save job result: %v\n", err)))
+				}
+				j.resultPatch = patch
+			}
+		}
 		if j.oldState != j.State {
 			switch j.State {
 			case "failed":
-				m.Runnable = false
-				_, e2 := j.rt.Save(m)
-				j.AddError(e2)
+				if t := tasks.Find(j.Task); t != nil && AsTask(t).Retry.Retryable(j.Job) {
+					// The machine is made runnable again when the retry
+					// is created.
+					j.retry = true
+					j.RetryAt = time.Now().Add(AsTask(t).Retry.Delay(j.Attempt))
+					break
+				}
+				// The agent marks the machine as not runnable before it
+				// fails the job, so a handled failure has to put it back.
+				if handled := m.FailureHandled(j.CurrentIndex, j); m.Runnable != handled {
+					j.setRunnable = true
+					j.runnable = handled
+				}
 			case "created":
 				j.StartTime = time.Now()
 			}
@@ -474,6 +527,27 @@ func (j *Job) BeforeSave() error {
 }
 
 func (j *Job) AfterSave() {
+	if len(j.resultPatch) > 0 {
+		j.applyResult(j.resultPatch)
+	}
+	j.resultPatch = nil
+	if j.setRunnable {
+		j.setRunnable = false
+		if mo := j.rt.find("machines", j.Machine.String()); mo != nil {
+			m := ModelToBackend(models.Clone(mo)).(*Machine)
+			m.oldLifecycle = lifecycleOf(m.Machine)
+			m.Runnable = j.runnable
+			if _, err := j.rt.Save(m); err != nil {
+				j.rt.Errorf("Unable to set runnable on machine %s after job %s failed: %v", m.UUID(), j.UUID(), err)
+			}
+		}
+	}
+	if j.retry {
+		j.retry = false
+		j.rt.Infof("Job %s for task %s failed on attempt %d, retrying at %s",
+			j.UUID(), j.Task, j.Attempt, j.RetryAt)
+		j.rt.dt.scheduleRetry(j)
+	}
 	if !j.Current {
 		return
 	}
@@ -486,9 +560,107 @@ func (j *Job) AfterSave() {
 	j.rt.Save(oj)
 }
 
+// scheduleRetry arranges for retryJob to be called for j once its
+// RetryAt has passed.
+func (p *DataTracker) scheduleRetry(j *Job) {
+	id := j.UUID()
+	time.AfterFunc(time.Until(j.RetryAt), func() { p.retryJob(id) })
+}
+
+// ResumeRetries schedules the retries of failed Jobs that were still
+// waiting to be retried when dr-provision last stopped.  Retries that
+// are overdue are made right away.
+func (p *DataTracker) ResumeRetries(l logger.Logger) {
+	rt := p.Request(l, "jobs")
+	rt.Do(func(d Stores) {
+		for _, jo := range d("jobs").Items() {
+			if j := AsJob(jo); j.State == "failed" && !j.RetryAt.IsZero() {
+				rt.Infof("Resuming retry of job %s for task %s at %s", j.UUID(), j.Task, j.RetryAt)
+				p.scheduleRetry(j)
+			}
+		}
+	})
+}
+
+// clearRetry marks j as no longer waiting to be retried.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) clearRetry(j *Job) {
+	nj := models.Clone(j.Job).(*models.Job)
+	nj.RetryAt = time.Time{}
+	if _, err := rt.Update(nj); err != nil {
+		rt.Errorf("Unable to clear the retry time of job %s: %v", j.UUID(), err)
+	}
+}
+
+// retryJob creates a new Job for the same Task and CurrentIndex as
+// the failed Job id, and makes the Machine runnable again so that the
+// agent will pick it up.  Nothing is done if the Machine has moved on
+// from the failed Job in the meantime.
+func (p *DataTracker) retryJob(id string) {
+	rt := p.Request(p.Logger, jobLockMap["create"]...)
+	rt.Do(func(d Stores) {
+		jo := rt.find("jobs", id)
+		if jo == nil {
+			return
+		}
+		j := AsJob(jo)
+		mo := rt.find("machines", j.Machine.String())
+		if mo == nil {
+			return
+		}
+		oldM := AsMachine(mo)
+		inGroup := false
+		for _, cj := range oldM.CurrentJobs {
+			inGroup = inGroup || uuid.Equal(cj, j.Uuid)
+		}
+		if j.State != "failed" ||
+			oldM.CurrentTask != j.CurrentIndex ||
+			!(inGroup || uuid.Equal(oldM.CurrentJob, j.Uuid)) {
+			rt.Infof("Machine %s has moved on from job %s, not retrying it", oldM.UUID(), id)
+			rt.clearRetry(j)
+			return
+		}
+		next := &models.Job{
+			Uuid:         uuid.NewRandom(),
+			Previous:     j.Uuid,
+			Machine:      j.Machine,
+			Task:         j.Task,
+			Stage:        j.Stage,
+			BootEnv:      j.BootEnv,
+			Workflow:     j.Workflow,
+			CurrentIndex: j.CurrentIndex,
+			NextIndex:    j.NextIndex,
+			State:        "created",
+			Attempt:      j.Attempt + 1,
+		}
+		if _, err := rt.Create(next); err != nil {
+			rt.Errorf("Unable to create retry of job %s: %v", id, err)
+			return
+		}
+		m := ModelToBackend(models.Clone(oldM)).(*Machine)
+		m.InRunner()
+		for i := range m.CurrentJobs {
+			if uuid.Equal(m.CurrentJobs[i], j.Uuid) {
+				m.CurrentJobs[i] = next.Uuid
+			}
+		}
+		if uuid.Equal(m.CurrentJob, j.Uuid) {
+			m.CurrentJob = next.Uuid
+		}
+		m.Runnable = true
+		if _, err := rt.Update(m); err != nil {
+			rt.Errorf("Unable to make machine %s runnable to retry job %s: %v", m.UUID(), id, err)
+			return
+		}
+		rt.clearRetry(j)
+		rt.Infof("Created job %s to retry task %s (attempt %d)", next.Uuid, next.Task, next.Attempt)
+	})
+}
+
 func (j *Job) BeforeDelete() error {
 	e := &models.Error{Code: 422, Type: ValidationError, Model: j.Prefix(), Key: j.Key()}
-	if j.State == "finished" || j.State == "failed" {
+	if j.State == "finished" || j.State == "failed" || j.State == "cancelled" {
 		return nil
 	}
 	machines := j.rt.stores("machines")
@@ -568,6 +740,7 @@ func (j *Job) RenderActions(rt *RequestTracker) ([]*models.JobAction, error) {
 
 func (j *Job) AfterDelete() {
 	os.Remove(j.LogPath(j.rt))
+	os.Remove(j.ArchivedLogPath(j.rt))
 }
 
 func (j *Job) Log(rt *RequestTracker, src io.Reader) error {
@@ -575,6 +748,9 @@ func (j *Job) Log(rt *RequestTracker, src io.Reader) error {
 		j.setRT(rt)
 		defer j.clearRT()
 	}
+	if j.Archived {
+		return fmt.Errorf("Job %s is archived, its log cannot be changed", j.UUID())
+	}
 	f, err := os.OpenFile(j.LogPath(rt), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
 		fmt.Printf("Umm err: %v\n", err)
@@ -0,0 +1,255 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/models"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// keyRotationPrefixes are the object types that have their own keys
+// for sealing secure Params, in the order they are rotated.
+var keyRotationPrefixes = []string{"machines", "profiles", "plugins"}
+
+// keyRotationLocks returns the locks needed to rotate the key of an
+// object with prefix.
+func keyRotationLocks(prefix string) []string {
+	switch prefix {
+	case "machines":
+		return machineLockMap["update"]
+	case "profiles":
+		return profileLockMap["update"]
+	default:
+		return pluginLockMap["update"]
+	}
+}
+
+// resealParams returns the Params of obj before and after every
+// secure Param that was not sealed with keep is resealed with pub.
+// A nil keep reseals all of them.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) resealParams(obj models.Paramer, keep, pub []byte) (orig, changed models.Paramer, err error) {
+	orig = models.Clone(obj).(models.Paramer)
+	changed = models.Clone(obj).(models.Paramer)
+	params := changed.GetParams()
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	for k, v := range params {
+		// SecretRefs are not sealed, so they do not need resealing.
+		if !isSealedValue(v) {
+			continue
+		}
+		sd := &models.SecureData{}
+		models.Remarshal(v, sd)
+		var val interface{}
+		key, err := rt.openSecure(obj, sd, &val)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open secure param %s: %v", k, err)
+		}
+		if keep != nil && bytes.Equal(key, keep) {
+			continue
+		}
+		resealed := &models.SecureData{}
+		if err := resealed.Marshal(pub, val); err != nil {
+			return nil, nil, fmt.Errorf("Unable to reseal secure param %s: %v", k, err)
+		}
+		params[k] = resealed
+	}
+	changed.SetParams(params)
+	return orig, changed, nil
+}
+
+// finishKeyRotation finishes a rotation of the key of obj that was
+// interrupted.  The secure Params of obj that are still sealed with
+// the previous key are resealed with the current key, and then the
+// previous key is removed.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) finishKeyRotation(obj models.Paramer) (models.Paramer, error) {
+	current, err := rt.PrivateKeyFor(obj)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := rt.PublicKeyFor(obj)
+	if err != nil {
+		return nil, err
+	}
+	orig, changed, err := rt.resealParams(obj, current, pub)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := models.GenPatch(orig, changed, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) > 0 {
+		res, err := rt.Patch(changed, changed.Key(), patch)
+		if err != nil {
+			return nil, err
+		}
+		obj = res.(models.Paramer)
+	}
+	rt.dt.secretsMux.Lock()
+	defer rt.dt.secretsMux.Unlock()
+	if err := rt.dt.Secrets.Remove(previousKeyName(obj)); err != nil {
+		return nil, err
+	}
+	rt.Infof("Finished interrupted secure param key rotation for %s:%s", obj.Prefix(), obj.Key())
+	return obj, nil
+}
+
+// RotateKey replaces the key used to seal the secure Params of obj
+// with a freshly generated one, and reseals all of the secure Params
+// of obj with the new key.  The new key is saved before the resealed
+// Params, and the key the Params were sealed with is kept until they
+// have been saved, so the Params can still be opened if the rotation
+// is interrupted.  If the resealed Params cannot be saved, the old
+// key is put back.  An interrupted rotation is finished before the
+// new one starts, so the Params are never sealed with more than two
+// keys.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) RotateKey(obj models.Paramer) (models.Model, error) {
+	if rt.previousKeyFor(obj) != nil {
+		var err error
+		if obj, err = rt.finishKeyRotation(obj); err != nil {
+			return nil, fmt.Errorf("Unable to finish interrupted key rotation: %v", err)
+		}
+	}
+	current, err := rt.PrivateKeyFor(obj)
+	if err != nil {
+		return nil, err
+	}
+	newPub, newPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	orig, changed, err := rt.resealParams(obj, nil, newPub[:])
+	if err != nil {
+		return nil, err
+	}
+	patch, err := models.GenPatch(orig, changed, false)
+	if err != nil {
+		return nil, err
+	}
+	rt.dt.secretsMux.Lock()
+	err = rt.dt.Secrets.Save(previousKeyName(obj), current)
+	if err == nil {
+		err = rt.saveKeyFor(obj, newPriv[:])
+	}
+	rt.dt.secretsMux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var res models.Model = obj
+	if len(patch) > 0 {
+		res, err = rt.Patch(changed, changed.Key(), patch)
+	}
+	rt.dt.secretsMux.Lock()
+	defer rt.dt.secretsMux.Unlock()
+	if err != nil {
+		if undoErr := rt.saveKeyFor(obj, current); undoErr != nil {
+			rt.Errorf("Unable to restore secure param key for %s:%s after failed key rotation: %v",
+				obj.Prefix(), obj.Key(), undoErr)
+			return nil, err
+		}
+		rt.dt.Secrets.Remove(previousKeyName(obj))
+		return nil, err
+	}
+	if rmErr := rt.dt.Secrets.Remove(previousKeyName(obj)); rmErr != nil {
+		rt.Warnf("Unable to remove previous secure param key for %s:%s: %v", obj.Prefix(), obj.Key(), rmErr)
+	}
+	rt.Infof("Rotated secure param key for %s:%s", obj.Prefix(), obj.Key())
+	return res, nil
+}
+
+// KeyRotationStatus returns the progress of the most recent rotation
+// of all the secure param keys, or nil if no rotation has been
+// started since dr-provision started.
+func (p *DataTracker) KeyRotationStatus() *models.KeyRotation {
+	p.keyRotationMux.Lock()
+	defer p.keyRotationMux.Unlock()
+	if p.keyRotation == nil {
+		return nil
+	}
+	res := *p.keyRotation
+	res.Failed = map[string]string{}
+	for k, v := range p.keyRotation.Failed {
+		res.Failed[k] = v
+	}
+	return &res
+}
+
+// RotateAllKeys starts rotating the secure param keys of every
+// machine, profile, and plugin in the background.  Each object is
+// rotated in its own transaction, so one failing does not stop the
+// rest.  Progress can be followed with KeyRotationStatus.  Only one
+// rotation can run at a time.
+func (p *DataTracker) RotateAllKeys(l logger.Logger) (*models.KeyRotation, error) {
+	p.keyRotationMux.Lock()
+	if p.keyRotation != nil && p.keyRotation.Running {
+		p.keyRotationMux.Unlock()
+		return nil, fmt.Errorf("Key rotation started at %s is still running", p.keyRotation.Started)
+	}
+	rotation := &models.KeyRotation{
+		Running: true,
+		Started: time.Now(),
+		Failed:  map[string]string{},
+	}
+	p.keyRotation = rotation
+	p.keyRotationMux.Unlock()
+
+	todo := map[string][]string{}
+	for _, prefix := range keyRotationPrefixes {
+		rt := p.Request(l, prefix)
+		rt.Do(func(d Stores) {
+			for _, item := range d(prefix).Items() {
+				todo[prefix] = append(todo[prefix], item.Key())
+			}
+		})
+		p.keyRotationMux.Lock()
+		rotation.Total += len(todo[prefix])
+		p.keyRotationMux.Unlock()
+	}
+	go func() {
+		for _, prefix := range keyRotationPrefixes {
+			locks := keyRotationLocks(prefix)
+			for _, key := range todo[prefix] {
+				rt := p.Request(l, locks...)
+				var err error
+				removed := false
+				rt.Do(func(d Stores) {
+					obj := rt.find(prefix, key)
+					if obj == nil {
+						// Removed since we started, nothing to do.
+						removed = true
+						return
+					}
+					_, err = rt.RotateKey(obj.(models.Paramer))
+				})
+				p.keyRotationMux.Lock()
+				if removed {
+					rotation.Skipped++
+				} else if err != nil {
+					rotation.Failed[prefix+":"+key] = err.Error()
+				} else {
+					rotation.Rotated++
+				}
+				p.keyRotationMux.Unlock()
+			}
+		}
+		p.keyRotationMux.Lock()
+		rotation.Running = false
+		rotation.Finished = time.Now()
+		l.Infof("Key rotation finished: %d of %d rotated, %d failed, %d skipped",
+			rotation.Rotated, rotation.Total, len(rotation.Failed), rotation.Skipped)
+		p.keyRotationMux.Unlock()
+	}()
+	return p.KeyRotationStatus(), nil
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"net/http"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// setPaused sets the Paused flag of m, and publishes action as an
+// event on machines if it changed.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) setPaused(m *Machine, paused bool, action string) (*Machine, error) {
+	if m.Paused != paused {
+		nm := ModelToBackend(models.Clone(m)).(*Machine)
+		nm.Paused = paused
+		nm.pauseChange = true
+		if _, err := rt.Update(nm); err != nil {
+			return nil, err
+		}
+	}
+	res := AsMachine(rt.find("machines", m.Key()))
+	rt.Publish("machines", action, res.Key(), res)
+	return res, nil
+}
+
+// PauseMachine pauses m.  The Job m is running is allowed to finish,
+// but no new Jobs will be created for m until it is resumed.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) PauseMachine(m *Machine) (*Machine, error) {
+	rt.Infof("Pausing machine %s", m.UUID())
+	return rt.setPaused(m, true, "pause")
+}
+
+// ResumeMachine lets a paused m continue with its Tasks.  A Task that
+// was cancelled is run again.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) ResumeMachine(m *Machine) (*Machine, error) {
+	rt.Infof("Resuming machine %s", m.UUID())
+	return rt.setPaused(m, false, "resume")
+}
+
+// CancelMachine pauses m and marks the Jobs it is running as
+// cancelled.  Machine agents watch for the cancel event, and kill the
+// Task they are running when they see it.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) CancelMachine(m *Machine) (*Machine, error) {
+	rt.Infof("Cancelling the current jobs of machine %s", m.UUID())
+	for _, id := range m.currentJobs() {
+		obj := rt.find("jobs", id.String())
+		if obj == nil {
+			continue
+		}
+		switch AsJob(obj).State {
+		case "created", "running", "incomplete":
+		default:
+			continue
+		}
+		nj := ModelToBackend(models.Clone(obj)).(*Job)
+		nj.State = "cancelled"
+		if _, err := rt.Update(nj); err != nil {
+			return nil, err
+		}
+	}
+	return rt.setPaused(m, true, "cancel")
+}
+
+// LockMachine locks m on behalf of the principal of rt.  The Stage,
+// BootEnv, Workflow, Tasks, and Params of a locked Machine cannot be
+// changed, and no new Jobs are created for it until it is unlocked.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) LockMachine(m *Machine, reason string) (*Machine, error) {
+	if m.Locked {
+		e := &models.Error{Code: http.StatusConflict, Type: "Conflict", Model: m.Prefix(), Key: m.Key()}
+		e.Errorf("Machine is already locked by %s (%s)", m.LockOwner, m.LockReason)
+		return nil, e
+	}
+	owner := rt.Principal()
+	rt.Infof("Locking machine %s for %s: %s", m.UUID(), owner, reason)
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.Locked, nm.LockOwner, nm.LockReason = true, owner, reason
+	nm.lockChange = true
+	if _, err := rt.Update(nm); err != nil {
+		return nil, err
+	}
+	res := AsMachine(rt.find("machines", m.Key()))
+	rt.Publish("machines", "lock", res.Key(), res)
+	return res, nil
+}
+
+// UnlockMachine removes the lock from m.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) UnlockMachine(m *Machine) (*Machine, error) {
+	if m.Locked {
+		rt.Infof("Unlocking machine %s, locked by %s (%s)", m.UUID(), m.LockOwner, m.LockReason)
+		nm := ModelToBackend(models.Clone(m)).(*Machine)
+		nm.Locked, nm.LockOwner, nm.LockReason = false, "", ""
+		nm.lockChange = true
+		if _, err := rt.Update(nm); err != nil {
+			return nil, err
+		}
+	}
+	res := AsMachine(rt.find("machines", m.Key()))
+	rt.Publish("machines", "unlock", res.Key(), res)
+	return res, nil
+}
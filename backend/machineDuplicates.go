@@ -0,0 +1,294 @@
+package backend
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+// junkIdentities are the placeholder serial numbers and system UUIDs
+// that firmware vendors ship when they cannot be bothered to fill in
+// a real one.  They say nothing about which system a Machine is.
+var junkIdentities = map[string]bool{
+	"":                                     true,
+	"0":                                    true,
+	"none":                                 true,
+	"n/a":                                  true,
+	"not specified":                        true,
+	"not available":                        true,
+	"not applicable":                       true,
+	"to be filled by o.e.m.":               true,
+	"system serial number":                 true,
+	"chassis serial number":                true,
+	"default string":                       true,
+	"0123456789":                           true,
+	"00000000-0000-0000-0000-000000000000": true,
+	"ffffffff-ffff-ffff-ffff-ffffffffffff": true,
+	"03000200-0400-0500-0006-000700080009": true,
+}
+
+// identitiesOf returns the things about m that should be unique to
+// the system it is.
+func identitiesOf(m *Machine) []string {
+	res := []string{}
+	if inv := m.Inventory; inv != nil {
+		if serial := strings.TrimSpace(inv.BIOS.SystemSerial); !junkIdentities[strings.ToLower(serial)] {
+			res = append(res, "serial:"+serial)
+		}
+		if id := strings.ToLower(strings.TrimSpace(inv.BIOS.SystemUUID)); !junkIdentities[id] {
+			res = append(res, "system-uuid:"+id)
+		}
+	}
+	for _, mac := range m.HardwareAddrs {
+		res = append(res, "mac:"+strings.ToLower(mac))
+	}
+	return res
+}
+
+// MachineDuplicates returns the sets of Machines that appear to be
+// the same system, because they have the same system serial number
+// or system UUID in their inventories, or share HardwareAddrs.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) MachineDuplicates() []*models.MachineDuplicate {
+	machines := AsMachines(rt.stores("machines").Items())
+	// Union the machines that share identities.
+	parent := make([]int, len(machines))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	owners := map[string][]int{}
+	ids := []string{}
+	for i, m := range machines {
+		for _, id := range identitiesOf(m) {
+			if _, ok := owners[id]; !ok {
+				ids = append(ids, id)
+			}
+			owners[id] = append(owners[id], i)
+		}
+	}
+	shared := map[int][]string{}
+	for _, id := range ids {
+		idx := owners[id]
+		if len(idx) < 2 {
+			continue
+		}
+		for _, i := range idx[1:] {
+			if ri, r0 := root(i), root(idx[0]); ri != r0 {
+				parent[ri] = r0
+			}
+		}
+	}
+	for _, id := range ids {
+		if idx := owners[id]; len(idx) > 1 {
+			r := root(idx[0])
+			shared[r] = append(shared[r], id)
+		}
+	}
+	groups := map[int]*models.MachineDuplicate{}
+	res := []*models.MachineDuplicate{}
+	for i, m := range machines {
+		r := root(i)
+		reasons, ok := shared[r]
+		if !ok {
+			continue
+		}
+		group, ok := groups[r]
+		if !ok {
+			sort.Strings(reasons)
+			group = &models.MachineDuplicate{Machines: []uuid.UUID{}, Reasons: reasons}
+			groups[r] = group
+			res = append(res, group)
+		}
+		group.Machines = append(group.Machines, m.Uuid)
+	}
+	return res
+}
+
+// DuplicatesOf returns the duplicates of m.  If m has no duplicates,
+// the result only has m in it.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) DuplicatesOf(m *Machine) *models.MachineDuplicate {
+	for _, group := range rt.MachineDuplicates() {
+		for _, id := range group.Machines {
+			if uuid.Equal(id, m.Uuid) {
+				return group
+			}
+		}
+	}
+	return &models.MachineDuplicate{Machines: []uuid.UUID{m.Uuid}, Reasons: []string{}}
+}
+
+// resealFor opens the secure value v of from, and seals it again with
+// the key of to.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) resealFor(from, to models.Model, v interface{}) (*models.SecureData, error) {
+	sd := &models.SecureData{}
+	if err := models.Remarshal(v, sd); err != nil {
+		return nil, err
+	}
+	var val interface{}
+	if _, err := rt.openSecure(from, sd, &val); err != nil {
+		return nil, err
+	}
+	pub, err := rt.PublicKeyFor(to)
+	if err != nil {
+		return nil, err
+	}
+	res := &models.SecureData{}
+	if err := res.Marshal(pub, val); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// MergeMachines folds dup into m, and then removes dup.
+//
+// Params, Profiles, and Meta of dup that m does not have are added
+// to m, with secure Params resealed with the key of m.  The HardwareAddrs of dup are added to m, so Reservations and
+// Leases for them now belong to m, and m takes the Address of dup if
+// it does not have one.  m takes the Inventory of dup if it does not
+// have one.  The Jobs of dup are moved to m, and the history of dup
+// is merged into the history of m.  Neither Machine can be locked.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) MergeMachines(m, dup *Machine) (*Machine, error) {
+	e := &models.Error{
+		Code:  http.StatusConflict,
+		Type:  "MERGE",
+		Model: m.Prefix(),
+		Key:   m.Key(),
+	}
+	if uuid.Equal(m.Uuid, dup.Uuid) {
+		e.Errorf("Cannot merge machine %s into itself", m.UUID())
+		return nil, e
+	}
+	if dup.Pool != "" {
+		e.Errorf("Machine %s is allocated from pool %s, release it first", dup.UUID(), dup.Pool)
+		return nil, e
+	}
+	for _, lm := range []*Machine{m, dup} {
+		if lm.Locked {
+			e.Errorf("Machine %s is locked by %s (%s), unlock it first", lm.UUID(), lm.LockOwner, lm.LockReason)
+		}
+	}
+	if e.ContainsError() {
+		return nil, e
+	}
+	// Make sure dup can be removed before changing anything, so that
+	// a merge that fails leaves both Machines alone.
+	if err := rt.canRemove(dup); err != nil {
+		return nil, err
+	}
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	if nm.Params == nil {
+		nm.Params = map[string]interface{}{}
+	}
+	for k, v := range dup.Params {
+		if _, ok := nm.Params[k]; ok {
+			continue
+		}
+		// Secure params of dup are sealed with its own key, so they
+		// have to be resealed with the key of m.
+		if isSealedValue(v) {
+			resealed, err := rt.resealFor(dup, m, v)
+			if err != nil {
+				e.Errorf("Unable to move secure param %s: %v", k, err)
+				continue
+			}
+			v = resealed
+		}
+		nm.Params[k] = v
+	}
+	if e.ContainsError() {
+		return nil, e
+	}
+	for _, p := range dup.Profiles {
+		found := false
+		for _, mp := range nm.Profiles {
+			if mp == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			nm.Profiles = append(nm.Profiles, p)
+		}
+	}
+	if nm.Meta == nil {
+		nm.Meta = models.Meta{}
+	}
+	for k, v := range dup.Meta {
+		if _, ok := nm.Meta[k]; !ok {
+			nm.Meta[k] = v
+		}
+	}
+	known := map[string]bool{}
+	for _, mac := range nm.HardwareAddrs {
+		known[strings.ToLower(mac)] = true
+	}
+	for _, mac := range dup.HardwareAddrs {
+		if !known[strings.ToLower(mac)] {
+			known[strings.ToLower(mac)] = true
+			nm.HardwareAddrs = append(nm.HardwareAddrs, mac)
+		}
+	}
+	takeInventory := nm.Inventory == nil && dup.Inventory != nil
+	if takeInventory {
+		nm.Inventory = dup.Inventory
+		nm.inventoryChange = true
+	}
+	if _, err := rt.Update(nm); err != nil {
+		return nil, err
+	}
+	if takeInventory {
+		if err := os.Rename(rt.machineInventoryDir(dup), rt.machineInventoryDir(nm)); err != nil && !os.IsNotExist(err) {
+			rt.Errorf("Unable to move inventory of %s to %s: %v", dup.UUID(), nm.UUID(), err)
+		}
+	}
+	if err := rt.mergeMachineHistory(nm, dup); err != nil {
+		rt.Errorf("Unable to merge history of %s into %s: %v", dup.UUID(), nm.UUID(), err)
+	}
+	if jobs := rt.stores("jobs"); jobs != nil {
+		for _, item := range jobs.Items() {
+			job := AsJob(item)
+			if !uuid.Equal(job.Machine, dup.Uuid) {
+				continue
+			}
+			nj := ModelToBackend(models.Clone(job)).(*Job)
+			nj.Machine = nm.Uuid
+			nj.Current = false
+			if _, err := rt.Save(nj); err != nil {
+				rt.Errorf("Unable to move job %s to %s: %v", job.UUID(), nm.UUID(), err)
+			}
+		}
+	}
+	if _, err := rt.Remove(dup); err != nil {
+		return nil, err
+	}
+	rt.Infof("Merged machine %s into %s", dup.UUID(), nm.UUID())
+	// Addresses are unique, so m can only take the Address of dup
+	// once dup is gone.
+	if (nm.Address == nil || nm.Address.IsUnspecified()) &&
+		dup.Address != nil && !dup.Address.IsUnspecified() {
+		am := ModelToBackend(models.Clone(rt.find("machines", nm.Key()))).(*Machine)
+		am.Address = dup.Address
+		if _, err := rt.Update(am); err != nil {
+			rt.Errorf("Unable to move address %s of %s to %s: %v", dup.Address, dup.UUID(), nm.UUID(), err)
+		}
+	}
+	return AsMachine(rt.find("machines", nm.Key())), nil
+}
@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+// machineLifecycle is a snapshot of the fields of a Machine that are
+// recorded in its history.
+type machineLifecycle struct {
+	Stage, BootEnv, Workflow, Address string
+	Runnable                          bool
+	CurrentTask                       int
+}
+
+func lifecycleOf(m *models.Machine) *machineLifecycle {
+	res := &machineLifecycle{
+		Stage:       m.Stage,
+		BootEnv:     m.BootEnv,
+		Workflow:    m.Workflow,
+		Runnable:    m.Runnable,
+		CurrentTask: m.CurrentTask,
+	}
+	if m.Address != nil {
+		res.Address = m.Address.String()
+	}
+	return res
+}
+
+// SaveMachineAddress sets the Address of m to addr and saves it, with
+// the change recorded in the history of m.  m itself is left alone.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) SaveMachineAddress(m *Machine, addr net.IP) (*Machine, error) {
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.oldLifecycle = lifecycleOf(m.Machine)
+	nm.Address = addr
+	if _, err := rt.Save(nm); err != nil {
+		return nil, err
+	}
+	return nm, nil
+}
+
+// machineHistoryPath returns the file that the history of m is kept
+// in.  Like the Param history, it lives alongside the job logs, one
+// JSON encoded models.MachineChange per line.
+func (rt *RequestTracker) machineHistoryPath(m *Machine) string {
+	return filepath.Join(rt.dt.LogRoot, "machine-history", m.Key())
+}
+
+// currentJobs returns the UUIDs of the Jobs m is currently running.
+func (n *Machine) currentJobs() []uuid.UUID {
+	res := []uuid.UUID{}
+	seen := map[string]bool{}
+	for _, id := range append([]uuid.UUID{n.CurrentJob}, n.CurrentJobs...) {
+		if id == nil || uuid.Equal(id, uuid.NIL) || seen[id.String()] {
+			continue
+		}
+		seen[id.String()] = true
+		res = append(res, id)
+	}
+	return res
+}
+
+// recordMachineChanges appends the differences between old and the
+// lifecycle fields of m to the history of m.
+func (rt *RequestTracker) recordMachineChanges(old *machineLifecycle, m *Machine) {
+	cur := lifecycleOf(m.Machine)
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"Stage", old.Stage, cur.Stage},
+		{"BootEnv", old.BootEnv, cur.BootEnv},
+		{"Workflow", old.Workflow, cur.Workflow},
+		{"Runnable", old.Runnable, cur.Runnable},
+		{"Address", old.Address, cur.Address},
+		{"CurrentTask", old.CurrentTask, cur.CurrentTask},
+	}
+	now := time.Now()
+	jobs := m.currentJobs()
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, f := range fields {
+		if f.old == f.new {
+			continue
+		}
+		enc.Encode(&models.MachineChange{
+			Time:      now,
+			Field:     f.name,
+			OldValue:  f.old,
+			NewValue:  f.new,
+			Principal: rt.principal,
+			Jobs:      jobs,
+		})
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	path := rt.machineHistoryPath(m)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		rt.Errorf("Unable to create machine history dir for %s: %v", m.Key(), err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		rt.Errorf("Unable to open machine history for %s: %v", m.Key(), err)
+		return
+	}
+	defer f.Close()
+	if _, err := buf.WriteTo(f); err != nil {
+		rt.Errorf("Unable to write machine history for %s: %v", m.Key(), err)
+	}
+}
+
+// removeMachineHistory removes the history of m.
+func (rt *RequestTracker) removeMachineHistory(m *Machine) {
+	os.Remove(rt.machineHistoryPath(m))
+}
+
+// MachineHistory returns the recorded lifecycle changes for m, oldest
+// first.  If field is not empty, only changes to that field are
+// returned.  If since or until are not zero, only changes made in
+// that time range are returned.
+func (rt *RequestTracker) MachineHistory(m *Machine, field string, since, until time.Time) ([]*models.MachineChange, error) {
+	res := []*models.MachineChange{}
+	f, err := os.Open(rt.machineHistoryPath(m))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		change := &models.MachineChange{}
+		if err := json.Unmarshal(scanner.Bytes(), change); err != nil {
+			return nil, err
+		}
+		if field != "" && change.Field != field {
+			continue
+		}
+		if !since.IsZero() && change.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && change.Time.After(until) {
+			continue
+		}
+		res = append(res, change)
+	}
+	return res, scanner.Err()
+}
+
+// mergeMachineHistory folds the history of from into the history of
+// into, keeping it in time order.
+func (rt *RequestTracker) mergeMachineHistory(into, from *Machine) error {
+	theirs, err := rt.MachineHistory(from, "", time.Time{}, time.Time{})
+	if err != nil || len(theirs) == 0 {
+		return err
+	}
+	ours, err := rt.MachineHistory(into, "", time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	all := append(ours, theirs...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, change := range all {
+		enc.Encode(change)
+	}
+	path := rt.machineHistoryPath(into)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpName := path + ".tmp"
+	if err := ioutil.WriteFile(tmpName, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
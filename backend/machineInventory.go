@@ -0,0 +1,260 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+)
+
+// machineInventoryDir returns the directory that the inventories of
+// m are kept in.  Like the machine history, it lives alongside the
+// job logs, one JSON encoded models.Inventory per version.
+func (rt *RequestTracker) machineInventoryDir(m *Machine) string {
+	return filepath.Join(rt.dt.LogRoot, "machine-inventory", m.Key())
+}
+
+// removeMachineInventory removes the saved inventories of m.
+func (rt *RequestTracker) removeMachineInventory(m *Machine) {
+	os.RemoveAll(rt.machineInventoryDir(m))
+}
+
+// SetInventory saves inv as the new inventory of m.  The inventory
+// gets the next Version, its Facts are filled in, and the MAC
+// addresses of its NICs are added to the HardwareAddrs of m.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) SetInventory(m *Machine, inv *models.Inventory) (*Machine, error) {
+	e := &models.Error{
+		Code:  http.StatusUnprocessableEntity,
+		Type:  ValidationError,
+		Model: m.Prefix(),
+		Key:   m.Key(),
+	}
+	inv.Validate(e)
+	if e.ContainsError() {
+		return nil, e
+	}
+	inv.Version = 1
+	if m.Inventory != nil {
+		inv.Version = m.Inventory.Version + 1
+	}
+	inv.Time = time.Now()
+	inv.FillFacts()
+	dir := rt.machineInventoryDir(m)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(inv)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(inv.Version)+".json"), buf, 0600); err != nil {
+		return nil, err
+	}
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.Inventory = inv
+	nm.inventoryChange = true
+	known := map[string]bool{}
+	for _, mac := range nm.HardwareAddrs {
+		known[strings.ToLower(mac)] = true
+	}
+	for _, mac := range inv.MACs() {
+		if !known[mac] {
+			known[mac] = true
+			nm.HardwareAddrs = append(nm.HardwareAddrs, mac)
+		}
+	}
+	if _, err := rt.Update(nm); err != nil {
+		return nil, err
+	}
+	return AsMachine(rt.find("machines", m.Key())), nil
+}
+
+// InventoryVersions returns the versions of the inventory of m that
+// have been saved, oldest first.
+func (rt *RequestTracker) InventoryVersions(m *Machine) ([]int, error) {
+	res := []int{}
+	ents, err := ioutil.ReadDir(rt.machineInventoryDir(m))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, ent := range ents {
+		if v, err := strconv.Atoi(strings.TrimSuffix(ent.Name(), ".json")); err == nil {
+			res = append(res, v)
+		}
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+// Inventory returns version of the inventory of m.  A version of 0
+// is the current inventory.
+func (rt *RequestTracker) Inventory(m *Machine, version int) (*models.Inventory, error) {
+	if m.Inventory != nil && (version == 0 || version == m.Inventory.Version) {
+		return m.Inventory, nil
+	}
+	e := &models.Error{
+		Code:  http.StatusNotFound,
+		Type:  "INVENTORY",
+		Model: m.Prefix(),
+		Key:   m.Key(),
+	}
+	if version == 0 {
+		e.Errorf("Machine %s has no inventory", m.UUID())
+		return nil, e
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(rt.machineInventoryDir(m), strconv.Itoa(version)+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			e.Errorf("Machine %s has no inventory version %d", m.UUID(), version)
+			return nil, e
+		}
+		return nil, err
+	}
+	res := &models.Inventory{}
+	return res, json.Unmarshal(buf, res)
+}
+
+// inventoryPrefixes maps the singular names of inventory sections to
+// the names used in Facts, so that both nic.model and nics.model work.
+var inventoryPrefixes = map[string]string{
+	"cpu.":   "cpus.",
+	"dimm.":  "memory.",
+	"dimms.": "memory.",
+	"disk.":  "disks.",
+	"nic.":   "nics.",
+}
+
+// inventoryFacts are the Facts of an empty Inventory.  They have the
+// names of all the Facts, and a value of the kind each one holds.
+var inventoryFacts = func() map[string]interface{} {
+	inv := &models.Inventory{}
+	inv.FillFacts()
+	return inv.Facts
+}()
+
+// inventoryFactName returns the name key has in Facts.
+func inventoryFactName(key string) string {
+	for singular, plural := range inventoryPrefixes {
+		if strings.HasPrefix(key, singular) {
+			return plural + strings.TrimPrefix(key, singular)
+		}
+	}
+	return key
+}
+
+// inventoryFactValues returns the values of the multi-valued fact key
+// in the Inventory of m.
+func inventoryFactValues(m models.Model, key string) []interface{} {
+	inv := AsMachine(m).Inventory
+	if inv == nil {
+		return nil
+	}
+	res := []interface{}{}
+	switch vals := inv.Facts[key].(type) {
+	case []string:
+		for _, v := range vals {
+			res = append(res, v)
+		}
+	case []interface{}:
+		res = append(res, vals...)
+	case string:
+		// Inventories uploaded before multi-valued facts were kept as
+		// lists have the values joined with commas.
+		for _, v := range strings.Split(vals, ",") {
+			if v != "" {
+				res = append(res, v)
+			}
+		}
+	}
+	return res
+}
+
+// InventoryMaker makes an index on a single fact in the Inventory of
+// Machines.  Machines without an inventory sort first.
+func (n *Machine) InventoryMaker(key string) index.Maker {
+	key = inventoryFactName(key)
+	fix := func(m models.Model) interface{} {
+		if inv := AsMachine(m).Inventory; inv != nil {
+			return inv.Facts[key]
+		}
+		return nil
+	}
+	return index.Make(
+		false,
+		"inventory",
+		func(i, j models.Model) bool { return resultLess(fix(i), fix(j)) },
+		func(ref models.Model) (gte, gt index.Test) {
+			refVal := fix(ref)
+			return func(s models.Model) bool {
+					return !resultLess(fix(s), refVal)
+				},
+				func(s models.Model) bool {
+					return resultLess(refVal, fix(s))
+				}
+		},
+		func(s string) (models.Model, error) {
+			fact, ok := inventoryFacts[key]
+			if !ok {
+				return nil, fmt.Errorf("No such Inventory fact: %s", key)
+			}
+			var val interface{} = s
+			if _, isNum := fact.(int); isNum {
+				f, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return nil, fmt.Errorf("Inventory fact %s must be a number: %s", key, s)
+				}
+				val = f
+			}
+			res := AsMachine(n.New())
+			res.Inventory = &models.Inventory{Facts: map[string]interface{}{key: val}}
+			return res, nil
+		})
+}
+
+// InventoryValueFilter turns f, a filter on the multi-valued fact key
+// in the Inventory of Machines, into one that keeps the Machines for
+// which any one of the values passes f.  It returns nil if key is not
+// a multi-valued fact.
+func (n *Machine) InventoryValueFilter(key string, f index.Filter) index.Filter {
+	key = inventoryFactName(key)
+	if _, ok := inventoryFacts[key].([]string); !ok {
+		return nil
+	}
+	maker := n.InventoryMaker(key)
+	return func(i *index.Index) (*index.Index, error) {
+		// Index every value as a Machine of its own, filter those,
+		// and keep the Machines that any of the survivors came from.
+		values := []models.Model{}
+		for _, obj := range i.Items() {
+			for _, v := range inventoryFactValues(obj, key) {
+				vm := AsMachine(n.New())
+				vm.Uuid = AsMachine(obj).Uuid
+				vm.Inventory = &models.Inventory{Facts: map[string]interface{}{key: v}}
+				values = append(values, vm)
+			}
+		}
+		found, err := index.All(index.Sort(maker), f)(index.New(values))
+		if err != nil {
+			return i, err
+		}
+		keep := map[string]bool{}
+		for _, obj := range found.Items() {
+			keep[obj.Key()] = true
+		}
+		return index.Select(func(obj models.Model) bool { return keep[obj.Key()] })(i)
+	}
+}
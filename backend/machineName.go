@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// MachineRenameLocks are the locks needed to rename a Machine with
+// its name template.
+var MachineRenameLocks = []string{"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows", "leases", "subnets", "reservations"}
+
+// discoveredName returns true if a Machine with name and macs looks
+// like it was discovered: it has macs, and name is empty or is the
+// name the discovery image derives from one of them, such as
+// d52-54-00-12-34-56.
+func discoveredName(name string, macs []string) bool {
+	if len(macs) == 0 {
+		return false
+	}
+	if name == "" {
+		return true
+	}
+	host := strings.ToLower(strings.SplitN(name, ".", 2)[0])
+	for _, mac := range macs {
+		if host == "d"+strings.ToLower(strings.Replace(mac, ":", "-", -1)) {
+			return true
+		}
+	}
+	return false
+}
+
+// machineLease returns the Lease for the Address of m, or else the
+// Lease handed out to one of its HardwareAddrs.
+func (rt *RequestTracker) machineLease(m *Machine) *Lease {
+	if m.Address != nil && !m.Address.IsUnspecified() {
+		if l := rt.find("leases", models.Hexaddr(m.Address)); l != nil {
+			return AsLease(l)
+		}
+	}
+	var res *Lease
+	for _, i := range rt.stores("leases").Items() {
+		l := AsLease(i)
+		if l.Strategy != "MAC" {
+			continue
+		}
+		for _, mac := range m.HardwareAddrs {
+			if strings.EqualFold(l.Token, mac) && (res == nil || l.ExpireTime.After(res.ExpireTime)) {
+				res = l
+			}
+		}
+	}
+	return res
+}
+
+// machineSubnet returns the Subnet that addr is in.
+func (rt *RequestTracker) machineSubnet(addr net.IP) *Subnet {
+	if addr == nil || addr.IsUnspecified() {
+		return nil
+	}
+	return (&Lease{Lease: &models.Lease{Addr: addr}}).Subnet(rt)
+}
+
+// machineNameTemplate returns the name template for m, along with
+// the Lease and Subnet it is for.  The NameTemplate of the Subnet m
+// got its address from is used, or else the machineNameTemplate
+// preference.
+func (rt *RequestTracker) machineNameTemplate(m *Machine) (string, *Lease, *Subnet) {
+	lease := rt.machineLease(m)
+	addr := m.Address
+	if lease != nil {
+		addr = lease.Addr
+	}
+	subnet := rt.machineSubnet(addr)
+	if subnet != nil && subnet.NameTemplate != "" {
+		return subnet.NameTemplate, lease, subnet
+	}
+	return rt.dt.pref("machineNameTemplate"), lease, subnet
+}
+
+// MachineName renders the name template for m.  The template is
+// given the aggregated params of m, along with Uuid, Name, Mac,
+// Address, Subnet, Fingerprint, CircuitId, and Index.  Index is the
+// lowest number from 1 that gives a name no other Machine has.
+//
+// Assumes MachineRenameLocks are held, except for reservations.
+func (rt *RequestTracker) MachineName(m *Machine) (string, error) {
+	tmplString, lease, subnet := rt.machineNameTemplate(m)
+	if tmplString == "" {
+		return "", fmt.Errorf("No machine name template applies to %s", m.UUID())
+	}
+	tmpl, err := template.New("machineName").Option("missingkey=error").Parse(tmplString)
+	if err != nil {
+		return "", err
+	}
+	data := rt.GetParams(m, true, false)
+	data["Uuid"] = m.UUID()
+	data["Name"] = m.Name
+	data["Mac"], data["Address"], data["Subnet"] = "", "", ""
+	data["Fingerprint"], data["CircuitId"] = "", ""
+	if len(m.HardwareAddrs) > 0 {
+		data["Mac"] = m.HardwareAddrs[0]
+	}
+	if m.Address != nil && !m.Address.IsUnspecified() {
+		data["Address"] = m.Address.String()
+	}
+	if subnet != nil {
+		data["Subnet"] = subnet.Name
+	}
+	if lease != nil {
+		data["Mac"], data["Address"] = lease.Token, lease.Addr.String()
+		data["Fingerprint"], data["CircuitId"] = lease.Fingerprint, lease.CircuitId
+	}
+	nameIdx := m.Indexes()["Name"]
+	first := ""
+	for i := 1; i <= rt.stores("machines").Count()+1; i++ {
+		data["Index"] = i
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, data); err != nil {
+			return "", err
+		}
+		name := strings.TrimSpace(buf.String())
+		if err := models.ValidMachineName("Invalid machine name", name); err != nil {
+			return "", err
+		}
+		if other := rt.FindByIndex("machines", nameIdx, name); other == nil || other.Key() == m.Key() {
+			return name, nil
+		}
+		if i == 1 {
+			first = name
+		} else if name == first {
+			// The template does not use Index.
+			break
+		}
+	}
+	return "", fmt.Errorf("Machine name %s is already in use", first)
+}
+
+// RenameMachine renames m with its name template.  The hostname
+// option of Reservations for m that hand out its old name is changed
+// to the new name.  m is only renamed if all of those Reservations
+// can be updated.
+//
+// Assumes MachineRenameLocks are held.
+func (rt *RequestTracker) RenameMachine(m *Machine) (*Machine, error) {
+	e := &models.Error{Code: 422, Type: ValidationError, Model: m.Prefix(), Key: m.Key()}
+	name, err := rt.MachineName(m)
+	if err != nil {
+		e.AddError(err)
+		return nil, e
+	}
+	if name == m.Name {
+		return m, nil
+	}
+	oldName := m.Name
+	// Work out and check the changes to the Reservations first, so
+	// that the Machine is only renamed if they can all be saved.
+	reservations := []*Reservation{}
+	for _, i := range rt.stores("reservations").Items() {
+		r := AsReservation(i)
+		mine := m.Address != nil && r.Addr.Equal(m.Address)
+		for _, mac := range m.HardwareAddrs {
+			mine = mine || (r.Strategy == "MAC" && strings.EqualFold(r.Token, mac))
+		}
+		if !mine {
+			continue
+		}
+		nr := ModelToBackend(models.Clone(r)).(*Reservation)
+		changed := false
+		for j := range nr.Options {
+			if nr.Options[j].Code == 12 && nr.Options[j].Value == oldName {
+				nr.Options[j].Value = name
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		patch, err := models.GenPatch(r, nr, false)
+		if err == nil {
+			_, err = rt.DryRunPatch(nr, nr.Key(), patch)
+		}
+		if err != nil {
+			e.Errorf("Unable to update Reservation %s: %v", r.Key(), err)
+			continue
+		}
+		reservations = append(reservations, nr)
+	}
+	if e.ContainsError() {
+		return nil, e
+	}
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.Name = name
+	if _, err := rt.Update(nm); err != nil {
+		return nil, err
+	}
+	for _, nr := range reservations {
+		if _, err := rt.Update(nr); err != nil {
+			e.Errorf("Failed to update Reservation %s: %v", nr.Key(), err)
+		}
+	}
+	return nm, e.HasError()
+}
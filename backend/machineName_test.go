@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestMachineName(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, MachineRenameLocks...)
+	m1, m2, m3 := uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Subnet with a bad NameTemplate", rt.Create, &models.Subnet{Name: "bad", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", NameTemplate: "r{{.rack"}, false},
+		{"Create Subnet with a NameTemplate", rt.Create, &models.Subnet{Name: "racks", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", NameTemplate: "r{{.rack}}-{{.Index}}"}, true},
+		{"Create Reservation with a hostname", rt.Create, &models.Reservation{Addr: net.ParseIP("192.168.124.11"), Token: "52:54:00:12:34:57", Strategy: "MAC", Options: []models.DhcpOption{{Code: 12, Value: "r14-2"}}}, true},
+		{"Create discovered Machine m1", rt.Create, &models.Machine{Uuid: m1, Name: "d52-54-00-12-34-56", Address: net.ParseIP("192.168.124.10"), HardwareAddrs: []string{"52:54:00:12:34:56"}, Params: map[string]interface{}{"rack": 14}}, true},
+		{"Create discovered Machine m2", rt.Create, &models.Machine{Uuid: m2, Name: "d52-54-00-12-34-57", Address: net.ParseIP("192.168.124.11"), HardwareAddrs: []string{"52:54:00:12:34:57"}, Params: map[string]interface{}{"rack": 14}}, true},
+		{"Create named Machine m3", rt.Create, &models.Machine{Uuid: m3, Name: "db1.example.com", Address: net.ParseIP("192.168.124.12"), HardwareAddrs: []string{"52:54:00:12:34:58"}, Params: map[string]interface{}{"rack": 14}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		for id, expected := range map[string]string{
+			m1.String(): "r14-1",
+			m2.String(): "r14-2",
+			m3.String(): "db1.example.com",
+		} {
+			if m := AsMachine(rt.Find("machines", id)); m.Name != expected {
+				t.Errorf("Expected machine %s to be named %s, not %s", id, expected, m.Name)
+			}
+		}
+		m := AsMachine(rt.find("machines", m2.String()))
+		nm := ModelToBackend(models.Clone(m)).(*Machine)
+		nm.Params["rack"] = 15
+		if _, err := rt.Update(nm); err != nil {
+			t.Fatalf("Unable to move m2 to rack 15: %v", err)
+		}
+		renamed, err := rt.RenameMachine(AsMachine(rt.find("machines", m2.String())))
+		if err != nil {
+			t.Fatalf("Unable to rename m2: %v", err)
+		}
+		if renamed.Name != "r15-1" {
+			t.Errorf("Expected m2 to be renamed r15-1, not %s", renamed.Name)
+		}
+		r := AsReservation(rt.Find("reservations", models.Hexaddr(net.ParseIP("192.168.124.11"))))
+		if len(r.Options) != 1 || r.Options[0].Value != "r15-1" {
+			t.Errorf("Expected the Reservation for m2 to hand out r15-1, not %v", r.Options)
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"path"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/digitalrebar/provision/backend/index"
 	"github.com/digitalrebar/provision/models"
@@ -25,6 +26,21 @@ type Machine struct {
 	// used during AfterSave() and AfterRemove() to handle boot environment changes.
 	oldBootEnv, oldStage, oldWorkflow      string
 	changeStageAllowed, inCreate, inRunner bool
+	// used to allow changes to the pool allocation fields, and to
+	// restart the current Workflow when a machine is released.
+	poolChange, restartWorkflow bool
+	// used to allow changes to the Inventory.
+	inventoryChange bool
+	// used to allow changes to the lock fields.
+	lockChange bool
+	// used to allow changes to Paused.
+	pauseChange bool
+	// used during AfterSave() to record lifecycle changes in the
+	// machine history.
+	oldLifecycle *machineLifecycle
+	// used during BeforeSave() to select profiles from a set that
+	// is not in the profile store yet.
+	selectFrom []*Profile
 
 	toDeRegister, toRegister renderers
 }
@@ -52,6 +68,11 @@ func (n *Machine) HasTask(s string) bool {
 		if p == s {
 			return true
 		}
+		for _, member := range models.TaskGroupMembers(p) {
+			if member == s {
+				return true
+			}
+		}
 	}
 	return false
 }
@@ -135,6 +156,60 @@ func (n *Machine) Indexes() map[string]index.Maker {
 			m.Workflow = s
 			return m, nil
 		})
+	res["Pool"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool { return fix(i).Pool < fix(j).Pool },
+		func(ref models.Model) (gte, gt index.Test) {
+			refPool := fix(ref).Pool
+			return func(s models.Model) bool {
+					return fix(s).Pool >= refPool
+				},
+				func(s models.Model) bool {
+					return fix(s).Pool > refPool
+				}
+		},
+		func(s string) (models.Model, error) {
+			m := fix(n.New())
+			m.Pool = s
+			return m, nil
+		})
+	res["PoolOwner"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool { return fix(i).PoolOwner < fix(j).PoolOwner },
+		func(ref models.Model) (gte, gt index.Test) {
+			refOwner := fix(ref).PoolOwner
+			return func(s models.Model) bool {
+					return fix(s).PoolOwner >= refOwner
+				},
+				func(s models.Model) bool {
+					return fix(s).PoolOwner > refOwner
+				}
+		},
+		func(s string) (models.Model, error) {
+			m := fix(n.New())
+			m.PoolOwner = s
+			return m, nil
+		})
+	res["LockOwner"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool { return fix(i).LockOwner < fix(j).LockOwner },
+		func(ref models.Model) (gte, gt index.Test) {
+			refOwner := fix(ref).LockOwner
+			return func(s models.Model) bool {
+					return fix(s).LockOwner >= refOwner
+				},
+				func(s models.Model) bool {
+					return fix(s).LockOwner > refOwner
+				}
+		},
+		func(s string) (models.Model, error) {
+			m := fix(n.New())
+			m.LockOwner = s
+			return m, nil
+		})
 	res["BootEnv"] = index.Make(
 		false,
 		"string",
@@ -213,6 +288,34 @@ func (n *Machine) Indexes() map[string]index.Maker {
 			}
 			return res, nil
 		})
+	res["Locked"] = index.Make(
+		false,
+		"boolean",
+		func(i, j models.Model) bool {
+			return (!fix(i).Locked) && fix(j).Locked
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			locked := fix(ref).Locked
+			return func(s models.Model) bool {
+					v := fix(s).Locked
+					return v || (v == locked)
+				},
+				func(s models.Model) bool {
+					return fix(s).Locked && !locked
+				}
+		},
+		func(s string) (models.Model, error) {
+			res := fix(n.New())
+			switch s {
+			case "true":
+				res.Locked = true
+			case "false":
+				res.Locked = false
+			default:
+				return nil, errors.New("Locked must be true or false")
+			}
+			return res, nil
+		})
 	return res
 }
 
@@ -377,6 +480,59 @@ func (n *Machine) HasProfile(name string) bool {
 	return false
 }
 
+// selectProfiles recomputes SelectedProfiles from the Selectors of
+// the passed profiles.  If a Selector cannot be matched, the previous
+// selection of that profile is kept.  The selection of a locked
+// Machine is left alone until it is unlocked.
+func (n *Machine) selectProfiles(profiles []*Profile) {
+	if n.Locked {
+		return
+	}
+	selected := []string{}
+	for _, profile := range profiles {
+		if profile.Selector == "" || n.HasProfile(profile.Name) {
+			continue
+		}
+		ok, err := profile.selects(n)
+		if err != nil {
+			n.rt.Errorf("Unable to match profile %s against machine %s: %v", profile.Name, n.UUID(), err)
+			ok = n.HasSelectedProfile(profile.Name)
+		}
+		if ok {
+			selected = append(selected, profile.Name)
+		}
+	}
+	n.SelectedProfiles = selected
+}
+
+// HasSelectedProfile returns true if the machine has the named
+// profile in its SelectedProfiles.
+func (n *Machine) HasSelectedProfile(name string) bool {
+	for _, e := range n.SelectedProfiles {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reselectProfiles recomputes SelectedProfiles for a machine that is
+// not otherwise being saved against profiles, and updates it if they
+// changed.
+func (rt *RequestTracker) reselectProfiles(m *Machine, profiles []*Profile) {
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.rt = rt
+	nm.selectProfiles(profiles)
+	nm.rt = nil
+	if reflect.DeepEqual(m.SelectedProfiles, nm.SelectedProfiles) {
+		return
+	}
+	nm.selectFrom = profiles
+	if _, err := rt.Update(nm); err != nil {
+		rt.Errorf("Unable to save selected profiles for machine %s: %v", m.UUID(), err)
+	}
+}
+
 func (n *Machine) New() store.KeySaver {
 	res := &Machine{Machine: &models.Machine{}}
 	res.Tasks = []string{}
@@ -400,6 +556,7 @@ func (n *Machine) OnCreate() error {
 	n.inCreate = true
 	n.oldStage = "none"
 	n.oldBootEnv = "local"
+	n.oldLifecycle = &machineLifecycle{CurrentTask: -1}
 	oldm := ModelToBackend(&models.Machine{}).(*Machine)
 	if n.Workflow == "" {
 		n.Workflow = n.rt.dt.pref("defaultWorkflow")
@@ -413,6 +570,22 @@ func (n *Machine) OnCreate() error {
 	if n.Tasks == nil {
 		n.Tasks = []string{}
 	}
+	// New machines start out unallocated, unlocked, and without an
+	// inventory.
+	n.Pool, n.PoolOwner, n.PoolExpires = "", "", time.Time{}
+	n.Locked, n.LockOwner, n.LockReason = false, "", ""
+	n.Inventory = nil
+	// Discovered machines are named with the machine name template,
+	// if one applies.
+	if discoveredName(n.Name, n.HardwareAddrs) {
+		if tmpl, _, _ := n.rt.machineNameTemplate(n); tmpl != "" {
+			if name, err := n.rt.MachineName(n); err != nil {
+				n.rt.Warnf("Unable to name discovered machine %s: %v", n.UUID(), err)
+			} else {
+				n.Name = name
+			}
+		}
+	}
 	realStage, realEnv := n.validateChangeWorkflow(oldm, e)
 	if realStage != "" {
 		n.Stage = realStage
@@ -464,7 +637,7 @@ func (n *Machine) Validate() {
 		}
 	}
 	if pk, err := n.rt.PrivateKeyFor(n); err == nil {
-		ValidateParams(n.rt, n, n.Params, pk)
+		ValidateParams(n.rt, n, n.Params, pk, n.rt.previousKeyFor(n))
 	} else {
 		n.Errorf("Unable to get key: %v", err)
 	}
@@ -578,6 +751,16 @@ func (n *Machine) Validate() {
 				if bootenvs.Find(parts[1]) == nil {
 					n.Errorf("BootEnv %s (at %d) does not exist", parts[1], i)
 				}
+			case "if", "goto":
+				if _, err := models.ParseWorkflowStep(ent); err != nil {
+					n.Errorf("%s (at %d) is malformed: %v", ent, i, err)
+				}
+			case "group":
+				for _, member := range models.TaskGroupMembers(ent) {
+					if tasks.Find(member) == nil {
+						n.Errorf("Task %s in %s (at %d) does not exist", member, ent, i)
+					}
+				}
 			default:
 				n.Errorf("%s (at %d) is malformed", ent, i)
 			}
@@ -608,6 +791,9 @@ func (n *Machine) BeforeSave() error {
 	if n.oldWorkflow == "" && n.Workflow != "" {
 		n.oldWorkflow = n.Workflow
 	}
+	if n.StageEntered.IsZero() || n.oldStage != n.Stage {
+		n.StageEntered = time.Now()
+	}
 	n.Validate()
 	if !n.Useable() {
 		return n.MakeError(422, ValidationError, n)
@@ -615,6 +801,11 @@ func (n *Machine) BeforeSave() error {
 	if !n.Available {
 		n.Runnable = false
 	}
+	if n.selectFrom != nil {
+		n.selectProfiles(n.selectFrom)
+	} else {
+		n.selectProfiles(AsProfiles(n.rt.stores("profiles").Items()))
+	}
 
 	// Set the features meta tag.
 	// Make sure the machine defaults to change-stage-v2
@@ -653,12 +844,22 @@ func (n *Machine) AfterSave() {
 	}
 	n.toDeRegister = nil
 	n.toRegister = nil
+	if n.oldLifecycle != nil {
+		n.rt.recordMachineChanges(n.oldLifecycle, n)
+		n.oldLifecycle = nil
+	}
 	n.oldStage = n.Stage
 	n.oldBootEnv = n.BootEnv
 	n.oldWorkflow = n.Workflow
 	n.changeStageAllowed = false
 	n.inCreate = false
 	n.inRunner = false
+	n.poolChange = false
+	n.restartWorkflow = false
+	n.inventoryChange = false
+	n.lockChange = false
+	n.pauseChange = false
+	n.selectFrom = nil
 	n.rt.dt.macAddrMux.Lock()
 	for _, mac := range n.HardwareAddrs {
 		n.rt.dt.macAddrMap[mac] = n.UUID()
@@ -701,7 +902,7 @@ func (n *Machine) OnLoad() error {
 }
 
 func (n *Machine) validateChangeWorkflow(oldm *Machine, e *models.Error) (newStage, newEnv string) {
-	if oldm.Workflow == n.Workflow {
+	if oldm.Workflow == n.Workflow && !n.restartWorkflow {
 		return
 	}
 	if n.Workflow == "" {
@@ -727,28 +928,161 @@ func (n *Machine) validateChangeWorkflow(oldm *Machine, e *models.Error) (newSta
 		return
 	}
 	n.CurrentTask = -1
-	taskList := []string{}
-	lastEnv := ""
-	firstStage := true
-	for _, stageName := range workflow.Stages {
-		stage := n.rt.find("stages", stageName).(*Stage)
-		taskList = append(taskList, "stage:"+stageName)
-		if firstStage {
-			newStage = stage.Name
-		}
-		if stage.BootEnv != "" && stage.BootEnv != lastEnv {
-			if firstStage {
-				newEnv = stage.BootEnv
-				n.BootEnv = stage.BootEnv
+	n.Tasks, newStage, newEnv = workflow.TaskList(n.rt)
+	if newEnv != "" {
+		n.BootEnv = newEnv
+	}
+	return
+}
+
+// jobExitState returns the ExitState of j as seen by flow control
+// steps.  Failed and cancelled Jobs that did not set an ExitState are
+// treated as having an ExitState of failed or cancelled.
+func jobExitState(j *Job) string {
+	if j == nil {
+		return ""
+	}
+	if j.ExitState == "" && (j.State == "failed" || j.State == "cancelled") {
+		return j.State
+	}
+	return j.ExitState
+}
+
+// LastTaskJob follows the Previous chain of Jobs back from j until it
+// finds one that ran a Task, rather than a stage, bootenv, or flow
+// control step.  It returns nil if there is no such Job.
+func (rt *RequestTracker) LastTaskJob(j *Job) *Job {
+	seen := map[string]bool{}
+	for j != nil && !seen[j.UUID()] {
+		if !strings.Contains(j.Task, ":") {
+			return j
+		}
+		seen[j.UUID()] = true
+		prev := rt.find("jobs", j.Previous.String())
+		if prev == nil {
+			return nil
+		}
+		j = AsJob(prev)
+	}
+	return nil
+}
+
+// NextStep evaluates the flow control step at index i of the Tasks of
+// the Machine, and returns the index of the entry the Machine should
+// continue with.  Jumps go to the first stage: entry for the target
+// Stage.  lastJob is the last Job that ran a Task on the Machine, and
+// may be nil.
+func (n *Machine) NextStep(rt *RequestTracker, i int, lastJob *Job) (int, error) {
+	step, err := models.ParseWorkflowStep(n.Tasks[i])
+	if err != nil {
+		return i, err
+	}
+	if step == nil {
+		return i, fmt.Errorf("Task list entry[%d]: '%s' is not a flow control step", i, n.Tasks[i])
+	}
+	var val interface{}
+	if step.Kind == "if" {
+		if step.Param == "ExitState" {
+			val = jobExitState(lastJob)
+		} else {
+			val, _ = rt.GetParam(n, step.Param, true, false)
+		}
+	}
+	if !step.Matches(val) {
+		return i + 1, nil
+	}
+	for j, t := range n.Tasks {
+		if t == "stage:"+step.Target {
+			return j, nil
+		}
+	}
+	return i, fmt.Errorf("Task list entry[%d]: '%s' jumps to Stage %s, which is not in the task list",
+		i, n.Tasks[i], step.Target)
+}
+
+// FailureHandled returns true if one of the flow control steps that
+// directly follow index i of the Tasks of the Machine is an if step
+// that branches on the ExitState of j, the Job that ran the entry at
+// index i.  In that case the Machine stays runnable when the Job
+// fails, so that it can continue at the branch.  The scan stops at the
+// first entry that is not a flow control step, or at a goto step,
+// since nothing after either of those is evaluated.
+func (n *Machine) FailureHandled(i int, j *Job) bool {
+	exitState := jobExitState(j)
+	if i < 0 || i >= len(n.Tasks) || exitState == "" {
+		return false
+	}
+	for _, entry := range n.Tasks[i+1:] {
+		step, err := models.ParseWorkflowStep(entry)
+		if err != nil || step == nil || step.Kind != "if" {
+			return false
+		}
+		if step.Param == "ExitState" && step.Matches(exitState) {
+			return true
+		}
+	}
+	return false
+}
+
+// TaskGroupJob returns the Job that stands for the state of the task
+// group at CurrentTask as a whole: the first failed member if any
+// member has failed, otherwise the first cancelled member, otherwise
+// the first member that is still created or running, otherwise the
+// first incomplete member, otherwise the last member.  more is true if
+// there are members of the group that do not have a Job yet, in which
+// case job is nil unless a member has failed or been cancelled.
+func (n *Machine) TaskGroupJob(rt *RequestTracker) (job *Job, more bool) {
+	if n.CurrentTask < 0 || n.CurrentTask >= len(n.Tasks) {
+		return nil, false
+	}
+	members := models.TaskGroupMembers(n.Tasks[n.CurrentTask])
+	if members == nil {
+		return nil, false
+	}
+	jobs := []*Job{}
+	for _, id := range n.CurrentJobs {
+		if obj := rt.find("jobs", id.String()); obj != nil {
+			jobs = append(jobs, AsJob(obj))
+		}
+	}
+	more = len(n.CurrentJobs) < len(members)
+	states := []string{"failed", "cancelled", "created", "running", "incomplete"}
+	if more {
+		states = states[:2]
+	}
+	for _, state := range states {
+		for _, j := range jobs {
+			if j.State == state {
+				return j, more
+			}
+		}
+	}
+	if more || len(jobs) == 0 {
+		return nil, more
+	}
+	return jobs[len(jobs)-1], false
+}
+
+// RetireJobs marks the Jobs in ids that are not also in keep as no
+// longer being current.  It is used to retire the members of a task
+// group once the Machine has moved past the group.
+func (rt *RequestTracker) RetireJobs(ids, keep []uuid.UUID) {
+	kept := map[string]bool{}
+	for _, id := range keep {
+		kept[id.String()] = true
+	}
+	for _, id := range ids {
+		if kept[id.String()] {
+			continue
+		}
+		if obj := rt.find("jobs", id.String()); obj != nil {
+			j := AsJob(obj)
+			if j.Current {
+				j.Current = false
+				rt.Save(j)
 			}
-			taskList = append(taskList, "bootenv:"+stage.BootEnv)
-			lastEnv = stage.BootEnv
 		}
-		taskList = append(taskList, stage.Tasks...)
-		firstStage = false
 	}
-	n.Tasks = taskList
-	return
 }
 
 func (n *Machine) validateChangeStage(oldm *Machine, e *models.Error) {
@@ -872,11 +1206,79 @@ func (n *Machine) resetCurrentTask(oldm *Machine, e *models.Error) {
 	n.rt.Infof("Resetting CurrentTask from %d to %d", oldm.CurrentTask, n.CurrentTask)
 }
 
+// paramsChanged returns true if the Params of n differ from those of
+// oldm.  Secure Params are compared by the values they hold, so
+// resealing them with a new key does not count as a change.
+func (n *Machine) paramsChanged(oldm *Machine) bool {
+	if len(oldm.Params) != len(n.Params) {
+		return true
+	}
+	for k, ov := range oldm.Params {
+		nv, ok := n.Params[k]
+		if !ok {
+			return true
+		}
+		if reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		if !isSealedValue(ov) || !isSealedValue(nv) {
+			return true
+		}
+		osd, nsd := &models.SecureData{}, &models.SecureData{}
+		models.Remarshal(ov, osd)
+		models.Remarshal(nv, nsd)
+		var oval, nval interface{}
+		if _, err := n.rt.openSecure(n, osd, &oval); err != nil {
+			return true
+		}
+		if _, err := n.rt.openSecure(n, nsd, &nval); err != nil {
+			return true
+		}
+		if !reflect.DeepEqual(oval, nval) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateLocked makes sure that the fields a lock protects are not
+// being changed.
+func (n *Machine) validateLocked(oldm *Machine, e *models.Error) {
+	changed := []string{}
+	if oldm.Stage != n.Stage {
+		changed = append(changed, "Stage")
+	}
+	if oldm.BootEnv != n.BootEnv {
+		changed = append(changed, "BootEnv")
+	}
+	if oldm.Workflow != n.Workflow {
+		changed = append(changed, "Workflow")
+	}
+	if !(len(oldm.Tasks) == 0 && len(n.Tasks) == 0) && !reflect.DeepEqual(oldm.Tasks, n.Tasks) {
+		changed = append(changed, "Tasks")
+	}
+	if !(len(oldm.Profiles) == 0 && len(n.Profiles) == 0) && !reflect.DeepEqual(oldm.Profiles, n.Profiles) {
+		changed = append(changed, "Profiles")
+	}
+	if n.paramsChanged(oldm) {
+		changed = append(changed, "Params")
+	}
+	if len(changed) > 0 {
+		e.Code = http.StatusConflict
+		e.Errorf("Machine is locked by %s (%s), cannot change %s", oldm.LockOwner, oldm.LockReason, strings.Join(changed, ", "))
+	}
+}
+
 func (n *Machine) OnChange(oldThing store.KeySaver) error {
 	oldm := AsMachine(oldThing)
 	n.oldBootEnv = oldm.BootEnv
 	n.oldStage = oldm.Stage
 	n.oldWorkflow = oldm.Workflow
+	n.oldLifecycle = lifecycleOf(oldm.Machine)
+	// A Machine made runnable again gets the whole Stage timeout.
+	if !oldm.Runnable && n.Runnable {
+		n.StageEntered = time.Now()
+	}
 	oldPast, _, oldFuture := oldm.SplitTasks()
 	newPast, _, newFuture := n.SplitTasks()
 	e := &models.Error{
@@ -891,6 +1293,35 @@ func (n *Machine) OnChange(oldThing store.KeySaver) error {
 		e.Errorf("Cannot change CurrentTask from %d to %d", oldm.CurrentTask, n.CurrentTask)
 		return e
 	}
+	if !n.poolChange &&
+		(oldm.Pool != n.Pool ||
+			oldm.PoolOwner != n.PoolOwner ||
+			!oldm.PoolExpires.Equal(n.PoolExpires)) {
+		e.Errorf("Pool allocations can only be changed by allocating or releasing the machine")
+		return e
+	}
+	if !n.pauseChange && oldm.Paused != n.Paused {
+		e.Errorf("Machines can only be paused or resumed with the pause, resume, and cancel actions")
+		return e
+	}
+	if !n.lockChange &&
+		(oldm.Locked != n.Locked ||
+			oldm.LockOwner != n.LockOwner ||
+			oldm.LockReason != n.LockReason) {
+		e.Errorf("Machine locks can only be changed by locking or unlocking the machine")
+		return e
+	}
+	if oldm.Locked && n.Locked {
+		n.validateLocked(oldm, e)
+		if e.ContainsError() {
+			return e
+		}
+	}
+	// The Inventory can only be replaced by uploading a new one, so
+	// updates from clients that did not fetch it do not clear it.
+	if !n.inventoryChange {
+		n.Inventory = oldm.Inventory
+	}
 	newStage, newEnv := n.validateChangeWorkflow(oldm, e)
 	if newStage != "" {
 		n.Stage = newStage
@@ -959,6 +1390,8 @@ func (n *Machine) AfterDelete() {
 	}
 	n.rt.DeleteKeyFor(n)
 	n.rt.dt.macAddrMux.Unlock()
+	n.rt.removeMachineHistory(n)
+	n.rt.removeMachineInventory(n)
 
 }
 
@@ -976,7 +1409,7 @@ func AsMachines(o []models.Model) []*Machine {
 
 var machineLockMap = map[string][]string{
 	"get":     {"stages", "bootenvs", "machines", "profiles", "params", "workflows"},
-	"create":  {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"},
+	"create":  {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows", "leases", "subnets"},
 	"update":  {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"},
 	"patch":   {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"},
 	"delete":  {"stages", "bootenvs", "machines", "jobs", "tasks"},
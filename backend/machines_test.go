@@ -2,10 +2,13 @@ package backend
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/backend/index"
 	"github.com/digitalrebar/provision/models"
 	"github.com/pborman/uuid"
 )
@@ -100,3 +103,496 @@ func TestMachineCrud(t *testing.T) {
 		}
 	})
 }
+
+func TestMachineHistory(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs").SetPrincipal("rocket")
+	machineUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Stage one", rt.Create, &models.Stage{Name: "one", BootEnv: "local"}, true},
+		{"Create Stage two", rt.Create, &models.Stage{Name: "two", BootEnv: "local"}, true},
+		{"Create Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "history.example.com", Stage: "one"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	start := time.Now()
+	rt.Do(func(d Stores) {
+		m := models.Clone(rt.Find("machines", machineUUID.String())).(*models.Machine)
+		m.Stage = "two"
+		m.Address = net.ParseIP("192.168.124.10")
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Failed to update machine: %v", err)
+		}
+		m = models.Clone(rt.Find("machines", machineUUID.String())).(*models.Machine)
+		m.Name = "renamed.example.com"
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Failed to rename machine: %v", err)
+		}
+	})
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		if _, err := rt.SaveMachineAddress(m, net.ParseIP("192.168.124.11")); err != nil {
+			t.Fatalf("Failed to save machine address: %v", err)
+		}
+	})
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		stages, err := rt.MachineHistory(m, "Stage", time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to get machine history: %v", err)
+		}
+		if len(stages) != 2 || stages[0].NewValue != "one" || stages[1].OldValue != "one" || stages[1].NewValue != "two" {
+			t.Errorf("Expected the machine to have been created in one and moved to two, got %v", stages)
+		}
+		for _, change := range stages {
+			if change.Principal != "rocket" {
+				t.Errorf("Expected change to be made by rocket, not %s", change.Principal)
+			}
+		}
+		recent, err := rt.MachineHistory(m, "", start, time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to get machine history: %v", err)
+		}
+		if len(recent) != 3 {
+			t.Errorf("Expected the Stage and both Address changes since the machine was created, got %v", recent)
+		}
+		if _, err := rt.Remove(m); err != nil {
+			t.Fatalf("Failed to remove machine: %v", err)
+		}
+		if gone, _ := rt.MachineHistory(m, "", time.Time{}, time.Time{}); len(gone) != 0 {
+			t.Errorf("Expected the history of a removed machine to be removed")
+		}
+	})
+}
+
+func TestMachineInventory(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	bigUUID, smallUUID := uuid.NewRandom(), uuid.NewRandom()
+	tests := []crudTest{
+		{"Create big Machine", rt.Create, &models.Machine{Uuid: bigUUID, Name: "big.example.com", HardwareAddrs: []string{"52:54:00:00:00:01"}}, true},
+		{"Create small Machine", rt.Create, &models.Machine{Uuid: smallUUID, Name: "small.example.com"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	disks := func(count int) []models.InventoryDisk {
+		res := []models.InventoryDisk{}
+		for i := 0; i < count; i++ {
+			res = append(res, models.InventoryDisk{Name: fmt.Sprintf("sd%c", 'a'+i), SizeBytes: 1000 * 1000 * 1000 * 1000})
+		}
+		return res
+	}
+	rt.Do(func(d Stores) {
+		big := AsMachine(rt.Find("machines", bigUUID.String()))
+		bad := &models.Inventory{NICs: []models.InventoryNIC{{Name: "eth0", MAC: "not a mac"}}}
+		if _, err := rt.SetInventory(big, bad); err == nil {
+			t.Errorf("Expected an inventory with an invalid MAC to be rejected")
+		}
+		inv := &models.Inventory{
+			Disks: disks(2),
+			NICs: []models.InventoryNIC{
+				{Name: "eth0", MAC: "52:54:00:00:00:01", Model: "X710", Link: true},
+				{Name: "eth1", MAC: "52:54:00:00:00:02", Model: "X710"},
+			},
+		}
+		big, err := rt.SetInventory(big, inv)
+		if err != nil {
+			t.Fatalf("Failed to set inventory: %v", err)
+		}
+		if len(big.HardwareAddrs) != 2 || big.HardwareAddrs[1] != "52:54:00:00:00:02" {
+			t.Errorf("Expected the new NIC to be added to the HardwareAddrs, got %v", big.HardwareAddrs)
+		}
+		if big, err = rt.SetInventory(big, &models.Inventory{Disks: disks(4), NICs: inv.NICs}); err != nil {
+			t.Fatalf("Failed to set inventory: %v", err)
+		}
+		if big.Inventory.Version != 2 || big.Inventory.Facts["disks.count"] != 4 || big.Inventory.Facts["disks.totalGB"] != 4000 {
+			t.Errorf("Expected version 2 with 4 disks, got %v", big.Inventory)
+		}
+		small := AsMachine(rt.Find("machines", smallUUID.String()))
+		small, err = rt.SetInventory(small, &models.Inventory{
+			Disks: disks(1),
+			NICs: []models.InventoryNIC{
+				{Name: "eth0", MAC: "52:54:00:00:01:01", Model: "X550"},
+				{Name: "eth1", MAC: "52:54:00:00:01:02", Model: "I350"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to set inventory: %v", err)
+		}
+		if nicModels := fmt.Sprint(small.Inventory.Facts["nics.model"]); nicModels != "[I350 X550]" {
+			t.Errorf("Expected the NIC models to be I350 and X550, got %s", nicModels)
+		}
+		versions, err := rt.InventoryVersions(big)
+		if err != nil || len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+			t.Errorf("Expected inventory versions 1 and 2, got %v (%v)", versions, err)
+		}
+		if old, err := rt.Inventory(big, 1); err != nil || len(old.Disks) != 2 {
+			t.Errorf("Expected version 1 to have 2 disks, got %v (%v)", old, err)
+		}
+		if _, err := rt.Inventory(big, 3); err == nil {
+			t.Errorf("Expected missing inventory version to fail")
+		}
+		for _, filter := range []struct {
+			name, val string
+			want      uuid.UUID
+		}{
+			{"Inventory.disks.count", "Gte(4)", bigUUID},
+			{"Inventory.nic.model", "X710", bigUUID},
+			{"Inventory.nic.model", "X550", smallUUID},
+			{"Inventory.nics.model", "I350", smallUUID},
+			{"Inventory.nics.model", "Lt(J)", smallUUID},
+		} {
+			filters, err := rt.FilterFor(&Machine{}, filter.name, []string{filter.val})
+			if err != nil {
+				t.Fatalf("Failed to make %s filter: %v", filter.name, err)
+			}
+			found, err := index.All(filters...)(&d("machines").Index)
+			if err != nil || found.Count() != 1 || found.Items()[0].Key() != filter.want.String() {
+				t.Errorf("Expected %s=%s to find only machine %s, got %v (%v)", filter.name, filter.val, filter.want, found, err)
+			}
+		}
+		if _, err := rt.FilterFor(&Machine{}, "Inventory.disks.count", []string{"lots"}); err == nil {
+			t.Errorf("Expected a non-numeric filter on a numeric fact to fail")
+		}
+		if _, err := rt.FilterFor(&Machine{}, "Inventory.flux.capacitors", []string{"1"}); err == nil {
+			t.Errorf("Expected a filter on an unknown fact to fail")
+		}
+		m := models.Clone(big.Machine).(*models.Machine)
+		m.Inventory = nil
+		m.Description = "lots of disks"
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Failed to update machine: %v", err)
+		}
+		if AsMachine(rt.Find("machines", bigUUID.String())).Inventory == nil {
+			t.Errorf("Expected the inventory to survive a regular update")
+		}
+	})
+}
+
+func TestMachineDuplicates(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	oldUUID, newUUID, macUUID, otherUUID, loneUUID := uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()
+	jobUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Profile", rt.Create, &models.Profile{Name: "rack1"}, true},
+		{"Create secure Param", rt.Create, &models.Param{Name: "bmc-password", Secure: true, Schema: map[string]interface{}{"type": "string"}}, true},
+		{"Create Task", rt.Create, &models.Task{Name: "discover"}, true},
+		{"Create Stage", rt.Create, &models.Stage{Name: "discover", BootEnv: "local", Tasks: []string{"discover"}}, true},
+		{"Create old Machine", rt.Create, &models.Machine{
+			Uuid:          oldUUID,
+			Name:          "old.example.com",
+			Stage:         "discover",
+			Address:       net.ParseIP("192.168.124.20"),
+			HardwareAddrs: []string{"52:54:00:00:01:01"},
+			Profiles:      []string{"rack1"},
+			Params:        map[string]interface{}{"owner": "alice", "rack": "r1"},
+			Meta:          models.Meta{"color": "red"},
+		}, true},
+		{"Create new Machine", rt.Create, &models.Machine{
+			Uuid:          newUUID,
+			Name:          "new.example.com",
+			HardwareAddrs: []string{"52:54:00:00:01:02"},
+			Params:        map[string]interface{}{"owner": "bob"},
+		}, true},
+		{"Create Machine sharing a MAC", rt.Create, &models.Machine{Uuid: macUUID, Name: "mac.example.com", HardwareAddrs: []string{"52:54:00:00:02:01"}}, true},
+		{"Create other Machine sharing a MAC", rt.Create, &models.Machine{Uuid: otherUUID, Name: "other.example.com", HardwareAddrs: []string{"52:54:00:00:02:01"}}, true},
+		{"Create lone Machine", rt.Create, &models.Machine{Uuid: loneUUID, Name: "lone.example.com"}, true},
+		{"Create Job for old Machine", rt.Create, &models.Job{
+			Uuid:     jobUUID,
+			Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+			Machine:  oldUUID,
+			Task:     "discover",
+			Stage:    "discover",
+			State:    "created",
+		}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		bios := models.InventoryBIOS{SystemSerial: "CZ1234", SystemUUID: "03000200-0400-0500-0006-000700080009"}
+		for _, id := range []uuid.UUID{oldUUID, newUUID} {
+			if _, err := rt.SetInventory(AsMachine(rt.Find("machines", id.String())), &models.Inventory{BIOS: bios}); err != nil {
+				t.Fatalf("Failed to set inventory: %v", err)
+			}
+		}
+		groups := rt.MachineDuplicates()
+		if len(groups) != 2 {
+			t.Fatalf("Expected 2 sets of duplicates, got %d", len(groups))
+		}
+		for _, group := range groups {
+			if len(group.Machines) != 2 || len(group.Reasons) != 1 {
+				t.Errorf("Expected 2 machines with 1 reason, got %v", group)
+			}
+			if group.Reasons[0] != "serial:CZ1234" && group.Reasons[0] != "mac:52:54:00:00:02:01" {
+				t.Errorf("Unexpected reason %s (placeholder system UUIDs should be ignored)", group.Reasons[0])
+			}
+		}
+		if lone := rt.DuplicatesOf(AsMachine(rt.Find("machines", loneUUID.String()))); len(lone.Machines) != 1 {
+			t.Errorf("Expected lone machine to have no duplicates, got %v", lone)
+		}
+		oldM := AsMachine(rt.Find("machines", oldUUID.String()))
+		pk, err := rt.PublicKeyFor(oldM)
+		if err != nil {
+			t.Fatalf("Failed to get public key: %v", err)
+		}
+		sd := &models.SecureData{}
+		if err := sd.Marshal(pk, "hunter2"); err != nil {
+			t.Fatalf("Failed to seal secure param: %v", err)
+		}
+		oldM.Params["bmc-password"] = sd
+		if _, err := rt.Update(oldM); err != nil {
+			t.Fatalf("Failed to set secure param: %v", err)
+		}
+		newM := AsMachine(rt.Find("machines", newUUID.String()))
+		if _, err := rt.MergeMachines(newM, newM); err == nil {
+			t.Errorf("Expected merging a machine into itself to fail")
+		}
+		merged, err := rt.MergeMachines(newM, AsMachine(rt.Find("machines", oldUUID.String())))
+		if err != nil {
+			t.Fatalf("Failed to merge machines: %v", err)
+		}
+		if rt.Find("machines", oldUUID.String()) != nil {
+			t.Errorf("Expected the duplicate to be removed")
+		}
+		if merged.Params["owner"] != "bob" || merged.Params["rack"] != "r1" {
+			t.Errorf("Expected params to be merged with the survivor winning, got %v", merged.Params)
+		}
+		if v, _ := rt.GetParam(merged, "bmc-password", false, true); v != "hunter2" {
+			t.Errorf("Expected secure param to be resealed for the survivor, got %v", v)
+		}
+		if len(merged.Profiles) != 1 || merged.Meta["color"] != "red" || len(merged.HardwareAddrs) != 2 {
+			t.Errorf("Expected profiles, meta, and MACs to be merged, got %v %v %v", merged.Profiles, merged.Meta, merged.HardwareAddrs)
+		}
+		if !merged.Address.Equal(net.ParseIP("192.168.124.20")) {
+			t.Errorf("Expected the survivor to take the address of the duplicate, got %v", merged.Address)
+		}
+		if job := AsJob(rt.Find("jobs", jobUUID.String())); !uuid.Equal(job.Machine, newUUID) {
+			t.Errorf("Expected the job to be moved to the survivor, got %s", job.Machine)
+		}
+		if len(rt.MachineDuplicates()) != 1 {
+			t.Errorf("Expected only the MAC duplicates to be left")
+		}
+	})
+}
+
+func TestDryRunPatch(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	machineUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Stage one", rt.Create, &models.Stage{Name: "one", BootEnv: "local"}, true},
+		{"Create Stage two", rt.Create, &models.Stage{Name: "two", BootEnv: "local"}, true},
+		{"Create Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "dryrun.example.com", Stage: "one"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		ref := &Machine{}
+		good := jsonpatch2.Patch{{Op: "replace", Path: "/Stage", Value: "two"}}
+		res, err := rt.DryRunPatch(ref, machineUUID.String(), good)
+		if err != nil {
+			t.Errorf("Expected dry run of a valid patch to pass: %v", err)
+		} else if AsMachine(res).Stage != "two" {
+			t.Errorf("Expected dry run to return the patched machine")
+		}
+		bad := jsonpatch2.Patch{{Op: "replace", Path: "/Stage", Value: "missing"}}
+		if _, err := rt.DryRunPatch(ref, machineUUID.String(), bad); err == nil {
+			t.Errorf("Expected dry run of a patch to a missing stage to fail")
+		}
+		if m := AsMachine(rt.Find("machines", machineUUID.String())); m.Stage != "one" {
+			t.Errorf("Expected dry run not to change the machine, but it is in %s", m.Stage)
+		}
+	})
+}
+
+func TestMachinePauseCancel(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	machineUUID, jobUUID, doneUUID := uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Task", rt.Create, &models.Task{Name: "install"}, true},
+		{"Create Stage", rt.Create, &models.Stage{Name: "install", BootEnv: "local", Tasks: []string{"install"}}, true},
+		{"Create Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "pause.example.com", Stage: "install"}, true},
+		{"Create finished Job", rt.Create, &models.Job{
+			Uuid:     doneUUID,
+			Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+			Machine:  machineUUID,
+			Task:     "install",
+			Stage:    "install",
+			State:    "finished",
+		}, true},
+		{"Create Job", rt.Create, &models.Job{
+			Uuid:     jobUUID,
+			Previous: doneUUID,
+			Machine:  machineUUID,
+			Task:     "install",
+			Stage:    "install",
+			State:    "created",
+		}, true},
+		{"Create Job with a bad State", rt.Create, &models.Job{
+			Uuid:     uuid.NewRandom(),
+			Previous: doneUUID,
+			Machine:  machineUUID,
+			Task:     "install",
+			Stage:    "install",
+			State:    "stopped",
+		}, false},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		m := ModelToBackend(models.Clone(rt.find("machines", machineUUID.String()))).(*Machine)
+		m.CurrentJobs = []uuid.UUID{doneUUID, jobUUID}
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Failed to set current jobs: %v", err)
+		}
+		res, err := rt.PauseMachine(AsMachine(rt.Find("machines", machineUUID.String())))
+		if err != nil {
+			t.Fatalf("Failed to pause machine: %v", err)
+		}
+		if !res.Paused {
+			t.Errorf("Expected machine to be paused")
+		}
+		if res, err = rt.ResumeMachine(res); err != nil {
+			t.Fatalf("Failed to resume machine: %v", err)
+		}
+		if res.Paused {
+			t.Errorf("Expected machine to be resumed")
+		}
+		if res, err = rt.CancelMachine(res); err != nil {
+			t.Fatalf("Failed to cancel machine: %v", err)
+		}
+		if !res.Paused {
+			t.Errorf("Expected cancelled machine to be paused")
+		}
+		if state := AsJob(rt.Find("jobs", jobUUID.String())).State; state != "cancelled" {
+			t.Errorf("Expected running job to be cancelled, not %s", state)
+		}
+		if state := AsJob(rt.Find("jobs", doneUUID.String())).State; state != "finished" {
+			t.Errorf("Expected finished job to stay finished, not %s", state)
+		}
+		j := AsJob(rt.Find("jobs", jobUUID.String()))
+		j.State = "failed"
+		if _, err := rt.Update(j); err == nil {
+			t.Errorf("Expected a cancelled job not to be able to fail")
+		}
+		m = AsMachine(rt.Find("machines", machineUUID.String()))
+		m.Paused = false
+		if _, err := rt.Update(m); err == nil {
+			t.Errorf("Expected a machine not to be resumed by an update")
+		}
+	})
+}
+
+func TestMachineLock(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs").SetPrincipal("ops")
+	machineUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Stage one", rt.Create, &models.Stage{Name: "one", BootEnv: "local"}, true},
+		{"Create Stage two", rt.Create, &models.Stage{Name: "two", BootEnv: "local"}, true},
+		{"Create secure Param", rt.Create, &models.Param{Name: "secret", Secure: true, Schema: map[string]interface{}{"type": "string"}}, true},
+		{"Create Profile", rt.Create, &models.Profile{Name: "plain"}, true},
+		{"Create locked Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "db1.example.com", Stage: "one", Locked: true, LockOwner: "me"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	changed := func(change func(*models.Machine)) *models.Machine {
+		var res *models.Machine
+		rt.Do(func(d Stores) {
+			res = models.Clone(rt.Find("machines", machineUUID.String())).(*models.Machine)
+		})
+		change(res)
+		return res
+	}
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		if m.Locked || m.LockOwner != "" {
+			t.Errorf("Expected new machine to be unlocked")
+		}
+		pk, err := rt.PublicKeyFor(m)
+		if err != nil {
+			t.Fatalf("Error getting public key: %v", err)
+		}
+		sd := &models.SecureData{}
+		if err := sd.Marshal(pk, "sekrit"); err != nil {
+			t.Fatalf("Error sealing secure param: %v", err)
+		}
+		m.Params = map[string]interface{}{"secret": sd}
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Failed to set secure param: %v", err)
+		}
+		m = AsMachine(rt.Find("machines", machineUUID.String()))
+		res, err := rt.LockMachine(m, "database migration")
+		if err != nil {
+			t.Fatalf("Failed to lock machine: %v", err)
+		}
+		if !res.Locked || res.LockOwner != "ops" || res.LockReason != "database migration" {
+			t.Errorf("Expected machine to be locked by ops for the migration, not %v %q %q", res.Locked, res.LockOwner, res.LockReason)
+		}
+		if _, err := rt.LockMachine(res, "again"); err == nil {
+			t.Errorf("Expected locking a locked machine to fail")
+		}
+		filters, err := rt.FilterFor(&Machine{}, "Locked", []string{"true"})
+		if err != nil {
+			t.Fatalf("Failed to make Locked filter: %v", err)
+		}
+		if found, err := index.All(filters...)(&d("machines").Index); err != nil || found.Count() != 1 {
+			t.Errorf("Expected Locked=true to find the locked machine, got %v (%v)", found, err)
+		}
+	})
+	tests = []crudTest{
+		{"Change Stage of a locked Machine", rt.Update, changed(func(m *models.Machine) { m.Stage = "two" }), false},
+		{"Change Params of a locked Machine", rt.Update, changed(func(m *models.Machine) { m.Params = map[string]interface{}{"foo": "bar"} }), false},
+		{"Change Tasks of a locked Machine", rt.Update, changed(func(m *models.Machine) { m.Tasks = []string{"stage:two"} }), false},
+		{"Change Profiles of a locked Machine", rt.Update, changed(func(m *models.Machine) { m.Profiles = []string{"plain"} }), false},
+		{"Unlock a locked Machine with an update", rt.Update, changed(func(m *models.Machine) { m.Locked = false }), false},
+		{"Change Description of a locked Machine", rt.Update, changed(func(m *models.Machine) { m.Description = "primary database" }), true},
+		{"Create Profile selecting the locked Machine", rt.Create, &models.Profile{Name: "db", Selector: "Name=db1.example.com"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		if reason := rt.machineBusy(m); reason == "" {
+			t.Errorf("Expected a locked machine to be busy")
+		}
+		if len(m.SelectedProfiles) != 0 {
+			t.Errorf("Expected a locked machine to keep its selected profiles, got %v", m.SelectedProfiles)
+		}
+		// Resealing the secure params with a new key does not change
+		// them, so it is allowed on a locked machine.
+		rotated, err := rt.RotateKey(m)
+		if err != nil {
+			t.Fatalf("Failed to rotate the key of a locked machine: %v", err)
+		}
+		if val, _ := rt.GetParam(rotated.(*Machine), "secret", false, true); val != "sekrit" {
+			t.Errorf("Expected secure param to decrypt to sekrit after rotation, not %v", val)
+		}
+		m = AsMachine(rt.Find("machines", machineUUID.String()))
+		res, err := rt.UnlockMachine(m)
+		if err != nil {
+			t.Fatalf("Failed to unlock machine: %v", err)
+		}
+		if res.Locked || res.LockOwner != "" || res.LockReason != "" {
+			t.Errorf("Expected machine to be unlocked")
+		}
+		if len(res.SelectedProfiles) != 1 || res.SelectedProfiles[0] != "db" {
+			t.Errorf("Expected an unlocked machine to be selected by db, got %v", res.SelectedProfiles)
+		}
+	})
+	tests = []crudTest{
+		{"Change Stage of an unlocked Machine", rt.Update, changed(func(m *models.Machine) { m.Stage = "two" }), true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+}
@@ -1,6 +1,8 @@
 package backend
 
 import (
+	"errors"
+
 	"github.com/digitalrebar/provision/backend/index"
 	"github.com/digitalrebar/provision/models"
 	"github.com/digitalrebar/store"
@@ -119,12 +121,19 @@ func validateAgainstSchema(val interface{}, schema *gojsonschema.Schema) error {
 	return e
 }
 
-func (p *Param) ValidateValue(val interface{}, key []byte) error {
+// ValidateValue checks val against the Param.  Secure values must
+// open with one of keys.
+func (p *Param) ValidateValue(val interface{}, keys ...[]byte) error {
 	if !p.Useable() {
 		return p.MakeError(422, ValidationError, p)
 	}
 	rv := val
 	if p.Secure {
+		if _, ok := secretRefFor(val); ok {
+			// The value lives in the external secret store, and
+			// is only fetched when it is needed.
+			return nil
+		}
 		sd := &models.SecureData{}
 		if err := models.Remarshal(val, sd); err != nil {
 			return err
@@ -133,7 +142,16 @@ func (p *Param) ValidateValue(val interface{}, key []byte) error {
 			return err
 		}
 		var realVal interface{}
-		if err := sd.Unmarshal(key, &realVal); err != nil {
+		err := errors.New("No key to open the secure value with")
+		for _, key := range keys {
+			if key == nil {
+				continue
+			}
+			if err = sd.Unmarshal(key, &realVal); err == nil {
+				break
+			}
+		}
+		if err != nil {
 			return err
 		}
 		rv = realVal
@@ -158,12 +176,16 @@ func (p *Param) ValidateValue(val interface{}, key []byte) error {
 	return e
 }
 
-func ValidateParams(rt *RequestTracker, e models.ErrorAdder, params map[string]interface{}, key []byte) {
+func ValidateParams(rt *RequestTracker, e models.ErrorAdder, params map[string]interface{}, keys ...[]byte) {
 	for k, v := range params {
 		if pIdx := rt.find("params", k); pIdx != nil {
 			param := AsParam(pIdx)
-			if err := param.ValidateValue(v, key); err != nil {
+			if err := param.ValidateValue(v, keys...); err != nil {
 				e.Errorf("Key '%s': invalid val '%v': %v", k, v, err)
+			} else if ref, ok := secretRefFor(v); ok && param.Secure && rt.dt.ExternalSecrets != nil {
+				if err := rt.dt.ExternalSecrets.Check(ref); err != nil {
+					e.Errorf("Key '%s': %v", k, err)
+				}
 			}
 		}
 	}
@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// paramHistoryPath returns the file that the Param change history
+// for obj is kept in.  History is kept alongside the job logs, one
+// file per object, one JSON encoded models.ParamChange per line.
+func (rt *RequestTracker) paramHistoryPath(obj models.Model) string {
+	return filepath.Join(rt.dt.LogRoot, "param-history", obj.Prefix(), obj.Key())
+}
+
+// isSecureValue returns true if v looks like a sealed SecureData
+// value or a SecretRef.  Secure params are always stored that way, so
+// this lets us detect them without needing the params store.
+func isSecureValue(v interface{}) bool {
+	return isSealedValue(v) || isSecretRef(v)
+}
+
+func isSecretRef(v interface{}) bool {
+	_, ok := secretRefFor(v)
+	return ok
+}
+
+// isSealedValue returns true if v looks like a sealed SecureData value.
+func isSealedValue(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	sd := &models.SecureData{}
+	if err := models.Remarshal(v, sd); err != nil {
+		return false
+	}
+	return sd.Validate() == nil
+}
+
+// recordParamChanges appends the differences between the Params of
+// oldObj and newObj to the Param history of newObj.  A nil oldObj
+// records the Params of a newly created newObj as changes from nil.
+// Objects that do not have Params are ignored.
+func (rt *RequestTracker) recordParamChanges(oldObj, newObj models.Model) {
+	np, ok := newObj.(models.Paramer)
+	if !ok {
+		return
+	}
+	var oldParams map[string]interface{}
+	if oldObj != nil {
+		op, ok := oldObj.(models.Paramer)
+		if !ok {
+			return
+		}
+		oldParams = op.GetParams()
+	}
+	newParams := np.GetParams()
+	keys := []string{}
+	for k := range oldParams {
+		keys = append(keys, k)
+	}
+	for k := range newParams {
+		if _, ok := oldParams[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, k := range keys {
+		ov, oldOK := oldParams[k]
+		nv, newOK := newParams[k]
+		if oldOK && newOK {
+			ob, _ := json.Marshal(ov)
+			nb, _ := json.Marshal(nv)
+			if bytes.Equal(ob, nb) {
+				continue
+			}
+		}
+		change := &models.ParamChange{
+			Time:      now,
+			Key:       k,
+			Principal: rt.principal,
+		}
+		if isSecureValue(ov) || isSecureValue(nv) {
+			change.Secure = true
+		} else {
+			change.OldValue, change.NewValue = ov, nv
+		}
+		enc.Encode(change)
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	path := rt.paramHistoryPath(newObj)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		rt.Errorf("Unable to create param history dir for %s:%s: %v", newObj.Prefix(), newObj.Key(), err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		rt.Errorf("Unable to open param history for %s:%s: %v", newObj.Prefix(), newObj.Key(), err)
+		return
+	}
+	defer f.Close()
+	if _, err := buf.WriteTo(f); err != nil {
+		rt.Errorf("Unable to write param history for %s:%s: %v", newObj.Prefix(), newObj.Key(), err)
+	}
+}
+
+// removeParamHistory removes the Param history for obj.
+func (rt *RequestTracker) removeParamHistory(obj models.Model) {
+	if _, ok := obj.(models.Paramer); !ok {
+		return
+	}
+	os.Remove(rt.paramHistoryPath(obj))
+}
+
+// ParamHistory returns the recorded Param changes for obj, oldest
+// first.  If key is not empty, only changes to that Param are
+// returned.
+func (rt *RequestTracker) ParamHistory(obj models.Paramer, key string) ([]*models.ParamChange, error) {
+	res := []*models.ParamChange{}
+	f, err := os.Open(rt.paramHistoryPath(obj))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		change := &models.ParamChange{}
+		if err := json.Unmarshal(scanner.Bytes(), change); err != nil {
+			return nil, err
+		}
+		if key == "" || change.Key == key {
+			res = append(res, change)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// RevertParams puts the Params of obj back to the values they had at
+// time at, using the recorded Param history.  Params added since then
+// are removed.  The values of secure Params are not recorded, so they
+// cannot be reverted; the names of any secure Params that changed
+// since at are returned in skipped and left as they are.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) RevertParams(obj models.Paramer, at time.Time) (res models.Model, skipped []string, err error) {
+	skipped = []string{}
+	history, err := rt.ParamHistory(obj, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	orig := models.Clone(obj).(models.Paramer)
+	changed := models.Clone(obj).(models.Paramer)
+	params := changed.GetParams()
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	reverted := map[string]bool{}
+	for _, change := range history {
+		if !change.Time.After(at) || reverted[change.Key] {
+			continue
+		}
+		reverted[change.Key] = true
+		if change.Secure {
+			skipped = append(skipped, change.Key)
+			continue
+		}
+		if change.OldValue == nil {
+			delete(params, change.Key)
+		} else {
+			params[change.Key] = change.OldValue
+		}
+	}
+	changed.SetParams(params)
+	patch, err := models.GenPatch(orig, changed, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(patch) == 0 {
+		return obj, skipped, nil
+	}
+	res, err = rt.Patch(changed, changed.Key(), patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, skipped, nil
+}
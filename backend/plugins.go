@@ -89,7 +89,7 @@ func (n *Plugin) Validate() {
 	n.Plugin.Validate()
 	n.AddError(index.CheckUnique(n, n.rt.stores("plugins").Items()))
 	if pk, err := n.rt.PrivateKeyFor(n); err == nil {
-		ValidateParams(n.rt, n, n.Params, pk)
+		ValidateParams(n.rt, n, n.Params, pk, n.rt.previousKeyFor(n))
 	} else {
 		n.Errorf("Unable to get key: %v", err)
 	}
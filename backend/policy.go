@@ -0,0 +1,253 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/digitalrebar/store"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Policy is the backend model wrapper for Policy.
+// This struct also includes validation helpers.
+type Policy struct {
+	*models.Policy
+	validate
+	validator *gojsonschema.Schema
+}
+
+// SetReadOnly is a helper function to set the ReadOnly flag.
+func (p *Policy) SetReadOnly(b bool) {
+	p.ReadOnly = b
+}
+
+// SaveClean is a helper function to run the model version's
+// ClearValidation function before converting back to
+// an object that can be stored in the backend.
+func (p *Policy) SaveClean() store.KeySaver {
+	mod := *p.Policy
+	mod.ClearValidation()
+	return toBackend(&mod, p.rt)
+}
+
+// AsPolicy casts a models.Model interface to
+// *Policy (helper function)
+func AsPolicy(o models.Model) *Policy {
+	return o.(*Policy)
+}
+
+// AsPolicies converts a list of models.Model to
+// a list of *Policy (helper function)
+func AsPolicies(o []models.Model) []*Policy {
+	res := make([]*Policy, len(o))
+	for i := range o {
+		res[i] = AsPolicy(o[i])
+	}
+	return res
+}
+
+// New creates a new empty instance of Policy.
+// The ForceChanged and RT fields are propogated.
+func (p *Policy) New() store.KeySaver {
+	res := &Policy{Policy: &models.Policy{}}
+	if p.Policy != nil && p.ChangeForced() {
+		res.ForceChange()
+	}
+	res.rt = p.rt
+	res.Fill()
+	return res
+}
+
+// Indexes returns a map of the indexes allowed for
+// Policy objects.
+func (p *Policy) Indexes() map[string]index.Maker {
+	fix := AsPolicy
+	res := index.MakeBaseIndexes(p)
+	res["Name"] = index.Make(
+		true,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Name < fix(j).Name
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			name := fix(ref).Name
+			return func(s models.Model) bool {
+					return fix(s).Name >= name
+				},
+				func(s models.Model) bool {
+					return fix(s).Name > name
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(p.New())
+			res.Name = v
+			return res, nil
+		})
+	res["Type"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Type < fix(j).Type
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			typ := fix(ref).Type
+			return func(s models.Model) bool {
+					return fix(s).Type >= typ
+				},
+				func(s models.Model) bool {
+					return fix(s).Type > typ
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(p.New())
+			res.Type = v
+			return res, nil
+		})
+	return res
+}
+
+// Validate sets the valid and available flags for the Policy.
+// This assumes that locks are held as appropriate, if needed.
+func (p *Policy) Validate() {
+	p.Policy.Validate()
+	p.AddError(index.CheckUnique(p, p.rt.stores("policies").Items()))
+	if p.Expression != "" && p.Type != "" {
+		if ref, err := models.New(p.Type); err == nil {
+			if _, err := p.rt.selectorFilters(toBackend(ref, p.rt), p.Expression); err != nil {
+				p.Errorf("Invalid Expression %s: %v", p.Expression, err)
+			}
+		}
+	}
+	if p.SetValid() && p.Schema != nil {
+		p.validator, _ = gojsonschema.NewSchema(gojsonschema.NewGoLoader(p.Schema))
+	}
+	p.SetAvailable()
+}
+
+// BeforeSave validates the state of the Policy.
+func (p *Policy) BeforeSave() error {
+	p.Fill()
+	p.Validate()
+	if !p.Validated {
+		return p.MakeError(422, ValidationError, p)
+	}
+	return nil
+}
+
+// OnLoad initializes the Policy when loaded from the data store.
+func (p *Policy) OnLoad() error {
+	defer func() { p.rt = nil }()
+	p.Fill()
+	return p.BeforeSave()
+}
+
+// AfterSave starts checking objects against the Policy.
+func (p *Policy) AfterSave() {
+	p.rt.dt.policyMux.Lock()
+	p.rt.dt.policies[p.Name] = p
+	p.rt.dt.policyMux.Unlock()
+}
+
+// AfterDelete stops checking objects against the Policy.
+func (p *Policy) AfterDelete() {
+	p.rt.dt.policyMux.Lock()
+	delete(p.rt.dt.policies, p.Name)
+	p.rt.dt.policyMux.Unlock()
+}
+
+var policyLockMap = map[string][]string{
+	"get":     {"policies"},
+	"create":  {"profiles", "params", "policies"},
+	"update":  {"profiles", "params", "policies"},
+	"patch":   {"profiles", "params", "policies"},
+	"delete":  {"policies"},
+	"actions": {"policies", "profiles", "params"},
+}
+
+// Locks returns the object lock list for a given action for the Policy object
+func (p *Policy) Locks(action string) []string {
+	return policyLockMap[action]
+}
+
+// policiesFor returns the enabled, usable Policies for objects of
+// type prefix, sorted by name.
+func (p *DataTracker) policiesFor(prefix string) []*Policy {
+	p.policyMux.RLock()
+	defer p.policyMux.RUnlock()
+	res := []*Policy{}
+	for _, policy := range p.policies {
+		if policy.Type == prefix && !policy.Disabled && policy.Useable() {
+			res = append(res, policy)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// policyErrors returns how obj fails to pass p, or nothing if it
+// passes.
+func (rt *RequestTracker) policyErrors(p *Policy, obj models.Model) []string {
+	res := []string{}
+	if p.validator != nil {
+		var val interface{}
+		if err := models.Remarshal(obj, &val); err != nil {
+			return []string{err.Error()}
+		}
+		matched, err := p.validator.Validate(gojsonschema.NewGoLoader(val))
+		if err != nil {
+			return []string{err.Error()}
+		}
+		for _, e := range matched.Errors() {
+			res = append(res, e.String())
+		}
+	}
+	if p.Expression != "" {
+		filters, err := rt.selectorFilters(obj, p.Expression)
+		if err != nil {
+			return append(res, err.Error())
+		}
+		matched, err := index.All(filters...)(index.New([]models.Model{obj}))
+		if err != nil {
+			return append(res, err.Error())
+		}
+		if matched.Count() == 0 {
+			res = append(res, fmt.Sprintf("does not match %s", p.Expression))
+		}
+	}
+	return res
+}
+
+// checkPolicies returns an error listing the Policies obj does not
+// pass.  If old is not nil, obj is a change to it, and Policies that
+// old did not pass either are not checked, so that objects created
+// before a Policy can still be changed.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) checkPolicies(obj, old models.Model) error {
+	policies := rt.dt.policiesFor(obj.Prefix())
+	if len(policies) == 0 {
+		return nil
+	}
+	err := &models.Error{
+		Code:  422,
+		Type:  ValidationError,
+		Model: obj.Prefix(),
+		Key:   obj.Key(),
+	}
+	for _, p := range policies {
+		fails := rt.policyErrors(p, obj)
+		if len(fails) == 0 || (old != nil && len(rt.policyErrors(p, old)) > 0) {
+			continue
+		}
+		if p.Message != "" {
+			err.Errorf("Policy %s: %s", p.Name, p.Message)
+			continue
+		}
+		for _, fail := range fails {
+			err.Errorf("Policy %s: %s", p.Name, fail)
+		}
+	}
+	return err.HasError()
+}
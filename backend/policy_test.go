@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestPolicies(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows", "policies")
+	legacy, web1 := uuid.NewRandom(), uuid.NewRandom()
+	namePattern := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"Name": map[string]interface{}{"pattern": "^[a-z]+[0-9]+$"},
+		},
+	}
+	tests := []crudTest{
+		{"Create Machine before the Policies", rt.Create, &models.Machine{Uuid: legacy, Name: "legacy.example.com"}, true},
+		{"Create Policy without a check", rt.Create, &models.Policy{Name: "bad", Type: "machines"}, false},
+		{"Create Policy with a bad Type", rt.Create, &models.Policy{Name: "bad", Type: "gadgets", Expression: "Meta.owner=Ne()"}, false},
+		{"Create Policy for Policies", rt.Create, &models.Policy{Name: "bad", Type: "policies", Expression: "Meta.owner=Ne()"}, false},
+		{"Create Policy with a bad Expression", rt.Create, &models.Policy{Name: "bad", Type: "machines", Expression: "Bogus=Eq(1)"}, false},
+		{"Create Policy with a bad Schema", rt.Create, &models.Policy{Name: "bad", Type: "machines", Schema: map[string]interface{}{"type": "nonsense"}}, false},
+		{"Create Policy owner", rt.Create, &models.Policy{Name: "owner", Type: "machines", Expression: "Meta.owner=Ne()"}, true},
+		{"Create Policy names", rt.Create, &models.Policy{Name: "names", Type: "machines", Schema: namePattern, Message: "Machine names must be letters followed by digits"}, true},
+		{"Create Machine that passes the Policies", rt.Create, &models.Machine{Uuid: web1, Name: "web1", Meta: models.Meta{"owner": "ops"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		_, err := rt.Create(&models.Machine{Uuid: uuid.NewRandom(), Name: "Web-2"})
+		if err == nil {
+			t.Fatalf("Expected a Machine that fails both Policies to not be created")
+		}
+		msg := err.Error()
+		for _, expected := range []string{
+			"Policy names: Machine names must be letters followed by digits",
+			"Policy owner: does not match Meta.owner=Ne()",
+		} {
+			if !strings.Contains(msg, expected) {
+				t.Errorf("Expected error to contain %q, got %s", expected, msg)
+			}
+		}
+	})
+	changed := func(id uuid.UUID, change func(*models.Machine)) *models.Machine {
+		var res *models.Machine
+		rt.Do(func(d Stores) {
+			res = models.Clone(rt.Find("machines", id.String())).(*models.Machine)
+		})
+		change(res)
+		return res
+	}
+	tests = []crudTest{
+		{"Update Machine created before the Policies", rt.Update, changed(legacy, func(m *models.Machine) { m.Description = "still here" }), true},
+		{"Update Machine to fail a Policy", rt.Update, changed(web1, func(m *models.Machine) { m.Meta = models.Meta{} }), false},
+		{"Save Machine to fail a Policy", rt.Save, changed(web1, func(m *models.Machine) { m.Name = "Web-1" }), false},
+		{"Update Machine that passes the Policies", rt.Update, changed(web1, func(m *models.Machine) { m.Description = "web server" }), true},
+		{"Disable Policy owner", rt.Update, &models.Policy{Name: "owner", Type: "machines", Expression: "Meta.owner=Ne()", Disabled: true}, true},
+		{"Create Machine without an owner", rt.Create, &models.Machine{Uuid: uuid.NewRandom(), Name: "web3"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+}
@@ -0,0 +1,415 @@
+package backend
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/digitalrebar/store"
+)
+
+// Pool is the backend model wrapper for Pool.
+// This struct also includes validation helpers.
+type Pool struct {
+	*models.Pool
+	validate
+}
+
+// SetReadOnly is a helper function to set the ReadOnly flag.
+func (p *Pool) SetReadOnly(b bool) {
+	p.ReadOnly = b
+}
+
+// SaveClean is a helper function to run the model version's
+// ClearValidation function before converting back to
+// an object that can be stored in the backend.
+func (p *Pool) SaveClean() store.KeySaver {
+	mod := *p.Pool
+	mod.ClearValidation()
+	return toBackend(&mod, p.rt)
+}
+
+// AsPool casts a models.Model interface to
+// *Pool (helper function)
+func AsPool(o models.Model) *Pool {
+	return o.(*Pool)
+}
+
+// AsPools converts a list of models.Model to
+// a list of *Pool (helper function)
+func AsPools(o []models.Model) []*Pool {
+	res := make([]*Pool, len(o))
+	for i := range o {
+		res[i] = AsPool(o[i])
+	}
+	return res
+}
+
+// New creates a new empty instance of Pool.
+// The ForceChanged and RT fields are propogated.
+func (p *Pool) New() store.KeySaver {
+	res := &Pool{Pool: &models.Pool{}}
+	if p.Pool != nil && p.ChangeForced() {
+		res.ForceChange()
+	}
+	res.rt = p.rt
+	res.Fill()
+	return res
+}
+
+// Indexes returns a map of the indexes allowed for
+// Pool objects.
+func (p *Pool) Indexes() map[string]index.Maker {
+	fix := AsPool
+	res := index.MakeBaseIndexes(p)
+	res["Name"] = index.Make(
+		true,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Name < fix(j).Name
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			name := fix(ref).Name
+			return func(s models.Model) bool {
+					return fix(s).Name >= name
+				},
+				func(s models.Model) bool {
+					return fix(s).Name > name
+				}
+		},
+		func(s string) (models.Model, error) {
+			res := fix(p.New())
+			res.Name = s
+			return res, nil
+		})
+	res["ReleaseWorkflow"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).ReleaseWorkflow < fix(j).ReleaseWorkflow
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			wf := fix(ref).ReleaseWorkflow
+			return func(s models.Model) bool {
+					return fix(s).ReleaseWorkflow >= wf
+				},
+				func(s models.Model) bool {
+					return fix(s).ReleaseWorkflow > wf
+				}
+		},
+		func(s string) (models.Model, error) {
+			res := fix(p.New())
+			res.ReleaseWorkflow = s
+			return res, nil
+		})
+	return res
+}
+
+// Validate sets the valid and available flags for the Pool.  This
+// assumes that locks are held as appropriate, if needed.
+func (p *Pool) Validate() {
+	p.Pool.Validate()
+	p.AddError(index.CheckUnique(p, p.rt.stores("pools").Items()))
+	if p.Selector != "" {
+		if _, err := p.rt.machineSelectorFilters(p.Selector); err != nil {
+			p.Errorf("Invalid Selector %s: %v", p.Selector, err)
+		}
+	}
+	if !p.SetValid() {
+		return
+	}
+	for _, name := range p.Profiles {
+		if p.rt.find("profiles", name) == nil {
+			p.Errorf("Profile %s does not exist", name)
+		}
+	}
+	if p.ReleaseWorkflow != "" {
+		if wf := p.rt.find("workflows", p.ReleaseWorkflow); wf == nil {
+			p.Errorf("Workflow %s does not exist", p.ReleaseWorkflow)
+		} else if !AsWorkflow(wf).Available {
+			p.Errorf("Workflow %s is not available", p.ReleaseWorkflow)
+		}
+	}
+	p.SetAvailable()
+}
+
+// BeforeSave validates the state of the Pool.
+func (p *Pool) BeforeSave() error {
+	p.Fill()
+	p.Validate()
+	if !p.Validated {
+		return p.MakeError(422, ValidationError, p)
+	}
+	return nil
+}
+
+// OnLoad initializes the Pool when loaded from the data store.
+func (p *Pool) OnLoad() error {
+	defer func() { p.rt = nil }()
+	p.Fill()
+	return p.BeforeSave()
+}
+
+// BeforeDelete refuses to delete a Pool that still has Machines
+// allocated from it.
+func (p *Pool) BeforeDelete() error {
+	e := &models.Error{Code: 422, Type: ValidationError, Model: p.Prefix(), Key: p.Key()}
+	for _, i := range p.rt.stores("machines").Items() {
+		if m := AsMachine(i); m.Pool == p.Name {
+			e.Errorf("Machine %s is allocated from pool %s", m.UUID(), p.Name)
+		}
+	}
+	return e.HasError()
+}
+
+var poolLockMap = map[string][]string{
+	"get":     {"pools"},
+	"create":  {"workflows", "machines", "profiles", "params", "pools"},
+	"update":  {"workflows", "machines", "profiles", "params", "pools"},
+	"patch":   {"workflows", "machines", "profiles", "params", "pools"},
+	"delete":  {"machines", "pools"},
+	"actions": {"pools", "profiles", "params"},
+}
+
+// Locks returns the object lock list for a given action for the Pool object
+func (p *Pool) Locks(action string) []string {
+	return poolLockMap[action]
+}
+
+// PoolLocks are the locks needed to allocate Machines from and
+// release Machines to a Pool.
+var PoolLocks = []string{"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows", "pools"}
+
+// HasMember returns true if m is a member of the Pool, whether or not
+// it is allocated.
+//
+// Assumes locks are held as appropriate.
+func (p *Pool) HasMember(rt *RequestTracker, m *Machine) (bool, error) {
+	for _, name := range p.Profiles {
+		found := m.HasProfile(name)
+		for _, sel := range m.SelectedProfiles {
+			found = found || sel == name
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if p.Selector == "" {
+		return true, nil
+	}
+	filters, err := rt.machineSelectorFilters(p.Selector)
+	if err != nil {
+		return false, err
+	}
+	res, err := index.All(filters...)(index.New([]models.Model{m}))
+	if err != nil {
+		return false, err
+	}
+	return res.Count() > 0, nil
+}
+
+// Members returns the Machines that are members of the Pool.
+//
+// Assumes locks are held as appropriate.
+func (p *Pool) Members(rt *RequestTracker) ([]*Machine, error) {
+	res := []*Machine{}
+	for _, i := range rt.stores("machines").Items() {
+		m := AsMachine(i)
+		ok, err := p.HasMember(rt, m)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+// leaseFor returns how long an allocation asked for secs seconds
+// should last.
+func (p *Pool) leaseFor(secs int) (time.Duration, error) {
+	if secs == 0 {
+		secs = p.DefaultLease
+	}
+	if secs == 0 {
+		secs = 3600
+	}
+	if p.MaxLease > 0 && secs > p.MaxLease {
+		e := &models.Error{Code: http.StatusUnprocessableEntity, Type: ValidationError, Model: p.Prefix(), Key: p.Key()}
+		e.Errorf("Lease %d is longer than the MaxLease %d of pool %s", secs, p.MaxLease, p.Name)
+		return 0, e
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// setAllocation changes the allocation of m and saves it.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) setAllocation(m *Machine, pool, owner string, expires time.Time, releaseTo string) (*Machine, error) {
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.Pool, nm.PoolOwner, nm.PoolExpires = pool, owner, expires
+	nm.poolChange = true
+	if releaseTo != "" {
+		nm.Workflow = releaseTo
+		nm.Runnable = true
+		nm.restartWorkflow = true
+	}
+	if _, err := rt.Update(nm); err != nil {
+		return nil, err
+	}
+	return AsMachine(rt.find("machines", m.Key())), nil
+}
+
+// AllocateMachines allocates req.Count free Machines from pool to
+// owner.  Either all of them are allocated or none are.  An allocate
+// event is published for every allocated Machine.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) AllocateMachines(pool *Pool, owner string, req *models.PoolAllocation) ([]*Machine, error) {
+	e := &models.Error{Code: http.StatusUnprocessableEntity, Type: ValidationError, Model: pool.Prefix(), Key: pool.Key()}
+	req.Validate(e)
+	if !pool.Available {
+		e.Errorf("Pool %s is not available", pool.Name)
+	}
+	lease, err := pool.leaseFor(req.Lease)
+	e.AddError(err)
+	if e.ContainsError() {
+		return nil, e
+	}
+	members, err := pool.Members(rt)
+	if err != nil {
+		return nil, err
+	}
+	free := []*Machine{}
+	for _, m := range members {
+		if m.Pool == "" && !m.Locked && m.Available && len(free) < req.Count {
+			free = append(free, m)
+		}
+	}
+	if len(free) < req.Count {
+		e.Code = http.StatusConflict
+		e.Errorf("Pool %s only has %d of %d machines free", pool.Name, len(free), req.Count)
+		return nil, e
+	}
+	expires := time.Now().Add(lease)
+	res := []*Machine{}
+	for _, m := range free {
+		nm, err := rt.setAllocation(m, pool.Name, owner, expires, "")
+		if err != nil {
+			for _, done := range res {
+				if _, rerr := rt.setAllocation(done, "", "", time.Time{}, ""); rerr != nil {
+					rt.Errorf("Unable to undo allocation of machine %s: %v", done.UUID(), rerr)
+				}
+			}
+			return nil, err
+		}
+		res = append(res, nm)
+	}
+	for _, m := range res {
+		rt.Infof("Machine %s allocated from pool %s to %s until %s", m.UUID(), pool.Name, owner, expires)
+		rt.Publish("machines", "allocate", m.Key(), m)
+	}
+	return res, nil
+}
+
+// releaseMachine releases m back to pool, switching it to the
+// ReleaseWorkflow of the pool.  action is the event published for the
+// release.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) releaseMachine(pool *Pool, m *Machine, action string) (*Machine, error) {
+	releaseTo := ""
+	if pool != nil {
+		releaseTo = pool.ReleaseWorkflow
+	}
+	nm, err := rt.setAllocation(m, "", "", time.Time{}, releaseTo)
+	if err != nil {
+		return nil, err
+	}
+	rt.Infof("Machine %s released from pool %s (%s)", m.UUID(), m.Pool, action)
+	rt.Publish("machines", action, nm.Key(), nm)
+	return nm, nil
+}
+
+// ReleaseMachines releases the Machines in req back to pool.  Only
+// Machines owned by owner can be released, unless req.Force is set.
+// A release event is published for every released Machine.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) ReleaseMachines(pool *Pool, owner string, req *models.PoolRelease) ([]*Machine, error) {
+	e := &models.Error{Code: http.StatusConflict, Type: "RELEASE", Model: pool.Prefix(), Key: pool.Key()}
+	toRelease := []*Machine{}
+	if len(req.Machines) == 0 {
+		for _, i := range rt.stores("machines").Items() {
+			m := AsMachine(i)
+			if m.Pool == pool.Name && (req.Force || m.PoolOwner == owner) {
+				toRelease = append(toRelease, m)
+			}
+		}
+	}
+	for _, id := range req.Machines {
+		mo := rt.find("machines", id.String())
+		if mo == nil {
+			e.Errorf("Machine %s does not exist", id)
+			continue
+		}
+		m := AsMachine(mo)
+		switch {
+		case m.Pool != pool.Name:
+			e.Errorf("Machine %s is not allocated from pool %s", id, pool.Name)
+		case !req.Force && m.PoolOwner != owner:
+			e.Errorf("Machine %s is allocated to %s", id, m.PoolOwner)
+		default:
+			toRelease = append(toRelease, m)
+		}
+	}
+	if e.ContainsError() {
+		return nil, e
+	}
+	res := []*Machine{}
+	for _, m := range toRelease {
+		nm, err := rt.releaseMachine(pool, m, "release")
+		if err != nil {
+			e.AddError(err)
+			continue
+		}
+		res = append(res, nm)
+	}
+	return res, e.HasError()
+}
+
+// ExpirePoolLeases releases every Machine whose allocation has run
+// out back to its Pool.  An expire event is published for every
+// released Machine.
+func (p *DataTracker) ExpirePoolLeases(l logger.Logger) {
+	rt := p.Request(l, PoolLocks...)
+	now := time.Now()
+	rt.Do(func(d Stores) {
+		for _, mo := range d("machines").Items() {
+			m := AsMachine(mo)
+			if m.Pool == "" || m.PoolExpires.After(now) {
+				continue
+			}
+			var pool *Pool
+			if po := d("pools").Find(m.Pool); po != nil {
+				pool = AsPool(po)
+			}
+			if _, err := rt.releaseMachine(pool, m, "expire"); err != nil {
+				rt.Errorf("Unable to release expired machine %s: %v", m.UUID(), err)
+			}
+		}
+	})
+}
+
+// StartPoolReaper runs ExpirePoolLeases every interval in the
+// background.
+func (p *DataTracker) StartPoolReaper(l logger.Logger, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			p.ExpirePoolLeases(l)
+		}
+	}()
+}
@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestPools(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, PoolLocks...)
+	m1, m2, m3 := uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Stage wipe", rt.Create, &models.Stage{Name: "wipe", BootEnv: "local"}, true},
+		{"Create Workflow wipe", rt.Create, &models.Workflow{Name: "wipe", Stages: []string{"wipe"}}, true},
+		{"Create Pool with bad selector", rt.Create, &models.Pool{Name: "bad", Selector: "Bogus=Eq(1)"}, false},
+		{"Create Pool with missing Workflow", rt.Create, &models.Pool{Name: "missing", ReleaseWorkflow: "missing"}, true},
+		{"Create Pool with too long DefaultLease", rt.Create, &models.Pool{Name: "bad", DefaultLease: 60, MaxLease: 30}, false},
+		{"Create Pool ci", rt.Create, &models.Pool{Name: "ci", Selector: "Meta.site=Eq(dc2)", ReleaseWorkflow: "wipe", MaxLease: 7200}, true},
+		{"Create Machine m1 in dc2", rt.Create, &models.Machine{Uuid: m1, Name: "m1.dc2", Meta: models.Meta{"site": "dc2"}}, true},
+		{"Create Machine m2 in dc2", rt.Create, &models.Machine{Uuid: m2, Name: "m2.dc2", Meta: models.Meta{"site": "dc2"}}, true},
+		{"Create Machine m3 in dc3", rt.Create, &models.Machine{Uuid: m3, Name: "m3.dc3", Meta: models.Meta{"site": "dc3"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		if AsPool(rt.Find("pools", "missing")).Available {
+			t.Errorf("Expected pool with a missing Workflow to not be available")
+		}
+		if _, err := rt.AllocateMachines(AsPool(rt.Find("pools", "missing")), "alice", &models.PoolAllocation{Count: 1}); err == nil {
+			t.Errorf("Expected allocating from an unavailable pool to fail")
+		}
+		pool := AsPool(rt.Find("pools", "ci"))
+		members, err := pool.Members(rt)
+		if err != nil || len(members) != 2 {
+			t.Errorf("Expected pool ci to have 2 members, not %d: %v", len(members), err)
+		}
+		if _, err := rt.AllocateMachines(pool, "alice", &models.PoolAllocation{Count: 1, Lease: 86400}); err == nil {
+			t.Errorf("Expected a lease longer than MaxLease to fail")
+		}
+		if _, err := rt.AllocateMachines(pool, "alice", &models.PoolAllocation{Count: 3}); err == nil {
+			t.Errorf("Expected allocating more machines than the pool has to fail")
+		}
+		if m := AsMachine(rt.Find("machines", m1.String())); m.Pool != "" {
+			t.Errorf("Expected a failed allocation to leave machines unallocated")
+		}
+		got, err := rt.AllocateMachines(pool, "alice", &models.PoolAllocation{Count: 2})
+		if err != nil || len(got) != 2 {
+			t.Errorf("Expected to allocate 2 machines, got %d: %v", len(got), err)
+		}
+		for _, m := range got {
+			if m.Pool != "ci" || m.PoolOwner != "alice" || m.PoolExpires.Before(time.Now()) {
+				t.Errorf("Machine %s has the wrong allocation %s/%s/%s", m.Name, m.Pool, m.PoolOwner, m.PoolExpires)
+			}
+		}
+		if _, err := rt.AllocateMachines(pool, "bob", &models.PoolAllocation{Count: 1}); err == nil {
+			t.Errorf("Expected allocating from an exhausted pool to fail")
+		}
+		nm := ModelToBackend(models.Clone(rt.Find("machines", m1.String()))).(*Machine)
+		nm.PoolOwner = "bob"
+		if _, err := rt.Update(nm); err == nil {
+			t.Errorf("Expected changing PoolOwner directly to fail")
+		}
+		if _, err := rt.ReleaseMachines(pool, "bob", &models.PoolRelease{Machines: []uuid.UUID{m1}}); err == nil {
+			t.Errorf("Expected bob to be unable to release a machine allocated to alice")
+		}
+		released, err := rt.ReleaseMachines(pool, "alice", &models.PoolRelease{Machines: []uuid.UUID{m1}})
+		if err != nil || len(released) != 1 {
+			t.Errorf("Expected alice to release 1 machine, released %d: %v", len(released), err)
+		}
+		if m := AsMachine(rt.Find("machines", m1.String())); m.Pool != "" || m.Workflow != "wipe" || m.Stage != "wipe" {
+			t.Errorf("Expected released machine to be in the wipe Workflow, not %s/%s", m.Workflow, m.Stage)
+		}
+		AsMachine(rt.find("machines", m2.String())).PoolExpires = time.Now().Add(-time.Minute)
+	})
+	crudTest{"Delete Pool with allocations", rt.Remove, &models.Pool{Name: "ci"}, false}.Test(t, rt)
+	dt.ExpirePoolLeases(dt.Logger)
+	rt.Do(func(d Stores) {
+		if m := AsMachine(rt.Find("machines", m2.String())); m.Pool != "" || m.Workflow != "wipe" {
+			t.Errorf("Expected expired machine to be released to the wipe Workflow, not %s/%s", m.Pool, m.Workflow)
+		}
+	})
+	crudTest{"Delete Pool without allocations", rt.Remove, &models.Pool{Name: "ci"}, true}.Test(t, rt)
+}
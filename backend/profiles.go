@@ -1,6 +1,11 @@
 package backend
 
 import (
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
 	"github.com/digitalrebar/provision/backend/index"
 	"github.com/digitalrebar/provision/models"
 	"github.com/digitalrebar/store"
@@ -16,6 +21,9 @@ import (
 type Profile struct {
 	*models.Profile
 	validate
+	// oldProfile is the stored copy of the profile while it is
+	// being created or updated.  It is nil for a plain Save.
+	oldProfile *models.Profile
 }
 
 func (p *Profile) SetReadOnly(b bool) {
@@ -52,12 +60,182 @@ func (p *Profile) Indexes() map[string]index.Maker {
 	return res
 }
 
+// HasProfile returns true if the profile name is in the Profiles list.
+func (p *Profile) HasProfile(name string) bool {
+	for _, e := range p.Profiles {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// includeCycle returns the chain of profile names that leads from
+// this profile back to itself through the Profiles lists, or nil
+// if there is no such chain.
+func (p *Profile) includeCycle() []string {
+	seen := map[string]bool{}
+	var walk func(name string, chain []string) []string
+	walk = func(name string, chain []string) []string {
+		chain = append(chain, name)
+		if name == p.Name && len(chain) > 1 {
+			return chain
+		}
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		includes := p.Profiles
+		if name != p.Name {
+			obj := p.rt.find("profiles", name)
+			if obj == nil {
+				return nil
+			}
+			includes = AsProfile(obj).Profiles
+		}
+		for _, sub := range includes {
+			if res := walk(sub, chain); res != nil {
+				return res
+			}
+		}
+		return nil
+	}
+	return walk(p.Name, []string{})
+}
+
+// selectorFilters returns the index filters that implement the
+// Selector of this profile against machines.
+func (p *Profile) selectorFilters() ([]index.Filter, error) {
+	return p.rt.machineSelectorFilters(p.Selector)
+}
+
+// machineSelectorFilters returns the index filters that implement a
+// selector written in the query syntax of the machine list API.
+func (rt *RequestTracker) machineSelectorFilters(selector string) ([]index.Filter, error) {
+	return rt.selectorFilters(&Machine{}, selector)
+}
+
+// selectorFilters returns the index filters that implement a selector
+// written in the query syntax of the list API for the type of ref.
+func (rt *RequestTracker) selectorFilters(ref models.Model, selector string) ([]index.Filter, error) {
+	vals, err := url.ParseQuery(selector)
+	if err != nil {
+		return nil, err
+	}
+	filters := []index.Filter{}
+	for k, vs := range vals {
+		subfilters, err := rt.FilterFor(ref, k, vs)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, subfilters...)
+	}
+	// Run the filters over nothing to catch values that do not parse.
+	if _, err := index.All(filters...)(index.New([]models.Model{})); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// selects returns true if the Selector of this profile matches the
+// machine.  Profiles selected for the machine are not considered when
+// matching against parameters.
+func (p *Profile) selects(m *Machine) (bool, error) {
+	if p.Selector == "" {
+		return false, nil
+	}
+	filters, err := m.rt.machineSelectorFilters(p.Selector)
+	if err != nil {
+		return false, err
+	}
+	selected := m.SelectedProfiles
+	m.SelectedProfiles = []string{}
+	defer func() { m.SelectedProfiles = selected }()
+	res, err := index.All(filters...)(index.New([]models.Model{m}))
+	if err != nil {
+		return false, err
+	}
+	return res.Count() > 0, nil
+}
+
+// currentProfiles returns the stored profiles with this profile
+// substituted for the stored copy, or without it if removed is true.
+func (p *Profile) currentProfiles(removed bool) []*Profile {
+	res := []*Profile{}
+	for _, i := range p.rt.stores("profiles").Items() {
+		if i.Key() != p.Key() {
+			res = append(res, AsProfile(i))
+		}
+	}
+	if !removed {
+		res = append(res, p)
+		sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	}
+	return res
+}
+
+// anySelectors reports whether any of the profiles has a Selector.
+func anySelectors(profiles []*Profile) bool {
+	for _, profile := range profiles {
+		if profile.Selector != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// selectionChanged reports whether this change to the profile can
+// change the SelectedProfiles of any machine.  That is the case when
+// its Selector changed, or when its Params or Profiles changed and
+// some profile selects machines.
+func (p *Profile) selectionChanged(removed bool, profiles []*Profile) bool {
+	old, cur := p.oldProfile, p.Profile
+	if removed {
+		old, cur = p.Profile, &models.Profile{}
+	}
+	if old == nil {
+		return true
+	}
+	if old.Selector != cur.Selector {
+		return true
+	}
+	sameParams := (len(old.Params) == 0 && len(cur.Params) == 0) || reflect.DeepEqual(old.Params, cur.Params)
+	sameProfiles := (len(old.Profiles) == 0 && len(cur.Profiles) == 0) || reflect.DeepEqual(old.Profiles, cur.Profiles)
+	if sameParams && sameProfiles {
+		return false
+	}
+	return anySelectors(profiles)
+}
+
+// reselectMachines updates the SelectedProfiles of every machine
+// to account for a change to this profile.
+func (p *Profile) reselectMachines(removed bool) {
+	profiles := p.currentProfiles(removed)
+	if !p.selectionChanged(removed, profiles) {
+		return
+	}
+	for _, i := range p.rt.stores("machines").Items() {
+		p.rt.reselectProfiles(AsMachine(i), profiles)
+	}
+}
+
+func (p *Profile) OnCreate() error {
+	p.oldProfile = &models.Profile{}
+	return nil
+}
+
+func (p *Profile) OnChange(oldThing store.KeySaver) error {
+	p.oldProfile = AsProfile(oldThing).Profile
+	return nil
+}
+
 func (p *Profile) New() store.KeySaver {
 	res := &Profile{Profile: &models.Profile{}}
 	if p.Profile != nil && p.ChangeForced() {
 		res.ForceChange()
 	}
 	res.Params = map[string]interface{}{}
+	res.Profiles = []string{}
 	res.rt = p.rt
 	return res
 }
@@ -81,6 +259,13 @@ func (p *Profile) BeforeDelete() error {
 			e.Errorf("Stage %s is using profile %s", s.Name, p.Name)
 		}
 	}
+	profiles := p.rt.stores("profiles")
+	for _, i := range profiles.Items() {
+		other := AsProfile(i)
+		if other.HasProfile(p.Name) {
+			e.Errorf("Profile %s is using profile %s", other.Name, p.Name)
+		}
+	}
 	return e.HasError()
 }
 
@@ -99,11 +284,27 @@ func (p *Profile) Validate() {
 	p.Profile.Validate()
 	p.AddError(index.CheckUnique(p, p.rt.stores("profiles").Items()))
 	if pk, err := p.rt.PrivateKeyFor(p); err == nil {
-		ValidateParams(p.rt, p, p.Params, pk)
+		ValidateParams(p.rt, p, p.Params, pk, p.rt.previousKeyFor(p))
 	} else {
 		p.Errorf("Unable to get key: %v", err)
 	}
-	p.SetValid()
+	if p.Selector != "" {
+		if _, err := p.selectorFilters(); err != nil {
+			p.Errorf("Invalid Selector %s: %v", p.Selector, err)
+		}
+	}
+	if chain := p.includeCycle(); chain != nil {
+		p.Errorf("Profile %s is part of an include cycle: %s", p.Name, strings.Join(chain, " -> "))
+	}
+	if !p.SetValid() {
+		// If we have not been validated at this point, return.
+		return
+	}
+	for i, name := range p.Profiles {
+		if p.rt.find("profiles", name) == nil {
+			p.Errorf("Profile %s (at %d) does not exist", name, i)
+		}
+	}
 	p.SetAvailable()
 }
 
@@ -121,16 +322,22 @@ func (p *Profile) OnLoad() error {
 	return p.BeforeSave()
 }
 
+func (p *Profile) AfterSave() {
+	p.reselectMachines(false)
+	p.oldProfile = nil
+}
+
 func (p *Profile) AfterDelete() {
+	p.reselectMachines(true)
 	p.rt.DeleteKeyFor(p)
 }
 
 var profileLockMap = map[string][]string{
 	"get":     {"profiles", "params"},
-	"create":  {"profiles", "tasks", "params"},
-	"update":  {"profiles", "tasks", "params"},
-	"patch":   {"profiles", "tasks", "params"},
-	"delete":  {"stages", "profiles", "machines"},
+	"create":  {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"},
+	"update":  {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"},
+	"patch":   {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"},
+	"delete":  {"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"},
 	"actions": {"profiles", "params"},
 }
 
@@ -1,9 +1,13 @@
 package backend
 
 import (
+	"bytes"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
 )
 
 func TestProfilesCrud(t *testing.T) {
@@ -74,3 +78,248 @@ func TestProfilesValidation(t *testing.T) {
 		test.Test(t, rt)
 	}
 }
+
+func TestProfilesIncludes(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "profiles", "params", "machines")
+	tests := []crudTest{
+		{"Create base profile", rt.Create, &models.Profile{Name: "base", Params: map[string]interface{}{"a": "base", "b": "base"}}, true},
+		{"Create site profile", rt.Create, &models.Profile{Name: "site", Profiles: []string{"base"}, Params: map[string]interface{}{"b": "site", "c": "site"}}, true},
+		{"Create role profile", rt.Create, &models.Profile{Name: "role", Profiles: []string{"site"}, Params: map[string]interface{}{"c": "role"}}, true},
+		{"Create self including profile", rt.Create, &models.Profile{Name: "loop", Profiles: []string{"loop"}}, false},
+		{"Create include cycle", rt.Update, &models.Profile{Name: "base", Profiles: []string{"role"}}, false},
+		{"Delete included profile", rt.Remove, &models.Profile{Name: "site"}, false},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		role := rt.Find("profiles", "role").(*Profile)
+		params := rt.GetParams(role, true, false)
+		for k, v := range map[string]string{"a": "base", "b": "site", "c": "role"} {
+			if params[k] != v {
+				t.Errorf("Expected param %s to be %s, not %v", k, v, params[k])
+			}
+		}
+	})
+	tests = []crudTest{
+		{"Delete including profile", rt.Remove, &models.Profile{Name: "role"}, true},
+		{"Delete newly unused profile", rt.Remove, &models.Profile{Name: "site"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+}
+
+func TestProfilesSelector(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "profiles", "params", "machines", "workflows")
+	machineUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create profile with bad selector", rt.Create, &models.Profile{Name: "bad", Selector: "Bogus=Eq(1)"}, false},
+		{"Create dc2 profile", rt.Create, &models.Profile{Name: "dc2", Selector: "Meta.site=Eq(dc2)", Params: map[string]interface{}{"site": "dc2"}}, true},
+		{"Create machine in dc2", rt.Create, &models.Machine{Uuid: machineUUID, Name: "m1.dc2", Meta: models.Meta{"site": "dc2"}}, true},
+		{"Create named profile", rt.Create, &models.Profile{Name: "named", Selector: "Name=m1.dc2", Params: map[string]interface{}{"named": true}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	checkSelected := func(want []string, site interface{}) {
+		t.Helper()
+		rt.Do(func(d Stores) {
+			m := AsMachine(rt.Find("machines", machineUUID.String()))
+			if !reflect.DeepEqual(m.SelectedProfiles, want) {
+				t.Errorf("Expected selected profiles %v, not %v", want, m.SelectedProfiles)
+			}
+			if v, _ := rt.GetParam(m, "site", true, false); v != site {
+				t.Errorf("Expected site param %v, not %v", site, v)
+			}
+		})
+	}
+	checkSelected([]string{"dc2", "named"}, "dc2")
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		m.Meta["site"] = "dc1"
+		if _, err := rt.Update(m); err != nil {
+			t.Errorf("Failed to move machine to dc1: %v", err)
+		}
+	})
+	checkSelected([]string{"named"}, nil)
+	tests = []crudTest{
+		{"Create rack profile", rt.Create, &models.Profile{Name: "rack", Selector: "rack=Eq(r1)"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		m.Params = map[string]interface{}{"rack": "r1"}
+		if _, err := rt.Update(m); err != nil {
+			t.Errorf("Failed to put machine in rack r1: %v", err)
+		}
+	})
+	checkSelected([]string{"named", "rack"}, nil)
+	tests = []crudTest{
+		{"Delete unselected profile", rt.Remove, &models.Profile{Name: "dc2"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	checkSelected([]string{"named", "rack"}, nil)
+	tests = []crudTest{
+		{"Delete selected profile", rt.Remove, &models.Profile{Name: "named"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	checkSelected([]string{"rack"}, nil)
+}
+
+func TestProfilesParamHistory(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "profiles", "params", "machines").SetPrincipal("fred")
+	tests := []crudTest{
+		{"Create history profile", rt.Create, &models.Profile{Name: "history", Params: map[string]interface{}{"a": "one"}}, true},
+		{"Update history profile", rt.Update, &models.Profile{Name: "history", Params: map[string]interface{}{"a": "two", "b": "one"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	var checkpoint time.Time
+	rt.Do(func(d Stores) {
+		history, err := rt.ParamHistory(rt.Find("profiles", "history").(*Profile), "")
+		if err != nil {
+			t.Fatalf("Error reading param history: %v", err)
+		}
+		if len(history) != 3 {
+			t.Fatalf("Expected 3 changes, not %d", len(history))
+		}
+		if history[0].Key != "a" || history[0].OldValue != nil || history[0].NewValue != "one" {
+			t.Errorf("Unexpected creation of a: %#v", history[0])
+		}
+		if history[1].Key != "a" || history[1].OldValue != "one" || history[1].NewValue != "two" {
+			t.Errorf("Unexpected change to a: %#v", history[1])
+		}
+		if history[2].Key != "b" || history[2].OldValue != nil || history[2].NewValue != "one" {
+			t.Errorf("Unexpected change to b: %#v", history[2])
+		}
+		if history[0].Principal != "fred" {
+			t.Errorf("Expected change to be made by fred, not %s", history[0].Principal)
+		}
+		checkpoint = history[2].Time
+	})
+	time.Sleep(10 * time.Millisecond)
+	tests = []crudTest{
+		{"Update history profile again", rt.Update, &models.Profile{Name: "history", Params: map[string]interface{}{"a": "three", "c": "one"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		res, skipped, err := rt.RevertParams(rt.Find("profiles", "history").(*Profile), checkpoint)
+		if err != nil {
+			t.Fatalf("Error reverting params: %v", err)
+		}
+		if len(skipped) != 0 {
+			t.Errorf("Expected no skipped params, got %v", skipped)
+		}
+		want := map[string]interface{}{"a": "two", "b": "one"}
+		if got := res.(*Profile).Params; !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected params %v after revert, not %v", want, got)
+		}
+		history, _ := rt.ParamHistory(res.(*Profile), "c")
+		if len(history) != 2 || history[1].NewValue != nil {
+			t.Errorf("Expected revert to remove c, got %#v", history)
+		}
+	})
+	tests = []crudTest{
+		{"Delete history profile", rt.Remove, &models.Profile{Name: "history"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		history, _ := rt.ParamHistory(&models.Profile{Name: "history"}, "")
+		if len(history) != 0 {
+			t.Errorf("Expected history to be removed with the profile, got %d changes", len(history))
+		}
+	})
+}
+
+func TestProfilesRotateKey(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "profiles", "params", "machines")
+	ref := &models.Profile{Name: "rotate"}
+	var oldKey []byte
+	rt.Do(func(d Stores) {
+		pk, err := rt.PublicKeyFor(ref)
+		if err != nil {
+			t.Fatalf("Error getting public key: %v", err)
+		}
+		oldKey, _ = rt.PrivateKeyFor(ref)
+		sd := &models.SecureData{}
+		if err := sd.Marshal(pk, "sekrit"); err != nil {
+			t.Fatalf("Error sealing secure param: %v", err)
+		}
+		ref.Params = map[string]interface{}{"secret": sd, "plain": "text"}
+	})
+	tests := []crudTest{
+		{"Create secure param", rt.Create, &models.Param{Name: "secret", Secure: true, Schema: map[string]interface{}{"type": "string"}}, true},
+		{"Create second secure param", rt.Create, &models.Param{Name: "secret2", Secure: true, Schema: map[string]interface{}{"type": "string"}}, true},
+		{"Create profile with secure param", rt.Create, ref, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		res, err := rt.RotateKey(rt.Find("profiles", "rotate").(*Profile))
+		if err != nil {
+			t.Fatalf("Error rotating key: %v", err)
+		}
+		newKey, _ := rt.PrivateKeyFor(ref)
+		if bytes.Equal(oldKey, newKey) {
+			t.Errorf("Expected key to change after rotation")
+		}
+		if val, _ := rt.GetParam(res.(*Profile), "secret", false, true); val != "sekrit" {
+			t.Errorf("Expected secure param to decrypt to sekrit after rotation, not %v", val)
+		}
+		if val, _ := rt.GetParam(res.(*Profile), "plain", false, false); val != "text" {
+			t.Errorf("Expected plain param to be unchanged after rotation, not %v", val)
+		}
+		// Interrupt a rotation after the new key was saved, but before
+		// the resealed params were.
+		if err := dt.Secrets.Save(previousKeyName(ref), newKey); err != nil {
+			t.Fatalf("Error saving previous key: %v", err)
+		}
+		if _, err := rt.rotateKeyFor(ref); err != nil {
+			t.Fatalf("Error saving new key: %v", err)
+		}
+		if val, _ := rt.GetParam(res.(*Profile), "secret", false, true); val != "sekrit" {
+			t.Errorf("Expected secure param to decrypt to sekrit after an interrupted rotation, not %v", val)
+		}
+		// Params saved after the interruption are sealed with the
+		// current key, so the profile now has params sealed with both.
+		pk, _ := rt.PublicKeyFor(ref)
+		sd := &models.SecureData{}
+		if err := sd.Marshal(pk, "sekrit2"); err != nil {
+			t.Fatalf("Error sealing secure param: %v", err)
+		}
+		mixed := rt.Find("profiles", "rotate").(*Profile)
+		mixed.Params["secret2"] = sd
+		if _, err := rt.Update(mixed); err != nil {
+			t.Fatalf("Error saving second secure param: %v", err)
+		}
+		if res, err = rt.RotateKey(rt.Find("profiles", "rotate").(*Profile)); err != nil {
+			t.Fatalf("Error rotating key after an interrupted rotation: %v", err)
+		}
+		if val, _ := rt.GetParam(res.(*Profile), "secret", false, true); val != "sekrit" {
+			t.Errorf("Expected secure param to decrypt to sekrit after finishing rotation, not %v", val)
+		}
+		if val, _ := rt.GetParam(res.(*Profile), "secret2", false, true); val != "sekrit2" {
+			t.Errorf("Expected second secure param to decrypt to sekrit2 after finishing rotation, not %v", val)
+		}
+		if prev := rt.previousKeyFor(ref); prev != nil {
+			t.Errorf("Expected previous key to be removed after rotation")
+		}
+	})
+}
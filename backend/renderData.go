@@ -796,13 +796,24 @@ func (r *RenderData) CallTemplate(name string, data interface{}) (ret interface{
 	return
 }
 
-func (r *RenderData) validateRequiredParams(e models.ErrorAdder) []models.TemplateInfo {
-	toRender, requiredParams := r.target.renderInfo()
+// missingRequiredParams returns the RequiredParams of the target
+// that cannot be resolved.
+func (r *RenderData) missingRequiredParams() []string {
+	_, requiredParams := r.target.renderInfo()
+	res := []string{}
 	for _, param := range requiredParams {
 		if !r.ParamExists(param) {
-			e.Errorf("Missing required parameter %s for %s %s", param, r.target.Prefix(), r.target.Key())
+			res = append(res, param)
 		}
 	}
+	return res
+}
+
+func (r *RenderData) validateRequiredParams(e models.ErrorAdder) []models.TemplateInfo {
+	toRender, _ := r.target.renderInfo()
+	for _, param := range r.missingRequiredParams() {
+		e.Errorf("Missing required parameter %s for %s %s", param, r.target.Prefix(), r.target.Key())
+	}
 	return toRender
 }
 
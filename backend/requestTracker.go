@@ -30,6 +30,7 @@ type RequestTracker struct {
 	locks     []string
 	d         Stores
 	toPublish []func()
+	principal string
 }
 
 func (rt *RequestTracker) unlocker(u func()) {
@@ -48,6 +49,19 @@ func (p *DataTracker) Request(l logger.Logger, locks ...string) *RequestTracker
 	return &RequestTracker{Mutex: &sync.Mutex{}, dt: p, Logger: l, locks: locks, toPublish: []func(){}}
 }
 
+// SetPrincipal records who is making the request.  It is used to
+// attribute changes made through this RequestTracker.
+func (rt *RequestTracker) SetPrincipal(p string) *RequestTracker {
+	rt.principal = p
+	return rt
+}
+
+// Principal returns who is making the request, or the empty string
+// if the request is being made by dr-provision itself.
+func (rt *RequestTracker) Principal() string {
+	return rt.principal
+}
+
 // PublishEvent records the Event to publish to all publish listeners
 // at after the RequestTracker locks have been released.  This
 // allows for Events to be published within a locked transaction
@@ -231,7 +245,8 @@ func (rt *RequestTracker) spkibrt(obj models.Model) (
 // Create takes an object and attempts to save it.  saved is
 // true if the object is actually saved.  error indicates the
 // actual error including validation errors. A "create" event
-// is generated from this call.
+// is generated from this call.  The object must pass the Policies
+// for its type.
 //
 // Assumes locks are held if appropriate.
 func (rt *RequestTracker) Create(obj models.Model) (saved bool, err error) {
@@ -261,11 +276,15 @@ func (rt *RequestTracker) Create(obj models.Model) (saved bool, err error) {
 	if checkOK {
 		checker.ClearValidation()
 	}
+	if err = rt.checkPolicies(ref, nil); err != nil {
+		ref.(validator).clearRT()
+		return false, err
+	}
 	saved, err = store.Create(backend, ref)
 	if saved {
 		ref.(validator).clearRT()
 		idx.Add(ref)
-
+		rt.recordParamChanges(nil, ref)
 		rt.Publish(prefix, "create", key, ref)
 	}
 
@@ -293,22 +312,46 @@ func (rt *RequestTracker) Remove(obj models.Model) (removed bool, err error) {
 	removed, err = store.Remove(backend, item.(store.KeySaver))
 	if removed {
 		idx.Remove(item)
+		rt.removeParamHistory(item)
 		rt.Publish(prefix, "delete", key, item)
 	}
 	return removed, err
 }
 
-// Patch takes a partially specified object to define the key space,
-// a key to find the object, and a JSON patch object to apply to
-// the found object.  Upon success, the new object is returned. Failure
-// returned in the error field.  This will generate an "update" event.
+// canRemove returns the error that Remove would fail with because of
+// the BeforeDelete hook of obj, without removing anything.
+//
+// Assumes locks are held if appropriate.
+func (rt *RequestTracker) canRemove(obj models.Model) error {
+	_, prefix, key, _, _, _, item := rt.spkibrt(obj)
+	if item == nil {
+		return &models.Error{
+			Type:     "DELETE",
+			Code:     http.StatusNotFound,
+			Key:      key,
+			Model:    prefix,
+			Messages: []string{"Not Found"},
+		}
+	}
+	bd, ok := item.(interface{ BeforeDelete() error })
+	if !ok {
+		return nil
+	}
+	item.(validator).setRT(rt)
+	defer item.(validator).clearRT()
+	return bd.BeforeDelete()
+}
+
+// patched applies patch to the object with key in obj's key space,
+// and returns both the object as it is now and the patched copy ready
+// to be saved.
 //
 // Assumes locks are held as appropriate.
-func (rt *RequestTracker) Patch(obj models.Model, key string, patch jsonpatch2.Patch) (models.Model, error) {
-	_, prefix, _, idx, backend, _, _ := rt.spkibrt(obj)
+func (rt *RequestTracker) patched(obj models.Model, key string, patch jsonpatch2.Patch) (target, toSave store.KeySaver, err error) {
+	_, prefix, _, idx, _, _, _ := rt.spkibrt(obj)
 	ref := idx.Find(key)
 	if ref == nil {
-		return nil, &models.Error{
+		return nil, nil, &models.Error{
 			Type:     "PATCH",
 			Code:     http.StatusNotFound,
 			Key:      key,
@@ -316,7 +359,7 @@ func (rt *RequestTracker) Patch(obj models.Model, key string, patch jsonpatch2.P
 			Messages: []string{"Not Found"},
 		}
 	}
-	target := ref.(store.KeySaver)
+	target = ref.(store.KeySaver)
 	buf, fatalErr := json.Marshal(target)
 	if fatalErr != nil {
 		rt.Fatalf("Non-JSON encodable %v:%v stored in cache: %v", obj.Prefix(), key, fatalErr)
@@ -335,9 +378,9 @@ func (rt *RequestTracker) Patch(obj models.Model, key string, patch jsonpatch2.P
 		err.Errorf("Patch error at line %d: %v", loc, patchErr)
 		buf, _ := json.Marshal(patch[loc])
 		err.Errorf("Patch line: %v", string(buf))
-		return nil, err
+		return nil, nil, err
 	}
-	toSave := target.New()
+	toSave = target.New()
 	if err := json.Unmarshal(resBuf, &toSave); err != nil {
 		retErr := &models.Error{
 			Code:  http.StatusNotAcceptable,
@@ -346,7 +389,7 @@ func (rt *RequestTracker) Patch(obj models.Model, key string, patch jsonpatch2.P
 			Type:  "PATCH",
 		}
 		retErr.AddError(err)
-		return nil, retErr
+		return nil, nil, retErr
 	}
 	if ms, ok := toSave.(models.Filler); ok {
 		ms.Fill()
@@ -367,19 +410,75 @@ func (rt *RequestTracker) Patch(obj models.Model, key string, patch jsonpatch2.P
 			}
 		}
 	}
+	return target, toSave, nil
+}
+
+// Patch takes a partially specified object to define the key space,
+// a key to find the object, and a JSON patch object to apply to
+// the found object.  Upon success, the new object is returned. Failure
+// returned in the error field.  This will generate an "update" event.
+// The patched object must pass the Policies for its type that the
+// object passed before.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) Patch(obj models.Model, key string, patch jsonpatch2.Patch) (models.Model, error) {
+	target, toSave, err := rt.patched(obj, key, patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := rt.checkPolicies(toSave, target); err != nil {
+		toSave.(validator).clearRT()
+		return nil, err
+	}
+	_, prefix, _, idx, backend, _, _ := rt.spkibrt(obj)
 	saved, err := store.Update(backend, toSave)
 	toSave.(validator).clearRT()
 	if saved {
 		idx.Add(toSave)
+		rt.recordParamChanges(target, toSave)
 		rt.Publish(prefix, "update", key, toSave)
 	}
 	return toSave, err
 }
 
+// DryRunPatch works like Patch, except that the patched object is
+// only validated and not saved.  The OnChange and BeforeSave hooks of
+// the object are run, so the returned object is what Patch would have
+// saved, and the error is what Patch would have returned.  No events
+// are generated.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) DryRunPatch(obj models.Model, key string, patch jsonpatch2.Patch) (models.Model, error) {
+	target, toSave, err := rt.patched(obj, key, patch)
+	if err != nil {
+		return nil, err
+	}
+	defer toSave.(validator).clearRT()
+	if err := rt.checkPolicies(toSave, target); err != nil {
+		return nil, err
+	}
+	if oc, ok := toSave.(interface {
+		OnChange(store.KeySaver) error
+	}); ok {
+		if err := oc.OnChange(target); err != nil {
+			return nil, err
+		}
+	}
+	if bs, ok := toSave.(interface {
+		BeforeSave() error
+	}); ok {
+		if err := bs.BeforeSave(); err != nil {
+			return nil, err
+		}
+	}
+	return toSave, nil
+}
+
 // Update takes a fully specified object and replaces an existing
 // object in the data store assuming the new object is valid.  saved
 // is true if the object is saved.  error indicates failure.  An
-// "update" event is generated from this call.
+// "update" event is generated from this call.  The new object must
+// pass the Policies for its type that the old object passed.
 //
 // Assumes locks are held as appropriate.
 func (rt *RequestTracker) Update(obj models.Model) (saved bool, err error) {
@@ -401,10 +500,15 @@ func (rt *RequestTracker) Update(obj models.Model) (saved bool, err error) {
 	if checkOK {
 		checker.ClearValidation()
 	}
+	if err = rt.checkPolicies(ref, target); err != nil {
+		ref.(validator).clearRT()
+		return false, err
+	}
 	saved, err = store.Update(backend, ref)
 	ref.(validator).clearRT()
 	if saved {
 		idx.Add(ref)
+		rt.recordParamChanges(target, ref)
 		rt.Publish(prefix, "update", key, ref)
 	}
 	return saved, err
@@ -414,11 +518,11 @@ func (rt *RequestTracker) Update(obj models.Model) (saved bool, err error) {
 // and backing index. This will generate a "save" event.
 // The difference between Update and Save is that Update will go
 // through the OnChange callback system.  Save will NOT.  Both calls
-// will call BeforeSave and AfterSave.
+// will call BeforeSave and AfterSave, and both check Policies.
 //
 // Assumes that locks are held as appropriate.
 func (rt *RequestTracker) Save(obj models.Model) (saved bool, err error) {
-	_, prefix, key, idx, backend, ref, _ := rt.spkibrt(obj)
+	_, prefix, key, idx, backend, ref, target := rt.spkibrt(obj)
 	if ms, ok := ref.(models.Filler); ok {
 		ms.Fill()
 	}
@@ -427,10 +531,17 @@ func (rt *RequestTracker) Save(obj models.Model) (saved bool, err error) {
 	if checkOK {
 		checker.ClearValidation()
 	}
+	if err = rt.checkPolicies(ref, target); err != nil {
+		ref.(validator).clearRT()
+		return false, err
+	}
 	saved, err = store.Save(backend, ref)
 	ref.(validator).clearRT()
 	if saved {
 		idx.Add(ref)
+		if target != nil {
+			rt.recordParamChanges(target, ref)
+		}
 		rt.Publish(prefix, "save", key, ref)
 	}
 	return saved, err
@@ -451,6 +562,14 @@ func (rt *RequestTracker) decryptParam(
 	if !param.Secure {
 		return val
 	}
+	if ref, ok := secretRefFor(val); ok {
+		ret, err := rt.resolveSecretRef(ref)
+		if err != nil {
+			rt.Errorf("Unable to resolve secure param %s on %s:%s: %v", name, obj.Prefix(), obj.Key(), err)
+			return val
+		}
+		return ret
+	}
 	sd := &models.SecureData{}
 	models.Remarshal(val, sd)
 	var ret interface{}
@@ -459,7 +578,11 @@ func (rt *RequestTracker) decryptParam(
 		panic(err.Error())
 	}
 	if err := sd.Unmarshal(pk, &ret); err != nil {
-		return val
+		// The param may still be sealed with the key obj had before
+		// an unfinished key rotation.
+		if prev := rt.previousKeyFor(obj); prev == nil || sd.Unmarshal(prev, &ret) != nil {
+			return val
+		}
 	}
 	return ret
 }
@@ -474,33 +597,47 @@ func (rt *RequestTracker) getAggParams(obj models.Paramer,
 		return
 	}
 	subObjs := []models.Paramer{}
+	seen := map[string]bool{}
 	var profiles []string
 	var stage string
 	switch ref := obj.(type) {
 	case *rMachine:
-		profiles, stage = ref.Profiles, ref.Stage
+		profiles, stage = ref.EffectiveProfiles(), ref.Stage
 	case *models.Machine:
-		profiles, stage = ref.Profiles, ref.Stage
+		profiles, stage = ref.EffectiveProfiles(), ref.Stage
 	case *Machine:
-		profiles, stage = ref.Profiles, ref.Stage
-	}
-	for _, pn := range profiles {
-		if pobj := rt.Find("profiles", pn); pobj != nil {
-			subObjs = append(subObjs, pobj.(models.Paramer))
+		profiles, stage = ref.EffectiveProfiles(), ref.Stage
+	case *models.Profile:
+		profiles = ref.Profiles
+		seen[ref.Name] = true
+	case *Profile:
+		profiles = ref.Profiles
+		seen[ref.Name] = true
+	}
+	// Profiles are expanded depth first, so that a profile is
+	// immediately followed by the profiles it includes.  Each
+	// profile is only consulted once, which also keeps us from
+	// looping forever on include cycles.
+	var addProfiles func([]string)
+	addProfiles = func(names []string) {
+		for _, pn := range names {
+			if seen[pn] {
+				continue
+			}
+			seen[pn] = true
+			if pobj := rt.Find("profiles", pn); pobj != nil {
+				subObjs = append(subObjs, pobj.(models.Paramer))
+				addProfiles(AsProfile(pobj).Profiles)
+			}
 		}
 	}
+	addProfiles(profiles)
 	if stage != "" {
 		if sobj := rt.Find("stages", stage); sobj != nil {
-			for _, pn := range AsStage(sobj).Profiles {
-				if pobj := rt.Find("profiles", pn); pobj != nil {
-					subObjs = append(subObjs, pobj.(models.Paramer))
-				}
-			}
+			addProfiles(AsStage(sobj).Profiles)
 		}
 	}
-	if pobj := rt.Find("profiles", rt.dt.GlobalProfileName); pobj != nil {
-		subObjs = append(subObjs, pobj.(models.Paramer))
-	}
+	addProfiles([]string{rt.dt.GlobalProfileName})
 	for _, sub := range subObjs {
 		for k, v := range sub.GetParams() {
 			if _, ok := params[k]; !ok {
@@ -580,12 +717,53 @@ func (rt *RequestTracker) rotateKeyFor(m models.Model) ([]byte, error) {
 		return nil, err
 	}
 	key := pk[:]
-	return key, rt.dt.Secrets.Save(m.Prefix()+"-"+m.Key(), key)
+	return key, rt.saveKeyFor(m, key)
+}
+
+func (rt *RequestTracker) saveKeyFor(m models.Model, key []byte) error {
+	return rt.dt.Secrets.Save(m.Prefix()+"-"+m.Key(), key)
+}
+
+// previousKeyName is where the key m had before its key rotation
+// started is kept until the rotation finishes.
+func previousKeyName(m models.Model) string {
+	return "previous-" + m.Prefix() + "-" + m.Key()
+}
+
+// previousKeyFor returns the key m had before an unfinished key
+// rotation, or nil if m is not being rotated.
+func (rt *RequestTracker) previousKeyFor(m models.Model) []byte {
+	rt.dt.secretsMux.Lock()
+	defer rt.dt.secretsMux.Unlock()
+	var res []byte
+	if err := rt.dt.Secrets.Load(previousKeyName(m), &res); err != nil {
+		return nil
+	}
+	return res
+}
+
+// openSecure opens sd into val with the key of m, or with the key m
+// had before an unfinished key rotation.  It returns the key that
+// opened sd.
+func (rt *RequestTracker) openSecure(m models.Model, sd *models.SecureData, val interface{}) ([]byte, error) {
+	pk, err := rt.PrivateKeyFor(m)
+	if err != nil {
+		return nil, err
+	}
+	err = sd.Unmarshal(pk, val)
+	if err == nil {
+		return pk, nil
+	}
+	if prev := rt.previousKeyFor(m); prev != nil && sd.Unmarshal(prev, val) == nil {
+		return prev, nil
+	}
+	return nil, err
 }
 
 func (rt *RequestTracker) DeleteKeyFor(m models.Model) error {
 	rt.dt.secretsMux.Lock()
 	defer rt.dt.secretsMux.Unlock()
+	rt.dt.Secrets.Remove(previousKeyName(m))
 	return rt.dt.Secrets.Remove(m.Prefix() + "-" + m.Key())
 }
 
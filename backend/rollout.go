@@ -0,0 +1,541 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/digitalrebar/store"
+)
+
+// Rollout is the backend model wrapper for Rollout.
+// This struct also includes validation helpers.
+type Rollout struct {
+	*models.Rollout
+	validate
+	// used to allow the rollout controller to change the progress.
+	rolloutRun bool
+}
+
+// SetReadOnly is a helper function to set the ReadOnly flag.
+func (r *Rollout) SetReadOnly(b bool) {
+	r.ReadOnly = b
+}
+
+// SaveClean is a helper function to run the model version's
+// ClearValidation function before converting back to
+// an object that can be stored in the backend.
+func (r *Rollout) SaveClean() store.KeySaver {
+	mod := *r.Rollout
+	mod.ClearValidation()
+	return toBackend(&mod, r.rt)
+}
+
+// AsRollout casts a models.Model interface to
+// *Rollout (helper function)
+func AsRollout(o models.Model) *Rollout {
+	return o.(*Rollout)
+}
+
+// AsRollouts converts a list of models.Model to
+// a list of *Rollout (helper function)
+func AsRollouts(o []models.Model) []*Rollout {
+	res := make([]*Rollout, len(o))
+	for i := range o {
+		res[i] = AsRollout(o[i])
+	}
+	return res
+}
+
+// New creates a new empty instance of Rollout.
+// The ForceChanged and RT fields are propogated.
+func (r *Rollout) New() store.KeySaver {
+	res := &Rollout{Rollout: &models.Rollout{}}
+	if r.Rollout != nil && r.ChangeForced() {
+		res.ForceChange()
+	}
+	res.rt = r.rt
+	res.Fill()
+	return res
+}
+
+// Indexes returns a map of the indexes allowed for
+// Rollout objects.
+func (r *Rollout) Indexes() map[string]index.Maker {
+	fix := AsRollout
+	res := index.MakeBaseIndexes(r)
+	res["Name"] = index.Make(
+		true,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Name < fix(j).Name
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			name := fix(ref).Name
+			return func(s models.Model) bool {
+					return fix(s).Name >= name
+				},
+				func(s models.Model) bool {
+					return fix(s).Name > name
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(r.New())
+			res.Name = v
+			return res, nil
+		})
+	res["Workflow"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Workflow < fix(j).Workflow
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			wf := fix(ref).Workflow
+			return func(s models.Model) bool {
+					return fix(s).Workflow >= wf
+				},
+				func(s models.Model) bool {
+					return fix(s).Workflow > wf
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(r.New())
+			res.Workflow = v
+			return res, nil
+		})
+	res["State"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).State < fix(j).State
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			state := fix(ref).State
+			return func(s models.Model) bool {
+					return fix(s).State >= state
+				},
+				func(s models.Model) bool {
+					return fix(s).State > state
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(r.New())
+			res.State = v
+			return res, nil
+		})
+	return res
+}
+
+// Validate sets the valid and available flags for the Rollout.
+// This assumes that locks are held as appropriate, if needed.
+func (r *Rollout) Validate() {
+	r.Rollout.Validate()
+	r.AddError(index.CheckUnique(r, r.rt.stores("rollouts").Items()))
+	if r.Selector != "" {
+		if _, err := r.rt.machineSelectorFilters(r.Selector); err != nil {
+			r.Errorf("Invalid Selector %s: %v", r.Selector, err)
+		}
+	}
+	if !r.SetValid() {
+		return
+	}
+	if wf := r.rt.find("workflows", r.Workflow); wf == nil {
+		r.Errorf("Workflow %s does not exist", r.Workflow)
+	} else if !AsWorkflow(wf).Available {
+		r.Errorf("Workflow %s is not available", r.Workflow)
+	}
+	r.SetAvailable()
+}
+
+// OnCreate starts the new Rollout out as pending.
+func (r *Rollout) OnCreate() error {
+	r.State = "pending"
+	r.Reason = ""
+	r.Wave = 0
+	r.Waived = 0
+	r.Progress = []models.RolloutMachine{}
+	return nil
+}
+
+// OnChange keeps the progress of the Rollout from being changed by
+// anything other than the rollout controller, and keeps the Workflow
+// of a Rollout that has started from changing.
+func (r *Rollout) OnChange(oldThing store.KeySaver) error {
+	if r.rolloutRun {
+		return nil
+	}
+	old := AsRollout(oldThing)
+	if old.State != "pending" && r.Workflow != old.Workflow {
+		e := &models.Error{Code: 422, Type: ValidationError, Model: r.Prefix(), Key: r.Key()}
+		e.Errorf("Cannot change the Workflow of a rollout that has started")
+		return e
+	}
+	r.State = old.State
+	r.Reason = old.Reason
+	r.Wave = old.Wave
+	r.Waived = old.Waived
+	r.Progress = old.Progress
+	return nil
+}
+
+// BeforeSave validates the state of the Rollout.
+func (r *Rollout) BeforeSave() error {
+	r.Fill()
+	r.Validate()
+	if !r.Validated {
+		return r.MakeError(422, ValidationError, r)
+	}
+	return nil
+}
+
+// AfterSave clears the rollout controller flag.
+func (r *Rollout) AfterSave() {
+	r.rolloutRun = false
+}
+
+// OnLoad initializes the Rollout when loaded from the data store.
+func (r *Rollout) OnLoad() error {
+	defer func() { r.rt = nil }()
+	r.Fill()
+	return r.BeforeSave()
+}
+
+var rolloutLockMap = map[string][]string{
+	"get":     {"rollouts"},
+	"create":  {"workflows", "machines", "profiles", "params", "rollouts"},
+	"update":  {"workflows", "machines", "profiles", "params", "rollouts"},
+	"patch":   {"workflows", "machines", "profiles", "params", "rollouts"},
+	"delete":  {"rollouts"},
+	"actions": {"rollouts", "profiles", "params"},
+}
+
+// Locks returns the object lock list for a given action for the Rollout object
+func (r *Rollout) Locks(action string) []string {
+	return rolloutLockMap[action]
+}
+
+// RolloutLocks are the locks needed to advance Rollouts.
+var RolloutLocks = []string{"stages", "bootenvs", "machines", "jobs", "tasks", "profiles", "templates", "params", "workflows", "rollouts"}
+
+// rolloutTargets returns the Machines picked by the Selector of r.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) rolloutTargets(r *Rollout) ([]*Machine, error) {
+	filters, err := rt.machineSelectorFilters(r.Selector)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := index.All(filters...)(index.New(rt.stores("machines").Items()))
+	if err != nil {
+		return nil, err
+	}
+	return AsMachines(selected.Items()), nil
+}
+
+// rolloutMachineState returns whether m is still running the
+// Workflow of r, has succeeded, or has failed, and why it failed.  m
+// is nil if the Machine was deleted.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) rolloutMachineState(r *Rollout, m *Machine) (string, string) {
+	if m == nil {
+		return "failed", "machine was deleted"
+	}
+	if m.Workflow != r.Workflow {
+		return "failed", fmt.Sprintf("machine left the workflow for %q", m.Workflow)
+	}
+	jobs := []*Job{}
+	for _, id := range m.currentJobs() {
+		if jo := rt.find("jobs", id.String()); jo != nil {
+			jobs = append(jobs, AsJob(jo))
+		}
+	}
+	if !m.Runnable {
+		for _, j := range jobs {
+			if j.State == "failed" || j.State == "cancelled" {
+				return "failed", fmt.Sprintf("job %s for %s %s", j.UUID(), j.Task, j.State)
+			}
+		}
+	}
+	if m.CurrentTask < len(m.Tasks)-1 || (len(m.Tasks) > 0 && len(jobs) == 0) {
+		return "running", ""
+	}
+	for _, j := range jobs {
+		if j.State != "finished" {
+			return "running", ""
+		}
+	}
+	return "succeeded", ""
+}
+
+// installBound returns true if m is in a BootEnv whose name ends in
+// -install, or is runnable and has one ahead of it in its Tasks.
+func installBound(m *Machine) bool {
+	if strings.HasSuffix(m.BootEnv, "-install") {
+		return true
+	}
+	if !m.Runnable {
+		return false
+	}
+	for i := m.CurrentTask + 1; i < len(m.Tasks); i++ {
+		if i >= 0 && strings.HasPrefix(m.Tasks[i], "bootenv:") && strings.HasSuffix(m.Tasks[i], "-install") {
+			return true
+		}
+	}
+	return false
+}
+
+// rolloutGroup returns the group m is in for r.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) rolloutGroup(r *Rollout, m *Machine) string {
+	if r.GroupBy == "" || m == nil {
+		return ""
+	}
+	val, _ := rt.GetParam(m, r.GroupBy, true, false)
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprint(val)
+}
+
+// AdvanceRollout moves r along: it picks the Machines of r when it
+// starts, checks on the Machines that are running, halts r if the
+// current wave has used up its FailureBudget, starts the next wave
+// when the current one is finished, and starts the Machines of the
+// current wave that the GroupPercent and InstallLimit allow.  r
+// should be a copy of the stored Rollout, and changed is true if it
+// needs to be saved.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) AdvanceRollout(r *Rollout) (changed bool, err error) {
+	set := func(p *models.RolloutMachine, state, reason string) {
+		if p.State != state || p.Reason != reason {
+			p.State, p.Reason = state, reason
+			changed = true
+		}
+	}
+	find := func(p *models.RolloutMachine) *Machine {
+		if mo := rt.find("machines", p.Machine.String()); mo != nil {
+			return AsMachine(mo)
+		}
+		return nil
+	}
+	switch r.State {
+	case "halted", "done":
+		return false, nil
+	case "pending":
+		if r.Paused {
+			return false, nil
+		}
+		machines, err := rt.rolloutTargets(r)
+		if err != nil {
+			return false, err
+		}
+		for _, m := range machines {
+			r.Progress = append(r.Progress, models.RolloutMachine{Machine: m.Uuid, State: "waiting"})
+		}
+		r.State = "running"
+		changed = true
+		rt.Infof("Rollout %s started with %d machines", r.Name, len(r.Progress))
+		rt.Publish("rollouts", "start", r.Key(), r)
+	}
+	for i := range r.Progress {
+		if p := &r.Progress[i]; p.State == "running" {
+			state, reason := rt.rolloutMachineState(r, find(p))
+			set(p, state, reason)
+		}
+	}
+	inWave, size, failed := 0, 0, 0
+	for _, p := range r.Progress {
+		if r.Wave == 0 || p.Wave != r.Wave {
+			continue
+		}
+		size++
+		switch p.State {
+		case "failed":
+			failed++
+		case "waiting", "running":
+			inWave++
+		}
+	}
+	if size > 0 && r.Wave != r.Waived && failed*100 > r.FailureBudget*size {
+		r.State = "halted"
+		r.Reason = fmt.Sprintf("%d of %d machines in wave %d failed", failed, size, r.Wave)
+		rt.Infof("Rollout %s halted: %s", r.Name, r.Reason)
+		rt.Publish("rollouts", "halt", r.Key(), r)
+		return true, nil
+	}
+	if r.Paused {
+		if r.State != "paused" {
+			r.State = "paused"
+			changed = true
+		}
+		return changed, nil
+	}
+	if r.State != "running" {
+		r.State = "running"
+		changed = true
+	}
+	if inWave == 0 {
+		next := 0
+		for i := range r.Progress {
+			if p := &r.Progress[i]; p.Wave == 0 && (r.BatchSize == 0 || next < r.BatchSize) {
+				p.Wave = r.Wave + 1
+				next++
+			}
+		}
+		if next == 0 {
+			r.State = "done"
+			counts := r.Counts()
+			rt.Infof("Rollout %s done: %d machines succeeded, %d failed", r.Name, counts["succeeded"], counts["failed"])
+			rt.Publish("rollouts", "done", r.Key(), r)
+			return true, nil
+		}
+		r.Wave++
+		changed = true
+		rt.Infof("Rollout %s starting wave %d with %d machines", r.Name, r.Wave, next)
+		rt.Publish("rollouts", "wave", r.Key(), r)
+	}
+	groupSize, groupRunning := map[string]int{}, map[string]int{}
+	if r.GroupPercent > 0 {
+		for i := range r.Progress {
+			p := &r.Progress[i]
+			group := rt.rolloutGroup(r, find(p))
+			groupSize[group]++
+			if p.State == "running" {
+				groupRunning[group]++
+			}
+		}
+	}
+	installing := 0
+	if r.InstallLimit > 0 {
+		for _, mo := range rt.stores("machines").Items() {
+			if installBound(AsMachine(mo)) {
+				installing++
+			}
+		}
+	}
+	for i := range r.Progress {
+		p := &r.Progress[i]
+		if p.Wave != r.Wave || p.State != "waiting" {
+			continue
+		}
+		m := find(p)
+		if m == nil {
+			set(p, "failed", "machine does not exist")
+			continue
+		}
+		if reason := rt.machineBusy(m); reason != "" {
+			set(p, "waiting", reason)
+			continue
+		}
+		group := rt.rolloutGroup(r, m)
+		if r.GroupPercent > 0 {
+			limit := groupSize[group] * r.GroupPercent / 100
+			if limit < 1 {
+				limit = 1
+			}
+			if groupRunning[group] >= limit {
+				set(p, "waiting", fmt.Sprintf("%d machines in group %q are running", groupRunning[group], group))
+				continue
+			}
+		}
+		if r.InstallLimit > 0 && installing >= r.InstallLimit {
+			set(p, "waiting", fmt.Sprintf("%d machines are installing", installing))
+			continue
+		}
+		nm := ModelToBackend(models.Clone(m)).(*Machine)
+		nm.Runnable = true
+		nm.Workflow = r.Workflow
+		nm.restartWorkflow = true
+		if _, err := rt.Update(nm); err != nil {
+			set(p, "failed", err.Error())
+			continue
+		}
+		set(p, "running", "")
+		groupRunning[group]++
+		if installBound(nm) {
+			installing++
+		}
+	}
+	return changed, nil
+}
+
+// setRolloutPaused sets the Paused flag of r.  Resuming a halted
+// Rollout waives the FailureBudget of its current wave, so that the
+// wave can finish.  action is published as an event on rollouts.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) setRolloutPaused(r *Rollout, paused bool, action string) (*Rollout, error) {
+	nr := ModelToBackend(models.Clone(r)).(*Rollout)
+	nr.rolloutRun = true
+	nr.Paused = paused
+	if !paused && nr.State == "halted" {
+		nr.State = "running"
+		nr.Reason = ""
+		nr.Waived = nr.Wave
+	}
+	if _, err := rt.Update(nr); err != nil {
+		return nil, err
+	}
+	res := AsRollout(rt.find("rollouts", r.Key()))
+	rt.Publish("rollouts", action, res.Key(), res)
+	return res, nil
+}
+
+// PauseRollout stops r from starting more Machines.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) PauseRollout(r *Rollout) (*Rollout, error) {
+	rt.Infof("Pausing rollout %s", r.Name)
+	return rt.setRolloutPaused(r, true, "pause")
+}
+
+// ResumeRollout lets a paused or halted r carry on.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) ResumeRollout(r *Rollout) (*Rollout, error) {
+	rt.Infof("Resuming rollout %s", r.Name)
+	return rt.setRolloutPaused(r, false, "resume")
+}
+
+// RunRollouts advances every Rollout.
+func (p *DataTracker) RunRollouts(l logger.Logger) {
+	rt := p.Request(l, RolloutLocks...)
+	rt.Do(func(d Stores) {
+		for _, ro := range d("rollouts").Items() {
+			r := AsRollout(ro)
+			if !r.Available || r.State == "halted" || r.State == "done" {
+				continue
+			}
+			nr := ModelToBackend(models.Clone(r)).(*Rollout)
+			nr.rolloutRun = true
+			changed, err := rt.AdvanceRollout(nr)
+			if err != nil {
+				rt.Errorf("Unable to advance rollout %s: %v", r.Name, err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if _, err := rt.Update(nr); err != nil {
+				rt.Errorf("Unable to update rollout %s: %v", r.Name, err)
+			}
+		}
+	})
+}
+
+// StartRolloutController runs RunRollouts every interval in the
+// background.
+func (p *DataTracker) StartRolloutController(l logger.Logger, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			p.RunRollouts(l)
+		}
+	}()
+}
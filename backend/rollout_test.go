@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestRollouts(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, RolloutLocks...)
+	machines := []uuid.UUID{uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()}
+	tests := []crudTest{
+		{"Create Task fw", rt.Create, &models.Task{Name: "fw"}, true},
+		{"Create Stage fw", rt.Create, &models.Stage{Name: "fw", BootEnv: "local", Tasks: []string{"fw"}}, true},
+		{"Create Workflow fw", rt.Create, &models.Workflow{Name: "fw", Stages: []string{"fw"}}, true},
+		{"Create Machine outside the rollout", rt.Create, &models.Machine{Uuid: uuid.NewRandom(), Name: "db.example.com", Meta: models.Meta{"role": "db"}}, true},
+		{"Create Rollout without a Selector", rt.Create, &models.Rollout{Name: "bad", Workflow: "fw"}, false},
+		{"Create Rollout with a bad FailureBudget", rt.Create, &models.Rollout{Name: "bad", Selector: "Meta.role=Eq(web)", Workflow: "fw", FailureBudget: 150}, false},
+		{"Create Rollout with a bad Selector", rt.Create, &models.Rollout{Name: "bad", Selector: "Bogus=Eq(1)", Workflow: "fw"}, false},
+		{"Create Rollout with missing Workflow", rt.Create, &models.Rollout{Name: "missing", Selector: "Meta.role=Eq(web)", Workflow: "missing"}, true},
+		{"Create Rollout web", rt.Create, &models.Rollout{Name: "web", Selector: "Meta.role=Eq(web)", Workflow: "fw", BatchSize: 2}, true},
+	}
+	for i, id := range machines {
+		tests = append(tests, crudTest{"Create Machine in the rollout", rt.Create, &models.Machine{Uuid: id, Name: fmt.Sprintf("web%d.example.com", i), Meta: models.Meta{"role": "web"}}, true})
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rollout := func() *Rollout {
+		var res *Rollout
+		rt.Do(func(d Stores) {
+			res = AsRollout(rt.Find("rollouts", "web"))
+		})
+		return res
+	}
+	waves := func(r *Rollout) map[string]int {
+		res := map[string]int{}
+		for _, p := range r.Progress {
+			res[p.Machine.String()] = p.Wave
+		}
+		return res
+	}
+	// finish makes id look like it finished the fw Workflow.
+	finish := func(id uuid.UUID) {
+		jobId := uuid.NewRandom()
+		crudTest{"Create finished Job", rt.Create, &models.Job{
+			Uuid:     jobId,
+			Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+			Machine:  id,
+			Task:     "fw",
+			Stage:    "fw",
+			State:    "finished",
+		}, true}.Test(t, rt)
+		rt.Do(func(d Stores) {
+			m := AsMachine(rt.find("machines", id.String()))
+			m.CurrentTask = len(m.Tasks) - 1
+			m.CurrentJob = jobId
+		})
+	}
+	inWave := func(r *Rollout, wave int) []uuid.UUID {
+		res := []uuid.UUID{}
+		for _, p := range r.Progress {
+			if p.Wave == wave {
+				res = append(res, p.Machine)
+			}
+		}
+		return res
+	}
+
+	dt.RunRollouts(dt.Logger)
+	r := rollout()
+	if r.State != "running" || r.Wave != 1 || len(r.Progress) != 4 {
+		t.Fatalf("Expected web to be running wave 1 of 4 machines, not %s wave %d of %d", r.State, r.Wave, len(r.Progress))
+	}
+	if counts := r.Counts(); counts["running"] != 2 || counts["waiting"] != 2 {
+		t.Errorf("Expected 2 running and 2 waiting machines, got %v", counts)
+	}
+	rt.Do(func(d Stores) {
+		if AsRollout(rt.Find("rollouts", "missing")).State != "pending" {
+			t.Errorf("Expected rollout with a missing Workflow to stay pending")
+		}
+		for id, wave := range waves(r) {
+			if m := AsMachine(rt.Find("machines", id)); (wave == 1) != (m.Workflow == "fw") {
+				t.Errorf("Expected machine %s in wave %d to be in Workflow fw only if it is in wave 1, it is in %q", id, wave, m.Workflow)
+			}
+		}
+		if _, err := rt.PauseRollout(r); err != nil {
+			t.Fatalf("Failed to pause web: %v", err)
+		}
+	})
+	first := inWave(r, 1)
+	for _, id := range first {
+		finish(id)
+	}
+	dt.RunRollouts(dt.Logger)
+	if r = rollout(); r.State != "paused" || r.Wave != 1 || r.Counts()["succeeded"] != 2 {
+		t.Errorf("Expected paused web to stay at wave 1 with 2 machines succeeded, not %s wave %d %v", r.State, r.Wave, r.Counts())
+	}
+	rt.Do(func(d Stores) {
+		if _, err := rt.ResumeRollout(r); err != nil {
+			t.Fatalf("Failed to resume web: %v", err)
+		}
+	})
+	dt.RunRollouts(dt.Logger)
+	if r = rollout(); r.State != "running" || r.Wave != 2 {
+		t.Fatalf("Expected web to be running wave 2, not %s wave %d", r.State, r.Wave)
+	}
+	second := inWave(r, 2)
+	rt.Do(func(d Stores) {
+		AsMachine(rt.find("machines", second[0].String())).Workflow = ""
+	})
+	dt.RunRollouts(dt.Logger)
+	if r = rollout(); r.State != "halted" || r.Reason == "" {
+		t.Errorf("Expected web to halt when a machine left the workflow, not %s (%s)", r.State, r.Reason)
+	}
+	patch := &models.Rollout{}
+	*patch = *r.Rollout
+	patch.Workflow = "missing"
+	crudTest{"Change the Workflow of a started Rollout", rt.Update, patch, false}.Test(t, rt)
+	r = rollout()
+	rt.Do(func(d Stores) {
+		if _, err := rt.ResumeRollout(r); err != nil {
+			t.Fatalf("Failed to resume web: %v", err)
+		}
+	})
+	finish(second[1])
+	dt.RunRollouts(dt.Logger)
+	r = rollout()
+	if counts := r.Counts(); r.State != "done" || counts["succeeded"] != 3 || counts["failed"] != 1 {
+		t.Errorf("Expected web to be done with 3 machines succeeded and 1 failed, not %s %v", r.State, counts)
+	}
+}
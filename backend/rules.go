@@ -0,0 +1,501 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/digitalrebar/store"
+)
+
+// Rule is the backend model wrapper for Rule.
+// This struct also includes validation helpers.
+type Rule struct {
+	*models.Rule
+	validate
+}
+
+// SetReadOnly is a helper function to set the ReadOnly flag.
+func (r *Rule) SetReadOnly(b bool) {
+	r.ReadOnly = b
+}
+
+// SaveClean is a helper function to run the model version's
+// ClearValidation function before converting back to
+// an object that can be stored in the backend.
+func (r *Rule) SaveClean() store.KeySaver {
+	mod := *r.Rule
+	mod.ClearValidation()
+	return toBackend(&mod, r.rt)
+}
+
+// AsRule casts a models.Model interface to
+// *Rule (helper function)
+func AsRule(o models.Model) *Rule {
+	return o.(*Rule)
+}
+
+// AsRules converts a list of models.Model to
+// a list of *Rule (helper function)
+func AsRules(o []models.Model) []*Rule {
+	res := make([]*Rule, len(o))
+	for i := range o {
+		res[i] = AsRule(o[i])
+	}
+	return res
+}
+
+// New creates a new empty instance of Rule.
+// The ForceChanged and RT fields are propogated.
+func (r *Rule) New() store.KeySaver {
+	res := &Rule{Rule: &models.Rule{}}
+	if r.Rule != nil && r.ChangeForced() {
+		res.ForceChange()
+	}
+	res.rt = r.rt
+	res.Fill()
+	return res
+}
+
+// Indexes returns a map of the indexes allowed for
+// Rule objects.
+func (r *Rule) Indexes() map[string]index.Maker {
+	fix := AsRule
+	res := index.MakeBaseIndexes(r)
+	res["Name"] = index.Make(
+		true,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Name < fix(j).Name
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			name := fix(ref).Name
+			return func(s models.Model) bool {
+					return fix(s).Name >= name
+				},
+				func(s models.Model) bool {
+					return fix(s).Name > name
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(r.New())
+			res.Name = v
+			return res, nil
+		})
+	res["Event"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Event < fix(j).Event
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			event := fix(ref).Event
+			return func(s models.Model) bool {
+					return fix(s).Event >= event
+				},
+				func(s models.Model) bool {
+					return fix(s).Event > event
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(r.New())
+			res.Event = v
+			return res, nil
+		})
+	return res
+}
+
+// eventRef returns an empty backend object of the type the Event of
+// r fires on, or an error if the type is a pattern or unknown.
+func (r *Rule) eventRef(rt *RequestTracker) (store.KeySaver, error) {
+	t, _, _, err := r.EventParts()
+	if err != nil {
+		return nil, err
+	}
+	ref, err := models.New(t)
+	if err != nil {
+		return nil, fmt.Errorf("Event type %s is not an object type", t)
+	}
+	return toBackend(ref, rt), nil
+}
+
+// Validate sets the valid and available flags for the Rule.
+// This assumes that locks are held as appropriate, if needed.
+func (r *Rule) Validate() {
+	r.Rule.Validate()
+	r.AddError(index.CheckUnique(r, r.rt.stores("rules").Items()))
+	if r.Condition != "" {
+		if ref, err := r.eventRef(r.rt); err != nil {
+			r.Errorf("Condition needs an Event with an object type: %v", err)
+		} else if _, err := r.rt.selectorFilters(ref, r.Condition); err != nil {
+			r.Errorf("Invalid Condition %s: %v", r.Condition, err)
+		}
+	}
+	for i, a := range r.Actions {
+		if a.Kind != "profile" {
+			continue
+		}
+		var target models.Model = &Machine{}
+		if r.Target == "" {
+			ref, err := r.eventRef(r.rt)
+			if err != nil {
+				continue
+			}
+			target = ref
+		}
+		if _, ok := target.(models.Profiler); !ok {
+			r.Errorf("Action %d: %s do not have Profiles", i, target.Prefix())
+		}
+	}
+	if !r.SetValid() {
+		return
+	}
+	for _, a := range r.Actions {
+		prefix := ""
+		switch a.Kind {
+		case "stage":
+			prefix = "stages"
+		case "workflow":
+			prefix = "workflows"
+		case "profile":
+			prefix = "profiles"
+		default:
+			continue
+		}
+		obj := r.rt.find(prefix, a.Name)
+		if obj == nil {
+			r.Errorf("%s %s does not exist", prefix, a.Name)
+		} else if v := obj.(interface{ SaveValidation() *models.Validation }).SaveValidation(); !v.Available {
+			r.Errorf("%s %s is not available", prefix, a.Name)
+		}
+	}
+	r.SetAvailable()
+}
+
+// BeforeSave validates the state of the Rule.
+func (r *Rule) BeforeSave() error {
+	r.Fill()
+	r.Validate()
+	if !r.Validated {
+		return r.MakeError(422, ValidationError, r)
+	}
+	return nil
+}
+
+// OnLoad initializes the Rule when loaded from the data store.
+func (r *Rule) OnLoad() error {
+	defer func() { r.rt = nil }()
+	r.Fill()
+	return r.BeforeSave()
+}
+
+var ruleLockMap = map[string][]string{
+	"get":     {"rules"},
+	"create":  {"stages", "workflows", "profiles", "params", "rules"},
+	"update":  {"stages", "workflows", "profiles", "params", "rules"},
+	"patch":   {"stages", "workflows", "profiles", "params", "rules"},
+	"delete":  {"rules"},
+	"actions": {"rules", "profiles", "params"},
+}
+
+// Locks returns the object lock list for a given action for the Rule object
+func (r *Rule) Locks(action string) []string {
+	return ruleLockMap[action]
+}
+
+// RuleActionRunner runs the action ma provided by a plugin on an
+// object of type prefix.  It is called without any locks held.
+type RuleActionRunner func(rt *RequestTracker, prefix string, ma *models.Action) (interface{}, error)
+
+// updateLocks returns the locks needed to update an object of type
+// prefix.
+func updateLocks(prefix string) []string {
+	ref, err := models.New(prefix)
+	if err != nil {
+		return []string{}
+	}
+	if l, ok := ModelToBackend(ref).(interface{ Locks(string) []string }); ok {
+		return l.Locks("update")
+	}
+	return []string{}
+}
+
+// ruleMatches returns true if the object of e matches the Condition
+// of r.
+func (p *DataTracker) ruleMatches(l logger.Logger, r *models.Rule, e *models.Event, obj models.Model) (bool, error) {
+	if r.Condition == "" {
+		return true, nil
+	}
+	if obj == nil {
+		return false, fmt.Errorf("event has no object to test the Condition against")
+	}
+	var res bool
+	var err error
+	rt := p.Request(l, updateLocks(e.Type)...)
+	rt.Do(func(d Stores) {
+		var filters []index.Filter
+		target := toBackend(obj, rt)
+		filters, err = rt.selectorFilters(target, r.Condition)
+		if err != nil {
+			return
+		}
+		var matched *index.Index
+		matched, err = index.All(filters...)(index.New([]models.Model{target}))
+		res = err == nil && matched.Count() > 0
+	})
+	return res, err
+}
+
+// ruleTarget returns the type and key of what the Actions of r are
+// performed on when it fires on e.
+func ruleTarget(r *models.Rule, e *models.Event, obj models.Model) (string, string, error) {
+	if r.Target != "machine" || e.Type == "machines" {
+		return e.Type, e.Key, nil
+	}
+	if job, ok := obj.(*models.Job); ok {
+		return "machines", job.Machine.String(), nil
+	}
+	return "", "", fmt.Errorf("event %s.%s.%s has no Machine", e.Type, e.Action, e.Key)
+}
+
+// ruleAction performs a on the object of type prefix with key key.
+// It returns false if a did not need to change anything.
+//
+// THIS MUST NOT BE CALLED UNDER LOCKS!
+func (p *DataTracker) ruleAction(l logger.Logger, r *models.Rule, a *models.RuleAction, e *models.Event, prefix, key string, runAction RuleActionRunner) (bool, error) {
+	switch a.Kind {
+	case "event":
+		rt := p.Request(l)
+		return true, rt.Publish("rules", a.Name, r.Name, map[string]interface{}{
+			"Rule":   r.Name,
+			"Event":  e,
+			"Params": a.Params,
+		})
+	}
+	if _, err := models.New(prefix); err != nil {
+		return false, fmt.Errorf("%s are not objects", prefix)
+	}
+	switch a.Kind {
+	case "plugin":
+		if runAction == nil {
+			return false, fmt.Errorf("plugin actions are not available")
+		}
+		rt := p.Request(l, updateLocks(prefix)...)
+		var obj models.Model
+		rt.Do(func(d Stores) {
+			obj = rt.Find(prefix, key)
+		})
+		if obj == nil {
+			return false, fmt.Errorf("%s %s does not exist", prefix, key)
+		}
+		params := map[string]interface{}{}
+		for k, v := range a.Params {
+			params[k] = v
+		}
+		_, err := runAction(rt, prefix, &models.Action{
+			Model:   obj,
+			Plugin:  a.Plugin,
+			Command: a.Name,
+			Params:  params,
+		})
+		return err == nil, err
+	}
+	changed := false
+	var err error
+	rt := p.Request(l, append(updateLocks(prefix), "jobs")...)
+	rt.Do(func(d Stores) {
+		obj := rt.find(prefix, key)
+		if obj == nil {
+			err = fmt.Errorf("%s %s does not exist", prefix, key)
+			return
+		}
+		switch a.Kind {
+		case "patch":
+			var after models.Model
+			after, err = rt.DryRunPatch(obj, key, a.Patch)
+			if err != nil {
+				return
+			}
+			if changes, _ := models.GenPatch(models.Clone(obj), after, false); len(changes) == 0 {
+				return
+			}
+			_, err = rt.Patch(obj, key, a.Patch)
+			changed = err == nil
+			return
+		case "profile":
+			profiler, ok := obj.(models.Profiler)
+			if !ok {
+				err = fmt.Errorf("%s do not have Profiles", prefix)
+				return
+			}
+			for _, name := range profiler.GetProfiles() {
+				if name == a.Name {
+					return
+				}
+			}
+			np := ModelToBackend(models.Clone(obj)).(models.Profiler)
+			np.SetProfiles(append(np.GetProfiles(), a.Name))
+			_, err = rt.Update(np)
+			changed = err == nil
+			return
+		}
+		m, ok := obj.(*Machine)
+		if !ok {
+			err = fmt.Errorf("%s %s is not a Machine", prefix, key)
+			return
+		}
+		nm := ModelToBackend(models.Clone(m)).(*Machine)
+		switch a.Kind {
+		case "stage":
+			if m.Stage == a.Name {
+				return
+			}
+			if m.Workflow != "" {
+				err = fmt.Errorf("machine is in workflow %s", m.Workflow)
+				return
+			}
+			nm.Stage = a.Name
+		case "workflow":
+			if m.Workflow == a.Name {
+				return
+			}
+			nm.Workflow = a.Name
+		}
+		nm.Runnable = true
+		_, err = rt.Update(nm)
+		changed = err == nil
+	})
+	return changed, err
+}
+
+// FireRule performs the Actions of r if the object of e matches its
+// Condition.  fired is true if r matched.  runAction is used for
+// plugin actions, and may be nil.
+//
+// THIS MUST NOT BE CALLED UNDER LOCKS!
+func (p *DataTracker) FireRule(l logger.Logger, r *models.Rule, e *models.Event, runAction RuleActionRunner) (fired bool, err error) {
+	obj, _ := e.Model()
+	if fired, err = p.ruleMatches(l, r, e, obj); !fired || err != nil {
+		return
+	}
+	prefix, key, err := ruleTarget(r, e, obj)
+	if err != nil {
+		return
+	}
+	for i := range r.Actions {
+		a := &r.Actions[i]
+		changed, aerr := p.ruleAction(l, r, a, e, prefix, key, runAction)
+		if aerr != nil {
+			return true, fmt.Errorf("Action %d (%s %s): %v", i, a.Kind, a.Name, aerr)
+		}
+		if changed {
+			l.Infof("Rule %s: %s %s on %s %s", r.Name, a.Kind, a.Name, prefix, key)
+		}
+	}
+	return
+}
+
+// ruleBurst is how many times a Rule may fire on the same object in
+// ruleBurstWindow before the rule engine stops firing it, which keeps
+// Rules whose Actions trigger themselves from looping forever.
+const (
+	ruleBurst       = 10
+	ruleBurstWindow = time.Minute
+)
+
+// ruleEngine is the Publisher that fires Rules as events come in.
+type ruleEngine struct {
+	dt        *DataTracker
+	l         logger.Logger
+	runAction RuleActionRunner
+	events    chan *models.Event
+	lock      sync.Mutex
+	fired     map[string][]time.Time
+}
+
+// Publish queues e for the rule engine.  Events are dropped if the
+// rule engine has fallen too far behind.
+func (re *ruleEngine) Publish(e *models.Event) error {
+	if e.Type == "log" || e.Type == "websocket" {
+		return nil
+	}
+	select {
+	case re.events <- e:
+	default:
+		re.l.NoPublish().Errorf("Rule engine is behind, dropping event %s.%s.%s", e.Type, e.Action, e.Key)
+	}
+	return nil
+}
+
+// The rule engine is never unloaded.
+func (re *ruleEngine) Reserve() error {
+	return nil
+}
+func (re *ruleEngine) Release() {}
+func (re *ruleEngine) Unload()  {}
+
+// allow records that r is about to fire on the object of e, and
+// returns false if it has fired on it too often lately.
+func (re *ruleEngine) allow(r *models.Rule, e *models.Event) bool {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	now := time.Now()
+	id := r.Name + "/" + e.Type + "/" + e.Key
+	recent := []time.Time{}
+	for _, t := range re.fired[id] {
+		if now.Sub(t) < ruleBurstWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= ruleBurst {
+		re.fired[id] = recent
+		return false
+	}
+	re.fired[id] = append(recent, now)
+	return true
+}
+
+// handle fires every Rule that matches e.
+func (re *ruleEngine) handle(e *models.Event) {
+	rules := []*models.Rule{}
+	rt := re.dt.Request(re.l, "rules")
+	rt.Do(func(d Stores) {
+		for _, ro := range d("rules").Items() {
+			r := AsRule(ro)
+			if !r.Disabled && r.Available && r.Matches(e) {
+				rules = append(rules, models.Clone(r.Rule).(*models.Rule))
+			}
+		}
+	})
+	for _, r := range rules {
+		if !re.allow(r, e) {
+			re.l.Errorf("Rule %s fired on %s %s too often, skipping event %s", r.Name, e.Type, e.Key, e.Action)
+			continue
+		}
+		if _, err := re.dt.FireRule(re.l, r, e, re.runAction); err != nil {
+			re.l.Errorf("Rule %s failed on %s.%s.%s: %v", r.Name, e.Type, e.Action, e.Key, err)
+		}
+	}
+}
+
+// StartRules subscribes the rule engine to the events of the
+// DataTracker, and fires Rules as they come in.  runAction is used
+// for plugin actions.
+func (p *DataTracker) StartRules(l logger.Logger, runAction RuleActionRunner) {
+	re := &ruleEngine{
+		dt:        p,
+		l:         l,
+		runAction: runAction,
+		events:    make(chan *models.Event, 1000),
+		fired:     map[string][]time.Time{},
+	}
+	p.publishers.Add(re)
+	go func() {
+		for e := range re.events {
+			re.handle(e)
+		}
+	}()
+}
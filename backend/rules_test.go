@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestRules(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows", "jobs", "rules")
+	m1, m2 := uuid.NewRandom(), uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Stage burnin", rt.Create, &models.Stage{Name: "burnin", BootEnv: "local"}, true},
+		{"Create Stage quarantine", rt.Create, &models.Stage{Name: "quarantine", BootEnv: "local"}, true},
+		{"Create Workflow quarantine", rt.Create, &models.Workflow{Name: "quarantine", Stages: []string{"quarantine"}}, true},
+		{"Create Profile acme", rt.Create, &models.Profile{Name: "acme"}, true},
+		{"Create Machine m1", rt.Create, &models.Machine{Uuid: m1, Name: "m1.example.com"}, true},
+		{"Create Machine m2 from acme", rt.Create, &models.Machine{Uuid: m2, Name: "m2.example.com", Meta: models.Meta{"vendor": "acme"}}, true},
+		{"Create Rule without Actions", rt.Create, &models.Rule{Name: "bad", Event: "machines.create.*"}, false},
+		{"Create Rule with a bad Event", rt.Create, &models.Rule{Name: "bad", Event: "machines.create", Actions: []models.RuleAction{{Kind: "profile", Name: "acme"}}}, false},
+		{"Create Rule with a Condition on a pattern type", rt.Create, &models.Rule{Name: "bad", Event: "*.create.*", Condition: "Name=Eq(m1)", Actions: []models.RuleAction{{Kind: "event", Name: "created"}}}, false},
+		{"Create Rule with a bad Condition", rt.Create, &models.Rule{Name: "bad", Event: "machines.create.*", Condition: "Bogus=Eq(1)", Actions: []models.RuleAction{{Kind: "profile", Name: "acme"}}}, false},
+		{"Create Rule moving a Job to a Workflow", rt.Create, &models.Rule{Name: "bad", Event: "jobs.update.*", Actions: []models.RuleAction{{Kind: "workflow", Name: "quarantine"}}}, false},
+		{"Create Rule adding a Profile to a Job", rt.Create, &models.Rule{Name: "bad", Event: "jobs.update.*", Actions: []models.RuleAction{{Kind: "profile", Name: "acme"}}}, false},
+		{"Create Rule targeting the machine of a Profile", rt.Create, &models.Rule{Name: "bad", Event: "profiles.*.*", Target: "machine", Actions: []models.RuleAction{{Kind: "profile", Name: "acme"}}}, false},
+		{"Create Rule with a missing Workflow", rt.Create, &models.Rule{Name: "missing", Event: "machines.create.*", Actions: []models.RuleAction{{Kind: "workflow", Name: "missing"}}}, true},
+		{"Create Rule quarantine", rt.Create, &models.Rule{
+			Name:      "quarantine",
+			Event:     "jobs.*.*",
+			Condition: "State=Eq(failed)&Stage=Eq(burnin)",
+			Target:    "machine",
+			Actions:   []models.RuleAction{{Kind: "workflow", Name: "quarantine"}},
+		}, true},
+		{"Create Rule acme", rt.Create, &models.Rule{
+			Name:      "acme",
+			Event:     "machines.create.*",
+			Condition: "Meta.vendor=Eq(acme)",
+			Actions:   []models.RuleAction{{Kind: "profile", Name: "acme"}},
+		}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	var quarantine, acme *models.Rule
+	var machine1, machine2 *models.Machine
+	rt.Do(func(d Stores) {
+		if AsRule(rt.Find("rules", "missing")).Available {
+			t.Errorf("Expected rule with a missing Workflow to not be available")
+		}
+		quarantine = AsRule(rt.Find("rules", "quarantine")).Rule
+		acme = AsRule(rt.Find("rules", "acme")).Rule
+		machine1 = AsMachine(rt.Find("machines", m1.String())).Machine
+		machine2 = AsMachine(rt.Find("machines", m2.String())).Machine
+	})
+	jobEvent := func(stage, state string) *models.Event {
+		return &models.Event{Type: "jobs", Action: "update", Key: "job", Object: &models.Job{
+			Uuid:    uuid.NewRandom(),
+			Machine: m1,
+			Stage:   stage,
+			State:   state,
+		}}
+	}
+	machineEvent := func(m *models.Machine) *models.Event {
+		return &models.Event{Type: "machines", Action: "create", Key: m.Key(), Object: m}
+	}
+	fires := []struct {
+		name  string
+		r     *models.Rule
+		e     *models.Event
+		fired bool
+	}{
+		{"quarantine on a finished job", quarantine, jobEvent("burnin", "finished"), false},
+		{"quarantine on a failed job in another stage", quarantine, jobEvent("quarantine", "failed"), false},
+		{"quarantine on a failed job in burnin", quarantine, jobEvent("burnin", "failed"), true},
+		{"acme on a machine from another vendor", acme, machineEvent(machine1), false},
+		{"acme on a machine from acme", acme, machineEvent(machine2), true},
+		{"acme again on a machine from acme", acme, machineEvent(machine2), true},
+	}
+	for _, test := range fires {
+		fired, err := dt.FireRule(dt.Logger, test.r, test.e, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if fired != test.fired {
+			t.Errorf("%s: expected fired to be %v, got %v", test.name, test.fired, fired)
+		}
+	}
+	rt.Do(func(d Stores) {
+		if m := AsMachine(rt.Find("machines", m1.String())); m.Workflow != "quarantine" || !m.Runnable {
+			t.Errorf("Expected m1 to be runnable in Workflow quarantine, not %q", m.Workflow)
+		}
+		if m := AsMachine(rt.Find("machines", m2.String())); len(m.Profiles) != 1 || m.Profiles[0] != "acme" {
+			t.Errorf("Expected m2 to have only Profile acme, not %v", m.Profiles)
+		}
+	})
+	re := &ruleEngine{fired: map[string][]time.Time{}}
+	e := machineEvent(machine2)
+	for i := 0; i < ruleBurst; i++ {
+		if !re.allow(acme, e) {
+			t.Fatalf("Expected acme to be allowed to fire %d times", ruleBurst)
+		}
+	}
+	if re.allow(acme, e) {
+		t.Errorf("Expected acme to not be allowed to fire more than %d times", ruleBurst)
+	}
+	if !re.allow(quarantine, e) {
+		t.Errorf("Expected quarantine to be allowed to fire on m2")
+	}
+}
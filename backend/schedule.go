@@ -0,0 +1,408 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/digitalrebar/store"
+	"github.com/pborman/uuid"
+)
+
+// Schedule is the backend model wrapper for Schedule.
+// This struct also includes validation helpers.
+type Schedule struct {
+	*models.Schedule
+	validate
+	// used to allow the scheduler to change NextRun and LastRun.
+	scheduleRun bool
+}
+
+// SetReadOnly is a helper function to set the ReadOnly flag.
+func (s *Schedule) SetReadOnly(b bool) {
+	s.ReadOnly = b
+}
+
+// SaveClean is a helper function to run the model version's
+// ClearValidation function before converting back to
+// an object that can be stored in the backend.
+func (s *Schedule) SaveClean() store.KeySaver {
+	mod := *s.Schedule
+	mod.ClearValidation()
+	return toBackend(&mod, s.rt)
+}
+
+// AsSchedule casts a models.Model interface to
+// *Schedule (helper function)
+func AsSchedule(o models.Model) *Schedule {
+	return o.(*Schedule)
+}
+
+// AsSchedules converts a list of models.Model to
+// a list of *Schedule (helper function)
+func AsSchedules(o []models.Model) []*Schedule {
+	res := make([]*Schedule, len(o))
+	for i := range o {
+		res[i] = AsSchedule(o[i])
+	}
+	return res
+}
+
+// New creates a new empty instance of Schedule.
+// The ForceChanged and RT fields are propogated.
+func (s *Schedule) New() store.KeySaver {
+	res := &Schedule{Schedule: &models.Schedule{}}
+	if s.Schedule != nil && s.ChangeForced() {
+		res.ForceChange()
+	}
+	res.rt = s.rt
+	res.Fill()
+	return res
+}
+
+// Indexes returns a map of the indexes allowed for
+// Schedule objects.
+func (s *Schedule) Indexes() map[string]index.Maker {
+	fix := AsSchedule
+	res := index.MakeBaseIndexes(s)
+	res["Name"] = index.Make(
+		true,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Name < fix(j).Name
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			name := fix(ref).Name
+			return func(s models.Model) bool {
+					return fix(s).Name >= name
+				},
+				func(s models.Model) bool {
+					return fix(s).Name > name
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(s.New())
+			res.Name = v
+			return res, nil
+		})
+	res["Workflow"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Workflow < fix(j).Workflow
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			wf := fix(ref).Workflow
+			return func(s models.Model) bool {
+					return fix(s).Workflow >= wf
+				},
+				func(s models.Model) bool {
+					return fix(s).Workflow > wf
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(s.New())
+			res.Workflow = v
+			return res, nil
+		})
+	res["Stage"] = index.Make(
+		false,
+		"string",
+		func(i, j models.Model) bool {
+			return fix(i).Stage < fix(j).Stage
+		},
+		func(ref models.Model) (gte, gt index.Test) {
+			stage := fix(ref).Stage
+			return func(s models.Model) bool {
+					return fix(s).Stage >= stage
+				},
+				func(s models.Model) bool {
+					return fix(s).Stage > stage
+				}
+		},
+		func(v string) (models.Model, error) {
+			res := fix(s.New())
+			res.Stage = v
+			return res, nil
+		})
+	return res
+}
+
+// Validate sets the valid and available flags for the Schedule.
+// This assumes that locks are held as appropriate, if needed.
+func (s *Schedule) Validate() {
+	s.Schedule.Validate()
+	s.AddError(index.CheckUnique(s, s.rt.stores("schedules").Items()))
+	if s.Selector != "" {
+		if _, err := s.rt.machineSelectorFilters(s.Selector); err != nil {
+			s.Errorf("Invalid Selector %s: %v", s.Selector, err)
+		}
+	}
+	if !s.SetValid() {
+		return
+	}
+	if s.Workflow != "" {
+		if wf := s.rt.find("workflows", s.Workflow); wf == nil {
+			s.Errorf("Workflow %s does not exist", s.Workflow)
+		} else if !AsWorkflow(wf).Available {
+			s.Errorf("Workflow %s is not available", s.Workflow)
+		}
+	}
+	if s.Stage != "" {
+		if st := s.rt.find("stages", s.Stage); st == nil {
+			s.Errorf("Stage %s does not exist", s.Stage)
+		} else if !AsStage(st).Available {
+			s.Errorf("Stage %s is not available", s.Stage)
+		}
+	}
+	s.SetAvailable()
+}
+
+// plan sets NextRun to the first time the Schedule fires after both
+// LastRun and the start of the window ending at now.
+func (s *Schedule) plan(now time.Time) {
+	if s.Disabled {
+		s.NextRun = time.Time{}
+		return
+	}
+	after := now.Add(-s.WindowLength())
+	if s.LastRun.After(after) {
+		after = s.LastRun
+	}
+	s.NextRun = s.Next(after)
+}
+
+// OnCreate works out when the new Schedule first fires.
+func (s *Schedule) OnCreate() error {
+	s.LastRun = time.Time{}
+	s.plan(time.Now())
+	return nil
+}
+
+// OnChange keeps NextRun and LastRun from being changed by anything
+// other than the scheduler, and works out when the Schedule next
+// fires.
+func (s *Schedule) OnChange(oldThing store.KeySaver) error {
+	if s.scheduleRun {
+		return nil
+	}
+	old := AsSchedule(oldThing)
+	s.LastRun = old.LastRun
+	s.plan(time.Now())
+	return nil
+}
+
+// BeforeSave validates the state of the Schedule.
+func (s *Schedule) BeforeSave() error {
+	s.Fill()
+	s.Validate()
+	if !s.Validated {
+		return s.MakeError(422, ValidationError, s)
+	}
+	return nil
+}
+
+// AfterSave clears the scheduler flag.
+func (s *Schedule) AfterSave() {
+	s.scheduleRun = false
+}
+
+// OnLoad initializes the Schedule when loaded from the data store.
+// NextRun is kept as it was saved, so firings that came due while
+// dr-provision was down are still run if their window is open.
+func (s *Schedule) OnLoad() error {
+	defer func() { s.rt = nil }()
+	s.Fill()
+	return s.BeforeSave()
+}
+
+var scheduleLockMap = map[string][]string{
+	"get":     {"schedules"},
+	"create":  {"stages", "workflows", "machines", "profiles", "params", "schedules"},
+	"update":  {"stages", "workflows", "machines", "profiles", "params", "schedules"},
+	"patch":   {"stages", "workflows", "machines", "profiles", "params", "schedules"},
+	"delete":  {"schedules"},
+	"actions": {"schedules", "profiles", "params"},
+}
+
+// Locks returns the object lock list for a given action for the Schedule object
+func (s *Schedule) Locks(action string) []string {
+	return scheduleLockMap[action]
+}
+
+// ScheduleLocks are the locks needed to fire Schedules.
+var ScheduleLocks = []string{"stages", "bootenvs", "machines", "jobs", "tasks", "profiles", "templates", "params", "workflows", "schedules"}
+
+// Targets returns the Machines the Schedule applies to, and the
+// UUIDs of listed Machines that do not exist.
+//
+// Assumes locks are held as appropriate.
+func (s *Schedule) Targets(rt *RequestTracker) ([]*Machine, []uuid.UUID, error) {
+	res := []*Machine{}
+	missing := []uuid.UUID{}
+	seen := map[string]bool{}
+	for _, id := range s.Machines {
+		mo := rt.find("machines", id.String())
+		if mo == nil {
+			missing = append(missing, id)
+			continue
+		}
+		if !seen[mo.Key()] {
+			seen[mo.Key()] = true
+			res = append(res, AsMachine(mo))
+		}
+	}
+	if s.Selector == "" {
+		return res, missing, nil
+	}
+	filters, err := rt.machineSelectorFilters(s.Selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	selected, err := index.All(filters...)(index.New(rt.stores("machines").Items()))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, mo := range selected.Items() {
+		if !seen[mo.Key()] {
+			seen[mo.Key()] = true
+			res = append(res, AsMachine(mo))
+		}
+	}
+	return res, missing, nil
+}
+
+// machineBusy returns why m should not be moved by a Schedule, or
+// the empty string if it can be.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) machineBusy(m *Machine) string {
+	if m.Paused {
+		return "machine is paused"
+	}
+	if m.Locked {
+		return fmt.Sprintf("machine is locked by %s (%s)", m.LockOwner, m.LockReason)
+	}
+	if m.Pool != "" {
+		return fmt.Sprintf("machine is allocated from pool %s", m.Pool)
+	}
+	for _, id := range m.currentJobs() {
+		if jo := rt.find("jobs", id.String()); jo != nil {
+			switch job := AsJob(jo); job.State {
+			case "created", "running", "incomplete":
+				return fmt.Sprintf("machine is running job %s (%s)", job.UUID(), job.State)
+			}
+		}
+	}
+	if m.Runnable && len(m.Tasks) > 0 && m.CurrentTask < len(m.Tasks) {
+		return "machine has tasks left to run"
+	}
+	return ""
+}
+
+// scheduleMachine switches m to the Workflow or Stage of s.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) scheduleMachine(s *Schedule, m *Machine) error {
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.Runnable = true
+	if s.Workflow != "" {
+		nm.Workflow = s.Workflow
+		nm.restartWorkflow = true
+	} else {
+		if nm.Workflow != "" {
+			return fmt.Errorf("machine is in workflow %s", nm.Workflow)
+		}
+		nm.Stage = s.Stage
+		nm.CurrentTask = -1
+	}
+	_, err := rt.Update(nm)
+	return err
+}
+
+// FireSchedule switches the Machines of s that are not busy to the
+// Workflow or Stage of s.  A fire event is published for s, and a
+// skip event if any Machines were left alone.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) FireSchedule(s *Schedule, at time.Time) (*models.ScheduleRun, error) {
+	run := &models.ScheduleRun{Schedule: s.Name, Time: at, Moved: []uuid.UUID{}, Skipped: []models.ScheduleSkip{}}
+	machines, missing, err := s.Targets(rt)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range missing {
+		run.Skipped = append(run.Skipped, models.ScheduleSkip{Machine: id, Reason: "machine does not exist"})
+	}
+	for _, m := range machines {
+		reason := rt.machineBusy(m)
+		if reason == "" {
+			if err := rt.scheduleMachine(s, m); err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason != "" {
+			rt.Infof("Schedule %s skipped machine %s: %s", s.Name, m.UUID(), reason)
+			run.Skipped = append(run.Skipped, models.ScheduleSkip{Machine: m.Uuid, Reason: reason})
+			continue
+		}
+		run.Moved = append(run.Moved, m.Uuid)
+	}
+	rt.Infof("Schedule %s fired: %d machines moved, %d skipped", s.Name, len(run.Moved), len(run.Skipped))
+	rt.Publish("schedules", "fire", s.Key(), run)
+	if len(run.Skipped) > 0 {
+		rt.Publish("schedules", "skip", s.Key(), run)
+	}
+	return run, nil
+}
+
+// RunSchedules fires every Schedule that has come due.  Schedules
+// whose window has closed, for example because dr-provision was down,
+// are not fired, and a miss event is published for them instead.
+func (p *DataTracker) RunSchedules(l logger.Logger) {
+	rt := p.Request(l, ScheduleLocks...)
+	now := time.Now()
+	rt.Do(func(d Stores) {
+		for _, so := range d("schedules").Items() {
+			s := AsSchedule(so)
+			if s.Disabled || s.NextRun.IsZero() || s.NextRun.After(now) {
+				continue
+			}
+			ns := ModelToBackend(models.Clone(s)).(*Schedule)
+			ns.scheduleRun = true
+			if now.Sub(s.NextRun) > s.WindowLength() {
+				rt.Infof("Schedule %s missed its window at %s", s.Name, s.NextRun)
+				rt.Publish("schedules", "miss", s.Key(), &models.ScheduleRun{
+					Schedule: s.Name,
+					Time:     s.NextRun,
+					Moved:    []uuid.UUID{},
+					Skipped:  []models.ScheduleSkip{},
+				})
+			} else if !s.Available {
+				// Wait for the Schedule to become available, or
+				// for its window to close.
+				continue
+			} else {
+				if _, err := rt.FireSchedule(s, s.NextRun); err != nil {
+					rt.Errorf("Unable to fire schedule %s: %v", s.Name, err)
+				}
+				ns.LastRun = s.NextRun
+			}
+			ns.plan(now)
+			if _, err := rt.Update(ns); err != nil {
+				rt.Errorf("Unable to update schedule %s: %v", s.Name, err)
+			}
+		}
+	})
+}
+
+// StartScheduler runs RunSchedules every interval in the background.
+func (p *DataTracker) StartScheduler(l logger.Logger, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			p.RunSchedules(l)
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestScheduleNext(t *testing.T) {
+	start := time.Date(2018, time.January, 15, 2, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s        models.Schedule
+		after    time.Time
+		expected time.Time
+	}{
+		{models.Schedule{Start: start}, start.Add(-time.Minute), start},
+		{models.Schedule{Start: start}, start, time.Time{}},
+		{models.Schedule{Start: start, Every: 6, Unit: "hours"}, start.Add(13 * time.Hour), start.Add(18 * time.Hour)},
+		{models.Schedule{Start: start, Every: 2, Unit: "weeks"}, start.AddDate(0, 0, 15), start.AddDate(0, 0, 28)},
+		{models.Schedule{Start: start, Every: 1, Unit: "months"}, start.AddDate(1, 0, 0), start.AddDate(1, 1, 0)},
+		{models.Schedule{Start: start, Every: 1, Unit: "days"}, start.AddDate(0, 0, 400).Add(-time.Second), start.AddDate(0, 0, 400)},
+	}
+	for _, test := range tests {
+		if got := test.s.Next(test.after); !got.Equal(test.expected) {
+			t.Errorf("Every %d %s after %s: expected %s, got %s", test.s.Every, test.s.Unit, test.after, test.expected, got)
+		}
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, ScheduleLocks...)
+	m1, m2, m3 := uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()
+	start := time.Now().Add(-10 * time.Minute).Round(time.Second)
+	lateStart := start.Add(-3 * time.Hour)
+	tests := []crudTest{
+		{"Create Stage fw", rt.Create, &models.Stage{Name: "fw", BootEnv: "local"}, true},
+		{"Create Workflow fw", rt.Create, &models.Workflow{Name: "fw", Stages: []string{"fw"}}, true},
+		{"Create Machine m1 in dc2", rt.Create, &models.Machine{Uuid: m1, Name: "m1.dc2", Meta: models.Meta{"site": "dc2"}}, true},
+		{"Create Machine m2 in dc2", rt.Create, &models.Machine{Uuid: m2, Name: "m2.dc2", Meta: models.Meta{"site": "dc2"}}, true},
+		{"Create Machine m3 in dc3", rt.Create, &models.Machine{Uuid: m3, Name: "m3.dc3", Meta: models.Meta{"site": "dc3"}}, true},
+		{"Create Schedule without a target", rt.Create, &models.Schedule{Name: "bad", Workflow: "fw", Start: start}, false},
+		{"Create Schedule without a Workflow or Stage", rt.Create, &models.Schedule{Name: "bad", Machines: []uuid.UUID{m1}, Start: start}, false},
+		{"Create Schedule with a Workflow and a Stage", rt.Create, &models.Schedule{Name: "bad", Machines: []uuid.UUID{m1}, Workflow: "fw", Stage: "fw", Start: start}, false},
+		{"Create Schedule with a bad Unit", rt.Create, &models.Schedule{Name: "bad", Machines: []uuid.UUID{m1}, Workflow: "fw", Start: start, Every: 1, Unit: "fortnights"}, false},
+		{"Create Schedule with a bad Selector", rt.Create, &models.Schedule{Name: "bad", Selector: "Bogus=Eq(1)", Workflow: "fw", Start: start}, false},
+		{"Create Schedule with missing Workflow", rt.Create, &models.Schedule{Name: "missing", Machines: []uuid.UUID{m1}, Workflow: "missing", Start: start}, true},
+		{"Create Schedule monthly", rt.Create, &models.Schedule{Name: "monthly", Selector: "Meta.site=Eq(dc2)", Workflow: "fw", Start: start, Every: 1, Unit: "months"}, true},
+		{"Create Schedule late", rt.Create, &models.Schedule{Name: "late", Machines: []uuid.UUID{m3}, Workflow: "fw", Start: lateStart, Every: 1, Unit: "days"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		if AsSchedule(rt.Find("schedules", "missing")).Available {
+			t.Errorf("Expected schedule with a missing Workflow to not be available")
+		}
+		if s := AsSchedule(rt.Find("schedules", "monthly")); !s.NextRun.Equal(start) {
+			t.Errorf("Expected schedule in its window to be due at %s, not %s", start, s.NextRun)
+		}
+		if _, err := rt.PauseMachine(AsMachine(rt.Find("machines", m2.String()))); err != nil {
+			t.Fatalf("Failed to pause m2: %v", err)
+		}
+		// Pretend late came due while dr-provision was down, and
+		// its window has closed since.
+		AsSchedule(rt.find("schedules", "late")).NextRun = lateStart
+	})
+	dt.RunSchedules(dt.Logger)
+	rt.Do(func(d Stores) {
+		if m := AsMachine(rt.Find("machines", m1.String())); m.Workflow != "fw" {
+			t.Errorf("Expected m1 to be moved to the fw Workflow, not %q", m.Workflow)
+		}
+		if m := AsMachine(rt.Find("machines", m2.String())); m.Workflow != "" {
+			t.Errorf("Expected paused m2 to be skipped, but it is in %q", m.Workflow)
+		}
+		if m := AsMachine(rt.Find("machines", m3.String())); m.Workflow != "" {
+			t.Errorf("Expected m3 to be left alone by a missed schedule, but it is in %q", m.Workflow)
+		}
+		s := AsSchedule(rt.Find("schedules", "monthly"))
+		if !s.LastRun.Equal(start) || !s.NextRun.Equal(start.AddDate(0, 1, 0)) {
+			t.Errorf("Expected monthly to have run at %s and be due next month, not %s/%s", start, s.LastRun, s.NextRun)
+		}
+		s = AsSchedule(rt.Find("schedules", "late"))
+		if !s.LastRun.IsZero() || !s.NextRun.Equal(lateStart.AddDate(0, 0, 1)) {
+			t.Errorf("Expected late to not have run and be due tomorrow, not %s/%s", s.LastRun, s.NextRun)
+		}
+	})
+	patch := &models.Schedule{}
+	rt.Do(func(d Stores) {
+		*patch = *AsSchedule(rt.Find("schedules", "monthly")).Schedule
+	})
+	patch.Disabled = true
+	patch.NextRun = time.Now()
+	crudTest{"Disable Schedule monthly", rt.Update, patch, true}.Test(t, rt)
+	rt.Do(func(d Stores) {
+		if s := AsSchedule(rt.Find("schedules", "monthly")); !s.NextRun.IsZero() || !s.LastRun.Equal(start) {
+			t.Errorf("Expected disabled schedule to keep LastRun and have no NextRun, not %s/%s", s.LastRun, s.NextRun)
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// SecretStore resolves SecretRefs against an external secret store
+// that speaks the HashiCorp Vault KV API over HTTP.  Both version 1
+// and version 2 KV mounts are supported.  Secrets are cached for TTL
+// after they are fetched.
+type SecretStore struct {
+	// URL is the base URL of the secret store API, such as
+	// https://vault.example.com:8200/v1
+	URL string
+	// Token is sent as the X-Vault-Token header on every request.
+	Token string
+	// TTL is how long a fetched secret is cached for.
+	TTL time.Duration
+	// Prefix is the path in the secret store that SecretRefs must
+	// be under.  If empty, SecretRefs can refer to any path.
+	Prefix string
+
+	client   *http.Client
+	mux      *sync.Mutex
+	cache    map[string]*cachedSecret
+	inflight map[string]*secretFetch
+}
+
+type cachedSecret struct {
+	data    map[string]interface{}
+	expires time.Time
+}
+
+type secretFetch struct {
+	done chan struct{}
+	data map[string]interface{}
+	err  error
+}
+
+// NewSecretStore creates a SecretStore that talks to the secret store
+// at url, authenticating with token.
+func NewSecretStore(url, token string, ttl time.Duration) *SecretStore {
+	return &SecretStore{
+		URL:      strings.TrimRight(url, "/"),
+		Token:    token,
+		TTL:      ttl,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		mux:      &sync.Mutex{},
+		cache:    map[string]*cachedSecret{},
+		inflight: map[string]*secretFetch{},
+	}
+}
+
+// secretRefFor returns the SecretRef held in v, if v is a
+// SecretValue.  Only values whose sole key is SecretRef count, so
+// ordinary object values are left alone.
+func secretRefFor(v interface{}) (*models.SecretRef, bool) {
+	if v == nil {
+		return nil, false
+	}
+	fields := map[string]interface{}{}
+	if err := models.Remarshal(v, &fields); err != nil {
+		return nil, false
+	}
+	if _, ok := fields["SecretRef"]; !ok || len(fields) != 1 {
+		return nil, false
+	}
+	res := &models.SecretValue{}
+	if err := models.Remarshal(fields, res); err != nil || res.SecretRef == nil || res.SecretRef.Path == "" {
+		return nil, false
+	}
+	return res.SecretRef, true
+}
+
+// ContainsSecretRef returns true if v, or any value nested in it, is
+// a SecretValue.
+func ContainsSecretRef(v interface{}) bool {
+	if _, ok := secretRefFor(v); ok {
+		return true
+	}
+	var val interface{}
+	if err := models.Remarshal(v, &val); err != nil {
+		return false
+	}
+	switch val := val.(type) {
+	case map[string]interface{}:
+		for _, sub := range val {
+			if ContainsSecretRef(sub) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, sub := range val {
+			if ContainsSecretRef(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *SecretStore) fetch(path string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", s.URL+"/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Secret %s: secret store returned %s", path, resp.Status)
+	}
+	body := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Secret %s: %v", path, err)
+	}
+	if body.Data == nil {
+		return nil, fmt.Errorf("Secret %s: no data", path)
+	}
+	// KV version 2 nests the secret and its metadata in data.
+	if inner, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, ok := body.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return body.Data, nil
+}
+
+// lookup returns the cached data for path, fetching it if it is
+// missing or stale.  The cache lock is not held during the fetch, so
+// a slow secret store does not hold up lookups of other paths;
+// concurrent lookups of the same path wait for a single fetch.
+func (s *SecretStore) lookup(path string) (map[string]interface{}, error) {
+	s.mux.Lock()
+	cached, ok := s.cache[path]
+	if ok && time.Now().Before(cached.expires) {
+		s.mux.Unlock()
+		return cached.data, nil
+	}
+	if f, ok := s.inflight[path]; ok {
+		s.mux.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+	f := &secretFetch{done: make(chan struct{})}
+	s.inflight[path] = f
+	s.mux.Unlock()
+	f.data, f.err = s.fetch(path)
+	s.mux.Lock()
+	delete(s.inflight, path)
+	if f.err == nil {
+		s.cache[path] = &cachedSecret{data: f.data, expires: time.Now().Add(s.TTL)}
+	}
+	s.mux.Unlock()
+	close(f.done)
+	return f.data, f.err
+}
+
+// Check returns an error if ref refers to a path outside of Prefix.
+func (s *SecretStore) Check(ref *models.SecretRef) error {
+	prefix := strings.Trim(s.Prefix, "/")
+	if prefix == "" {
+		return nil
+	}
+	p := strings.Trim(ref.Path, "/")
+	if path.Clean(p) != p || (p != prefix && !strings.HasPrefix(p, prefix+"/")) {
+		return fmt.Errorf("Secret %s is not under %s", ref.Path, s.Prefix)
+	}
+	return nil
+}
+
+// Get resolves ref to the value it refers to.
+func (s *SecretStore) Get(ref *models.SecretRef) (interface{}, error) {
+	if err := s.Check(ref); err != nil {
+		return nil, err
+	}
+	data, err := s.lookup(ref.Path)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Field == "" {
+		res := map[string]interface{}{}
+		for k, v := range data {
+			res[k] = v
+		}
+		return res, nil
+	}
+	res, ok := data[ref.Field]
+	if !ok {
+		return nil, fmt.Errorf("Secret %s has no field %s", ref.Path, ref.Field)
+	}
+	return res, nil
+}
+
+// resolveSecretRef looks up the value ref refers to in the external
+// secret store.
+func (rt *RequestTracker) resolveSecretRef(ref *models.SecretRef) (interface{}, error) {
+	if rt.dt.ExternalSecrets == nil {
+		return nil, fmt.Errorf("Secret %s: no external secret store configured", ref.Path)
+	}
+	return rt.dt.ExternalSecrets.Get(ref)
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+func fakeKV(hits *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		*hits++
+		var body interface{}
+		switch r.URL.Path {
+		case "/v1/kv/db":
+			body = map[string]interface{}{
+				"data": map[string]interface{}{"password": "v1pass"},
+			}
+		case "/v1/secret/data/db":
+			body = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"password": "v2pass", "user": "admin"},
+					"metadata": map[string]interface{}{"version": 3},
+				},
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+}
+
+func TestSecretStore(t *testing.T) {
+	hits := 0
+	srv := fakeKV(&hits)
+	defer srv.Close()
+	ss := NewSecretStore(srv.URL+"/v1/", "s.token", time.Hour)
+	if v, err := ss.Get(&models.SecretRef{Path: "kv/db", Field: "password"}); err != nil || v != "v1pass" {
+		t.Errorf("Expected v1pass from KV v1 secret, got %v: %v", v, err)
+	}
+	if v, err := ss.Get(&models.SecretRef{Path: "secret/data/db", Field: "password"}); err != nil || v != "v2pass" {
+		t.Errorf("Expected v2pass from KV v2 secret, got %v: %v", v, err)
+	}
+	if v, err := ss.Get(&models.SecretRef{Path: "secret/data/db"}); err != nil || v.(map[string]interface{})["user"] != "admin" {
+		t.Errorf("Expected whole KV v2 secret, got %v: %v", v, err)
+	}
+	if hits != 2 {
+		t.Errorf("Expected cached secrets to be reused, but the store was hit %d times", hits)
+	}
+	if _, err := ss.Get(&models.SecretRef{Path: "secret/data/db", Field: "missing"}); err == nil {
+		t.Errorf("Expected an error fetching a missing field")
+	}
+	if _, err := ss.Get(&models.SecretRef{Path: "secret/data/nope"}); err == nil {
+		t.Errorf("Expected an error fetching a missing secret")
+	}
+	short := NewSecretStore(srv.URL+"/v1", "s.token", 0)
+	short.Get(&models.SecretRef{Path: "kv/db", Field: "password"})
+	short.Get(&models.SecretRef{Path: "kv/db", Field: "password"})
+	if hits != 5 {
+		t.Errorf("Expected expired secrets to be refetched, but the store was hit %d times", hits)
+	}
+	bad := NewSecretStore(srv.URL+"/v1", "wrong", time.Hour)
+	if _, err := bad.Get(&models.SecretRef{Path: "kv/db"}); err == nil {
+		t.Errorf("Expected an error with a bad token")
+	}
+	ss.Prefix = "secret/data/"
+	if _, err := ss.Get(&models.SecretRef{Path: "kv/db", Field: "password"}); err == nil {
+		t.Errorf("Expected an error fetching a secret outside of the prefix")
+	}
+	if _, err := ss.Get(&models.SecretRef{Path: "secret/data/../../kv/db", Field: "password"}); err == nil {
+		t.Errorf("Expected an error fetching a secret that escapes the prefix")
+	}
+	if v, err := ss.Get(&models.SecretRef{Path: "secret/data/db", Field: "password"}); err != nil || v != "v2pass" {
+		t.Errorf("Expected v2pass from a secret under the prefix, got %v: %v", v, err)
+	}
+}
+
+func TestSecretStoreParams(t *testing.T) {
+	hits := 0
+	srv := fakeKV(&hits)
+	defer srv.Close()
+	dt := mkDT(nil)
+	dt.ExternalSecrets = NewSecretStore(srv.URL+"/v1", "s.token", time.Hour)
+	rt := dt.Request(dt.Logger, "stages", "profiles", "params", "machines")
+	tests := []crudTest{
+		{"Create secure param", rt.Create, &models.Param{Name: "db-password", Secure: true, Schema: map[string]interface{}{"type": "string"}}, true},
+		{"Create profile with secret ref", rt.Create, &models.Profile{
+			Name:   "external",
+			Params: map[string]interface{}{"db-password": &models.SecretValue{SecretRef: &models.SecretRef{Path: "secret/data/db", Field: "password"}}},
+		}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		p := rt.Find("profiles", "external").(*Profile)
+		if v, _ := rt.GetParam(p, "db-password", false, true); v != "v2pass" {
+			t.Errorf("Expected secret ref to resolve to v2pass, not %v", v)
+		}
+		if v, _ := rt.GetParam(p, "db-password", false, false); v == "v2pass" {
+			t.Errorf("Expected secret ref not to be resolved unless decrypting")
+		}
+	})
+	dt.ExternalSecrets.Prefix = "secret/data/app"
+	tests = []crudTest{
+		{"Create profile with secret ref outside the prefix", rt.Create, &models.Profile{
+			Name:   "outside",
+			Params: map[string]interface{}{"db-password": &models.SecretValue{SecretRef: &models.SecretRef{Path: "secret/data/db", Field: "password"}}},
+		}, false},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+}
+
+func TestSecretRefFor(t *testing.T) {
+	if _, ok := secretRefFor(map[string]interface{}{"Path": "/srv/data", "Field": "x"}); ok {
+		t.Errorf("Expected a plain object with a Path not to be a secret ref")
+	}
+	if _, ok := secretRefFor(map[string]interface{}{"SecretRef": map[string]interface{}{"Path": "kv/db"}, "Other": 1}); ok {
+		t.Errorf("Expected an object with keys besides SecretRef not to be a secret ref")
+	}
+	if ref, ok := secretRefFor(&models.SecretValue{SecretRef: &models.SecretRef{Path: "kv/db"}}); !ok || ref.Path != "kv/db" {
+		t.Errorf("Expected a SecretValue to be a secret ref, got %v", ref)
+	}
+	nested := map[string]interface{}{"db": map[string]interface{}{"password": &models.SecretValue{SecretRef: &models.SecretRef{Path: "kv/db"}}}}
+	if !ContainsSecretRef(nested) {
+		t.Errorf("Expected a nested SecretValue to be found")
+	}
+	if ContainsSecretRef(map[string]interface{}{"db": []interface{}{"kv/db"}}) {
+		t.Errorf("Expected plain values not to contain a secret ref")
+	}
+}
@@ -33,12 +33,18 @@ func (s *Stage) SaveClean() store.KeySaver {
 	return toBackend(&mod, s.rt)
 }
 
-// HasTask returns true if the task name is in the Tasks list.
+// HasTask returns true if the task name is in the Tasks list,
+// either directly or as a member of a task group.
 func (s *Stage) HasTask(ts string) bool {
 	for _, p := range s.Tasks {
 		if p == ts {
 			return true
 		}
+		for _, member := range models.TaskGroupMembers(p) {
+			if member == ts {
+				return true
+			}
+		}
 	}
 	return false
 }
@@ -162,6 +168,14 @@ func (s *Stage) Validate() {
 	s.renderers = renderers{}
 	// First, the stuff that must be correct in order for
 	for _, taskName := range s.Tasks {
+		if members := models.TaskGroupMembers(taskName); members != nil {
+			for _, member := range members {
+				if s.rt.find("tasks", member) == nil {
+					s.Errorf("Task %s in %s does not exist", member, taskName)
+				}
+			}
+			continue
+		}
 		if s.rt.find("tasks", taskName) == nil {
 			s.Errorf("Task %s does not exist", taskName)
 		}
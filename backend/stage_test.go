@@ -71,3 +71,88 @@ func TestStageCrud(t *testing.T) {
 		test.Test(t, rt)
 	}
 }
+
+func TestStageTaskGroups(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	machineUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Task fw-bmc", rt.Create, &models.Task{Name: "fw-bmc"}, true},
+		{"Create Task fw-nic", rt.Create, &models.Task{Name: "fw-nic"}, true},
+		{"Create Stage with repeated group member", rt.Create, &models.Stage{Name: "twice", BootEnv: "local", Tasks: []string{"group:fw-bmc,fw-bmc"}}, false},
+		{"Create Stage with bad group member", rt.Create, &models.Stage{Name: "bad", BootEnv: "local", Tasks: []string{"group:fw-bmc,fw/nic"}}, false},
+		{"Create Stage with missing group member", rt.Create, &models.Stage{Name: "missing", BootEnv: "local", Tasks: []string{"group:fw-bmc,fw-raid"}}, true},
+		{"Create Stage with task group", rt.Create, &models.Stage{Name: "firmware", BootEnv: "local", Tasks: []string{"group:fw-bmc,fw-nic"}}, true},
+		{"Create Machine in Stage with task group", rt.Create, &models.Machine{Uuid: machineUUID, Name: "group.example.com", Stage: "firmware"}, true},
+		{"Remove Task in a task group", rt.Remove, &models.Task{Name: "fw-nic"}, false},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		if s := AsStage(rt.Find("stages", "missing")); s.Available {
+			t.Errorf("Expected Stage with a missing group member to be unavailable")
+		}
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		if len(m.Tasks) != 1 || m.Tasks[0] != "group:fw-bmc,fw-nic" {
+			t.Fatalf("Expected Machine to have the task group, not %v", m.Tasks)
+		}
+		updateMachine := func(jobs ...uuid.UUID) {
+			m.InRunner()
+			m.CurrentTask = 0
+			m.CurrentJobs = append(m.CurrentJobs, jobs...)
+			if _, err := rt.Update(m); err != nil {
+				t.Fatalf("Failed to update Machine: %v", err)
+			}
+			m = AsMachine(rt.Find("machines", machineUUID.String()))
+		}
+		setState := func(id uuid.UUID, state string) {
+			j := AsJob(rt.Find("jobs", id.String()))
+			j.State = state
+			if _, err := rt.Update(j); err != nil {
+				t.Fatalf("Failed to set Job %s to %s: %v", id, state, err)
+			}
+		}
+		updateMachine()
+		if j, more := m.TaskGroupJob(rt); j != nil || !more {
+			t.Errorf("Expected a group with no Jobs to need more, got %v, %v", j, more)
+		}
+		jobs := []uuid.UUID{}
+		for _, task := range []string{"fw-bmc", "fw-nic"} {
+			j := &models.Job{
+				Uuid:     uuid.NewRandom(),
+				Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+				Machine:  machineUUID,
+				Task:     task,
+				Stage:    "firmware",
+				State:    "created",
+			}
+			if ok, err := rt.Create(j); !ok {
+				t.Fatalf("Failed to create Job for %s: %v", task, err)
+			}
+			updateMachine(j.Uuid)
+			jobs = append(jobs, j.Uuid)
+			if len(m.CurrentJobs) == 1 {
+				if gj, more := m.TaskGroupJob(rt); gj != nil || !more {
+					t.Errorf("Expected a partly started group to need more, got %v, %v", gj, more)
+				}
+			}
+		}
+		setState(jobs[0], "finished")
+		if gj, more := m.TaskGroupJob(rt); more || gj == nil || !uuid.Equal(gj.Uuid, jobs[1]) || gj.State != "created" {
+			t.Errorf("Expected the group to be waiting on fw-nic, got %v, %v", gj, more)
+		}
+		setState(jobs[1], "failed")
+		if gj, _ := m.TaskGroupJob(rt); gj == nil || !uuid.Equal(gj.Uuid, jobs[1]) || gj.State != "failed" {
+			t.Errorf("Expected the group to have failed with fw-nic, got %v", gj)
+		}
+		setState(jobs[1], "finished")
+		if gj, more := m.TaskGroupJob(rt); more || gj == nil || gj.State != "finished" {
+			t.Errorf("Expected the group to be finished, got %v, %v", gj, more)
+		}
+		rt.RetireJobs(m.CurrentJobs, m.CurrentJobs[1:])
+		if AsJob(rt.Find("jobs", jobs[0].String())).Current || !AsJob(rt.Find("jobs", jobs[1].String())).Current {
+			t.Errorf("Expected only the retired Job to no longer be current")
+		}
+	})
+}
@@ -2,8 +2,12 @@ package backend
 
 import (
 	"testing"
+	"time"
 
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/backend/index"
 	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
 )
 
 func TestTaskCrud(t *testing.T) {
@@ -64,3 +68,213 @@ func TestTaskCrud(t *testing.T) {
 		}
 	*/
 }
+
+func TestTaskRetry(t *testing.T) {
+	backoff := &models.TaskRetry{MaxAttempts: 5, Backoff: 10, MaxBackoff: 30}
+	for attempt, want := range []time.Duration{10 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if got := backoff.Delay(attempt); got != want {
+			t.Errorf("Expected retry after attempt %d to wait %s, not %s", attempt, want, got)
+		}
+	}
+	codes := &models.TaskRetry{MaxAttempts: 3, ExitCodes: []int{7}}
+	if codes.Retryable(&models.Job{State: "failed", Attempt: 1, ExitCode: 1}) {
+		t.Errorf("Expected exit code 1 not to be retryable")
+	}
+	if !codes.Retryable(&models.Job{State: "failed", Attempt: 1, ExitCode: 7}) {
+		t.Errorf("Expected exit code 7 to be retryable")
+	}
+	if codes.Retryable(&models.Job{State: "failed", Attempt: 3, ExitCode: 7}) {
+		t.Errorf("Expected the last attempt not to be retryable")
+	}
+
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	machineUUID := uuid.NewRandom()
+	firstJob := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Task with bad retry policy", rt.Create, &models.Task{Name: "bad", Retry: models.TaskRetry{MaxAttempts: -1}}, false},
+		{"Create Task with bad retry ExitState", rt.Create, &models.Task{Name: "bad", Retry: models.TaskRetry{ExitStates: []string{"sad"}}}, false},
+		{"Create Task with retry policy", rt.Create, &models.Task{Name: "flaky", Retry: models.TaskRetry{MaxAttempts: 2}}, true},
+		{"Create Stage running flaky Task", rt.Create, &models.Stage{Name: "flaky", BootEnv: "local", Tasks: []string{"flaky"}}, true},
+		{"Create Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "flaky.example.com", Stage: "flaky"}, true},
+		{"Create first Job", rt.Create, &models.Job{
+			Uuid:     firstJob,
+			Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+			Machine:  machineUUID,
+			Task:     "flaky",
+			Stage:    "flaky",
+			State:    "created",
+		}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	fail := func(id uuid.UUID) {
+		rt.Do(func(d Stores) {
+			j := models.Clone(rt.Find("jobs", id.String())).(*models.Job)
+			j.State = "failed"
+			if _, err := rt.Update(j); err != nil {
+				t.Fatalf("Failed to fail job %s: %v", id, err)
+			}
+		})
+	}
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		m.InRunner()
+		m.CurrentTask = 0
+		m.CurrentJob = firstJob
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Failed to start machine on job %s: %v", firstJob, err)
+		}
+		if j := AsJob(rt.Find("jobs", firstJob.String())); j.Attempt != 1 {
+			t.Errorf("Expected first Job to be attempt 1, not %d", j.Attempt)
+		}
+	})
+	fail(firstJob)
+	var retried *Job
+	for i := 0; i < 50 && retried == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		rt.Do(func(d Stores) {
+			m := AsMachine(rt.Find("machines", machineUUID.String()))
+			if !uuid.Equal(m.CurrentJob, firstJob) {
+				retried = AsJob(rt.Find("jobs", m.CurrentJob.String()))
+				if !m.Runnable {
+					t.Errorf("Expected machine to be runnable for the retry")
+				}
+			}
+		})
+	}
+	if retried == nil {
+		t.Fatalf("Failed job was not retried")
+	}
+	if retried.State != "created" || retried.Attempt != 2 || retried.Task != "flaky" {
+		t.Errorf("Expected a created attempt 2 of flaky, got %s attempt %d of %s", retried.State, retried.Attempt, retried.Task)
+	}
+	fail(retried.Uuid)
+	rt.Do(func(d Stores) {
+		if m := AsMachine(rt.Find("machines", machineUUID.String())); m.Runnable {
+			t.Errorf("Expected machine not to be runnable after the last attempt failed")
+		}
+		if j := AsJob(rt.Find("jobs", firstJob.String())); !j.RetryAt.IsZero() {
+			t.Errorf("Expected the retried job not to be waiting for a retry, got %s", j.RetryAt)
+		}
+		if j := AsJob(rt.Find("jobs", retried.UUID())); !j.RetryAt.IsZero() {
+			t.Errorf("Expected the last attempt not to be waiting for a retry, got %s", j.RetryAt)
+		}
+		// Pretend dr-provision stopped while the first job was waiting
+		// to be retried.
+		j := AsJob(rt.Find("jobs", firstJob.String()))
+		j.RetryAt = time.Now()
+		if _, err := rt.Update(j); err != nil {
+			t.Fatalf("Failed to set the retry time of job %s: %v", firstJob, err)
+		}
+	})
+	dt.ResumeRetries(dt.Logger)
+	cleared := false
+	for i := 0; i < 50 && !cleared; i++ {
+		time.Sleep(100 * time.Millisecond)
+		rt.Do(func(d Stores) {
+			cleared = AsJob(rt.Find("jobs", firstJob.String())).RetryAt.IsZero()
+		})
+	}
+	if !cleared {
+		t.Errorf("Expected the resumed retry of job %s to be picked up", firstJob)
+	}
+	rt.Do(func(d Stores) {
+		if m := AsMachine(rt.Find("machines", machineUUID.String())); !uuid.Equal(m.CurrentJob, retried.Uuid) {
+			t.Errorf("Expected the machine that moved on not to get another retry, got job %s", m.CurrentJob)
+		}
+	})
+}
+
+func TestJobResult(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	machineUUID := uuid.NewRandom()
+	goodJob, badJob := uuid.NewRandom(), uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Task with bad ResultParams", rt.Create, &models.Task{Name: "bad", ResultParams: map[string]string{"disks": ""}}, false},
+		{"Create Task with bad ResultMeta", rt.Create, &models.Task{Name: "bad", ResultMeta: map[string]string{"": "disks"}}, false},
+		{"Create Param", rt.Create, &models.Param{Name: "disk-count", Schema: map[string]interface{}{"type": "number"}}, true},
+		{"Create Task with result mapping", rt.Create, &models.Task{
+			Name:         "inventory",
+			ResultParams: map[string]string{"disks": "disk-count"},
+			ResultMeta:   map[string]string{"vendor": "vendor", "nics": "nics"},
+		}, true},
+		{"Create Stage", rt.Create, &models.Stage{Name: "inventory", BootEnv: "local", Tasks: []string{"inventory"}}, true},
+		{"Create Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "result.example.com", Stage: "inventory"}, true},
+		{"Create Job", rt.Create, &models.Job{
+			Uuid:     goodJob,
+			Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+			Machine:  machineUUID,
+			Task:     "inventory",
+			Stage:    "inventory",
+			State:    "created",
+		}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	finish := func(id uuid.UUID, result map[string]interface{}) *Job {
+		var res *Job
+		rt.Do(func(d Stores) {
+			j := models.Clone(rt.Find("jobs", id.String())).(*models.Job)
+			j.State = "finished"
+			j.Result = result
+			if _, err := rt.Update(j); err != nil {
+				t.Fatalf("Failed to finish job %s: %v", id, err)
+			}
+			res = AsJob(rt.Find("jobs", id.String()))
+		})
+		return res
+	}
+	rt.Do(func(d Stores) {
+		patch := jsonpatch2.Patch{
+			{Op: "replace", Path: "/State", Value: "finished"},
+			{Op: "add", Path: "/Result", Value: map[string]interface{}{"disks": float64(8)}},
+		}
+		if _, err := rt.DryRunPatch(&models.Job{Uuid: goodJob}, goodJob.String(), patch); err != nil {
+			t.Fatalf("Failed to dry run finishing job: %v", err)
+		}
+		if m := AsMachine(rt.Find("machines", machineUUID.String())); m.Params["disk-count"] != nil {
+			t.Errorf("Expected a dry run not to save the result, but disk-count is %v", m.Params["disk-count"])
+		}
+	})
+	if j := finish(goodJob, map[string]interface{}{"disks": float64(4), "vendor": "acme", "nics": []interface{}{"eth0"}}); j.State != "finished" {
+		t.Errorf("Expected job with a valid result to finish, not %s", j.State)
+	}
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		if m.Params["disk-count"] != float64(4) {
+			t.Errorf("Expected disk-count param to be 4, not %v", m.Params["disk-count"])
+		}
+		if m.Meta["vendor"] != "acme" || m.Meta["nics"] != `["eth0"]` {
+			t.Errorf("Expected result to be saved in Meta, got %v", m.Meta)
+		}
+		filters, err := rt.FilterFor(&Job{}, "Result.vendor", []string{"acme"})
+		if err != nil {
+			t.Fatalf("Failed to make Result filter: %v", err)
+		}
+		found, err := index.All(filters...)(&d("jobs").Index)
+		if err != nil || found.Count() != 1 {
+			t.Errorf("Expected to find 1 job by Result.vendor, got %v (%v)", found, err)
+		}
+	})
+	crudTest{"Create second Job", rt.Create, &models.Job{
+		Uuid:     badJob,
+		Previous: goodJob,
+		Machine:  machineUUID,
+		Task:     "inventory",
+		Stage:    "inventory",
+		State:    "created",
+	}, true}.Test(t, rt)
+	if j := finish(badJob, map[string]interface{}{"disks": "lots", "vendor": "other"}); j.State != "failed" {
+		t.Errorf("Expected job with an invalid result to fail, not %s", j.State)
+	}
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		if m.Params["disk-count"] != float64(4) || m.Meta["vendor"] != "acme" {
+			t.Errorf("Expected an invalid result not to change the machine")
+		}
+	})
+}
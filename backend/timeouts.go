@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+// timeoutLocks are the locks SweepTimeouts needs to fail Jobs and
+// switch Machines to fallback Workflows.
+var timeoutLocks = []string{"stages", "bootenvs", "jobs", "machines", "tasks", "profiles", "templates", "params", "workflows"}
+
+// timeoutJob fails j with an ExitState of timeout, and publishes a
+// jobs timeout event for it.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) timeoutJob(j *Job, why string) (*Job, error) {
+	rt.Infof("Job %s for task %s on machine %s timed out: %s", j.UUID(), j.Task, j.Machine, why)
+	failed := models.Clone(j.Job).(*models.Job)
+	failed.State = "failed"
+	failed.ExitState = "timeout"
+	if _, err := rt.Update(failed); err != nil {
+		return nil, err
+	}
+	res := AsJob(rt.find("jobs", j.Key()))
+	rt.Publish("jobs", "timeout", res.Key(), res)
+	return res, nil
+}
+
+// fallBack switches m to the Workflow wf after it has timed out.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) fallBack(m *Machine, wf string) {
+	if wf == "" || m.Workflow == wf {
+		return
+	}
+	if rt.find("workflows", wf) == nil {
+		rt.Errorf("Machine %s timed out, but its fallback Workflow %s does not exist", m.UUID(), wf)
+		return
+	}
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.Workflow = wf
+	nm.Runnable = true
+	if _, err := rt.Update(nm); err != nil {
+		rt.Errorf("Unable to switch machine %s to fallback Workflow %s: %v", m.UUID(), wf, err)
+		return
+	}
+	rt.Infof("Machine %s switched to fallback Workflow %s", m.UUID(), wf)
+}
+
+// sweepMachine enforces the Task and Stage timeouts for m.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) sweepMachine(m *Machine, now time.Time) {
+	fallback := ""
+	ids := append([]uuid.UUID{m.CurrentJob}, m.CurrentJobs...)
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id.String()] {
+			continue
+		}
+		seen[id.String()] = true
+		jo := rt.find("jobs", id.String())
+		if jo == nil {
+			continue
+		}
+		j := AsJob(jo)
+		to := rt.find("tasks", j.Task)
+		if j.State != "running" || to == nil {
+			continue
+		}
+		task := AsTask(to)
+		limit := time.Duration(task.Timeout) * time.Second
+		if limit == 0 || now.Sub(j.StartTime) < limit {
+			continue
+		}
+		failed, err := rt.timeoutJob(j, "task "+task.Name+" ran for longer than "+limit.String())
+		if err != nil {
+			rt.Errorf("Unable to time out job %s: %v", j.UUID(), err)
+			continue
+		}
+		if !task.Retry.Retryable(failed.Job) && fallback == "" {
+			fallback = task.TimeoutWorkflow
+		}
+	}
+	if so := rt.find("stages", m.Stage); so != nil && m.Runnable {
+		stage := AsStage(so)
+		limit := time.Duration(stage.Timeout) * time.Second
+		if limit > 0 && now.Sub(m.StageEntered) >= limit {
+			rt.Infof("Machine %s has been in stage %s for longer than %s", m.UUID(), stage.Name, limit)
+			if jo := rt.find("jobs", m.CurrentJob.String()); jo != nil {
+				switch j := AsJob(jo); j.State {
+				case "created", "running", "incomplete":
+					if _, err := rt.timeoutJob(j, "stage "+stage.Name+" took longer than "+limit.String()); err != nil {
+						rt.Errorf("Unable to time out job %s: %v", j.UUID(), err)
+					}
+				}
+			}
+			// A Machine that timed out in a Stage needs attention, just
+			// like one that failed a Job.  The clock restarts, so that
+			// the timeout only fires once.
+			nm := ModelToBackend(models.Clone(rt.find("machines", m.Key()))).(*Machine)
+			nm.Runnable = false
+			nm.StageEntered = now
+			if _, err := rt.Update(nm); err != nil {
+				rt.Errorf("Unable to mark machine %s not runnable: %v", m.UUID(), err)
+			}
+			m = AsMachine(rt.find("machines", m.Key()))
+			rt.Publish("machines", "timeout", m.Key(), m)
+			if stage.TimeoutWorkflow != "" {
+				fallback = stage.TimeoutWorkflow
+			}
+		}
+	}
+	if fallback != "" {
+		rt.fallBack(AsMachine(rt.find("machines", m.Key())), fallback)
+	}
+}
+
+// SweepTimeouts fails running Jobs that have run for longer than the
+// Timeout of their Task, and the current Jobs of Machines that have
+// been in a Stage for longer than the Timeout of the Stage.  Timed out
+// Jobs get an ExitState of timeout, and a timeout event is published
+// for every Job and Machine that times out.  Machines are switched to
+// the TimeoutWorkflow of the Task or Stage if it has one.
+func (p *DataTracker) SweepTimeouts(l logger.Logger) {
+	rt := p.Request(l, timeoutLocks...)
+	now := time.Now()
+	rt.Do(func(d Stores) {
+		for _, mo := range d("machines").Items() {
+			rt.sweepMachine(AsMachine(mo), now)
+		}
+	})
+}
+
+// StartTimeoutSweeper runs SweepTimeouts every interval in the
+// background.
+func (p *DataTracker) StartTimeoutSweeper(l logger.Logger, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			p.SweepTimeouts(l)
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestSweepTimeouts(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, timeoutLocks...)
+	slowMachine, hungMachine := uuid.NewRandom(), uuid.NewRandom()
+	slowJob, hungJob := uuid.NewRandom(), uuid.NewRandom()
+	noJob := uuid.Parse("00000000-0000-0000-0000-000000000000")
+	tests := []crudTest{
+		{"Create Task with bad Timeout", rt.Create, &models.Task{Name: "bad", Timeout: -1}, false},
+		{"Create Task with Timeout", rt.Create, &models.Task{Name: "slow", Timeout: 60, TimeoutWorkflow: "rescue"}, true},
+		{"Create Task without Timeout", rt.Create, &models.Task{Name: "hang"}, true},
+		{"Create Stage rescue", rt.Create, &models.Stage{Name: "rescue", BootEnv: "local"}, true},
+		{"Create Workflow rescue", rt.Create, &models.Workflow{Name: "rescue", Stages: []string{"rescue"}}, true},
+		{"Create Stage slow", rt.Create, &models.Stage{Name: "slow", BootEnv: "local", Tasks: []string{"slow"}}, true},
+		{"Create Stage with Timeout", rt.Create, &models.Stage{Name: "hang", BootEnv: "local", Tasks: []string{"hang"}, Timeout: 600}, true},
+		{"Create Machine in slow", rt.Create, &models.Machine{Uuid: slowMachine, Name: "slow.example.com", Stage: "slow"}, true},
+		{"Create Machine in hang", rt.Create, &models.Machine{Uuid: hungMachine, Name: "hang.example.com", Stage: "hang"}, true},
+		{"Create slow Job", rt.Create, &models.Job{Uuid: slowJob, Previous: noJob, Machine: slowMachine, Task: "slow", Stage: "slow", State: "created"}, true},
+		{"Create hung Job", rt.Create, &models.Job{Uuid: hungJob, Previous: noJob, Machine: hungMachine, Task: "hang", Stage: "hang", State: "created"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		for _, id := range []uuid.UUID{slowJob, hungJob} {
+			j := AsJob(rt.Find("jobs", id.String()))
+			j.State = "running"
+			j.StartTime = time.Now()
+			if _, err := rt.Update(j); err != nil {
+				t.Fatalf("Unable to start job %s: %v", j.Task, err)
+			}
+			m := AsMachine(rt.Find("machines", j.Machine.String()))
+			m.InRunner()
+			m.CurrentTask = 0
+			m.CurrentJob = id
+			if _, err := rt.Update(m); err != nil {
+				t.Fatalf("Unable to set the current job of machine %s: %v", m.Name, err)
+			}
+		}
+	})
+	dt.SweepTimeouts(dt.Logger)
+	rt.Do(func(d Stores) {
+		for _, id := range []uuid.UUID{slowJob, hungJob} {
+			if j := AsJob(rt.Find("jobs", id.String())); j.State != "running" {
+				t.Errorf("Expected job %s not to time out yet, but it is %s", j.Task, j.State)
+			}
+		}
+		j := AsJob(rt.Find("jobs", slowJob.String()))
+		j.StartTime = time.Now().Add(-time.Hour)
+		if _, err := rt.Update(j); err != nil {
+			t.Fatalf("Unable to backdate slow job: %v", err)
+		}
+		m := AsMachine(rt.Find("machines", hungMachine.String()))
+		m.StageEntered = time.Now().Add(-time.Hour)
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Unable to backdate hung machine: %v", err)
+		}
+	})
+	dt.SweepTimeouts(dt.Logger)
+	rt.Do(func(d Stores) {
+		for _, id := range []uuid.UUID{slowJob, hungJob} {
+			if j := AsJob(rt.Find("jobs", id.String())); j.State != "failed" || j.ExitState != "timeout" {
+				t.Errorf("Expected job %s to have timed out, but it is %s/%s", j.Task, j.State, j.ExitState)
+			}
+		}
+		if m := AsMachine(rt.Find("machines", slowMachine.String())); m.Workflow != "rescue" || m.Stage != "rescue" {
+			t.Errorf("Expected slow machine to fall back to the rescue Workflow, not %s/%s", m.Workflow, m.Stage)
+		}
+		m := AsMachine(rt.Find("machines", hungMachine.String()))
+		if m.Runnable {
+			t.Errorf("Expected hung machine not to be runnable after timing out")
+		}
+		m.Runnable = true
+		if _, err := rt.Update(m); err != nil {
+			t.Fatalf("Unable to make hung machine runnable again: %v", err)
+		}
+	})
+	dt.SweepTimeouts(dt.Logger)
+	rt.Do(func(d Stores) {
+		if m := AsMachine(rt.Find("machines", hungMachine.String())); !m.Runnable {
+			t.Errorf("Expected hung machine not to time out again as soon as it is runnable")
+		}
+	})
+}
@@ -92,7 +92,20 @@ func (w *Workflow) Validate() {
 	if !w.SetValid() {
 		return
 	}
+	inWorkflow := map[string]bool{}
 	for _, stageName := range w.Stages {
+		if !models.IsWorkflowStep(stageName) {
+			inWorkflow[stageName] = true
+		}
+	}
+	for _, stageName := range w.Stages {
+		if models.IsWorkflowStep(stageName) {
+			step, _ := models.ParseWorkflowStep(stageName)
+			if !inWorkflow[step.Target] {
+				w.Errorf("Step %s jumps to Stage %s, which is not in the Workflow", stageName, step.Target)
+			}
+			continue
+		}
 		if stage := w.rt.find("stages", stageName); stage == nil {
 			w.Errorf("Stage %s does not exist", stageName)
 		} else if !stage.(*Stage).Available {
@@ -102,6 +115,51 @@ func (w *Workflow) Validate() {
 	w.SetAvailable()
 }
 
+// TaskList expands the Stages of the Workflow into the task list
+// that a Machine in the Workflow runs.  It also returns the first
+// Stage, and the BootEnv of the first Stage if it has one.  Stages
+// that do not exist are left out.
+//
+// Assumes locks are held as appropriate.
+func (w *Workflow) TaskList(rt *RequestTracker) (taskList []string, firstStage, firstEnv string) {
+	taskList = []string{}
+	lastEnv := ""
+	first := true
+	// Flow control steps can make the Machine arrive at a Stage from
+	// anywhere, so every Stage must carry its own BootEnv.
+	hasSteps := false
+	for _, stageName := range w.Stages {
+		hasSteps = hasSteps || models.IsWorkflowStep(stageName)
+	}
+	for _, stageName := range w.Stages {
+		if models.IsWorkflowStep(stageName) {
+			// Flow control steps are evaluated as the Machine
+			// reaches them.
+			taskList = append(taskList, stageName)
+			continue
+		}
+		obj := rt.find("stages", stageName)
+		if obj == nil {
+			continue
+		}
+		stage := AsStage(obj)
+		taskList = append(taskList, "stage:"+stageName)
+		if first {
+			firstStage = stage.Name
+		}
+		if stage.BootEnv != "" && (stage.BootEnv != lastEnv || hasSteps) {
+			if first {
+				firstEnv = stage.BootEnv
+			}
+			taskList = append(taskList, "bootenv:"+stage.BootEnv)
+			lastEnv = stage.BootEnv
+		}
+		taskList = append(taskList, stage.Tasks...)
+		first = false
+	}
+	return
+}
+
 // BeforeSave validates the state of the Workflow.
 // This is used generally before saving but also
 // when an object needs to initialized and
@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// WorkflowCheckLocks are the locks needed to check a Workflow against
+// a Machine.
+var WorkflowCheckLocks = []string{"stages", "bootenvs", "machines", "tasks", "profiles", "templates", "params", "workflows"}
+
+// checkRender adds the RequiredParams of target that m cannot
+// resolve, and the templates of target that fail to render for m, to
+// res.  at is the index in the task list that target is at.
+func (rt *RequestTracker) checkRender(res *models.WorkflowCheck, m *Machine, target renderable, at int) {
+	r := newRenderData(rt, m, target)
+	for _, param := range r.missingRequiredParams() {
+		res.Problem("params", param, at,
+			fmt.Sprintf("Missing required parameter %s for %s %s", param, target.Prefix(), target.Key()))
+	}
+	tmpls, _ := target.renderInfo()
+	root := target.templates()
+	if root == nil {
+		return
+	}
+	if len(m.HardwareAddrs) > 0 {
+		r.Machine.currMac = m.HardwareAddrs[0]
+	}
+	for i := range tmpls {
+		ti := &tmpls[i]
+		e := &models.Error{}
+		rts := r.addRenderer(e, ti, renderers{})
+		for _, msg := range e.Messages {
+			res.Problem("templates", ti.Name, at, fmt.Sprintf("%s %s: %s", target.Prefix(), target.Key(), msg))
+		}
+		if len(rts) == 0 {
+			continue
+		}
+		tmpl := root.Lookup(ti.Id())
+		if tmpl == nil {
+			res.Problem("templates", ti.Name, at,
+				fmt.Sprintf("%s %s: missing template %s", target.Prefix(), target.Key(), ti.Id()))
+			continue
+		}
+		r.tmplKey, r.tmplPath = rts[0].name, rts[0].path
+		if err := tmpl.Execute(ioutil.Discard, r); err != nil {
+			res.Problem("templates", ti.Name, at,
+				fmt.Sprintf("Error rendering template %s for %s %s: %v", ti.Name, target.Prefix(), target.Key(), err))
+		}
+	}
+}
+
+// checkTask checks that the Task name exists, is available, and
+// renders for m.
+func (rt *RequestTracker) checkTask(res *models.WorkflowCheck, m *Machine, name string, at int) {
+	obj := rt.find("tasks", name)
+	if obj == nil {
+		res.Problem("tasks", name, at, fmt.Sprintf("Task %s (at %d) does not exist", name, at))
+		return
+	}
+	task := AsTask(obj)
+	if !task.Available {
+		res.Problem("tasks", name, at, fmt.Sprintf("Task %s (at %d) is not available", name, at))
+		return
+	}
+	rt.checkRender(res, m, task, at)
+}
+
+// CheckWorkflow checks whether the Workflow name would work on m,
+// without changing m.  The task list m would run is walked the same
+// way Machine.Validate walks it, with m moved to each Stage and
+// BootEnv as they are reached, so Params are aggregated the way they
+// would be when the Tasks run.  Every template is rendered for m.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) CheckWorkflow(m *Machine, name string) *models.WorkflowCheck {
+	res := &models.WorkflowCheck{
+		Workflow: name,
+		Machine:  m.Uuid,
+		Tasks:    []string{},
+		Problems: []models.WorkflowProblem{},
+		OK:       true,
+	}
+	obj := rt.find("workflows", name)
+	if obj == nil {
+		res.Problem("workflows", name, -1, fmt.Sprintf("Workflow %s does not exist", name))
+		return res
+	}
+	wf := AsWorkflow(obj)
+	if !wf.Available {
+		res.Problem("workflows", name, -1,
+			fmt.Sprintf("Workflow %s is not available: %s", name, strings.Join(wf.Errors, ", ")))
+	}
+	for _, stageName := range wf.Stages {
+		if !models.IsWorkflowStep(stageName) && rt.find("stages", stageName) == nil {
+			res.Problem("stages", stageName, -1, fmt.Sprintf("Stage %s does not exist", stageName))
+		}
+	}
+	var firstStage, firstEnv string
+	res.Tasks, firstStage, firstEnv = wf.TaskList(rt)
+	hm := ModelToBackend(models.Clone(m)).(*Machine)
+	hm.Workflow = name
+	hm.Tasks = res.Tasks
+	hm.CurrentTask = -1
+	if firstStage != "" {
+		hm.Stage = firstStage
+	}
+	if firstEnv != "" {
+		hm.BootEnv = firstEnv
+	}
+	for i, ent := range res.Tasks {
+		parts := strings.SplitN(ent, ":", 2)
+		if len(parts) != 2 {
+			rt.checkTask(res, hm, ent, i)
+			continue
+		}
+		switch parts[0] {
+		case "stage":
+			stage := AsStage(rt.find("stages", parts[1]))
+			hm.Stage = stage.Name
+			if !stage.Available {
+				res.Problem("stages", stage.Name, i, fmt.Sprintf("Stage %s (at %d) is not available", stage.Name, i))
+				continue
+			}
+			rt.checkRender(res, hm, stage, i)
+		case "bootenv":
+			obj := rt.find("bootenvs", parts[1])
+			if obj == nil {
+				res.Problem("bootenvs", parts[1], i, fmt.Sprintf("BootEnv %s (at %d) does not exist", parts[1], i))
+				continue
+			}
+			env := AsBootEnv(obj)
+			hm.BootEnv = env.Name
+			if env.OnlyUnknown {
+				res.Problem("bootenvs", env.Name, i,
+					fmt.Sprintf("BootEnv %s does not allow Machine assignments, it has the OnlyUnknown flag.", env.Name))
+				continue
+			}
+			if !env.Available {
+				res.Problem("bootenvs", env.Name, i, fmt.Sprintf("BootEnv %s (at %d) is not available", env.Name, i))
+				continue
+			}
+			rt.checkRender(res, hm, env, i)
+		case "if", "goto":
+			if _, err := models.ParseWorkflowStep(ent); err != nil {
+				res.Problem("workflows", name, i, fmt.Sprintf("%s (at %d) is malformed: %v", ent, i, err))
+			}
+		case "group":
+			for _, member := range models.TaskGroupMembers(ent) {
+				rt.checkTask(res, hm, member, i)
+			}
+		default:
+			res.Problem("tasks", ent, i, fmt.Sprintf("%s (at %d) is malformed", ent, i))
+		}
+	}
+	return res
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// WorkflowGraphLocks are the locks needed to build the graph of a
+// Workflow.
+var WorkflowGraphLocks = []string{"stages", "bootenvs", "tasks", "profiles", "workflows"}
+
+// graphNode adds a node for the object named name in prefix to g,
+// marking it unavailable if it is missing.
+func (rt *RequestTracker) graphNode(g *models.WorkflowGraph, kind, prefix, name string) string {
+	id := kind + ":" + name
+	obj := rt.find(prefix, name)
+	if obj == nil {
+		return g.Node(id, kind, name, false, []string{fmt.Sprintf("%s %s does not exist", prefix, name)})
+	}
+	v := obj.(interface{ SaveValidation() *models.Validation }).SaveValidation()
+	return g.Node(id, kind, name, v.Available, v.Errors)
+}
+
+// graphTask adds a node with the given id for the task list entry
+// ent to g, and returns the id.
+func (rt *RequestTracker) graphTask(g *models.WorkflowGraph, id, ent string) string {
+	if !models.IsTaskGroup(ent) {
+		if obj := rt.find("tasks", ent); obj == nil {
+			g.Node(id, "task", ent, false, []string{fmt.Sprintf("tasks %s does not exist", ent)})
+		} else {
+			task := AsTask(obj)
+			g.Node(id, "task", ent, task.Available, task.Errors)
+		}
+		return id
+	}
+	g.Node(id, "group", ent, true, nil)
+	for j, member := range models.TaskGroupMembers(ent) {
+		g.Edge(id, rt.graphTask(g, fmt.Sprintf("%s/%d", id, j), member), "member", "")
+	}
+	return id
+}
+
+// WorkflowGraph expands the Workflow w into the Stages and flow
+// control steps it goes through, and the BootEnvs, Profiles, and
+// Tasks of each Stage, annotated with their availability.
+//
+// Assumes locks are held as appropriate.
+func (rt *RequestTracker) WorkflowGraph(w *Workflow) *models.WorkflowGraph {
+	g := &models.WorkflowGraph{
+		Workflow:  w.Name,
+		Available: true,
+		Nodes:     []models.WorkflowNode{},
+		Edges:     []models.WorkflowEdge{},
+	}
+	prev := g.Node("workflow:"+w.Name, "workflow", w.Name, w.Available, w.Errors)
+	stageIds := map[string]string{}
+	for _, stageName := range w.Stages {
+		if !models.IsWorkflowStep(stageName) {
+			stageIds[stageName] = rt.graphNode(g, "stage", "stages", stageName)
+		}
+	}
+	lastEnv := ""
+	for i, stageName := range w.Stages {
+		if models.IsWorkflowStep(stageName) {
+			id := g.Node("step:"+strconv.Itoa(i), "step", stageName, true, nil)
+			g.Edge(prev, id, "next", "")
+			step, err := models.ParseWorkflowStep(stageName)
+			if err != nil {
+				g.Nodes[len(g.Nodes)-1].Available = false
+				g.Nodes[len(g.Nodes)-1].Errors = []string{err.Error()}
+				g.Available = false
+				prev = id
+				continue
+			}
+			if target, ok := stageIds[step.Target]; ok {
+				label := ""
+				if step.Kind == "if" {
+					label = strings.TrimSuffix(strings.TrimPrefix(stageName, "if:"), ":"+step.Target)
+				}
+				g.Edge(id, target, "jump", label)
+			}
+			prev = id
+			continue
+		}
+		id := stageIds[stageName]
+		g.Edge(prev, id, "next", "")
+		prev = id
+		obj := rt.find("stages", stageName)
+		if obj == nil {
+			continue
+		}
+		stage := AsStage(obj)
+		if stage.Reboot || (stage.BootEnv != "" && stage.BootEnv != lastEnv) {
+			for j := range g.Nodes {
+				if g.Nodes[j].Id == id {
+					g.Nodes[j].Reboot = true
+				}
+			}
+		}
+		if stage.BootEnv != "" {
+			g.Edge(id, rt.graphNode(g, "bootenv", "bootenvs", stage.BootEnv), "bootenv", "")
+			lastEnv = stage.BootEnv
+		}
+		for _, profile := range stage.Profiles {
+			g.Edge(id, rt.graphNode(g, "profile", "profiles", profile), "profile", "")
+		}
+		for j, ent := range stage.Tasks {
+			taskId := fmt.Sprintf("%s/%d", id, j)
+			g.Edge(id, rt.graphTask(g, taskId, ent), "task", strconv.Itoa(j))
+		}
+	}
+	return g
+}
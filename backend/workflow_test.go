@@ -1,9 +1,11 @@
 package backend
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
 )
 
 func TestWorkflowCrud(t *testing.T) {
@@ -22,3 +24,204 @@ func TestWorkflowCrud(t *testing.T) {
 		test.Test(t, rt)
 	}
 }
+
+func TestWorkflowSteps(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows", "jobs")
+	machineUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Stage inventory", rt.Create, &models.Stage{Name: "inventory"}, true},
+		{"Create Stage raid", rt.Create, &models.Stage{Name: "raid"}, true},
+		{"Create Stage noraid", rt.Create, &models.Stage{Name: "noraid"}, true},
+		{"Create Stage remediate", rt.Create, &models.Stage{Name: "remediate"}, true},
+		{"Create Workflow with bad if step", rt.Create, &models.Workflow{Name: "bad", Stages: []string{"inventory", "if:raid/present:raid"}}, false},
+		{"Create Workflow jumping out of the Workflow", rt.Create, &models.Workflow{Name: "away", Stages: []string{"inventory", "goto:raid"}}, true},
+		{"Create branching Workflow", rt.Create, &models.Workflow{
+			Name: "branch",
+			Stages: []string{
+				"inventory",
+				"if:ExitState=failed:remediate",
+				"if:raid/present=true:raid",
+				"if:ExitState=timeout:remediate",
+				"noraid",
+				"goto:remediate",
+				"raid",
+				"remediate",
+			},
+		}, true},
+		{"Create Machine using branching Workflow", rt.Create, &models.Machine{Uuid: machineUUID, Name: "branch.example.com", Workflow: "branch"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		if w := AsWorkflow(rt.Find("workflows", "away")); w.Available {
+			t.Errorf("Expected Workflow jumping to a Stage outside of it to be unavailable")
+		}
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		index := func(entry string) int {
+			for i, task := range m.Tasks {
+				if task == entry {
+					return i
+				}
+			}
+			t.Fatalf("Machine task list %v does not contain %s", m.Tasks, entry)
+			return -1
+		}
+		ifFailed, ifRaid := index("if:ExitState=failed:remediate"), index("if:raid/present=true:raid")
+		failed := &Job{Job: &models.Job{Task: "inventory-task", State: "failed"}}
+		timedOut := &Job{Job: &models.Job{Task: "inventory-task", State: "failed", ExitState: "timeout"}}
+		cancelled := &Job{Job: &models.Job{Task: "inventory-task", State: "cancelled"}}
+		if !m.FailureHandled(ifFailed-1, failed) {
+			t.Errorf("Expected a failure before %d to be handled", ifFailed)
+		}
+		if !m.FailureHandled(ifFailed-1, timedOut) {
+			t.Errorf("Expected a timeout before %d to be handled by a later step", ifFailed)
+		}
+		if m.FailureHandled(ifFailed-1, cancelled) {
+			t.Errorf("Expected a cancellation before %d not to be handled", ifFailed)
+		}
+		if m.FailureHandled(ifRaid+1, failed) {
+			t.Errorf("Expected a failure before %d not to be handled", ifRaid+2)
+		}
+		if next, err := m.NextStep(rt, ifFailed, failed); err != nil || next != index("stage:remediate") {
+			t.Errorf("Expected failed Job to branch to remediate, got %d: %v", next, err)
+		}
+		finished := &Job{Job: &models.Job{Task: "inventory-task", State: "finished", ExitState: "complete"}}
+		if next, err := m.NextStep(rt, ifFailed, finished); err != nil || next != ifFailed+1 {
+			t.Errorf("Expected finished Job to continue at %d, got %d: %v", ifFailed+1, next, err)
+		}
+		if next, err := m.NextStep(rt, ifRaid, finished); err != nil || next != ifRaid+1 {
+			t.Errorf("Expected machine without raid to continue at %d, got %d: %v", ifRaid+1, next, err)
+		}
+		m.Params["raid/present"] = true
+		if next, err := m.NextStep(rt, ifRaid, finished); err != nil || next != index("stage:raid") {
+			t.Errorf("Expected machine with raid to branch to raid, got %d: %v", next, err)
+		}
+		if next, err := m.NextStep(rt, index("goto:remediate"), finished); err != nil || next != index("stage:remediate") {
+			t.Errorf("Expected goto to jump to remediate, got %d: %v", next, err)
+		}
+	})
+}
+
+func TestWorkflowCheck(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, WorkflowCheckLocks...)
+	machineUUID := uuid.NewRandom()
+	tests := []crudTest{
+		{"Create Task ok", rt.Create, &models.Task{Name: "ok", Templates: []models.TemplateInfo{{Name: "ok.sh", Contents: "echo {{ .Machine.Name }}"}}}, true},
+		{"Create Task wipe", rt.Create, &models.Task{
+			Name:           "wipe",
+			RequiredParams: []string{"wipe/confirm"},
+			Templates:      []models.TemplateInfo{{Name: "wipe.sh", Contents: `wipe {{ .Param "wipe/disk" }}`}},
+		}, true},
+		{"Create Stage plain", rt.Create, &models.Stage{Name: "plain", Tasks: []string{"ok"}}, true},
+		{"Create Stage wipe", rt.Create, &models.Stage{Name: "wipe", Tasks: []string{"ok", "wipe"}}, true},
+		{"Create Workflow good", rt.Create, &models.Workflow{Name: "good", Stages: []string{"plain"}}, true},
+		{"Create Workflow wiping", rt.Create, &models.Workflow{Name: "wiping", Stages: []string{"plain", "wipe"}}, true},
+		{"Create Workflow broken", rt.Create, &models.Workflow{Name: "broken", Stages: []string{"plain", "gone"}}, true},
+		{"Create Machine", rt.Create, &models.Machine{Uuid: machineUUID, Name: "check.example.com"}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	problems := func(res *models.WorkflowCheck, kind string) []string {
+		names := []string{}
+		for _, p := range res.Problems {
+			if p.Kind == kind {
+				names = append(names, p.Name)
+			}
+		}
+		return names
+	}
+	rt.Do(func(d Stores) {
+		m := AsMachine(rt.Find("machines", machineUUID.String()))
+		oldTasks := len(m.Tasks)
+		if res := rt.CheckWorkflow(m, "good"); !res.OK || len(res.Tasks) != 2 {
+			t.Errorf("Expected Workflow good to pass with 2 tasks, got %v", res)
+		}
+		res := rt.CheckWorkflow(m, "wiping")
+		if res.OK {
+			t.Errorf("Expected Workflow wiping to fail")
+		}
+		if names := problems(res, "params"); len(names) != 1 || names[0] != "wipe/confirm" {
+			t.Errorf("Expected wipe/confirm to be unresolved, got %v", res.Problems)
+		}
+		if names := problems(res, "templates"); len(names) != 1 || names[0] != "wipe.sh" {
+			t.Errorf("Expected wipe.sh to fail to render, got %v", res.Problems)
+		}
+		for _, p := range res.Problems {
+			if res.Tasks[p.At] != "wipe" {
+				t.Errorf("Expected problems at the wipe task, not %s", res.Tasks[p.At])
+			}
+		}
+		res = rt.CheckWorkflow(m, "broken")
+		if names := problems(res, "stages"); res.OK || len(names) != 1 || names[0] != "gone" {
+			t.Errorf("Expected Stage gone to be missing, got %v", res.Problems)
+		}
+		if res = rt.CheckWorkflow(m, "missing"); res.OK || len(problems(res, "workflows")) != 1 {
+			t.Errorf("Expected a missing Workflow to fail, got %v", res.Problems)
+		}
+		if m := AsMachine(rt.Find("machines", machineUUID.String())); m.Workflow != "" || len(m.Tasks) != oldTasks {
+			t.Errorf("Expected checking Workflows to leave the Machine alone, got %s %v", m.Workflow, m.Tasks)
+		}
+	})
+}
+
+func TestWorkflowGraph(t *testing.T) {
+	dt := mkDT(nil)
+	rt := dt.Request(dt.Logger, WorkflowGraphLocks...)
+	tests := []crudTest{
+		{"Create Task t1", rt.Create, &models.Task{Name: "t1"}, true},
+		{"Create Task t2", rt.Create, &models.Task{Name: "t2"}, true},
+		{"Create Stage a", rt.Create, &models.Stage{Name: "a", BootEnv: "local", Tasks: []string{"t1", "group:t1,t2"}}, true},
+		{"Create Stage b", rt.Create, &models.Stage{Name: "b", BootEnv: "local", Reboot: true, Tasks: []string{"gone"}}, true},
+		{"Create Stage c", rt.Create, &models.Stage{Name: "c", BootEnv: "local", Tasks: []string{"t2"}}, true},
+		{"Create Workflow g", rt.Create, &models.Workflow{Name: "g", Stages: []string{"a", "if:ExitState=failed:b", "c", "b"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		g := rt.WorkflowGraph(AsWorkflow(rt.Find("workflows", "g")))
+		if g.Available {
+			t.Errorf("Expected the graph of g to not be available, as b runs a missing Task")
+		}
+		nodes := map[string]models.WorkflowNode{}
+		for _, n := range g.Nodes {
+			nodes[n.Id] = n
+		}
+		for id, reboot := range map[string]bool{"stage:a": true, "stage:b": true, "stage:c": false} {
+			if n, ok := nodes[id]; !ok || n.Reboot != reboot {
+				t.Errorf("Expected node %s with Reboot %v, got %v", id, reboot, n)
+			}
+		}
+		if n := nodes["stage:b/0"]; n.Kind != "task" || n.Available || len(n.Errors) == 0 {
+			t.Errorf("Expected the missing Task in b to be unavailable with errors, got %v", n)
+		}
+		if n := nodes["stage:a/1"]; n.Kind != "group" {
+			t.Errorf("Expected the task group in a to be a group node, got %v", n)
+		}
+		if n := nodes["stage:a/1/1"]; n.Name != "t2" || !n.Available {
+			t.Errorf("Expected t2 to be an available member of the task group in a, got %v", n)
+		}
+		if _, ok := nodes["bootenv:local"]; !ok {
+			t.Errorf("Expected a node for BootEnv local")
+		}
+		jumps := 0
+		for _, e := range g.Edges {
+			if e.Kind == "jump" {
+				jumps++
+				if e.From != "step:1" || e.To != "stage:b" || e.Label != "ExitState=failed" {
+					t.Errorf("Expected a jump from step:1 to stage:b on ExitState=failed, got %v", e)
+				}
+			}
+		}
+		if jumps != 1 {
+			t.Errorf("Expected 1 jump, got %d", jumps)
+		}
+		if dot := g.Dot(); !strings.Contains(dot, `"step:1" -> "stage:b" [style=dashed, label="ExitState=failed"];`) {
+			t.Errorf("Expected the DOT output to have the jump, got:\n%s", dot)
+		}
+	})
+}
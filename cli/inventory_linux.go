@@ -0,0 +1,321 @@
+// +build linux
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// readSys returns the trimmed contents of a sysfs or procfs file, or
+// an empty string if it cannot be read.
+func readSys(parts ...string) string {
+	buf, err := ioutil.ReadFile(filepath.Join(parts...))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buf))
+}
+
+func atoiSys(parts ...string) int {
+	i, _ := strconv.Atoi(readSys(parts...))
+	return i
+}
+
+// linkName returns the base name of the target of a sysfs link.
+func linkName(parts ...string) string {
+	dest, err := os.Readlink(filepath.Join(parts...))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(dest)
+}
+
+// pciIds holds the vendor and device names from the pci.ids database,
+// keyed by "vendor" and "vendor:device" in lower case hex.
+type pciIds map[string]string
+
+func loadPciIds() pciIds {
+	res := pciIds{}
+	for _, path := range []string{"/usr/share/hwdata/pci.ids", "/usr/share/misc/pci.ids", "/usr/share/pci.ids"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		vendor := ""
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			if strings.HasPrefix(line, "C ") {
+				// Device classes come after all the vendors.
+				break
+			}
+			switch {
+			case line[0] != '\t' && len(line) > 6:
+				vendor = line[:4]
+				res[vendor] = strings.TrimSpace(line[4:])
+			case strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "\t\t") && len(line) > 7:
+				res[vendor+":"+line[1:5]] = strings.TrimSpace(line[5:])
+			}
+		}
+		break
+	}
+	return res
+}
+
+// names returns the vendor and device names of a PCI device from its
+// sysfs directory, falling back to the hex ids.
+func (p pciIds) names(dir string) (vendor, device string) {
+	v := strings.TrimPrefix(readSys(dir, "vendor"), "0x")
+	d := strings.TrimPrefix(readSys(dir, "device"), "0x")
+	if v == "" {
+		return "", ""
+	}
+	vendor, device = v, v+":"+d
+	if name, ok := p[v]; ok {
+		vendor = name
+	}
+	if name, ok := p[v+":"+d]; ok {
+		device = name
+	}
+	return
+}
+
+func gatherCPUs() []models.InventoryCPU {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return []models.InventoryCPU{}
+	}
+	defer f.Close()
+	sockets := map[int]*models.InventoryCPU{}
+	order := []int{}
+	cur := map[string]string{}
+	flush := func() {
+		if len(cur) == 0 {
+			return
+		}
+		id, _ := strconv.Atoi(cur["physical id"])
+		if _, ok := sockets[id]; !ok {
+			cpu := &models.InventoryCPU{Socket: id, Vendor: cur["vendor_id"], Model: cur["model name"]}
+			cpu.Cores, _ = strconv.Atoi(cur["cpu cores"])
+			cpu.Threads, _ = strconv.Atoi(cur["siblings"])
+			cpu.MHz, _ = strconv.ParseFloat(cur["cpu MHz"], 64)
+			sockets[id] = cpu
+			order = append(order, id)
+		}
+		cur = map[string]string{}
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			flush()
+			continue
+		}
+		cur[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	flush()
+	res := []models.InventoryCPU{}
+	for _, id := range order {
+		res = append(res, *sockets[id])
+	}
+	return res
+}
+
+var dimmTypes = map[byte]string{
+	0x12: "DDR",
+	0x13: "DDR2",
+	0x18: "DDR3",
+	0x1a: "DDR4",
+	0x1b: "LPDDR",
+	0x1c: "LPDDR2",
+	0x1d: "LPDDR3",
+	0x1e: "LPDDR4",
+	0x22: "DDR5",
+	0x23: "LPDDR5",
+}
+
+// gatherDIMMs decodes the SMBIOS Memory Device (type 17) structures
+// exported by the kernel.
+func gatherDIMMs() []models.InventoryDIMM {
+	res := []models.InventoryDIMM{}
+	entries, _ := filepath.Glob("/sys/firmware/dmi/entries/17-*/raw")
+	for _, entry := range entries {
+		raw, err := ioutil.ReadFile(entry)
+		if err != nil || len(raw) < 0x1b || int(raw[1]) > len(raw) {
+			continue
+		}
+		word := func(off int) int { return int(raw[off]) | int(raw[off+1])<<8 }
+		strs := strings.Split(string(raw[raw[1]:]), "\x00")
+		str := func(off int) string {
+			idx := int(raw[off])
+			if idx == 0 || idx > len(strs) {
+				return ""
+			}
+			return strings.TrimSpace(strs[idx-1])
+		}
+		size := word(0x0c)
+		switch {
+		case size == 0 || size == 0xffff:
+			// Empty slot or unknown size.
+			continue
+		case size == 0x7fff && len(raw) >= 0x20:
+			size = int(raw[0x1c]) | int(raw[0x1d])<<8 | int(raw[0x1e])<<16 | int(raw[0x1f])<<24
+		case size&0x8000 != 0:
+			size = (size & 0x7fff) / 1024
+		}
+		res = append(res, models.InventoryDIMM{
+			Slot:         str(0x10),
+			Type:         dimmTypes[raw[0x12]],
+			SpeedMTs:     word(0x15),
+			Manufacturer: str(0x17),
+			SerialNumber: str(0x18),
+			PartNumber:   str(0x1a),
+			SizeMB:       size,
+		})
+	}
+	return res
+}
+
+func gatherDisks() []models.InventoryDisk {
+	res := []models.InventoryDisk{}
+	ents, _ := ioutil.ReadDir("/sys/block")
+	for _, ent := range ents {
+		name := ent.Name()
+		dir := filepath.Join("/sys/block", name)
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			// Not backed by hardware: loop, ram, dm, md, and friends.
+			continue
+		}
+		sectors, _ := strconv.ParseInt(readSys(dir, "size"), 10, 64)
+		serial := readSys(dir, "device", "serial")
+		if serial == "" {
+			serial = readSys(dir, "serial")
+		}
+		res = append(res, models.InventoryDisk{
+			Name:       name,
+			Vendor:     readSys(dir, "device", "vendor"),
+			Model:      readSys(dir, "device", "model"),
+			Serial:     serial,
+			SizeBytes:  sectors * 512,
+			Rotational: readSys(dir, "queue", "rotational") == "1",
+		})
+	}
+	return res
+}
+
+func gatherNICs(ids pciIds) []models.InventoryNIC {
+	res := []models.InventoryNIC{}
+	ents, _ := ioutil.ReadDir("/sys/class/net")
+	for _, ent := range ents {
+		dir := filepath.Join("/sys/class/net", ent.Name())
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			// Virtual interfaces have no device.
+			continue
+		}
+		nic := models.InventoryNIC{
+			Name:   ent.Name(),
+			MAC:    readSys(dir, "address"),
+			Driver: linkName(dir, "device", "driver"),
+			Link:   readSys(dir, "carrier") == "1",
+		}
+		if speed := atoiSys(dir, "speed"); speed > 0 {
+			nic.SpeedMbps = speed
+		}
+		nic.Vendor, nic.Model = ids.names(filepath.Join(dir, "device"))
+		res = append(res, nic)
+	}
+	return res
+}
+
+func gatherPCI(ids pciIds) []models.InventoryPCIDevice {
+	res := []models.InventoryPCIDevice{}
+	ents, _ := ioutil.ReadDir("/sys/bus/pci/devices")
+	for _, ent := range ents {
+		dir := filepath.Join("/sys/bus/pci/devices", ent.Name())
+		dev := models.InventoryPCIDevice{
+			Address: ent.Name(),
+			Class:   readSys(dir, "class"),
+			Driver:  linkName(dir, "driver"),
+		}
+		dev.Vendor, dev.Device = ids.names(dir)
+		res = append(res, dev)
+	}
+	return res
+}
+
+func gatherBIOS() models.InventoryBIOS {
+	dir := "/sys/class/dmi/id"
+	return models.InventoryBIOS{
+		Vendor:        readSys(dir, "bios_vendor"),
+		Version:       readSys(dir, "bios_version"),
+		Date:          readSys(dir, "bios_date"),
+		SystemVendor:  readSys(dir, "sys_vendor"),
+		SystemProduct: readSys(dir, "product_name"),
+		SystemSerial:  readSys(dir, "product_serial"),
+		SystemUUID:    readSys(dir, "product_uuid"),
+	}
+}
+
+// ipmitool runs ipmitool with args, and returns the fields of its
+// "name : value" output.
+func ipmitool(args ...string) map[string]string {
+	res := map[string]string{}
+	out, err := exec.Command("ipmitool", args...).Output()
+	if err != nil {
+		return res
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			key := strings.TrimSpace(parts[0])
+			if _, ok := res[key]; !ok {
+				res[key] = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	return res
+}
+
+// gatherBMC asks ipmitool about the BMC, if it is installed.
+func gatherBMC() models.InventoryBMC {
+	if _, err := exec.LookPath("ipmitool"); err != nil {
+		return models.InventoryBMC{}
+	}
+	lan := ipmitool("lan", "print")
+	return models.InventoryBMC{
+		Address:  lan["IP Address"],
+		MAC:      lan["MAC Address"],
+		Firmware: ipmitool("mc", "info")["Firmware Revision"],
+	}
+}
+
+// gatherInventory collects the hardware inventory of the system
+// from sysfs, procfs, and ipmitool.
+func gatherInventory() (*models.Inventory, error) {
+	if _, err := os.Stat("/sys/class/net"); err != nil {
+		return nil, fmt.Errorf("Unable to read sysfs: %v", err)
+	}
+	ids := loadPciIds()
+	return &models.Inventory{
+		CPUs:   gatherCPUs(),
+		Memory: gatherDIMMs(),
+		Disks:  gatherDisks(),
+		NICs:   gatherNICs(ids),
+		PCI:    gatherPCI(ids),
+		BIOS:   gatherBIOS(),
+		BMC:    gatherBMC(),
+	}, nil
+}
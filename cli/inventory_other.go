@@ -0,0 +1,14 @@
+// +build !linux
+
+package cli
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+func gatherInventory() (*models.Inventory, error) {
+	return nil, fmt.Errorf("Hardware inventory is not supported on %s", runtime.GOOS)
+}
@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/api"
 	"github.com/digitalrebar/provision/models"
 	"github.com/spf13/cobra"
 )
@@ -49,6 +51,31 @@ func registerMachine(app *cobra.Command) {
 			return prettyPrint(clone)
 		},
 	})
+	op.addCommand(&cobra.Command{
+		Use:   "checkworkflow [id] [workflow]",
+		Short: "Check whether a workflow will work on the machine",
+		Long: `Walk the tasks the machine would run in the workflow without
+changing the machine, and report missing or unavailable stages,
+bootenvs, and tasks, required params that cannot be resolved, and
+templates that fail to render.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			res, err := session.CheckWorkflow(m.(*models.Machine), args[1])
+			if err != nil {
+				return generateError(err, "Failed to check workflow %v on %v", args[1], args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
 	op.addCommand(&cobra.Command{
 		Use:   "stage [id] [stage]",
 		Short: fmt.Sprintf("Set the machine's stage"),
@@ -93,6 +120,304 @@ func registerMachine(app *cobra.Command) {
 			return session.Req().UrlFor("jobs", m.(*models.Machine).CurrentJob.String(), "log").Do(os.Stdout)
 		},
 	})
+	var historyField, historySince, historyUntil string
+	history := &cobra.Command{
+		Use:   "history [id]",
+		Short: "Show the lifecycle history of the machine",
+		Long: `Show the changes to the Stage, BootEnv, Workflow, Runnable, Address,
+and CurrentTask of the machine, oldest first.  The history can be
+limited to a single field, and to changes made in a time range.
+Times are in RFC3339 format.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			params := []string{}
+			if historyField != "" {
+				params = append(params, "field", historyField)
+			}
+			if historySince != "" {
+				params = append(params, "since", historySince)
+			}
+			if historyUntil != "" {
+				params = append(params, "until", historyUntil)
+			}
+			req := session.Req().UrlFor("machines", m.Key(), "history")
+			if len(params) > 0 {
+				req.Params(params...)
+			}
+			res := []*models.MachineChange{}
+			if err := req.Do(&res); err != nil {
+				return generateError(err, "Failed to fetch history for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	}
+	history.Flags().StringVar(&historyField, "field", "", "Only show changes to this field")
+	history.Flags().StringVar(&historySince, "since", "", "Only show changes made at or after this time")
+	history.Flags().StringVar(&historyUntil, "until", "", "Only show changes made at or before this time")
+	op.addCommand(history)
+	var inventoryVersion int
+	inventory := &cobra.Command{
+		Use:   "inventory [id]",
+		Short: "Show the hardware inventory of the machine",
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			req := session.Req().UrlFor("machines", m.Key(), "inventory")
+			if inventoryVersion != 0 {
+				req.Params("version", strconv.Itoa(inventoryVersion))
+			}
+			res := &models.Inventory{}
+			if err := req.Do(res); err != nil {
+				return generateError(err, "Failed to fetch inventory for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	}
+	inventory.Flags().IntVar(&inventoryVersion, "version", 0, "Show this version of the inventory instead of the current one")
+	op.addCommand(inventory)
+	op.addCommand(&cobra.Command{
+		Use:   "inventoryversions [id]",
+		Short: "List the saved versions of the hardware inventory of the machine",
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			res := []int{}
+			if err := session.Req().UrlFor("machines", m.Key(), "inventory", "versions").Do(&res); err != nil {
+				return generateError(err, "Failed to fetch inventory versions for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
+	var inventoryFrom, inventoryTo int
+	inventoryDiff := &cobra.Command{
+		Use:   "inventorydiff [id]",
+		Short: "Show the changes between two versions of the hardware inventory of the machine",
+		Long: `Show the changes between two versions of the hardware inventory of
+the machine as a JSON Patch.  --to defaults to the current inventory,
+and --from defaults to the version before --to.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			params := []string{}
+			if inventoryFrom != 0 {
+				params = append(params, "from", strconv.Itoa(inventoryFrom))
+			}
+			if inventoryTo != 0 {
+				params = append(params, "to", strconv.Itoa(inventoryTo))
+			}
+			req := session.Req().UrlFor("machines", m.Key(), "inventory", "diff")
+			if len(params) > 0 {
+				req.Params(params...)
+			}
+			res := jsonpatch2.Patch{}
+			if err := req.Do(&res); err != nil {
+				return generateError(err, "Failed to compare inventories for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	}
+	inventoryDiff.Flags().IntVar(&inventoryFrom, "from", 0, "The older inventory version to compare")
+	inventoryDiff.Flags().IntVar(&inventoryTo, "to", 0, "The newer inventory version to compare")
+	op.addCommand(inventoryDiff)
+	op.addCommand(&cobra.Command{
+		Use:   "uploadinventory [id] [json|file|-|collect]",
+		Short: "Upload a new hardware inventory for the machine",
+		Long: `Upload a new hardware inventory for the machine.  The inventory can
+be passed as JSON, a file name, or - for stdin.  collect gathers the
+inventory of the system the command is running on.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			inv := &models.Inventory{}
+			if args[1] == "collect" {
+				if inv, err = gatherInventory(); err != nil {
+					return err
+				}
+			} else if err := into(args[1], inv); err != nil {
+				return fmt.Errorf("Invalid inventory: %v", err)
+			}
+			res, err := session.UploadInventory(m.(*models.Machine), inv)
+			if err != nil {
+				return generateError(err, "Failed to upload inventory for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
+	op.addCommand(&cobra.Command{
+		Use:   "duplicates [id]",
+		Short: "List machines that appear to be the same system",
+		Long: `List the sets of machines that appear to be the same system, because
+their inventories have the same system serial number or system UUID,
+or they share HardwareAddrs.  If a machine is given, only show its
+duplicates.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("%v accepts at most 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				res, err := session.MachineDuplicates()
+				if err != nil {
+					return generateError(err, "Failed to list duplicate machines")
+				}
+				return prettyPrint(res)
+			}
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			res := &models.MachineDuplicate{}
+			if err := session.Req().UrlFor("machines", m.Key(), "duplicates").Do(res); err != nil {
+				return generateError(err, "Failed to fetch duplicates of %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
+	op.addCommand(&cobra.Command{
+		Use:   "merge [id] [duplicate]",
+		Short: "Merge a duplicate machine into a machine",
+		Long: `Fold the Params, Profiles, Meta, HardwareAddrs, and Jobs of the
+duplicate machine into the machine, and then delete the duplicate.
+Where both machines have a value, the one on the machine is kept.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			dup, err := op.refOrFill(args[1])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[1])
+			}
+			res, err := session.MergeMachines(m.(*models.Machine), dup.(*models.Machine))
+			if err != nil {
+				return generateError(err, "Failed to merge %v into %v", args[1], args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
+	for _, ctl := range []struct {
+		cmd, short, long string
+		run              func(*api.Client, *models.Machine) (*models.Machine, error)
+	}{
+		{"pause", "Pause a machine",
+			`Stop a machine from starting new tasks.  The task it is running
+is allowed to finish.`,
+			(*api.Client).PauseMachine},
+		{"resume", "Resume a paused machine",
+			`Let a paused machine continue with its tasks.  A task that was
+cancelled is run again.`,
+			(*api.Client).ResumeMachine},
+		{"cancel", "Cancel the running task of a machine",
+			`Cancel the jobs a machine is running and pause it.  The agent on
+the machine kills the task it is running.`,
+			(*api.Client).CancelMachine},
+		{"rename", "Rename a machine with its name template",
+			`Apply the name template of the subnet of a machine, or the
+machineNameTemplate preference, to the machine.  Reservations for the
+machine that hand out its old name as the hostname are updated.`,
+			(*api.Client).RenameMachine},
+		{"unlock", "Unlock a locked machine",
+			`Remove the lock from a machine, so that it can be changed and run
+tasks again.`,
+			(*api.Client).UnlockMachine},
+	} {
+		ctl := ctl
+		op.addCommand(&cobra.Command{
+			Use:   ctl.cmd + " [id]",
+			Short: ctl.short,
+			Long:  ctl.long,
+			Args: func(c *cobra.Command, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("%v requires 1 argument", c.UseLine())
+				}
+				return nil
+			},
+			RunE: func(c *cobra.Command, args []string) error {
+				m, err := op.refOrFill(args[0])
+				if err != nil {
+					return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+				}
+				res, err := ctl.run(session, m.(*models.Machine))
+				if err != nil {
+					return generateError(err, "Failed to %v %v", ctl.cmd, args[0])
+				}
+				return prettyPrint(res)
+			},
+		})
+	}
+	op.addCommand(&cobra.Command{
+		Use:   "lock [id] [reason]",
+		Short: "Lock a machine",
+		Long: `Lock a machine for maintenance.  The stage, bootenv, workflow,
+tasks, and params of a locked machine cannot be changed, and it does
+not start new tasks, until it is unlocked.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			res, err := session.LockMachine(m.(*models.Machine), args[1])
+			if err != nil {
+				return generateError(err, "Failed to lock %v", args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
 	op.addCommand(&cobra.Command{
 		Use:   "deletejobs [id]",
 		Short: "Delete all jobs associated with machine",
@@ -203,6 +528,7 @@ pass in more than one task.`,
 	op.addCommand(tasks)
 	var exitOnFailure = false
 	var oneShot = false
+	var sendInventory = true
 	processJobs := &cobra.Command{
 		Use:   "processjobs [id]",
 		Short: "For the given machine, process pending jobs until done.",
@@ -231,11 +557,15 @@ the stage runner wait flag.
 			if oneShot {
 				agent = agent.Timeout(time.Second)
 			}
+			if sendInventory {
+				agent = agent.Inventory(gatherInventory)
+			}
 			return agent.Run()
 		},
 	}
 	processJobs.Flags().BoolVar(&exitOnFailure, "exit-on-failure", false, "Exit on failure of a task")
 	processJobs.Flags().BoolVar(&oneShot, "oneshot", false, "Do not wait for additional tasks to appear")
+	processJobs.Flags().BoolVar(&sendInventory, "inventory", true, "Upload the hardware inventory of the system before processing tasks")
 	op.addCommand(processJobs)
 	op.command(app)
 }
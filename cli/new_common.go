@@ -27,7 +27,7 @@ func maybeEncryptParam(param string,
 	if err := session.FillModel(p, param); err != nil {
 		return val, nil
 	}
-	if !p.Secure {
+	if !p.Secure || isSecretRef(val) {
 		return val, nil
 	}
 	k := []byte{}
@@ -39,6 +39,22 @@ func maybeEncryptParam(param string,
 	return sv, sv.Marshal(k, val)
 }
 
+// isSecretRef returns true if val is a reference to a secret in an
+// external secret store, which is passed to the server as-is.  Such
+// references are objects whose only key is SecretRef.
+func isSecretRef(val interface{}) bool {
+	fields, ok := val.(map[string]interface{})
+	if !ok || len(fields) != 1 {
+		return false
+	}
+	ref, ok := fields["SecretRef"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	path, ok := ref["Path"].(string)
+	return ok && path != ""
+}
+
 func (o *ops) refOrFill(key string) (data models.Model, err error) {
 	data = o.example()
 
@@ -245,4 +245,23 @@ func (o *ops) params() {
 			return prettyPrint(param)
 		},
 	})
+	o.addCommand(&cobra.Command{
+		Use:   "rotatekey [id]",
+		Short: fmt.Sprintf("Rotate the secure param key of the %s", o.singleName),
+		Long:  fmt.Sprintf(`Replace the key used to seal the secure params of the %s and reseal them with the new key.`, o.singleName),
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			uuid := args[0]
+			var pk []byte
+			if err := session.Req().Post(nil).UrlFor(o.name, uuid, "rotatekey").Do(&pk); err != nil {
+				return generateError(err, "Failed to rotate key for %v: %v", o.singleName, uuid)
+			}
+			return prettyPrint(pk)
+		},
+	})
 }
@@ -0,0 +1,19 @@
+package cli
+
+import (
+	"github.com/digitalrebar/provision/models"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	addRegistrar(registerPolicy)
+}
+
+func registerPolicy(app *cobra.Command) {
+	op := &ops{
+		name:       "policies",
+		singleName: "policy",
+		example:    func() models.Model { return &models.Policy{} },
+	}
+	op.command(app)
+}
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	addRegistrar(registerPool)
+}
+
+func registerPool(app *cobra.Command) {
+	op := &ops{
+		name:       "pools",
+		singleName: "pool",
+		example:    func() models.Model { return &models.Pool{} },
+	}
+	op.addCommand(&cobra.Command{
+		Use:   "members [id]",
+		Short: "List the machines that are members of the pool",
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			res := []*models.Machine{}
+			if err := session.Req().UrlFor("pools", args[0], "members").Do(&res); err != nil {
+				return generateError(err, "Failed to list members of %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
+	var lease int
+	allocate := &cobra.Command{
+		Use:   "allocate [id] [count]",
+		Short: "Allocate count machines from the pool",
+		Long: `Allocate count free machines from the pool.  Either all of them
+are allocated, or none are.  The machines are released back to the
+pool when their lease runs out.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			count, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("Invalid count %s: %v", args[1], err)
+			}
+			res, err := session.AllocateMachines(args[0], &models.PoolAllocation{Count: count, Lease: lease})
+			if err != nil {
+				return generateError(err, "Failed to allocate from %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	}
+	allocate.Flags().IntVar(&lease, "lease", 0, "How long in seconds to allocate the machines for.  0 uses the default of the pool")
+	op.addCommand(allocate)
+	var force bool
+	release := &cobra.Command{
+		Use:   "release [id] [machine uuids...]",
+		Short: "Release machines back to the pool",
+		Long: `Release machines back to the pool.  If no machines are listed,
+every machine in the pool allocated to you is released.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("%v requires at least 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			req := &models.PoolRelease{Machines: []uuid.UUID{}, Force: force}
+			for _, arg := range args[1:] {
+				id := uuid.Parse(arg)
+				if id == nil {
+					return fmt.Errorf("Invalid machine UUID %s", arg)
+				}
+				req.Machines = append(req.Machines, id)
+			}
+			res, err := session.ReleaseMachines(args[0], req)
+			if err != nil {
+				return generateError(err, "Failed to release to %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	}
+	release.Flags().BoolVar(&force, "force", false, "Release machines allocated to someone else")
+	op.addCommand(release)
+	op.command(app)
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/digitalrebar/provision/api"
+	"github.com/digitalrebar/provision/models"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	addRegistrar(registerRollout)
+}
+
+func registerRollout(app *cobra.Command) {
+	op := &ops{
+		name:       "rollouts",
+		singleName: "rollout",
+		example:    func() models.Model { return &models.Rollout{} },
+	}
+	for _, ctl := range []struct {
+		cmd, short, long string
+		run              func(*api.Client, *models.Rollout) (*models.Rollout, error)
+	}{
+		{"pause", "Pause a rollout",
+			`Stop a rollout from starting more machines.  Machines that are
+already running the workflow carry on.`,
+			(*api.Client).PauseRollout},
+		{"resume", "Resume a paused or halted rollout",
+			`Let a paused or halted rollout carry on.  Resuming a halted
+rollout lets its current wave finish regardless of how many of its
+machines fail.`,
+			(*api.Client).ResumeRollout},
+	} {
+		ctl := ctl
+		op.addCommand(&cobra.Command{
+			Use:   ctl.cmd + " [id]",
+			Short: ctl.short,
+			Long:  ctl.long,
+			Args: func(c *cobra.Command, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("%v requires 1 argument", c.UseLine())
+				}
+				return nil
+			},
+			RunE: func(c *cobra.Command, args []string) error {
+				r, err := op.refOrFill(args[0])
+				if err != nil {
+					return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+				}
+				res, err := ctl.run(session, r.(*models.Rollout))
+				if err != nil {
+					return generateError(err, "Failed to %v %v", ctl.cmd, args[0])
+				}
+				return prettyPrint(res)
+			},
+		})
+	}
+	op.addCommand(&cobra.Command{
+		Use:   "status [id]",
+		Short: "Show the progress of a rollout",
+		Long: `Show the state and current wave of a rollout, why it halted, and
+how many of its machines are waiting, running, succeeded, and failed.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			obj, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			r := obj.(*models.Rollout)
+			return prettyPrint(map[string]interface{}{
+				"State":    r.State,
+				"Reason":   r.Reason,
+				"Wave":     r.Wave,
+				"Machines": r.Counts(),
+			})
+		},
+	})
+	op.command(app)
+}
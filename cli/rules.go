@@ -0,0 +1,19 @@
+package cli
+
+import (
+	"github.com/digitalrebar/provision/models"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	addRegistrar(registerRule)
+}
+
+func registerRule(app *cobra.Command) {
+	op := &ops{
+		name:       "rules",
+		singleName: "rule",
+		example:    func() models.Model { return &models.Rule{} },
+	}
+	op.command(app)
+}
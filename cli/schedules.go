@@ -0,0 +1,19 @@
+package cli
+
+import (
+	"github.com/digitalrebar/provision/models"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	addRegistrar(registerSchedule)
+}
+
+func registerSchedule(app *cobra.Command) {
+	op := &ops{
+		name:       "schedules",
+		singleName: "schedule",
+		example:    func() models.Model { return &models.Schedule{} },
+	}
+	op.command(app)
+}
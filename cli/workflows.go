@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"fmt"
+
 	"github.com/digitalrebar/provision/models"
 	"github.com/spf13/cobra"
 )
@@ -15,5 +17,33 @@ func registerWorkflow(app *cobra.Command) {
 		singleName: "workflow",
 		example:    func() models.Model { return &models.Workflow{} },
 	}
+	graphDot := false
+	graph := &cobra.Command{
+		Use:   "graph [id]",
+		Short: "Show the expanded structure of the workflow",
+		Long: `Show the stages and flow control steps of the workflow, with the
+bootenvs, profiles, and tasks of each stage, and whether each of them
+is available.  With --dot, the graph is printed in the Graphviz DOT
+language, e.g. drpcli workflows graph foo --dot | dot -Tsvg > foo.svg`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			res, err := session.WorkflowGraph(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch the graph of %v: %v", op.singleName, args[0])
+			}
+			if graphDot {
+				fmt.Print(res.Dot())
+				return nil
+			}
+			return prettyPrint(res)
+		},
+	}
+	graph.Flags().BoolVar(&graphDot, "dot", false, "Print the graph in the Graphviz DOT language")
+	op.addCommand(graph)
 	op.command(app)
 }
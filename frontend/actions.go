@@ -30,6 +30,216 @@ type ActionPostResponse struct {
 	Body interface{}
 }
 
+// builtinAction is an Action that dr-provision runs itself instead
+// of handing it to a plugin.
+type builtinAction struct {
+	models.AvailableAction
+	locks []string
+	// readOnly builtins do not change anything, so bulk requests
+	// run them even when dry running.
+	readOnly bool
+	run      func(rt *backend.RequestTracker, obj models.Model, params map[string]interface{}) (interface{}, error)
+}
+
+// machineControl makes a builtin machine Action that runs op.
+func machineControl(cmd string, op func(*backend.RequestTracker, *backend.Machine) (*backend.Machine, error)) *builtinAction {
+	return &builtinAction{
+		AvailableAction: models.AvailableAction{
+			Provider:       "dr-provision",
+			Model:          "machines",
+			Command:        cmd,
+			RequiredParams: []string{},
+			OptionalParams: []string{},
+		},
+		locks: append((&backend.Machine{}).Locks("update"), "jobs"),
+		run: func(rt *backend.RequestTracker, obj models.Model, params map[string]interface{}) (interface{}, error) {
+			m, err := op(rt, backend.AsMachine(obj))
+			if err != nil {
+				return nil, err
+			}
+			return m.Machine, nil
+		},
+	}
+}
+
+// rolloutControl makes a builtin rollout Action that runs op.
+func rolloutControl(cmd string, op func(*backend.RequestTracker, *backend.Rollout) (*backend.Rollout, error)) *builtinAction {
+	return &builtinAction{
+		AvailableAction: models.AvailableAction{
+			Provider:       "dr-provision",
+			Model:          "rollouts",
+			Command:        cmd,
+			RequiredParams: []string{},
+			OptionalParams: []string{},
+		},
+		locks: (&backend.Rollout{}).Locks("update"),
+		run: func(rt *backend.RequestTracker, obj models.Model, params map[string]interface{}) (interface{}, error) {
+			r, err := op(rt, backend.AsRollout(obj))
+			if err != nil {
+				return nil, err
+			}
+			return r.Rollout, nil
+		},
+	}
+}
+
+// stringParam returns the string params[name], or an error that
+// says why it is not usable.
+func stringParam(prefix, key, name string, params map[string]interface{}) (string, error) {
+	val, ok := params[name].(string)
+	if !ok || val == "" {
+		e := &models.Error{Code: http.StatusBadRequest, Type: "INVOKE", Model: prefix, Key: key}
+		e.Errorf("Parameter %s must be a non-empty string", name)
+		return "", e
+	}
+	return val, nil
+}
+
+// checkWorkflow is the builtin machine Action that checks whether
+// the workflow param would work on the machine.
+var checkWorkflow = &builtinAction{
+	AvailableAction: models.AvailableAction{
+		Provider:       "dr-provision",
+		Model:          "machines",
+		Command:        "checkWorkflow",
+		RequiredParams: []string{"workflow"},
+		OptionalParams: []string{},
+	},
+	locks:    backend.WorkflowCheckLocks,
+	readOnly: true,
+	run: func(rt *backend.RequestTracker, obj models.Model, params map[string]interface{}) (interface{}, error) {
+		wf, err := stringParam(obj.Prefix(), obj.Key(), "workflow", params)
+		if err != nil {
+			return nil, err
+		}
+		return rt.CheckWorkflow(backend.AsMachine(obj), wf), nil
+	},
+}
+
+// checkMachine is the builtin workflow Action that checks whether the
+// workflow would work on the machine param.
+var checkMachine = &builtinAction{
+	AvailableAction: models.AvailableAction{
+		Provider:       "dr-provision",
+		Model:          "workflows",
+		Command:        "checkMachine",
+		RequiredParams: []string{"machine"},
+		OptionalParams: []string{},
+	},
+	locks:    backend.WorkflowCheckLocks,
+	readOnly: true,
+	run: func(rt *backend.RequestTracker, obj models.Model, params map[string]interface{}) (interface{}, error) {
+		id, err := stringParam(obj.Prefix(), obj.Key(), "machine", params)
+		if err != nil {
+			return nil, err
+		}
+		m := rt.Find("machines", id)
+		if m == nil {
+			e := &models.Error{Code: http.StatusNotFound, Type: "INVOKE", Model: "machines", Key: id}
+			e.Errorf("Not Found")
+			return nil, e
+		}
+		return rt.CheckWorkflow(backend.AsMachine(m), obj.Key()), nil
+	},
+}
+
+// renameMachine is the builtin machine Action that renames the
+// machine with its name template.
+var renameMachine = func() *builtinAction {
+	res := machineControl("rename", (*backend.RequestTracker).RenameMachine)
+	res.locks = backend.MachineRenameLocks
+	return res
+}()
+
+// lockMachine is the builtin machine Action that locks the machine
+// for the reason param.
+var lockMachine = &builtinAction{
+	AvailableAction: models.AvailableAction{
+		Provider:       "dr-provision",
+		Model:          "machines",
+		Command:        "lock",
+		RequiredParams: []string{"reason"},
+		OptionalParams: []string{},
+	},
+	locks: (&backend.Machine{}).Locks("update"),
+	run: func(rt *backend.RequestTracker, obj models.Model, params map[string]interface{}) (interface{}, error) {
+		reason, err := stringParam(obj.Prefix(), obj.Key(), "reason", params)
+		if err != nil {
+			return nil, err
+		}
+		m, err := rt.LockMachine(backend.AsMachine(obj), reason)
+		if err != nil {
+			return nil, err
+		}
+		return m.Machine, nil
+	},
+}
+
+// builtinActions are the builtin Actions, by object type and command.
+var builtinActions = map[string]map[string]*builtinAction{
+	"machines": {
+		"pause":         machineControl("pause", (*backend.RequestTracker).PauseMachine),
+		"resume":        machineControl("resume", (*backend.RequestTracker).ResumeMachine),
+		"cancel":        machineControl("cancel", (*backend.RequestTracker).CancelMachine),
+		"rename":        renameMachine,
+		"lock":          lockMachine,
+		"unlock":        machineControl("unlock", (*backend.RequestTracker).UnlockMachine),
+		"checkWorkflow": checkWorkflow,
+	},
+	"workflows": {
+		"checkMachine": checkMachine,
+	},
+	"rollouts": {
+		"pause":  rolloutControl("pause", (*backend.RequestTracker).PauseRollout),
+		"resume": rolloutControl("resume", (*backend.RequestTracker).ResumeRollout),
+	},
+}
+
+// checkParams returns an error if any of the RequiredParams of ba are
+// missing from params.
+func (ba *builtinAction) checkParams(prefix, key string, params map[string]interface{}) *models.Error {
+	for _, param := range ba.RequiredParams {
+		if _, ok := params[param]; !ok {
+			be := &models.Error{Code: http.StatusBadRequest, Type: "INVOKE", Model: prefix, Key: key}
+			be.Errorf("Action %s Missing Parameter %s", ba.Command, param)
+			return be
+		}
+	}
+	return nil
+}
+
+// runBuiltin runs the builtin Action ba with params on the object of
+// type prefix with key key.
+//
+// THIS MUST NOT BE CALLED UNDER LOCKS!
+func (f *Frontend) runBuiltin(c *gin.Context, ba *builtinAction, prefix, key string, params map[string]interface{}) (interface{}, *models.Error) {
+	if be := ba.checkParams(prefix, key, params); be != nil {
+		return nil, be
+	}
+	var res interface{}
+	var err error
+	rt := f.rt(c, ba.locks...)
+	rt.Do(func(d backend.Stores) {
+		obj := rt.Find(prefix, key)
+		if obj == nil {
+			be := &models.Error{Code: http.StatusNotFound, Type: "INVOKE", Model: prefix, Key: key}
+			be.Errorf("Not Found")
+			err = be
+			return
+		}
+		res, err = ba.run(rt, obj, params)
+	})
+	if err != nil {
+		be, ok := err.(*models.Error)
+		if !ok {
+			be = &models.Error{Code: http.StatusConflict, Type: "INVOKE", Model: prefix, Key: key}
+			be.AddError(err)
+		}
+		return nil, be
+	}
+	return res, nil
+}
+
 func (f *Frontend) makeActionEndpoints(cmdSet string, obj models.Model, idKey string) (
 	getActions, getAction, runAction func(c *gin.Context)) {
 	plugin := func(c *gin.Context) string {
@@ -60,6 +270,11 @@ func (f *Frontend) makeActionEndpoints(cmdSet string, obj models.Model, idKey st
 				return
 			}
 			p := plugin(c)
+			if p == "" {
+				for _, ba := range builtinActions[cmdSet] {
+					actions = append(actions, ba.AvailableAction)
+				}
+			}
 			for _, laa := range f.pc.Actions.List(cmdSet) {
 				for _, aa := range laa {
 					if p != "" && p != aa.Plugin.Plugin.Name {
@@ -96,6 +311,10 @@ func (f *Frontend) makeActionEndpoints(cmdSet string, obj models.Model, idKey st
 			}
 			err.Errorf("%s: Not Found", cmd)
 			p := plugin(c)
+			if ba, ok := builtinActions[cmdSet][cmd]; ok && p == "" {
+				c.JSON(http.StatusOK, ba.AvailableAction)
+				return
+			}
 			laa, _ := f.pc.Actions.Get(cmdSet, cmd)
 			for _, aa := range laa {
 				if p != "" && p != aa.Plugin.Plugin.Name {
@@ -127,6 +346,15 @@ func (f *Frontend) makeActionEndpoints(cmdSet string, obj models.Model, idKey st
 			if ref == nil {
 				return
 			}
+			if ba, ok := builtinActions[cmdSet][cmd]; ok && plugin(c) == "" {
+				retval, err := f.runBuiltin(c, ba, obj.Prefix(), id, val)
+				if err != nil {
+					c.JSON(err.Code, err)
+					return
+				}
+				c.JSON(http.StatusOK, retval)
+				return
+			}
 			res := &models.Action{
 				Model:   ref,
 				Plugin:  plugin(c),
@@ -0,0 +1,301 @@
+package frontend
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
+)
+
+// BulkResponse returned on a successful bulk operation
+// swagger:response
+type BulkResponse struct {
+	// in: body
+	Body *models.BulkResponse
+}
+
+// BulkParameter is the bulk operation to perform
+// swagger:parameters bulkOperation
+type BulkParameter struct {
+	// in: path
+	// required: true
+	Prefix string `json:"prefix"`
+	// in: body
+	// required: true
+	Body *models.BulkRequest
+}
+
+// bulkError turns err into a *models.Error for a BulkResult.
+func bulkError(err error, prefix, key string) *models.Error {
+	if err == nil {
+		return nil
+	}
+	if be, ok := err.(*models.Error); ok {
+		return be
+	}
+	res := &models.Error{
+		Type:  "BULK",
+		Code:  http.StatusConflict,
+		Model: prefix,
+		Key:   key,
+	}
+	res.AddError(err)
+	return res
+}
+
+// bulkPatch applies the Patch of req to the object key.
+//
+// THIS MUST NOT BE CALLED UNDER LOCKS!
+func (f *Frontend) bulkPatch(c *gin.Context, ref models.Model, key string, req *models.BulkRequest) *models.BulkResult {
+	res := &models.BulkResult{Key: key}
+	auth := f.getAuth(c)
+	if !auth.matchClaim(patchClaims(ref.Prefix(), key, req.Patch)) || !auth.isLicensed(ref.Prefix(), "patch") {
+		res.Error = &models.Error{Type: "AUTH", Code: http.StatusForbidden, Model: ref.Prefix(), Key: key}
+		res.Error.Errorf("Cannot patch %s %s", ref.Prefix(), key)
+		return res
+	}
+	rt := f.rt(c, ref.(Lockable).Locks("update")...)
+	rt.Do(func(d backend.Stores) {
+		before := rt.Find(ref.Prefix(), key)
+		if before == nil {
+			res.Error = &models.Error{Type: "BULK", Code: http.StatusNotFound, Model: ref.Prefix(), Key: key}
+			res.Error.Errorf("Not Found")
+			return
+		}
+		before = models.Clone(before)
+		var after models.Model
+		var err error
+		if req.DryRun {
+			after, err = rt.DryRunPatch(ref, key, req.Patch)
+		} else {
+			after, err = rt.Patch(ref, key, req.Patch)
+		}
+		if err != nil {
+			res.Error = bulkError(err, ref.Prefix(), key)
+			return
+		}
+		changes, _ := models.GenPatch(before, after, false)
+		res.Changed = len(changes) > 0
+	})
+	return res
+}
+
+// bulkAction runs the Action of req on the object key.
+//
+// THIS MUST NOT BE CALLED UNDER LOCKS!
+func (f *Frontend) bulkAction(c *gin.Context, ref models.Model, key string, req *models.BulkRequest) *models.BulkResult {
+	res := &models.BulkResult{Key: key}
+	auth := f.getAuth(c)
+	action := "action:" + req.Action
+	if !auth.matchClaim(models.MakeRole("", ref.Prefix(), action, key).Compile()) || !auth.isLicensed(ref.Prefix(), action) {
+		res.Error = &models.Error{Type: "AUTH", Code: http.StatusForbidden, Model: ref.Prefix(), Key: key}
+		res.Error.Errorf("Cannot run %s on %s %s", req.Action, ref.Prefix(), key)
+		return res
+	}
+	rt := f.rt(c, ref.(Lockable).Locks("actions")...)
+	var obj models.Model
+	rt.Do(func(d backend.Stores) {
+		obj = rt.Find(ref.Prefix(), key)
+	})
+	if obj == nil {
+		res.Error = &models.Error{Type: "BULK", Code: http.StatusNotFound, Model: ref.Prefix(), Key: key}
+		res.Error.Errorf("Not Found")
+		return res
+	}
+	if ba, ok := builtinActions[ref.Prefix()][req.Action]; ok && req.Plugin == "" {
+		if req.DryRun && !ba.readOnly {
+			// Builtins that change things cannot be run without
+			// changing them, so only their params can be checked.
+			if res.Error = ba.checkParams(ref.Prefix(), key, req.Params); res.Error == nil {
+				res.Changed = true
+				res.Unchecked = true
+			}
+			return res
+		}
+		res.Changed = !ba.readOnly
+		retval, err := f.runBuiltin(c, ba, ref.Prefix(), key, req.Params)
+		if err != nil {
+			res.Changed = false
+			res.Error = err
+			return res
+		}
+		res.Result = retval
+		return res
+	}
+	params := map[string]interface{}{}
+	for k, v := range req.Params {
+		params[k] = v
+	}
+	ma, verr := validateAction(f, rt, ref.Prefix(), key, &models.Action{
+		Model:   obj,
+		Plugin:  req.Plugin,
+		Command: req.Action,
+		Params:  params,
+	})
+	if verr != nil {
+		res.Error = verr
+		return res
+	}
+	res.Changed = true
+	if req.DryRun {
+		return res
+	}
+	rt.Publish(ref.Prefix(), req.Action, key, ma)
+	retval, err := f.pc.Actions.Run(rt, ref.Prefix(), ma)
+	if err != nil {
+		res.Changed = false
+		res.Error = bulkError(err, ref.Prefix(), key)
+		return res
+	}
+	res.Result = retval
+	return res
+}
+
+// runBulk performs req on each of keys, running up to
+// req.Concurrency of them at once.
+func (f *Frontend) runBulk(c *gin.Context, ref models.Model, keys []string, req *models.BulkRequest) *models.BulkResponse {
+	res := &models.BulkResponse{
+		DryRun:  req.DryRun,
+		Matched: len(keys),
+		Results: make([]*models.BulkResult, len(keys)),
+	}
+	workers := req.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	wg := &sync.WaitGroup{}
+	mux := &sync.Mutex{}
+	stopped := false
+	for i, key := range keys {
+		sem <- struct{}{}
+		mux.Lock()
+		skip := stopped
+		mux.Unlock()
+		if skip {
+			<-sem
+			res.Results[i] = &models.BulkResult{Key: key, Skipped: true}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var r *models.BulkResult
+			if req.Action != "" {
+				r = f.bulkAction(c, ref, key, req)
+			} else {
+				r = f.bulkPatch(c, ref, key, req)
+			}
+			res.Results[i] = r
+			if r.Error != nil && req.StopOnError && !req.DryRun {
+				mux.Lock()
+				stopped = true
+				mux.Unlock()
+			}
+		}(i, key)
+	}
+	wg.Wait()
+	for _, r := range res.Results {
+		switch {
+		case r.Skipped:
+			res.Skipped++
+		case r.Error != nil:
+			res.Failed++
+		case r.Changed:
+			res.Changed++
+		}
+		if r.Unchecked {
+			res.Unchecked++
+		}
+	}
+	return res
+}
+
+func (f *Frontend) InitBulkApi() {
+	// swagger:route POST /bulk/{prefix} Bulk bulkOperation
+	//
+	// Patch or run an action on many objects at once
+	//
+	// Applies a JSON patch to, or runs an action on, every object of
+	// the type {prefix} that matches the Filter of the request.  The
+	// Filter uses the same syntax as the query parameters of the list
+	// API.  Each object is changed in its own transaction, and the
+	// outcome for each object is returned.  A DryRun reports which
+	// objects would be changed and which would fail validation,
+	// without changing anything.  Builtin actions that change the
+	// object cannot be dry run; only their params are checked, and
+	// their results are marked Unchecked.
+	//
+	//     Responses:
+	//       200: BulkResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.POST("/bulk/:prefix",
+		func(c *gin.Context) {
+			req := &models.BulkRequest{}
+			if !assureDecode(c, req) {
+				return
+			}
+			prefix := c.Param("prefix")
+			res := &models.Error{
+				Type:  c.Request.Method,
+				Code:  http.StatusBadRequest,
+				Model: prefix,
+			}
+			m, err := models.New(prefix)
+			var ref models.Model
+			if err == nil {
+				ref = backend.ModelToBackend(m)
+			}
+			if _, ok := ref.(Lockable); !ok {
+				res.Code = http.StatusNotFound
+				res.Errorf("bulk: not found: %s", prefix)
+				c.JSON(res.Code, res)
+				return
+			}
+			if !f.assureSimpleAuth(c, prefix, "list", "") {
+				return
+			}
+			req.Validate(res)
+			query, err := url.ParseQuery(req.Filter)
+			if err != nil {
+				res.Errorf("Invalid Filter %s: %v", req.Filter, err)
+			}
+			if res.ContainsError() {
+				c.JSON(res.Code, res)
+				return
+			}
+			keys := []string{}
+			rt := f.rt(c, ref.(Lockable).Locks("get")...)
+			rt.Do(func(d backend.Stores) {
+				filters, err := f.processFilters(rt, d, ref, query)
+				if err != nil {
+					res.AddError(err)
+					return
+				}
+				items, err := index.All(filters...)(&d(prefix).Index)
+				if err != nil {
+					res.AddError(err)
+					return
+				}
+				auth := f.getAuth(c)
+				for _, item := range items.Items() {
+					if auth.Find(rt, prefix, item.Key()) != nil {
+						keys = append(keys, item.Key())
+					}
+				}
+			})
+			if res.ContainsError() {
+				c.JSON(res.Code, res)
+				return
+			}
+			c.JSON(http.StatusOK, f.runBulk(c, ref, keys, req))
+		})
+}
@@ -136,7 +136,7 @@ func (a *authBlob) isLicensed(scope, action string) bool {
 	switch action {
 	case "list", "get":
 		return true
-	case "getSecure", "updateSecure":
+	case "getSecure", "updateSecure", "rotateKey":
 		license := a.f.dt.LicenseFor("secure-params")
 		return license != nil && license.Active
 	default:
@@ -144,6 +144,9 @@ func (a *authBlob) isLicensed(scope, action string) bool {
 		case "roles", "tenants":
 			license := a.f.dt.LicenseFor("rbac")
 			return license != nil && license.Active
+		case "keyrotation":
+			license := a.f.dt.LicenseFor("secure-params")
+			return license != nil && license.Active
 		default:
 			return true
 		}
@@ -201,11 +204,31 @@ func (f *Frontend) Find(c *gin.Context, rt *backend.RequestTracker, prefix, key
 
 func (f *Frontend) rt(c *gin.Context, locks ...string) *backend.RequestTracker {
 	if c != nil {
-		return f.dt.Request(f.l(c), locks...)
+		return f.dt.Request(f.l(c), locks...).SetPrincipal(principal(c))
 	}
 	return f.dt.Request(f.Logger, locks...)
 }
 
+// principal returns who the request is being made on behalf of, based
+// on the auth token used for the request.
+func principal(c *gin.Context) string {
+	b, ok := c.Get("DRP-AUTH")
+	if !ok {
+		return ""
+	}
+	auth := b.(*authBlob)
+	if auth.claim == nil {
+		return ""
+	}
+	if auth.claim.GrantorClaims.UserId != "" {
+		return auth.claim.GrantorClaims.UserId
+	}
+	if auth.claim.GrantorClaims.MachineUuid != "" {
+		return "machine:" + auth.claim.GrantorClaims.MachineUuid
+	}
+	return ""
+}
+
 type AuthSource interface {
 	GetUser(f *Frontend, c *gin.Context, username string) *backend.User
 }
@@ -496,7 +519,13 @@ func NewFrontend(
 	me.InitEventApi()
 	me.InitContentApi()
 	me.InitTenantApi()
+	me.InitPoolApi()
+	me.InitScheduleApi()
+	me.InitRolloutApi()
+	me.InitRuleApi()
+	me.InitPolicyApi()
 	me.InitSystemApi()
+	me.InitBulkApi()
 
 	if EmbeddedAssetsServerFunc != nil {
 		EmbeddedAssetsServerFunc(mgmtApi, lgr)
@@ -594,9 +623,10 @@ func (f *Frontend) assureSimpleAuth(c *gin.Context, scope, action, specific stri
 	return f.assureAuth(c, wantsClaims, scope, action, specific)
 }
 
-func (f *Frontend) assureAuthUpdate(c *gin.Context,
-	scope, action, specific string,
-	patch jsonpatch2.Patch) bool {
+// patchClaims returns the claims needed to apply patch to the object
+// specific in scope.  Writing a SecretRef also needs updateSecure, the
+// same as getting the key to seal a secure value with.
+func patchClaims(scope, specific string, patch jsonpatch2.Patch) models.Claims {
 	claims := []string{}
 	for _, line := range patch {
 		switch line.Op {
@@ -608,9 +638,17 @@ func (f *Frontend) assureAuthUpdate(c *gin.Context,
 		default:
 			claims = append(claims, scope, "update:"+line.Path, specific)
 		}
+		if (line.Op == "add" || line.Op == "replace") && backend.ContainsSecretRef(line.Value) {
+			claims = append(claims, scope, "updateSecure", specific)
+		}
 	}
-	wantsClaims := models.MakeRole("", claims...).Compile()
-	return f.assureAuth(c, wantsClaims, scope, action, specific)
+	return models.MakeRole("", claims...).Compile()
+}
+
+func (f *Frontend) assureAuthUpdate(c *gin.Context,
+	scope, action, specific string,
+	patch jsonpatch2.Patch) bool {
+	return f.assureAuth(c, patchClaims(scope, specific, patch), scope, action, specific)
 }
 
 func assureDecode(c *gin.Context, val interface{}) bool {
@@ -631,59 +669,12 @@ func assureDecode(c *gin.Context, val interface{}) bool {
 	return false
 }
 
-// This processes the value into a function, if function not specified, assume Eq.
-// Supported Forms:
-//
-//   Eq(value)
-//   Lt(value)
-//   Lte(value)
-//   Gt(value)
-//   Gte(value)
-//   Ne(value)
-//   Between(valueLower, valueHigher)
-//   Except(valueLower, valueHigher)
-//
-func convertValueToFilter(v string) (index.Filter, error) {
-	args := strings.SplitN(v, "(", 2)
-	switch args[0] {
-	case "Eq":
-		subargs := strings.SplitN(args[1], ")", 2)
-		return index.Eq(subargs[0]), nil
-	case "Lt":
-		subargs := strings.SplitN(args[1], ")", 2)
-		return index.Lt(subargs[0]), nil
-	case "Lte":
-		subargs := strings.SplitN(args[1], ")", 2)
-		return index.Lte(subargs[0]), nil
-	case "Gt":
-		subargs := strings.SplitN(args[1], ")", 2)
-		return index.Gt(subargs[0]), nil
-	case "Gte":
-		subargs := strings.SplitN(args[1], ")", 2)
-		return index.Gte(subargs[0]), nil
-	case "Ne":
-		subargs := strings.SplitN(args[1], ")", 2)
-		return index.Ne(subargs[0]), nil
-	case "Between":
-		subargs := strings.SplitN(args[1], ")", 2)
-		parts := strings.Split(subargs[0], ",")
-		return index.Between(parts[0], parts[1]), nil
-	case "Except":
-		subargs := strings.SplitN(args[1], ")", 2)
-		parts := strings.Split(subargs[0], ",")
-		return index.Except(parts[0], parts[1]), nil
-	default:
-		return index.Eq(v), nil
-	}
-}
-
 type dynParameter interface {
 	ParameterMaker(*backend.RequestTracker, string) (index.Maker, error)
 }
 
 func (f *Frontend) processFilters(rt *backend.RequestTracker, d backend.Stores, ref models.Model, params map[string][]string) ([]index.Filter, error) {
 	filters := []index.Filter{}
-	var err error
 	var indexes map[string]index.Maker
 	if indexer, ok := ref.(index.Indexer); ok {
 		indexes = indexer.Indexes()
@@ -695,30 +686,11 @@ func (f *Frontend) processFilters(rt *backend.RequestTracker, d backend.Stores,
 		if k == "offset" || k == "limit" || k == "sort" || k == "reverse" || k == "slim" {
 			continue
 		}
-		maker, ok := indexes[k]
-		pMaker, found := ref.(dynParameter)
-		if !ok {
-			if !found {
-				return nil, fmt.Errorf("Filter not found: %s", k)
-			}
-			maker, err = pMaker.ParameterMaker(rt, k)
-			if err != nil {
-				return nil, err
-			}
-			ok = true
-		}
-		if ok {
-			filters = append(filters, index.Sort(maker))
-			subfilters := []index.Filter{}
-			for _, v := range vs {
-				f, err := convertValueToFilter(v)
-				if err != nil {
-					return nil, err
-				}
-				subfilters = append(subfilters, f)
-			}
-			filters = append(filters, index.Any(subfilters...))
+		subfilters, err := rt.FilterFor(ref, k, vs)
+		if err != nil {
+			return nil, err
 		}
+		filters = append(filters, subfilters...)
 	}
 
 	if vs, ok := params["sort"]; ok {
@@ -793,6 +765,10 @@ func processItem(obj models.Model, slim string) models.Model {
 			if o, ok := obj.(models.Paramer); ok {
 				o.SetParams(map[string]interface{}{})
 			}
+		case "inventory":
+			if o, ok := obj.(*models.Machine); ok {
+				o.Inventory = nil
+			}
 		default:
 			// ignore for now -- will add more later, maybe
 		}
@@ -905,6 +881,10 @@ func (f *Frontend) create(c *gin.Context, val store.KeySaver) {
 	if !f.assureSimpleAuth(c, val.Prefix(), "create", "") {
 		return
 	}
+	if p, ok := val.(models.Paramer); ok && backend.ContainsSecretRef(p.GetParams()) &&
+		!f.assureSimpleAuth(c, val.Prefix(), "updateSecure", "") {
+		return
+	}
 	var err error
 	var res models.Model
 	tenant := f.getAuth(c).currentTenant
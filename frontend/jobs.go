@@ -2,6 +2,7 @@ package frontend
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -171,6 +172,12 @@ type JobActionBodyParameter struct {
 	Body map[string]interface{}
 }
 
+// isTaskStep returns true if the task list entry s is a stage,
+// bootenv, or flow control step rather than something that runs Tasks.
+func isTaskStep(s string) bool {
+	return strings.Contains(s, ":") && !models.IsTaskGroup(s)
+}
+
 func (f *Frontend) InitJobApi() {
 	// swagger:route GET /jobs Jobs listJobs
 	//
@@ -328,6 +335,22 @@ func (f *Frontend) InitJobApi() {
 					code = http.StatusConflict
 					return
 				}
+				// Paused machines hold until they are resumed.
+				if oldM.Paused {
+					rt.Infof("Machine %s is paused", b.Machine.String())
+					err = &models.Error{Code: http.StatusConflict, Type: "Conflict",
+						Messages: []string{fmt.Sprintf("Machine %s is paused", b.Machine.String())}}
+					code = http.StatusConflict
+					return
+				}
+				// Locked machines hold until they are unlocked.
+				if oldM.Locked {
+					rt.Infof("Machine %s is locked by %s", b.Machine.String(), oldM.LockOwner)
+					err = &models.Error{Code: http.StatusConflict, Type: "Conflict",
+						Messages: []string{fmt.Sprintf("Machine %s is locked by %s (%s)", b.Machine.String(), oldM.LockOwner, oldM.LockReason)}}
+					code = http.StatusConflict
+					return
+				}
 				m := backend.ModelToBackend(models.Clone(oldM)).(*backend.Machine)
 				m.InRunner()
 				// Are we running a job or not on list yet, do some checking.
@@ -336,13 +359,24 @@ func (f *Frontend) InitJobApi() {
 				} else if m.CurrentJob != nil && len(m.CurrentJob) > 0 {
 					cj.Uuid = m.CurrentJob
 				}
+				// The state of a task group is the state of all of its
+				// members taken together.  If some members have not been
+				// started yet, start the next one, unless an earlier
+				// member has failed or been cancelled.  That stops the
+				// group, and it is handled like any other failed or
+				// cancelled Job.
+				groupJob, groupPending := m.TaskGroupJob(rt)
+				if groupJob != nil {
+					cj = groupJob
+					groupPending = false
+				}
 				if m.CurrentTask >= len(m.Tasks) {
 					rt.Infof("Machine %s is out of tasks", b.Machine.String())
 					return
 				}
 				nextTask := m.CurrentTask + 1
 				skipCurrentCheck := false
-				if m.CurrentTask == -1 || strings.Contains(m.Tasks[m.CurrentTask], ":") {
+				if m.CurrentTask == -1 || isTaskStep(m.Tasks[m.CurrentTask]) {
 					// At this point, we are starting over on the task list
 					// We could have been forced and need to close out a job.
 					// if it is running, created, or incomplete, we need
@@ -365,12 +399,14 @@ func (f *Frontend) InitJobApi() {
 						rt.Infof("Machine %s is out of tasks", b.Machine.String())
 						return
 					}
-					if strings.Contains(m.Tasks[m.CurrentTask], ":") {
+					if isTaskStep(m.Tasks[m.CurrentTask]) {
+						lastJob := rt.LastTaskJob(cj)
+						jumps := 0
 						// If we return from inside this for loop, it will be with NoContent
 						for i := m.CurrentTask; i < len(m.Tasks); i++ {
 							rt.Infof("Machine %s ([%d]%s)is checking to see if it needs to change stage", b.Machine.String(), i, m.Tasks[i])
 							st := strings.SplitN(m.Tasks[i], ":", 2)
-							if len(st) != 2 {
+							if !isTaskStep(m.Tasks[i]) {
 								rt.Infof("Machine %s rolled forward to ([%d]%s)", b.Machine.String(), i, m.Tasks[i])
 								m.CurrentTask = i
 								nextTask = i
@@ -390,6 +426,26 @@ func (f *Frontend) InitJobApi() {
 								}
 								rt.Infof("Machine %s is changing bootenv from %s to %s", b.Machine.String(), m.BootEnv, st[1])
 								m.BootEnv = st[1]
+							case "if", "goto":
+								next, stepErr := m.NextStep(rt, i, lastJob)
+								jumps++
+								if stepErr == nil && jumps > len(m.Tasks) {
+									stepErr = fmt.Errorf("Task list loops at entry[%d]: '%s' without running a task", i, m.Tasks[i])
+								}
+								if stepErr != nil {
+									code = http.StatusInternalServerError
+									err = &models.Error{
+										Code:  code,
+										Type:  "InvalidTaskList",
+										Key:   m.Key(),
+										Model: m.Prefix(),
+									}
+									err.(*models.Error).AddError(stepErr)
+									return
+								}
+								rt.Infof("Machine %s step ([%d]%s) continues at %d", b.Machine.String(), i, m.Tasks[i], next)
+								i = next - 1
+								continue
 							default:
 								code = http.StatusInternalServerError
 								err = &models.Error{
@@ -411,7 +467,7 @@ func (f *Frontend) InitJobApi() {
 						}
 					}
 				}
-				if !skipCurrentCheck {
+				if !skipCurrentCheck && !groupPending {
 					switch cj.State {
 					case "incomplete":
 						rt.Infof("Machine %s task %s at %d is incomplete, rerunning it",
@@ -425,10 +481,38 @@ func (f *Frontend) InitJobApi() {
 							cj.Machine.String(), cj.Task, m.CurrentTask, nextTask)
 						m.CurrentTask = nextTask
 					case "failed":
+						if m.FailureHandled(m.CurrentTask, cj) {
+							rt.Infof("Machine %s task %s at %d is failed, advancing to %d to handle it",
+								cj.Machine.String(), cj.Task, m.CurrentTask, nextTask)
+							m.CurrentTask = nextTask
+							break
+						}
 						rt.Infof("Machine %s task %s at %d is failed, retrying",
 							cj.Machine.String(), cj.Task, m.CurrentTask)
 						// Someone has set the machine back to runnable and wants
-						// to rerun the current task again.  Let them
+						// to rerun the current task again.  Let them.
+						// A failed task group is rerun from its first member.
+						m.CurrentJobs = []uuid.UUID{}
+					case "cancelled":
+						if m.FailureHandled(m.CurrentTask, cj) {
+							rt.Infof("Machine %s task %s at %d was cancelled, advancing to %d to handle it",
+								cj.Machine.String(), cj.Task, m.CurrentTask, nextTask)
+							m.CurrentTask = nextTask
+							break
+						}
+						rt.Infof("Machine %s task %s at %d was cancelled, rerunning it",
+							cj.Machine.String(), cj.Task, m.CurrentTask)
+						m.CurrentJobs = []uuid.UUID{}
+					case "created":
+						if cj.Attempt > 1 {
+							// The server created this job to retry a failed one.
+							rt.Infof("Machine %s task %s at %d is being retried (attempt %d)",
+								cj.Machine.String(), cj.Task, m.CurrentTask, cj.Attempt)
+							b = cj
+							code = http.StatusAccepted
+							return
+						}
+						fallthrough
 					default:
 						rt.Warnf("Machine %s task %s at %d is %s, conflict",
 							cj.Machine.String(), cj.Task, m.CurrentTask, cj.State)
@@ -441,13 +525,22 @@ func (f *Frontend) InitJobApi() {
 				}
 				if m.CurrentTask >= len(m.Tasks) {
 					rt.Infof("Machine %s as no more tasks", cj.Machine.String())
+					m.CurrentJobs = []uuid.UUID{}
+					rt.RetireJobs(oldM.CurrentJobs, m.CurrentJobs)
 					if _, err = rt.Update(m); err != nil {
 						code = http.StatusInternalServerError
 					}
 					code = http.StatusNoContent
 					return
 				}
+				if m.CurrentTask != oldM.CurrentTask {
+					m.CurrentJobs = []uuid.UUID{}
+				}
 				thisTask := m.Tasks[m.CurrentTask]
+				members := models.TaskGroupMembers(thisTask)
+				if members != nil {
+					thisTask = members[len(m.CurrentJobs)]
+				}
 				b.StartTime = time.Now()
 				b.Previous = cj.Uuid
 				b.Machine = m.Uuid
@@ -457,7 +550,7 @@ func (f *Frontend) InitJobApi() {
 				b.CurrentIndex = m.CurrentTask
 				b.NextIndex = m.CurrentTask + 1
 				b.Task = thisTask
-				if strings.Contains(thisTask, ":") {
+				if isTaskStep(thisTask) {
 					b.State = "finished"
 					b.ExitState = "complete"
 					if oldM.Stage != m.Stage {
@@ -468,11 +561,22 @@ func (f *Frontend) InitJobApi() {
 					b.Previous = cj.Uuid
 					code = http.StatusCreated
 				}
+				if members != nil && len(m.CurrentJobs) > 0 {
+					// Every member of a task group follows the Job that
+					// ran before the group, so that they all stay current.
+					if first := rt.Find("jobs", m.CurrentJobs[0].String()); first != nil {
+						b.Previous = backend.AsJob(first).Previous
+					}
+				}
 				if _, err = rt.Create(b); err != nil {
 					code = http.StatusInternalServerError
 					return
 				}
 				m.CurrentJob = b.Uuid
+				if members != nil {
+					m.CurrentJobs = append(m.CurrentJobs, b.Uuid)
+				}
+				rt.RetireJobs(oldM.CurrentJobs, m.CurrentJobs)
 				rt.Infof("Created job %s for task %s at index %d", b.UUID(), b.Task, b.CurrentIndex)
 				if _, err = rt.Update(m); err != nil {
 					code = http.StatusInternalServerError
@@ -661,7 +765,8 @@ func (f *Frontend) InitJobApi() {
 			j := &backend.Job{}
 			var bad bool
 			var err *models.Error
-			var path string
+			var log io.ReadCloser
+			var logErr error
 			rt := f.rt(c, j.Locks("get")...)
 			rt.Do(func(d backend.Stores) {
 				var jo models.Model
@@ -672,19 +777,28 @@ func (f *Frontend) InitJobApi() {
 					return
 				}
 				j = backend.AsJob(jo)
-				path = j.LogPath(rt)
+				// Archived job logs are compressed, so read them through
+				// OpenLog rather than serving the file directly.
+				log, logErr = j.OpenLog(rt)
 			})
 			if bad {
 				c.JSON(err.Code, err)
 				return
 			}
+			if logErr != nil {
+				c.JSON(http.StatusNotFound,
+					models.NewError(c.Request.Method, http.StatusNotFound, logErr.Error()))
+				return
+			}
+			defer log.Close()
 
 			if !f.assureSimpleAuth(c, "jobs", "log", j.AuthKey()) {
 				return
 			}
 
 			c.Writer.Header().Set("Content-Type", "application/octet-stream")
-			c.File(path)
+			c.Status(http.StatusOK)
+			io.Copy(c.Writer, log)
 		})
 
 	// swagger:route PUT /jobs/{uuid}/log Jobs putJobLog
@@ -1,6 +1,10 @@
 package frontend
 
 import (
+	"net/http"
+	"strconv"
+	"time"
+
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/provision/models"
@@ -43,6 +47,48 @@ type MachineParamResponse struct {
 	Body interface{}
 }
 
+// MachineHistoryResponse return on a successful GET of the lifecycle history of a Machine
+// swagger:response
+type MachineHistoryResponse struct {
+	// in: body
+	Body []*models.MachineChange
+}
+
+// MachineInventoryResponse return on a successful GET or POST of the inventory of a Machine
+// swagger:response
+type MachineInventoryResponse struct {
+	// in: body
+	Body *models.Inventory
+}
+
+// MachineInventoryVersionsResponse return on a successful GET of the inventory versions of a Machine
+// swagger:response
+type MachineInventoryVersionsResponse struct {
+	// in: body
+	Body []int
+}
+
+// MachineInventoryDiffResponse return on a successful GET of the differences between two inventories of a Machine
+// swagger:response
+type MachineInventoryDiffResponse struct {
+	// in: body
+	Body jsonpatch2.Patch
+}
+
+// MachineDuplicatesResponse return on a successful GET of all the duplicate Machines
+// swagger:response
+type MachineDuplicatesResponse struct {
+	// in: body
+	Body []*models.MachineDuplicate
+}
+
+// MachineDuplicateResponse return on a successful GET of the duplicates of a Machine
+// swagger:response
+type MachineDuplicateResponse struct {
+	// in: body
+	Body *models.MachineDuplicate
+}
+
 // MachineBodyParameter used to inject a Machine
 // swagger:parameters createMachine putMachine
 type MachineBodyParameter struct {
@@ -88,7 +134,7 @@ type MachinePostParamsParameter struct {
 }
 
 // MachinePathParameter used to find a Machine in the path
-// swagger:parameters putMachines getMachine putMachine patchMachine deleteMachine headMachine patchMachineParams postMachineParams getMachinePubKey
+// swagger:parameters putMachines getMachine putMachine patchMachine deleteMachine headMachine patchMachineParams postMachineParams getMachinePubKey getMachineInventoryVersions getMachineDuplicates
 type MachinePathParameter struct {
 	// in: path
 	// required: true
@@ -137,6 +183,72 @@ type MachineGetParamPathParemeter struct {
 	Key string `json:"key"`
 }
 
+// MachineHistoryParameter used to select the lifecycle history of a Machine
+// swagger:parameters getMachineHistory
+type MachineHistoryParameter struct {
+	// in: query
+	Field string `json:"field"`
+	// in: query
+	// swagger:strfmt date-time
+	Since string `json:"since"`
+	// in: query
+	// swagger:strfmt date-time
+	Until string `json:"until"`
+	// in: path
+	// required: true
+	// swagger:strfmt uuid
+	Uuid uuid.UUID `json:"uuid"`
+}
+
+// MachineInventoryParameter used to upload the inventory of a Machine
+// swagger:parameters postMachineInventory
+type MachineInventoryParameter struct {
+	// in: path
+	// required: true
+	// swagger:strfmt uuid
+	Uuid uuid.UUID `json:"uuid"`
+	// in: body
+	// required: true
+	Body *models.Inventory
+}
+
+// MachineGetInventoryParameter used to get the inventory of a Machine
+// swagger:parameters getMachineInventory
+type MachineGetInventoryParameter struct {
+	// in: query
+	Version int `json:"version"`
+	// in: path
+	// required: true
+	// swagger:strfmt uuid
+	Uuid uuid.UUID `json:"uuid"`
+}
+
+// MachineInventoryDiffParameter used to compare two inventories of a Machine
+// swagger:parameters getMachineInventoryDiff
+type MachineInventoryDiffParameter struct {
+	// in: query
+	From int `json:"from"`
+	// in: query
+	To int `json:"to"`
+	// in: path
+	// required: true
+	// swagger:strfmt uuid
+	Uuid uuid.UUID `json:"uuid"`
+}
+
+// MachineMergeParameter used to merge a duplicate into a Machine
+// swagger:parameters mergeMachine
+type MachineMergeParameter struct {
+	// in: path
+	// required: true
+	// swagger:strfmt uuid
+	Uuid uuid.UUID `json:"uuid"`
+	// in: path
+	// required: true
+	// swagger:strfmt uuid
+	Duplicate uuid.UUID `json:"duplicate"`
+}
+
 // MachineActionsPathParameter used to find a Machine / Actions in the path
 // swagger:parameters getMachineActions
 type MachineActionsPathParameter struct {
@@ -355,6 +467,354 @@ func (f *Frontend) InitMachineApi() {
 			f.Exists(c, &backend.Machine{}, c.Param(`uuid`))
 		})
 
+	// swagger:route GET /machines/{uuid}/history Machines getMachineHistory
+	//
+	// Get the lifecycle history of a Machine
+	//
+	// Get the changes to the Stage, BootEnv, Workflow, Runnable, Address,
+	// and CurrentTask of the Machine specified by {uuid}, oldest first.
+	//
+	// Optionally, query parameters can be used to limit the history to a
+	// single field, and to changes made in a time range in RFC3339 format.
+	//   e.g. ?field=Stage&since=2018-01-02T15:04:05Z
+	//
+	//     Responses:
+	//       200: MachineHistoryResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/history",
+		func(c *gin.Context) {
+			machine := &backend.Machine{}
+			id := c.Param(`uuid`)
+			if !f.assureSimpleAuth(c, machine.Prefix(), "get", id) {
+				return
+			}
+			res := &models.Error{
+				Code:  http.StatusBadRequest,
+				Type:  c.Request.Method,
+				Model: machine.Prefix(),
+				Key:   id,
+			}
+			times := map[string]time.Time{}
+			for _, q := range []string{"since", "until"} {
+				if v := c.Query(q); v != "" {
+					t, err := time.Parse(time.RFC3339, v)
+					if err != nil {
+						res.Errorf("Invalid %s time %s: %v", q, v, err)
+					}
+					times[q] = t
+				}
+			}
+			if res.ContainsError() {
+				c.JSON(res.Code, res)
+				return
+			}
+			rt := f.rt(c, machine.Locks("get")...)
+			ob := f.Find(c, rt, machine.Prefix(), id)
+			if ob == nil {
+				return
+			}
+			history, err := rt.MachineHistory(backend.AsMachine(ob), c.Query("field"), times["since"], times["until"])
+			if err != nil {
+				res.Code = http.StatusInternalServerError
+				res.AddError(err)
+				c.JSON(res.Code, res)
+				return
+			}
+			c.JSON(http.StatusOK, history)
+		})
+
+	// swagger:route POST /machines/{uuid}/inventory Machines postMachineInventory
+	//
+	// Upload the inventory of a Machine
+	//
+	// Save a new hardware inventory for the Machine specified by
+	// {uuid}.  The inventory gets the next version, and the MAC
+	// addresses of its NICs are added to the HardwareAddrs of the
+	// Machine.
+	//
+	//     Responses:
+	//       200: MachineInventoryResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/machines/:uuid/inventory",
+		func(c *gin.Context) {
+			inv := &models.Inventory{}
+			if !assureDecode(c, inv) {
+				return
+			}
+			machine := &backend.Machine{}
+			id := c.Param(`uuid`)
+			if !f.assureSimpleAuth(c, machine.Prefix(), "update", id) {
+				return
+			}
+			var res *backend.Machine
+			var err error
+			rt := f.rt(c, machine.Locks("update")...)
+			rt.Do(func(d backend.Stores) {
+				ob := f.getAuth(c).Find(rt, machine.Prefix(), id)
+				if ob == nil {
+					err = &models.Error{
+						Code:     http.StatusNotFound,
+						Type:     c.Request.Method,
+						Model:    machine.Prefix(),
+						Key:      id,
+						Messages: []string{"Not Found"},
+					}
+					return
+				}
+				res, err = rt.SetInventory(backend.AsMachine(ob), inv)
+			})
+			if err != nil {
+				be, ok := err.(*models.Error)
+				if !ok {
+					be = &models.Error{Code: http.StatusInternalServerError, Type: c.Request.Method, Model: machine.Prefix(), Key: id}
+					be.AddError(err)
+				}
+				c.JSON(be.Code, be)
+				return
+			}
+			c.JSON(http.StatusOK, res.Inventory)
+		})
+
+	// swagger:route GET /machines/{uuid}/inventory Machines getMachineInventory
+	//
+	// Get the inventory of a Machine
+	//
+	// Get the current hardware inventory of the Machine specified by
+	// {uuid}, or an earlier one if a version is given.
+	//   e.g. ?version=3
+	//
+	//     Responses:
+	//       200: MachineInventoryResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/inventory",
+		func(c *gin.Context) {
+			versions, ok := f.inventoryVersions(c, "version")
+			if !ok {
+				return
+			}
+			f.withInventory(c, func(rt *backend.RequestTracker, m *backend.Machine) (interface{}, error) {
+				return rt.Inventory(m, versions["version"])
+			})
+		})
+
+	// swagger:route GET /machines/{uuid}/inventory/versions Machines getMachineInventoryVersions
+	//
+	// List the inventory versions of a Machine
+	//
+	// List the versions of the hardware inventory of the Machine
+	// specified by {uuid} that have been saved, oldest first.
+	//
+	//     Responses:
+	//       200: MachineInventoryVersionsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/inventory/versions",
+		func(c *gin.Context) {
+			f.withInventory(c, func(rt *backend.RequestTracker, m *backend.Machine) (interface{}, error) {
+				return rt.InventoryVersions(m)
+			})
+		})
+
+	// swagger:route GET /machines/{uuid}/inventory/diff Machines getMachineInventoryDiff
+	//
+	// Compare two inventories of a Machine
+	//
+	// Return the RFC6902 Patch that turns inventory version {from}
+	// of the Machine specified by {uuid} into version {to}.  {to}
+	// defaults to the current inventory, and {from} defaults to the
+	// version before {to}.
+	//   e.g. ?from=2&to=5
+	//
+	//     Responses:
+	//       200: MachineInventoryDiffResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/inventory/diff",
+		func(c *gin.Context) {
+			versions, ok := f.inventoryVersions(c, "from", "to")
+			if !ok {
+				return
+			}
+			f.withInventory(c, func(rt *backend.RequestTracker, m *backend.Machine) (interface{}, error) {
+				to, err := rt.Inventory(m, versions["to"])
+				if err != nil {
+					return nil, err
+				}
+				from := versions["from"]
+				if from == 0 {
+					from = to.Version - 1
+				}
+				old := &models.Inventory{}
+				if from > 0 {
+					if old, err = rt.Inventory(m, from); err != nil {
+						return nil, err
+					}
+				}
+				// Version and Time always differ, so leave them out.
+				a, b := *old, *to
+				a.Version, a.Time = 0, time.Time{}
+				b.Version, b.Time = 0, time.Time{}
+				return models.GenPatch(&a, &b, false)
+			})
+		})
+
+	// swagger:route GET /machine_duplicates Machines listMachineDuplicates
+	//
+	// List duplicate Machines
+	//
+	// List the sets of Machines that appear to be the same system,
+	// because their inventories have the same system serial number or
+	// system UUID, or they share HardwareAddrs.
+	//
+	//     Responses:
+	//       200: MachineDuplicatesResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/machine_duplicates",
+		func(c *gin.Context) {
+			machine := &backend.Machine{}
+			if !f.assureSimpleAuth(c, machine.Prefix(), "list", "") {
+				return
+			}
+			res := []*models.MachineDuplicate{}
+			rt := f.rt(c, machine.Locks("get")...)
+			rt.Do(func(d backend.Stores) {
+				for _, group := range rt.MachineDuplicates() {
+					// Only show the Machines the caller can see.
+					visible := []uuid.UUID{}
+					for _, id := range group.Machines {
+						if f.getAuth(c).Find(rt, machine.Prefix(), id.String()) != nil {
+							visible = append(visible, id)
+						}
+					}
+					if len(visible) > 1 {
+						group.Machines = visible
+						res = append(res, group)
+					}
+				}
+			})
+			c.JSON(http.StatusOK, res)
+		})
+
+	// swagger:route GET /machines/{uuid}/duplicates Machines getMachineDuplicates
+	//
+	// Get the duplicates of a Machine
+	//
+	// Get the Machines that appear to be the same system as the
+	// Machine specified by {uuid}.
+	//
+	//     Responses:
+	//       200: MachineDuplicateResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/duplicates",
+		func(c *gin.Context) {
+			machine := &backend.Machine{}
+			id := c.Param(`uuid`)
+			if !f.assureSimpleAuth(c, machine.Prefix(), "get", id) {
+				return
+			}
+			var res *models.MachineDuplicate
+			rt := f.rt(c, machine.Locks("get")...)
+			rt.Do(func(d backend.Stores) {
+				ob := f.getAuth(c).Find(rt, machine.Prefix(), id)
+				if ob == nil {
+					return
+				}
+				res = rt.DuplicatesOf(backend.AsMachine(ob))
+				visible := []uuid.UUID{}
+				for _, mid := range res.Machines {
+					if f.getAuth(c).Find(rt, machine.Prefix(), mid.String()) != nil {
+						visible = append(visible, mid)
+					}
+				}
+				res.Machines = visible
+			})
+			if res == nil {
+				be := &models.Error{Code: http.StatusNotFound, Type: c.Request.Method, Model: machine.Prefix(), Key: id}
+				be.Errorf("Not Found")
+				c.JSON(be.Code, be)
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+
+	// swagger:route POST /machines/{uuid}/merge/{duplicate} Machines mergeMachine
+	//
+	// Merge a duplicate into a Machine
+	//
+	// Fold the Machine specified by {duplicate} into the Machine
+	// specified by {uuid}, and delete {duplicate}.  Params, Profiles,
+	// Meta, HardwareAddrs, and Jobs of {duplicate} are moved to
+	// {uuid}.  Where both Machines have a value, the one on {uuid}
+	// is kept.
+	//
+	//     Responses:
+	//       200: MachineResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/machines/:uuid/merge/:duplicate",
+		func(c *gin.Context) {
+			machine := &backend.Machine{}
+			id, dupId := c.Param(`uuid`), c.Param(`duplicate`)
+			if !f.assureSimpleAuth(c, machine.Prefix(), "update", id) ||
+				!f.assureSimpleAuth(c, machine.Prefix(), "delete", dupId) {
+				return
+			}
+			var res *backend.Machine
+			var err error
+			rt := f.rt(c, append(machine.Locks("update"), "jobs")...)
+			rt.Do(func(d backend.Stores) {
+				var m, dup models.Model
+				for _, key := range []string{id, dupId} {
+					ob := f.getAuth(c).Find(rt, machine.Prefix(), key)
+					if ob == nil {
+						err = &models.Error{
+							Code:     http.StatusNotFound,
+							Type:     c.Request.Method,
+							Model:    machine.Prefix(),
+							Key:      key,
+							Messages: []string{"Not Found"},
+						}
+						return
+					}
+					if m == nil {
+						m = ob
+					} else {
+						dup = ob
+					}
+				}
+				res, err = rt.MergeMachines(backend.AsMachine(m), backend.AsMachine(dup))
+			})
+			if err != nil {
+				be, ok := err.(*models.Error)
+				if !ok {
+					be = &models.Error{Code: http.StatusInternalServerError, Type: c.Request.Method, Model: machine.Prefix(), Key: id}
+					be.AddError(err)
+				}
+				c.JSON(be.Code, be)
+				return
+			}
+			c.JSON(http.StatusOK, res.Machine)
+		})
+
 	// swagger:route PATCH /machines/{uuid} Machines patchMachine
 	//
 	// Patch a Machine
@@ -421,7 +881,7 @@ func (f *Frontend) InitMachineApi() {
 			f.Remove(c, &backend.Machine{}, c.Param(`uuid`))
 		})
 
-	pGetAll, pGetOne, pPatch, pSetThem, pSetOne, pDeleteOne, pGetPubKey := f.makeParamEndpoints(&backend.Machine{}, "uuid")
+	pGetAll, pGetOne, pPatch, pSetThem, pSetOne, pDeleteOne, pGetPubKey, pRotateKey, pGetHistory, pRevert := f.makeParamEndpoints(&backend.Machine{}, "uuid")
 
 	// swagger:route GET /machines/{uuid}/pubkey Machines getMachinePubKey
 	//
@@ -437,6 +897,21 @@ func (f *Frontend) InitMachineApi() {
 	//       500: ErrorResponse
 	f.ApiGroup.GET("/machines/:uuid/pubkey", pGetPubKey)
 
+	// swagger:route POST /machines/{uuid}/rotatekey Machines rotateMachineKey
+	//
+	// Rotate the key for secure params on a machine
+	//
+	// Replace the key used to seal the secure params of a Machine specified by {uuid}
+	// and reseal all of its secure params with the new key.  Returns the new public key.
+	//
+	//     Responses:
+	//       200: PubKeyResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/machines/:uuid/rotatekey", pRotateKey)
+
 	// swagger:route GET /machines/{uuid}/params Machines getMachineParams
 	//
 	// List machine params Machine
@@ -512,6 +987,41 @@ func (f *Frontend) InitMachineApi() {
 	//       409: ErrorResponse
 	f.ApiGroup.POST("/machines/:uuid/params/*key", pSetOne)
 
+	// swagger:route GET /machines/{uuid}/paramhistory Machines getMachineParamHistory
+	//
+	// Get the param change history for a Machine
+	//
+	// Get the param change history of a Machine specified by {uuid}, oldest first.
+	// The values of secure params are not recorded.
+	//
+	// Optionally, a query parameter can be used to limit the history to a single param.
+	//   e.g. ?key=fred
+	//
+	//     Responses:
+	//       200: ParamHistoryResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/paramhistory", pGetHistory)
+
+	// swagger:route POST /machines/{uuid}/paramhistory/revert Machines revertMachineParams
+	//
+	// Revert the params of a Machine to a point in time
+	//
+	// Revert the params of a Machine specified by {uuid} to the values they
+	// had at the time given by the at query parameter, in RFC3339 format.
+	// Secure params cannot be reverted and are left unchanged.
+	//
+	//     Responses:
+	//       200: ParamRevertResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/machines/:uuid/paramhistory/revert", pRevert)
+
 	machine := &backend.Machine{}
 	pActions, pAction, pRun := f.makeActionEndpoints(machine.Prefix(), machine, "uuid")
 
@@ -565,3 +1075,50 @@ func (f *Frontend) InitMachineApi() {
 	f.ApiGroup.POST("/machines/:uuid/actions/:cmd", pRun)
 
 }
+
+// inventoryVersions parses the named inventory version query
+// parameters.  Missing ones are 0.
+func (f *Frontend) inventoryVersions(c *gin.Context, names ...string) (map[string]int, bool) {
+	res := map[string]int{}
+	for _, name := range names {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			be := &models.Error{Code: http.StatusBadRequest, Type: c.Request.Method, Model: "machines", Key: c.Param(`uuid`)}
+			be.Errorf("Invalid %s %s", name, v)
+			c.JSON(be.Code, be)
+			return nil, false
+		}
+		res[name] = i
+	}
+	return res, true
+}
+
+// withInventory returns the result of op on the Machine in the path
+// to the client.
+func (f *Frontend) withInventory(c *gin.Context, op func(*backend.RequestTracker, *backend.Machine) (interface{}, error)) {
+	machine := &backend.Machine{}
+	id := c.Param(`uuid`)
+	if !f.assureSimpleAuth(c, machine.Prefix(), "get", id) {
+		return
+	}
+	rt := f.rt(c, machine.Locks("get")...)
+	ob := f.Find(c, rt, machine.Prefix(), id)
+	if ob == nil {
+		return
+	}
+	res, err := op(rt, backend.AsMachine(ob))
+	if err != nil {
+		be, ok := err.(*models.Error)
+		if !ok {
+			be = &models.Error{Code: http.StatusInternalServerError, Type: c.Request.Method, Model: machine.Prefix(), Key: id}
+			be.AddError(err)
+		}
+		c.JSON(be.Code, be)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
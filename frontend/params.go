@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
@@ -12,7 +13,7 @@ import (
 )
 
 func (f *Frontend) makeParamEndpoints(obj models.Paramer, idKey string) (
-	getAll, getOne, patchThem, setThem, setOne, deleteOne, getPubKey func(c *gin.Context)) {
+	getAll, getOne, patchThem, setThem, setOne, deleteOne, getPubKey, rotateKey, getHistory, revert func(c *gin.Context)) {
 	trimmer := func(s string) string {
 		return strings.TrimLeft(s, `/`)
 	}
@@ -221,9 +222,116 @@ func (f *Frontend) makeParamEndpoints(obj models.Paramer, idKey string) (
 			} else {
 				c.JSON(http.StatusOK, pk)
 			}
+		},
+		/* rotateKey */ func(c *gin.Context) {
+			id, rt, _ := idrtkey(c, "update")
+			if !f.assureSimpleAuth(c, obj.Prefix(), "rotateKey", id) {
+				return
+			}
+			ob := f.Find(c, rt, obj.Prefix(), id)
+			if ob == nil {
+				return
+			}
+			var pk []byte
+			var err error
+			rt.Do(func(_ backend.Stores) {
+				if _, err = rt.RotateKey(ob.(models.Paramer)); err == nil {
+					pk, err = rt.PublicKeyFor(ob)
+				}
+			})
+			if err != nil {
+				ret := &models.Error{
+					Code:  http.StatusConflict,
+					Model: ob.Prefix(),
+					Key:   ob.Key(),
+					Type:  "Bad Secret",
+				}
+				ret.AddError(err)
+				c.JSON(ret.Code, ret)
+			} else {
+				c.JSON(http.StatusOK, pk)
+			}
+		},
+		/* getHistory */ func(c *gin.Context) {
+			id, rt, _ := idrtkey(c, "get")
+			if !f.assureSimpleAuth(c, obj.Prefix(), "get", id) {
+				return
+			}
+			ob := f.Find(c, rt, obj.Prefix(), id)
+			if ob == nil {
+				return
+			}
+			history, err := rt.ParamHistory(ob.(models.Paramer), c.Query("key"))
+			if err != nil {
+				res := &models.Error{
+					Code:  http.StatusInternalServerError,
+					Type:  c.Request.Method,
+					Model: obj.Prefix(),
+					Key:   id,
+				}
+				res.AddError(err)
+				c.JSON(res.Code, res)
+				return
+			}
+			c.JSON(http.StatusOK, history)
+		},
+		/* revert */ func(c *gin.Context) {
+			id, rt, _ := idrtkey(c, "update")
+			if !f.assureSimpleAuth(c, obj.Prefix(), "update", id) {
+				return
+			}
+			revertErr := &models.Error{
+				Code:  http.StatusBadRequest,
+				Type:  c.Request.Method,
+				Model: obj.Prefix(),
+				Key:   id,
+			}
+			at, err := time.Parse(time.RFC3339, c.Query("at"))
+			if err != nil {
+				revertErr.Errorf("Invalid revert time %s: %v", c.Query("at"), err)
+				c.JSON(revertErr.Code, revertErr)
+				return
+			}
+			ob := f.Find(c, rt, obj.Prefix(), id)
+			if ob == nil {
+				return
+			}
+			var res models.Model
+			var skipped []string
+			rt.Do(func(_ backend.Stores) {
+				res, skipped, err = rt.RevertParams(ob.(models.Paramer), at)
+			})
+			if err != nil {
+				if be, ok := err.(*models.Error); ok {
+					c.JSON(be.Code, be)
+					return
+				}
+				revertErr.Code = http.StatusInternalServerError
+				revertErr.AddError(err)
+				c.JSON(revertErr.Code, revertErr)
+				return
+			}
+			c.JSON(http.StatusOK, &models.ParamRevert{
+				Params:  res.(models.Paramer).GetParams(),
+				Skipped: skipped,
+			})
 		}
 }
 
+// ParamHistoryResponse returned on a successful GET of the param history of an object
+// swagger:response
+type ParamHistoryResponse struct {
+	// in: body
+	Body []*models.ParamChange
+}
+
+// ParamRevertResponse returned on a successful revert of the params of an object
+// swagger:response
+type ParamRevertResponse struct {
+	// in: body
+	Body *models.ParamRevert
+}
+
 // ParamResponse returned on a successful GET, PUT, PATCH, or POST of a single param
 // swagger:response
 type ParamResponse struct {
@@ -372,7 +372,7 @@ func (f *Frontend) InitPluginApi() {
 			f.Remove(c, &backend.Plugin{}, c.Param(`name`))
 		})
 
-	pGetAll, pGetOne, pPatch, pSetThem, pSetOne, pDeleteOne, pGetPubKey := f.makeParamEndpoints(&backend.Plugin{}, "name")
+	pGetAll, pGetOne, pPatch, pSetThem, pSetOne, pDeleteOne, pGetPubKey, pRotateKey, pGetHistory, pRevert := f.makeParamEndpoints(&backend.Plugin{}, "name")
 
 	// swagger:route GET /plugins/{name}/pubkey Plugins getPluginPubKey
 	//
@@ -388,6 +388,21 @@ func (f *Frontend) InitPluginApi() {
 	//       500: ErrorResponse
 	f.ApiGroup.GET("/plugins/:name/pubkey", pGetPubKey)
 
+	// swagger:route POST /plugins/{name}/rotatekey Plugins rotatePluginKey
+	//
+	// Rotate the key for secure params on a plugin
+	//
+	// Replace the key used to seal the secure params of a Plugin specified by {name}
+	// and reseal all of its secure params with the new key.  Returns the new public key.
+	//
+	//     Responses:
+	//       200: PubKeyResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/plugins/:name/rotatekey", pRotateKey)
+
 	// swagger:route GET /plugins/{name}/params Plugins getPluginParams
 	//
 	// List plugin params Plugin
@@ -463,6 +478,41 @@ func (f *Frontend) InitPluginApi() {
 	//       409: ErrorResponse
 	f.ApiGroup.POST("/plugins/:name/params/*key", pSetOne)
 
+	// swagger:route GET /plugins/{name}/paramhistory Plugins getPluginParamHistory
+	//
+	// Get the param change history for a Plugin
+	//
+	// Get the param change history of a Plugin specified by {name}, oldest first.
+	// The values of secure params are not recorded.
+	//
+	// Optionally, a query parameter can be used to limit the history to a single param.
+	//   e.g. ?key=fred
+	//
+	//     Responses:
+	//       200: ParamHistoryResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/plugins/:name/paramhistory", pGetHistory)
+
+	// swagger:route POST /plugins/{name}/paramhistory/revert Plugins revertPluginParams
+	//
+	// Revert the params of a Plugin to a point in time
+	//
+	// Revert the params of a Plugin specified by {name} to the values they
+	// had at the time given by the at query parameter, in RFC3339 format.
+	// Secure params cannot be reverted and are left unchanged.
+	//
+	//     Responses:
+	//       200: ParamRevertResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/plugins/:name/paramhistory/revert", pRevert)
+
 	plugin := &backend.Plugin{}
 	pActions, pAction, pRun := f.makeActionEndpoints(plugin.Prefix(), plugin, "name")
 
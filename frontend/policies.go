@@ -0,0 +1,344 @@
+package frontend
+
+import (
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
+)
+
+// PolicyResponse returned on a successful GET, PUT, PATCH, or POST of a single policy
+// swagger:response
+type PolicyResponse struct {
+	// in: body
+	Body *models.Policy
+}
+
+// PoliciesResponse returned on a successful GET of all the policies
+// swagger:response
+type PoliciesResponse struct {
+	//in: body
+	Body []*models.Policy
+}
+
+// PolicyBodyParameter used to inject a Policy
+// swagger:parameters createPolicy putPolicy
+type PolicyBodyParameter struct {
+	// in: body
+	// required: true
+	Body *models.Policy
+}
+
+// PolicyPatchBodyParameter used to patch a Policy
+// swagger:parameters patchPolicy
+type PolicyPatchBodyParameter struct {
+	// in: body
+	// required: true
+	Body jsonpatch2.Patch
+}
+
+// PolicyPathParameter used to name a Policy in the path
+// swagger:parameters putPolicies getPolicy putPolicy patchPolicy deletePolicy headPolicy
+type PolicyPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+}
+
+// PolicyListPathParameter used to limit lists of Policy by path options
+// swagger:parameters listPolicies listStatsPolicies
+type PolicyListPathParameter struct {
+	// in: query
+	Offest int `json:"offset"`
+	// in: query
+	Limit int `json:"limit"`
+	// in: query
+	Available string
+	// in: query
+	Valid string
+	// in: query
+	ReadOnly string
+	// in: query
+	Name string
+	// in: query
+	Type string
+}
+
+// PolicyActionsPathParameter used to find a Policy / Actions in the path
+// swagger:parameters getPolicyActions
+type PolicyActionsPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// PolicyActionPathParameter used to find a Policy / Action in the path
+// swagger:parameters getPolicyAction
+type PolicyActionPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// PolicyActionBodyParameter used to post a Policy / Action in the path
+// swagger:parameters postPolicyAction
+type PolicyActionBodyParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+	// in: body
+	// required: true
+	Body map[string]interface{}
+}
+
+func (f *Frontend) InitPolicyApi() {
+	// swagger:route GET /policies Policies listPolicies
+	//
+	// Lists Policies filtered by some parameters.
+	//
+	// This will show all Policies by default.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    Type = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: PoliciesResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.GET("/policies",
+		func(c *gin.Context) {
+			f.List(c, &backend.Policy{})
+		})
+
+	// swagger:route HEAD /policies Policies listStatsPolicies
+	//
+	// Stats of the List Policies filtered by some parameters.
+	//
+	// This will return headers with the stats of the list.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    Type = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: NoContentResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.HEAD("/policies",
+		func(c *gin.Context) {
+			f.ListStats(c, &backend.Policy{})
+		})
+
+	// swagger:route POST /policies Policies createPolicy
+	//
+	// Create a Policy
+	//
+	// Create a Policy from the provided object
+	//
+	//     Responses:
+	//       201: PolicyResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/policies",
+		func(c *gin.Context) {
+			b := &backend.Policy{}
+			f.Create(c, b)
+		})
+	// swagger:route GET /policies/{name} Policies getPolicy
+	//
+	// Get a Policy
+	//
+	// Get the Policy specified by {name} or return NotFound.
+	//
+	//     Responses:
+	//       200: PolicyResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/policies/:name",
+		func(c *gin.Context) {
+			f.Fetch(c, &backend.Policy{}, c.Param(`name`))
+		})
+
+	// swagger:route HEAD /policies/{name} Policies headPolicy
+	//
+	// See if a Policy exists
+	//
+	// Return 200 if the Policy specifiec by {name} exists, or return NotFound.
+	//
+	//     Responses:
+	//       200: NoContentResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: NoContentResponse
+	f.ApiGroup.HEAD("/policies/:name",
+		func(c *gin.Context) {
+			f.Exists(c, &backend.Policy{}, c.Param(`name`))
+		})
+
+	// swagger:route PATCH /policies/{name} Policies patchPolicy
+	//
+	// Patch a Policy
+	//
+	// Update a Policy specified by {name} using a RFC6902 Patch structure
+	//
+	//     Responses:
+	//       200: PolicyResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       406: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PATCH("/policies/:name",
+		func(c *gin.Context) {
+			f.Patch(c, &backend.Policy{}, c.Param(`name`))
+		})
+
+	// swagger:route PUT /policies/{name} Policies putPolicy
+	//
+	// Put a Policy
+	//
+	// Update a Policy specified by {name} using a JSON Policy
+	//
+	//     Responses:
+	//       200: PolicyResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PUT("/policies/:name",
+		func(c *gin.Context) {
+			f.Update(c, &backend.Policy{}, c.Param(`name`))
+		})
+
+	// swagger:route DELETE /policies/{name} Policies deletePolicy
+	//
+	// Delete a Policy
+	//
+	// Delete a Policy specified by {name}
+	//
+	//     Responses:
+	//       200: PolicyResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.DELETE("/policies/:name",
+		func(c *gin.Context) {
+			f.Remove(c, &backend.Policy{}, c.Param(`name`))
+		})
+
+	policy := &backend.Policy{}
+	pActions, pAction, pRun := f.makeActionEndpoints(policy.Prefix(), policy, "name")
+
+	// swagger:route GET /policies/{name}/actions Policies getPolicyActions
+	//
+	// List policy actions Policy
+	//
+	// List Policy actions for a Policy specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/policies/:name/actions", pActions)
+
+	// swagger:route GET /policies/{name}/actions/{cmd} Policies getPolicyAction
+	//
+	// List specific action for a policy Policy
+	//
+	// List specific {cmd} action for a Policy specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/policies/:name/actions/:cmd", pAction)
+
+	// swagger:route POST /policies/{name}/actions/{cmd} Policies postPolicyAction
+	//
+	// Call an action on the policy.
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//
+	//     Responses:
+	//       400: ErrorResponse
+	//       200: ActionPostResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/policies/:name/actions/:cmd", pRun)
+}
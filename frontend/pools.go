@@ -0,0 +1,508 @@
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
+)
+
+// PoolResponse returned on a successful GET, PUT, PATCH, or POST of a single pool
+// swagger:response
+type PoolResponse struct {
+	// in: body
+	Body *models.Pool
+}
+
+// PoolsResponse returned on a successful GET of all the pools
+// swagger:response
+type PoolsResponse struct {
+	//in: body
+	Body []*models.Pool
+}
+
+// PoolBodyParameter used to inject a Pool
+// swagger:parameters createPool putPool
+type PoolBodyParameter struct {
+	// in: body
+	// required: true
+	Body *models.Pool
+}
+
+// PoolPatchBodyParameter used to patch a Pool
+// swagger:parameters patchPool
+type PoolPatchBodyParameter struct {
+	// in: body
+	// required: true
+	Body jsonpatch2.Patch
+}
+
+// PoolPathParameter used to name a Pool in the path
+// swagger:parameters putPools getPool putPool patchPool deletePool headPool
+type PoolPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+}
+
+// PoolMachinesResponse returned on a successful allocation from,
+// release to, or listing of the members of a pool
+// swagger:response
+type PoolMachinesResponse struct {
+	//in: body
+	Body []*models.Machine
+}
+
+// PoolMembersParameter used to list the members of a Pool
+// swagger:parameters getPoolMembers
+type PoolMembersParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+}
+
+// PoolAllocateParameter used to allocate Machines from a Pool
+// swagger:parameters allocatePool
+type PoolAllocateParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: body
+	// required: true
+	Body *models.PoolAllocation
+}
+
+// PoolReleaseParameter used to release Machines to a Pool
+// swagger:parameters releasePool
+type PoolReleaseParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: body
+	Body *models.PoolRelease
+}
+
+// PoolListPathParameter used to limit lists of Pool by path options
+// swagger:parameters listPools listStatsPools
+type PoolListPathParameter struct {
+	// in: query
+	Offest int `json:"offset"`
+	// in: query
+	Limit int `json:"limit"`
+	// in: query
+	Available string
+	// in: query
+	Valid string
+	// in: query
+	ReadOnly string
+	// in: query
+	Name string
+	// in: query
+	ReleaseWorkflow string
+}
+
+// PoolActionsPathParameter used to find a Pool / Actions in the path
+// swagger:parameters getPoolActions
+type PoolActionsPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// PoolActionPathParameter used to find a Pool / Action in the path
+// swagger:parameters getPoolAction
+type PoolActionPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// PoolActionBodyParameter used to post a Pool / Action in the path
+// swagger:parameters postPoolAction
+type PoolActionBodyParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+	// in: body
+	// required: true
+	Body map[string]interface{}
+}
+
+func (f *Frontend) InitPoolApi() {
+	// swagger:route GET /pools Pools listPools
+	//
+	// Lists Pools filtered by some parameters.
+	//
+	// This will show all Pools by default.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    ReleaseWorkflow = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: PoolsResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.GET("/pools",
+		func(c *gin.Context) {
+			f.List(c, &backend.Pool{})
+		})
+
+	// swagger:route HEAD /pools Pools listStatsPools
+	//
+	// Stats of the List Pools filtered by some parameters.
+	//
+	// This will return headers with the stats of the list.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    ReleaseWorkflow = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: NoContentResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.HEAD("/pools",
+		func(c *gin.Context) {
+			f.ListStats(c, &backend.Pool{})
+		})
+
+	// swagger:route POST /pools Pools createPool
+	//
+	// Create a Pool
+	//
+	// Create a Pool from the provided object
+	//
+	//     Responses:
+	//       201: PoolResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/pools",
+		func(c *gin.Context) {
+			b := &backend.Pool{}
+			f.Create(c, b)
+		})
+	// swagger:route GET /pools/{name} Pools getPool
+	//
+	// Get a Pool
+	//
+	// Get the Pool specified by {name} or return NotFound.
+	//
+	//     Responses:
+	//       200: PoolResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/pools/:name",
+		func(c *gin.Context) {
+			f.Fetch(c, &backend.Pool{}, c.Param(`name`))
+		})
+
+	// swagger:route HEAD /pools/{name} Pools headPool
+	//
+	// See if a Pool exists
+	//
+	// Return 200 if the Pool specifiec by {name} exists, or return NotFound.
+	//
+	//     Responses:
+	//       200: NoContentResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: NoContentResponse
+	f.ApiGroup.HEAD("/pools/:name",
+		func(c *gin.Context) {
+			f.Exists(c, &backend.Pool{}, c.Param(`name`))
+		})
+
+	// swagger:route PATCH /pools/{name} Pools patchPool
+	//
+	// Patch a Pool
+	//
+	// Update a Pool specified by {name} using a RFC6902 Patch structure
+	//
+	//     Responses:
+	//       200: PoolResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       406: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PATCH("/pools/:name",
+		func(c *gin.Context) {
+			f.Patch(c, &backend.Pool{}, c.Param(`name`))
+		})
+
+	// swagger:route PUT /pools/{name} Pools putPool
+	//
+	// Put a Pool
+	//
+	// Update a Pool specified by {name} using a JSON Pool
+	//
+	//     Responses:
+	//       200: PoolResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PUT("/pools/:name",
+		func(c *gin.Context) {
+			f.Update(c, &backend.Pool{}, c.Param(`name`))
+		})
+
+	// swagger:route DELETE /pools/{name} Pools deletePool
+	//
+	// Delete a Pool
+	//
+	// Delete a Pool specified by {name}
+	//
+	//     Responses:
+	//       200: PoolResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.DELETE("/pools/:name",
+		func(c *gin.Context) {
+			f.Remove(c, &backend.Pool{}, c.Param(`name`))
+		})
+
+	// swagger:route GET /pools/{name}/members Pools getPoolMembers
+	//
+	// List the members of a Pool
+	//
+	// List the Machines that are members of the Pool specified by
+	// {name}, whether or not they are allocated.
+	//
+	//     Responses:
+	//       200: PoolMachinesResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.GET("/pools/:name/members",
+		func(c *gin.Context) {
+			f.poolOp(c, "get", func(rt *backend.RequestTracker, pool *backend.Pool) ([]*backend.Machine, error) {
+				return pool.Members(rt)
+			})
+		})
+
+	// swagger:route POST /pools/{name}/allocate Pools allocatePool
+	//
+	// Allocate Machines from a Pool
+	//
+	// Allocate Count free Machines from the Pool specified by {name}
+	// to the caller for Lease seconds.  Either all of the Machines
+	// are allocated, or none are.
+	//
+	//     Responses:
+	//       200: PoolMachinesResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/pools/:name/allocate",
+		func(c *gin.Context) {
+			req := &models.PoolAllocation{}
+			if !assureDecode(c, req) {
+				return
+			}
+			f.poolOp(c, "allocate", func(rt *backend.RequestTracker, pool *backend.Pool) ([]*backend.Machine, error) {
+				return rt.AllocateMachines(pool, rt.Principal(), req)
+			})
+		})
+
+	// swagger:route POST /pools/{name}/release Pools releasePool
+	//
+	// Release Machines to a Pool
+	//
+	// Release Machines allocated from the Pool specified by {name}.
+	// If no Machines are listed, every Machine in the Pool allocated
+	// to the caller is released.  Released Machines are switched to
+	// the ReleaseWorkflow of the Pool.
+	//
+	//     Responses:
+	//       200: PoolMachinesResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/pools/:name/release",
+		func(c *gin.Context) {
+			req := &models.PoolRelease{}
+			if !assureDecode(c, req) {
+				return
+			}
+			if req.Force && !f.assureSimpleAuth(c, "pools", "update", c.Param("name")) {
+				return
+			}
+			f.poolOp(c, "release", func(rt *backend.RequestTracker, pool *backend.Pool) ([]*backend.Machine, error) {
+				return rt.ReleaseMachines(pool, rt.Principal(), req)
+			})
+		})
+
+	pool := &backend.Pool{}
+	pActions, pAction, pRun := f.makeActionEndpoints(pool.Prefix(), pool, "name")
+
+	// swagger:route GET /pools/{name}/actions Pools getPoolActions
+	//
+	// List pool actions Pool
+	//
+	// List Pool actions for a Pool specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/pools/:name/actions", pActions)
+
+	// swagger:route GET /pools/{name}/actions/{cmd} Pools getPoolAction
+	//
+	// List specific action for a pool Pool
+	//
+	// List specific {cmd} action for a Pool specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/pools/:name/actions/:cmd", pAction)
+
+	// swagger:route POST /pools/{name}/actions/{cmd} Pools postPoolAction
+	//
+	// Call an action on the node.
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//
+	//     Responses:
+	//       400: ErrorResponse
+	//       200: ActionPostResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/pools/:name/actions/:cmd", pRun)
+}
+
+// poolOp runs op on the Pool in the path with the locks needed to
+// allocate and release Machines, and returns the Machines op returns.
+func (f *Frontend) poolOp(c *gin.Context,
+	action string,
+	op func(*backend.RequestTracker, *backend.Pool) ([]*backend.Machine, error)) {
+	name := c.Param("name")
+	if !f.assureSimpleAuth(c, "pools", action, name) {
+		return
+	}
+	var machines []*backend.Machine
+	var err error
+	found := false
+	rt := f.rt(c, backend.PoolLocks...)
+	rt.Do(func(d backend.Stores) {
+		po := f.getAuth(c).Find(rt, "pools", name)
+		if po == nil {
+			return
+		}
+		found = true
+		machines, err = op(rt, backend.AsPool(po))
+	})
+	if !found {
+		res := &models.Error{
+			Model:    "pools",
+			Key:      name,
+			Code:     http.StatusNotFound,
+			Type:     c.Request.Method,
+			Messages: []string{"Not Found"},
+		}
+		c.JSON(res.Code, res)
+		return
+	}
+	if err != nil {
+		res, ok := err.(*models.Error)
+		if !ok {
+			res = &models.Error{Model: "pools", Key: name, Code: http.StatusInternalServerError, Type: c.Request.Method}
+			res.AddError(err)
+		}
+		c.JSON(res.Code, res)
+		return
+	}
+	res := make([]*models.Machine, len(machines))
+	for i := range machines {
+		res[i] = machines[i].Machine
+	}
+	c.JSON(http.StatusOK, res)
+}
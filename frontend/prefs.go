@@ -76,11 +76,13 @@ func (f *Frontend) InitPrefApi() {
 						err.Errorf("%s: Must be 32 bytes long", k)
 					}
 				case "defaultBootEnv", "unknownBootEnv", "defaultStage", "defaultWorkflow", "systemGrantorSecret",
-					"debugRenderer", "debugDhcp", "debugBootEnv", "debugFrontend", "debugPlugins", "logLevel":
+					"debugRenderer", "debugDhcp", "debugBootEnv", "debugFrontend", "debugPlugins", "logLevel",
+					"machineNameTemplate":
 					if !f.assureSimpleAuth(c, "prefs", "post", k) {
 						return
 					}
-				case "knownTokenTimeout", "unknownTokenTimeout":
+				case "knownTokenTimeout", "unknownTokenTimeout",
+					"jobRetentionCount", "jobRetentionDays", "jobArchiveDays":
 					if !f.assureSimpleAuth(c, "prefs", "post", k) {
 						return
 					}
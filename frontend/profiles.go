@@ -331,7 +331,7 @@ func (f *Frontend) InitProfileApi() {
 			f.Remove(c, &backend.Profile{}, c.Param(`name`))
 		})
 
-	pGetAll, pGetOne, pPatch, pSetThem, pSetOne, pDeleteOne, pGetPubKey := f.makeParamEndpoints(&backend.Profile{}, "name")
+	pGetAll, pGetOne, pPatch, pSetThem, pSetOne, pDeleteOne, pGetPubKey, pRotateKey, pGetHistory, pRevert := f.makeParamEndpoints(&backend.Profile{}, "name")
 
 	// swagger:route GET /profiles/{name}/pubkey Profiles getProfilePubKey
 	//
@@ -347,6 +347,21 @@ func (f *Frontend) InitProfileApi() {
 	//       500: ErrorResponse
 	f.ApiGroup.GET("/profiles/:name/pubkey", pGetPubKey)
 
+	// swagger:route POST /profiles/{name}/rotatekey Profiles rotateProfileKey
+	//
+	// Rotate the key for secure params on a profile
+	//
+	// Replace the key used to seal the secure params of a Profile specified by {name}
+	// and reseal all of its secure params with the new key.  Returns the new public key.
+	//
+	//     Responses:
+	//       200: PubKeyResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/profiles/:name/rotatekey", pRotateKey)
+
 	// swagger:route GET /profiles/{name}/params Profiles getProfileParams
 	//
 	// List profile params Profile
@@ -422,6 +437,41 @@ func (f *Frontend) InitProfileApi() {
 	//       409: ErrorResponse
 	f.ApiGroup.POST("/profiles/:name/params/*key", pSetOne)
 
+	// swagger:route GET /profiles/{name}/paramhistory Profiles getProfileParamHistory
+	//
+	// Get the param change history for a Profile
+	//
+	// Get the param change history of a Profile specified by {name}, oldest first.
+	// The values of secure params are not recorded.
+	//
+	// Optionally, a query parameter can be used to limit the history to a single param.
+	//   e.g. ?key=fred
+	//
+	//     Responses:
+	//       200: ParamHistoryResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/profiles/:name/paramhistory", pGetHistory)
+
+	// swagger:route POST /profiles/{name}/paramhistory/revert Profiles revertProfileParams
+	//
+	// Revert the params of a Profile to a point in time
+	//
+	// Revert the params of a Profile specified by {name} to the values they
+	// had at the time given by the at query parameter, in RFC3339 format.
+	// Secure params cannot be reverted and are left unchanged.
+	//
+	//     Responses:
+	//       200: ParamRevertResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/profiles/:name/paramhistory/revert", pRevert)
+
 	profile := &backend.Profile{}
 	pActions, pAction, pRun := f.makeActionEndpoints(profile.Prefix(), profile, "name")
 
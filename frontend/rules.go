@@ -0,0 +1,344 @@
+package frontend
+
+import (
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
+)
+
+// RuleResponse returned on a successful GET, PUT, PATCH, or POST of a single rule
+// swagger:response
+type RuleResponse struct {
+	// in: body
+	Body *models.Rule
+}
+
+// RulesResponse returned on a successful GET of all the rules
+// swagger:response
+type RulesResponse struct {
+	//in: body
+	Body []*models.Rule
+}
+
+// RuleBodyParameter used to inject a Rule
+// swagger:parameters createRule putRule
+type RuleBodyParameter struct {
+	// in: body
+	// required: true
+	Body *models.Rule
+}
+
+// RulePatchBodyParameter used to patch a Rule
+// swagger:parameters patchRule
+type RulePatchBodyParameter struct {
+	// in: body
+	// required: true
+	Body jsonpatch2.Patch
+}
+
+// RulePathParameter used to name a Rule in the path
+// swagger:parameters putRules getRule putRule patchRule deleteRule headRule
+type RulePathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+}
+
+// RuleListPathParameter used to limit lists of Rule by path options
+// swagger:parameters listRules listStatsRules
+type RuleListPathParameter struct {
+	// in: query
+	Offest int `json:"offset"`
+	// in: query
+	Limit int `json:"limit"`
+	// in: query
+	Available string
+	// in: query
+	Valid string
+	// in: query
+	ReadOnly string
+	// in: query
+	Name string
+	// in: query
+	Event string
+}
+
+// RuleActionsPathParameter used to find a Rule / Actions in the path
+// swagger:parameters getRuleActions
+type RuleActionsPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// RuleActionPathParameter used to find a Rule / Action in the path
+// swagger:parameters getRuleAction
+type RuleActionPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// RuleActionBodyParameter used to post a Rule / Action in the path
+// swagger:parameters postRuleAction
+type RuleActionBodyParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+	// in: body
+	// required: true
+	Body map[string]interface{}
+}
+
+func (f *Frontend) InitRuleApi() {
+	// swagger:route GET /rules Rules listRules
+	//
+	// Lists Rules filtered by some parameters.
+	//
+	// This will show all Rules by default.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    Event = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: RulesResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.GET("/rules",
+		func(c *gin.Context) {
+			f.List(c, &backend.Rule{})
+		})
+
+	// swagger:route HEAD /rules Rules listStatsRules
+	//
+	// Stats of the List Rules filtered by some parameters.
+	//
+	// This will return headers with the stats of the list.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    Event = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: NoContentResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.HEAD("/rules",
+		func(c *gin.Context) {
+			f.ListStats(c, &backend.Rule{})
+		})
+
+	// swagger:route POST /rules Rules createRule
+	//
+	// Create a Rule
+	//
+	// Create a Rule from the provided object
+	//
+	//     Responses:
+	//       201: RuleResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/rules",
+		func(c *gin.Context) {
+			b := &backend.Rule{}
+			f.Create(c, b)
+		})
+	// swagger:route GET /rules/{name} Rules getRule
+	//
+	// Get a Rule
+	//
+	// Get the Rule specified by {name} or return NotFound.
+	//
+	//     Responses:
+	//       200: RuleResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/rules/:name",
+		func(c *gin.Context) {
+			f.Fetch(c, &backend.Rule{}, c.Param(`name`))
+		})
+
+	// swagger:route HEAD /rules/{name} Rules headRule
+	//
+	// See if a Rule exists
+	//
+	// Return 200 if the Rule specifiec by {name} exists, or return NotFound.
+	//
+	//     Responses:
+	//       200: NoContentResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: NoContentResponse
+	f.ApiGroup.HEAD("/rules/:name",
+		func(c *gin.Context) {
+			f.Exists(c, &backend.Rule{}, c.Param(`name`))
+		})
+
+	// swagger:route PATCH /rules/{name} Rules patchRule
+	//
+	// Patch a Rule
+	//
+	// Update a Rule specified by {name} using a RFC6902 Patch structure
+	//
+	//     Responses:
+	//       200: RuleResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       406: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PATCH("/rules/:name",
+		func(c *gin.Context) {
+			f.Patch(c, &backend.Rule{}, c.Param(`name`))
+		})
+
+	// swagger:route PUT /rules/{name} Rules putRule
+	//
+	// Put a Rule
+	//
+	// Update a Rule specified by {name} using a JSON Rule
+	//
+	//     Responses:
+	//       200: RuleResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PUT("/rules/:name",
+		func(c *gin.Context) {
+			f.Update(c, &backend.Rule{}, c.Param(`name`))
+		})
+
+	// swagger:route DELETE /rules/{name} Rules deleteRule
+	//
+	// Delete a Rule
+	//
+	// Delete a Rule specified by {name}
+	//
+	//     Responses:
+	//       200: RuleResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.DELETE("/rules/:name",
+		func(c *gin.Context) {
+			f.Remove(c, &backend.Rule{}, c.Param(`name`))
+		})
+
+	rule := &backend.Rule{}
+	pActions, pAction, pRun := f.makeActionEndpoints(rule.Prefix(), rule, "name")
+
+	// swagger:route GET /rules/{name}/actions Rules getRuleActions
+	//
+	// List rule actions Rule
+	//
+	// List Rule actions for a Rule specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/rules/:name/actions", pActions)
+
+	// swagger:route GET /rules/{name}/actions/{cmd} Rules getRuleAction
+	//
+	// List specific action for a rule Rule
+	//
+	// List specific {cmd} action for a Rule specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/rules/:name/actions/:cmd", pAction)
+
+	// swagger:route POST /rules/{name}/actions/{cmd} Rules postRuleAction
+	//
+	// Call an action on the rule.
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//
+	//     Responses:
+	//       400: ErrorResponse
+	//       200: ActionPostResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/rules/:name/actions/:cmd", pRun)
+}
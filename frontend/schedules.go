@@ -0,0 +1,348 @@
+package frontend
+
+import (
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduleResponse returned on a successful GET, PUT, PATCH, or POST of a single schedule
+// swagger:response
+type ScheduleResponse struct {
+	// in: body
+	Body *models.Schedule
+}
+
+// SchedulesResponse returned on a successful GET of all the schedules
+// swagger:response
+type SchedulesResponse struct {
+	//in: body
+	Body []*models.Schedule
+}
+
+// ScheduleBodyParameter used to inject a Schedule
+// swagger:parameters createSchedule putSchedule
+type ScheduleBodyParameter struct {
+	// in: body
+	// required: true
+	Body *models.Schedule
+}
+
+// SchedulePatchBodyParameter used to patch a Schedule
+// swagger:parameters patchSchedule
+type SchedulePatchBodyParameter struct {
+	// in: body
+	// required: true
+	Body jsonpatch2.Patch
+}
+
+// SchedulePathParameter used to name a Schedule in the path
+// swagger:parameters putSchedules getSchedule putSchedule patchSchedule deleteSchedule headSchedule
+type SchedulePathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+}
+
+// ScheduleListPathParameter used to limit lists of Schedule by path options
+// swagger:parameters listSchedules listStatsSchedules
+type ScheduleListPathParameter struct {
+	// in: query
+	Offest int `json:"offset"`
+	// in: query
+	Limit int `json:"limit"`
+	// in: query
+	Available string
+	// in: query
+	Valid string
+	// in: query
+	ReadOnly string
+	// in: query
+	Name string
+	// in: query
+	Workflow string
+	// in: query
+	Stage string
+}
+
+// ScheduleActionsPathParameter used to find a Schedule / Actions in the path
+// swagger:parameters getScheduleActions
+type ScheduleActionsPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// ScheduleActionPathParameter used to find a Schedule / Action in the path
+// swagger:parameters getScheduleAction
+type ScheduleActionPathParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+}
+
+// ScheduleActionBodyParameter used to post a Schedule / Action in the path
+// swagger:parameters postScheduleAction
+type ScheduleActionBodyParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: path
+	// required: true
+	Cmd string `json:"cmd"`
+	// in: query
+	Plugin string `json:"plugin"`
+	// in: body
+	// required: true
+	Body map[string]interface{}
+}
+
+func (f *Frontend) InitScheduleApi() {
+	// swagger:route GET /schedules Schedules listSchedules
+	//
+	// Lists Schedules filtered by some parameters.
+	//
+	// This will show all Schedules by default.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    Workflow = string
+	//    Stage = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: SchedulesResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.GET("/schedules",
+		func(c *gin.Context) {
+			f.List(c, &backend.Schedule{})
+		})
+
+	// swagger:route HEAD /schedules Schedules listStatsSchedules
+	//
+	// Stats of the List Schedules filtered by some parameters.
+	//
+	// This will return headers with the stats of the list.
+	//
+	// You may specify:
+	//    Offset = integer, 0-based inclusive starting point in filter data.
+	//    Limit = integer, number of items to return
+	//
+	// Functional Indexs:
+	//    Name = string
+	//    Workflow = string
+	//    Stage = string
+	//    Available = boolean
+	//
+	// Functions:
+	//    Eq(value) = Return items that are equal to value
+	//    Lt(value) = Return items that are less than value
+	//    Lte(value) = Return items that less than or equal to value
+	//    Gt(value) = Return items that are greater than value
+	//    Gte(value) = Return items that greater than or equal to value
+	//    Between(lower,upper) = Return items that are inclusively between lower and upper
+	//    Except(lower,upper) = Return items that are not inclusively between lower and upper
+	//
+	// Example:
+	//    Name=fred - returns items named fred
+	//    Name=Lt(fred) - returns items that alphabetically less than fred.
+	//    Name=Lt(fred)&Available=true - returns items with Name less than fred and Available is true
+	//
+	// Responses:
+	//    200: NoContentResponse
+	//    401: NoContentResponse
+	//    403: NoContentResponse
+	//    406: ErrorResponse
+	f.ApiGroup.HEAD("/schedules",
+		func(c *gin.Context) {
+			f.ListStats(c, &backend.Schedule{})
+		})
+
+	// swagger:route POST /schedules Schedules createSchedule
+	//
+	// Create a Schedule
+	//
+	// Create a Schedule from the provided object
+	//
+	//     Responses:
+	//       201: ScheduleResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/schedules",
+		func(c *gin.Context) {
+			b := &backend.Schedule{}
+			f.Create(c, b)
+		})
+	// swagger:route GET /schedules/{name} Schedules getSchedule
+	//
+	// Get a Schedule
+	//
+	// Get the Schedule specified by {name} or return NotFound.
+	//
+	//     Responses:
+	//       200: ScheduleResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/schedules/:name",
+		func(c *gin.Context) {
+			f.Fetch(c, &backend.Schedule{}, c.Param(`name`))
+		})
+
+	// swagger:route HEAD /schedules/{name} Schedules headSchedule
+	//
+	// See if a Schedule exists
+	//
+	// Return 200 if the Schedule specifiec by {name} exists, or return NotFound.
+	//
+	//     Responses:
+	//       200: NoContentResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: NoContentResponse
+	f.ApiGroup.HEAD("/schedules/:name",
+		func(c *gin.Context) {
+			f.Exists(c, &backend.Schedule{}, c.Param(`name`))
+		})
+
+	// swagger:route PATCH /schedules/{name} Schedules patchSchedule
+	//
+	// Patch a Schedule
+	//
+	// Update a Schedule specified by {name} using a RFC6902 Patch structure
+	//
+	//     Responses:
+	//       200: ScheduleResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       406: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PATCH("/schedules/:name",
+		func(c *gin.Context) {
+			f.Patch(c, &backend.Schedule{}, c.Param(`name`))
+		})
+
+	// swagger:route PUT /schedules/{name} Schedules putSchedule
+	//
+	// Put a Schedule
+	//
+	// Update a Schedule specified by {name} using a JSON Schedule
+	//
+	//     Responses:
+	//       200: ScheduleResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.PUT("/schedules/:name",
+		func(c *gin.Context) {
+			f.Update(c, &backend.Schedule{}, c.Param(`name`))
+		})
+
+	// swagger:route DELETE /schedules/{name} Schedules deleteSchedule
+	//
+	// Delete a Schedule
+	//
+	// Delete a Schedule specified by {name}
+	//
+	//     Responses:
+	//       200: ScheduleResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.DELETE("/schedules/:name",
+		func(c *gin.Context) {
+			f.Remove(c, &backend.Schedule{}, c.Param(`name`))
+		})
+
+	schedule := &backend.Schedule{}
+	pActions, pAction, pRun := f.makeActionEndpoints(schedule.Prefix(), schedule, "name")
+
+	// swagger:route GET /schedules/{name}/actions Schedules getScheduleActions
+	//
+	// List schedule actions Schedule
+	//
+	// List Schedule actions for a Schedule specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/schedules/:name/actions", pActions)
+
+	// swagger:route GET /schedules/{name}/actions/{cmd} Schedules getScheduleAction
+	//
+	// List specific action for a schedule Schedule
+	//
+	// List specific {cmd} action for a Schedule specified by {name}
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//     Responses:
+	//       200: ActionResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/schedules/:name/actions/:cmd", pAction)
+
+	// swagger:route POST /schedules/{name}/actions/{cmd} Schedules postScheduleAction
+	//
+	// Call an action on the node.
+	//
+	// Optionally, a query parameter can be used to limit the scope to a specific plugin.
+	//   e.g. ?plugin=fred
+	//
+	//
+	//     Responses:
+	//       400: ErrorResponse
+	//       200: ActionPostResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/schedules/:name/actions/:cmd", pRun)
+}
@@ -1,9 +1,20 @@
 package frontend
 
 import (
+	"net/http"
+
 	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
 )
 
+// KeyRotationResponse returned on a successful GET or POST of the key rotation
+// swagger:response
+type KeyRotationResponse struct {
+	// in: body
+	Body *models.KeyRotation
+}
+
 // SystemActionsPathParameter used to find a System / Actions in the path
 // swagger:parameters getSystemActions
 type SystemActionsPathParameter struct {
@@ -87,4 +98,68 @@ func (f *Frontend) InitSystemApi() {
 	//       404: ErrorResponse
 	//       409: ErrorResponse
 	f.ApiGroup.POST("/system/actions/:cmd", pRun)
+
+	// swagger:route GET /system/keyrotation System getKeyRotation
+	//
+	// Get the progress of the secure param key rotation
+	//
+	// Get the progress of the most recent rotation of the secure param
+	// keys of all machines, profiles, and plugins.
+	//
+	//     Responses:
+	//       200: KeyRotationResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/system/keyrotation",
+		func(c *gin.Context) {
+			if !f.assureSimpleAuth(c, "keyrotation", "get", "") {
+				return
+			}
+			res := f.dt.KeyRotationStatus()
+			if res == nil {
+				err := &models.Error{
+					Code:  http.StatusNotFound,
+					Type:  c.Request.Method,
+					Model: "keyrotation",
+				}
+				err.Errorf("No key rotation has been started")
+				c.JSON(err.Code, err)
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+
+	// swagger:route POST /system/keyrotation System startKeyRotation
+	//
+	// Start rotating the secure param keys
+	//
+	// Start rotating the secure param keys of all machines, profiles,
+	// and plugins, resealing their secure params with the new keys.
+	// The rotation runs in the background; its progress can be followed
+	// with GET /system/keyrotation.
+	//
+	//     Responses:
+	//       202: KeyRotationResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/system/keyrotation",
+		func(c *gin.Context) {
+			if !f.assureSimpleAuth(c, "keyrotation", "post", "") {
+				return
+			}
+			res, err := f.dt.RotateAllKeys(f.Logger)
+			if err != nil {
+				ret := &models.Error{
+					Code:  http.StatusConflict,
+					Type:  c.Request.Method,
+					Model: "keyrotation",
+				}
+				ret.AddError(err)
+				c.JSON(ret.Code, ret)
+				return
+			}
+			c.JSON(http.StatusAccepted, res)
+		})
 }
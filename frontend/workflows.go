@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"net/http"
+
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/provision/models"
@@ -21,6 +23,23 @@ type WorkflowsResponse struct {
 	Body []*models.Workflow
 }
 
+// WorkflowGraphResponse returned on a successful GET of the graph of a workflow
+// swagger:response
+type WorkflowGraphResponse struct {
+	// in: body
+	Body *models.WorkflowGraph
+}
+
+// WorkflowGraphParameter used to pick the format of the graph of a Workflow
+// swagger:parameters getWorkflowGraph
+type WorkflowGraphParameter struct {
+	// in: path
+	// required: true
+	Name string `json:"name"`
+	// in: query
+	Format string `json:"format"`
+}
+
 // WorkflowBodyParameter used to inject a Workflow
 // swagger:parameters createWorkflow putWorkflow
 type WorkflowBodyParameter struct {
@@ -293,6 +312,60 @@ func (f *Frontend) InitWorkflowApi() {
 			f.Remove(c, &backend.Workflow{}, c.Param(`name`))
 		})
 
+	// swagger:route GET /workflows/{name}/graph Workflows getWorkflowGraph
+	//
+	// Get the graph of a Workflow
+	//
+	// Get the Stages and flow control steps of the Workflow specified
+	// by {name}, with the BootEnvs, Profiles, and Tasks of each
+	// Stage, the Stages that reboot the Machine, and the availability
+	// and validation errors of each of them.
+	//
+	// Optionally, a query parameter can be used to get the graph in
+	// the Graphviz DOT language instead of JSON.
+	//   e.g. ?format=dot
+	//
+	//     Responses:
+	//       200: WorkflowGraphResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/workflows/:name/graph",
+		func(c *gin.Context) {
+			workflow := &backend.Workflow{}
+			name := c.Param(`name`)
+			if !f.assureSimpleAuth(c, workflow.Prefix(), "get", name) {
+				return
+			}
+			format := c.DefaultQuery("format", "json")
+			if format != "json" && format != "dot" {
+				res := &models.Error{
+					Code:  http.StatusBadRequest,
+					Type:  c.Request.Method,
+					Model: workflow.Prefix(),
+					Key:   name,
+				}
+				res.Errorf("Invalid format %s: must be json or dot", format)
+				c.JSON(res.Code, res)
+				return
+			}
+			rt := f.rt(c, backend.WorkflowGraphLocks...)
+			ob := f.Find(c, rt, workflow.Prefix(), name)
+			if ob == nil {
+				return
+			}
+			var graph *models.WorkflowGraph
+			rt.Do(func(d backend.Stores) {
+				graph = rt.WorkflowGraph(backend.AsWorkflow(ob))
+			})
+			if format == "dot" {
+				c.Data(http.StatusOK, "text/vnd.graphviz; charset=utf-8", []byte(graph.Dot()))
+				return
+			}
+			c.JSON(http.StatusOK, graph)
+		})
+
 	workflow := &backend.Workflow{}
 	pActions, pAction, pRun := f.makeActionEndpoints(workflow.Prefix(), workflow, "name")
 
@@ -498,14 +498,16 @@ func (dhr *DhcpRequest) coalesceOptions(
 				oMachine := backend.AsMachine(other)
 				rt.Warnf("Machine %s also has address %s, which we are handing out to %s", oMachine.UUID(), l.Addr, machine.UUID())
 				rt.Warnf("Setting machine %s address to all zeros", oMachine.UUID())
-				oMachine.Address = net.IPv4(0, 0, 0, 0)
-				rt.Save(oMachine)
+				if _, err := rt.SaveMachineAddress(oMachine, net.IPv4(0, 0, 0, 0)); err != nil {
+					rt.Errorf("Unable to clear address of machine %s: %v", oMachine.UUID(), err)
+				}
 			}
 		}
 		if machineSave {
 			rt.Warnf("%s: Updating machine %s address from %s to %s", dhr.xid(), machine.UUID(), machine.Address, l.Addr)
-			machine.Address = l.Addr
-			rt.Save(machine)
+			if _, err := rt.SaveMachineAddress(machine, l.Addr); err != nil {
+				rt.Errorf("%s: Unable to update machine %s address: %v", dhr.xid(), machine.UUID(), err)
+			}
 		}
 	})
 	if !dhr.offerPXE {
@@ -546,6 +548,55 @@ func (dhr *DhcpRequest) coalesceOptions(
 	}
 }
 
+// clientInfo returns the DHCP fingerprint of the request, which is
+// the list of options it asked for, and the circuit id the relay
+// agent added to it, if any.
+func (dhr *DhcpRequest) clientInfo() (fingerprint, circuitId string) {
+	if prl, ok := dhr.pktOpts[dhcp.OptionParameterRequestList]; ok {
+		codes := make([]string, len(prl))
+		for i, code := range prl {
+			codes[i] = strconv.Itoa(int(code))
+		}
+		fingerprint = strings.Join(codes, ",")
+	}
+	// Option 82 holds relay agent sub-options, of which 1 is the
+	// circuit id.
+	rai := dhr.pktOpts[dhcp.OptionCode(82)]
+	for len(rai) >= 2 && len(rai) >= 2+int(rai[1]) {
+		code, val := rai[0], rai[2:2+int(rai[1])]
+		rai = rai[2+len(val):]
+		if code != 1 {
+			continue
+		}
+		circuitId = string(val)
+		for _, b := range val {
+			if b < 0x20 || b > 0x7e {
+				circuitId = fmt.Sprintf("%x", val)
+				break
+			}
+		}
+		break
+	}
+	return
+}
+
+// recordClient saves the DHCP fingerprint and relay agent circuit id
+// of the request on the lease, so that they can be used to name the
+// machine that got it.
+func (dhr *DhcpRequest) recordClient(rt *backend.RequestTracker, lease *backend.Lease) {
+	fingerprint, circuitId := dhr.clientInfo()
+	rt.Do(func(d backend.Stores) {
+		if lease.Fingerprint == fingerprint && lease.CircuitId == circuitId {
+			return
+		}
+		nl := backend.ModelToBackend(models.Clone(lease)).(*backend.Lease)
+		nl.Fingerprint, nl.CircuitId = fingerprint, circuitId
+		if _, err := rt.Save(nl); err != nil {
+			rt.Errorf("%s: Unable to record client of lease %s: %v", dhr.xid(), lease.Key(), err)
+		}
+	})
+}
+
 // buildReply is the general purpose function for building the
 // appropriate response to the DHCP packet we are currently handling.
 func (dhr *DhcpRequest) buildReply(
@@ -876,6 +927,7 @@ func (dhr *DhcpRequest) ServeDHCP(msgType dhcp.MessageType) dhcp.Packet {
 			dhr.Infof("%s: Proxy Subnet should not respond to %s.", dhr.xid(), req)
 			return nil
 		}
+		dhr.recordClient(rt, lease)
 		serverID := dhr.respondFrom(lease.Addr)
 		dhr.buildDhcpOptions(lease, subnet, reservation, serverID)
 		reply := dhr.buildReply(dhcp.ACK, serverID, lease.Addr)
@@ -0,0 +1,97 @@
+package models
+
+import "github.com/VictorLowther/jsonpatch2"
+
+// BulkRequest describes an operation to perform on every object of
+// one type that matches a filter.  Exactly one of Patch or Action
+// must be set.
+//
+// swagger:model
+type BulkRequest struct {
+	// Filter selects the objects to operate on.  It uses the same
+	// syntax as the query parameters of the list API, for example
+	// Workflow=discover&Stage=Ne(none).
+	//
+	// required: true
+	Filter string
+	// Patch is the JSON patch to apply to each object.
+	Patch jsonpatch2.Patch
+	// Action is the name of the action to run on each object.
+	Action string
+	// Plugin is the plugin that provides Action.  If it is empty,
+	// any plugin that provides Action can be used.
+	Plugin string
+	// Params are the parameters passed to Action.
+	Params map[string]interface{}
+	// DryRun reports what would happen to each object without
+	// changing anything.  Patches are validated but not saved, and
+	// actions are validated but not run.  Builtin actions that change
+	// the object are only checked for their required params.
+	DryRun bool
+	// Concurrency is how many objects are operated on at the same
+	// time.  0 means one at a time.
+	Concurrency int
+	// StopOnError stops the operation at the first object that
+	// fails.  Objects that were not operated on are reported as
+	// skipped.  It has no effect on a DryRun.
+	StopOnError bool
+}
+
+// Validate checks that r is a well formed BulkRequest.
+func (r *BulkRequest) Validate(e ErrorAdder) {
+	if r.Filter == "" {
+		e.Errorf("Bulk requests must have a Filter")
+	}
+	if (len(r.Patch) == 0) == (r.Action == "") {
+		e.Errorf("Bulk requests must have exactly one of a Patch or an Action")
+	}
+	if r.Concurrency < 0 {
+		e.Errorf("Invalid Concurrency %d", r.Concurrency)
+	}
+}
+
+// BulkResult is the outcome of a bulk operation on a single object.
+//
+// swagger:model
+type BulkResult struct {
+	// Key is the key of the object.
+	Key string
+	// Changed is true if the object was changed by the Patch, or
+	// the Action was run on it.  For a DryRun, it is true if that
+	// would have happened.
+	Changed bool
+	// Skipped is true if the object was not operated on because
+	// the operation was stopped by an earlier failure.
+	Skipped bool
+	// Unchecked is true for a DryRun of an Action that cannot be
+	// dry run.  Only the params of the Action were checked, so it
+	// may still fail when it is run for real.
+	Unchecked bool
+	// Error is why the operation failed on the object, if it did.
+	Error *Error
+	// Result is what the Action returned.
+	Result interface{}
+}
+
+// BulkResponse is the outcome of a bulk operation.
+//
+// swagger:model
+type BulkResponse struct {
+	// DryRun is true if nothing was actually changed.
+	DryRun bool
+	// Matched is the number of objects that matched the Filter.
+	Matched int
+	// Changed is the number of objects that were, or would have
+	// been, changed.
+	Changed int
+	// Failed is the number of objects the operation failed on.
+	Failed int
+	// Skipped is the number of objects that were not operated on.
+	Skipped int
+	// Unchecked is the number of objects whose DryRun result is
+	// Unchecked.
+	Unchecked int
+	// Results has the outcome for each object, in the order the
+	// objects were matched.
+	Results []*BulkResult
+}
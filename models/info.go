@@ -80,6 +80,11 @@ func (i *Info) Fill() {
 			"secure-params",
 			"seperate-meta-api",
 			"slim-objects",
+			"machine-pools",
+			"schedules",
+			"rollouts",
+			"rules",
+			"policies",
 		}
 	}
 }
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// InventoryCPU describes a single processor socket.
+type InventoryCPU struct {
+	Socket  int
+	Vendor  string
+	Model   string
+	Cores   int
+	Threads int
+	MHz     float64
+}
+
+// InventoryDIMM describes a single memory module.
+type InventoryDIMM struct {
+	Slot         string
+	Type         string
+	Manufacturer string
+	PartNumber   string
+	SerialNumber string
+	SizeMB       int
+	SpeedMTs     int
+}
+
+// InventoryDisk describes a single block device.
+type InventoryDisk struct {
+	Name       string
+	Vendor     string
+	Model      string
+	Serial     string
+	SizeBytes  int64
+	Rotational bool
+}
+
+// InventoryNIC describes a single network interface.
+type InventoryNIC struct {
+	Name      string
+	MAC       string
+	Vendor    string
+	Model     string
+	Driver    string
+	Link      bool
+	SpeedMbps int
+}
+
+// InventoryPCIDevice describes a single PCI device.
+type InventoryPCIDevice struct {
+	Address string
+	Class   string
+	Vendor  string
+	Device  string
+	Driver  string
+}
+
+// InventoryBIOS describes the firmware and the system it runs on.
+type InventoryBIOS struct {
+	Vendor        string
+	Version       string
+	Date          string
+	SystemVendor  string
+	SystemProduct string
+	SystemSerial  string
+	SystemUUID    string
+}
+
+// InventoryBMC describes the baseboard management controller.
+type InventoryBMC struct {
+	Address  string
+	MAC      string
+	Firmware string
+}
+
+// Inventory is the hardware of a Machine, as reported by the
+// machine agent.  Every upload gets a new Version, and the previous
+// versions are kept so that they can be compared.
+//
+// swagger:model
+type Inventory struct {
+	// Version is the number of this inventory.  It is set by the
+	// server, and goes up by one every time a new inventory is
+	// uploaded for the Machine.
+	//
+	// read only: true
+	Version int
+	// Time the inventory was uploaded.
+	//
+	// read only: true
+	// swagger:strfmt date-time
+	Time   time.Time
+	CPUs   []InventoryCPU
+	Memory []InventoryDIMM
+	Disks  []InventoryDisk
+	NICs   []InventoryNIC
+	PCI    []InventoryPCIDevice
+	BIOS   InventoryBIOS
+	BMC    InventoryBMC
+	// Facts is a flattened summary of the inventory that machines
+	// can be filtered on with Inventory.<fact>.  It is computed by the
+	// server.
+	//
+	// read only: true
+	Facts map[string]interface{}
+}
+
+// Validate checks that the inventory is well formed.
+func (i *Inventory) Validate(e ErrorAdder) {
+	for _, nic := range i.NICs {
+		if nic.Name == "" {
+			e.Errorf("NICs must have a Name")
+		}
+		if nic.MAC != "" {
+			ValidateMac(e, nic.MAC)
+		}
+	}
+	for _, disk := range i.Disks {
+		if disk.Name == "" {
+			e.Errorf("Disks must have a Name")
+		}
+		if disk.SizeBytes < 0 {
+			e.Errorf("Disk %s has an invalid size %d", disk.Name, disk.SizeBytes)
+		}
+	}
+	for _, dimm := range i.Memory {
+		if dimm.SizeMB < 0 {
+			e.Errorf("DIMM %s has an invalid size %d", dimm.Slot, dimm.SizeMB)
+		}
+	}
+	if i.BMC.MAC != "" {
+		ValidateMac(e, i.BMC.MAC)
+	}
+}
+
+// distinct returns the distinct non-empty vals in sorted order.
+func distinct(vals []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, v := range vals {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// MACs returns the MAC addresses of the NICs in the inventory.
+func (i *Inventory) MACs() []string {
+	res := []string{}
+	for _, nic := range i.NICs {
+		if nic.MAC != "" && nic.MAC != "00:00:00:00:00:00" {
+			res = append(res, strings.ToLower(nic.MAC))
+		}
+	}
+	return res
+}
+
+// FillFacts computes the Facts of the inventory.  Counts and totals
+// are numbers.  Fields that can differ from device to device, such
+// as nics.model, are lists of the distinct values in sorted order.
+func (i *Inventory) FillFacts() {
+	f := map[string]interface{}{}
+	cores, threads := 0, 0
+	cpuModels := []string{}
+	for _, cpu := range i.CPUs {
+		cores += cpu.Cores
+		threads += cpu.Threads
+		cpuModels = append(cpuModels, cpu.Model)
+	}
+	f["cpus.count"] = len(i.CPUs)
+	f["cpus.cores"] = cores
+	f["cpus.threads"] = threads
+	f["cpus.model"] = distinct(cpuModels)
+
+	totalMB := 0
+	memTypes := []string{}
+	for _, dimm := range i.Memory {
+		totalMB += dimm.SizeMB
+		memTypes = append(memTypes, dimm.Type)
+	}
+	f["memory.count"] = len(i.Memory)
+	f["memory.totalMB"] = totalMB
+	f["memory.type"] = distinct(memTypes)
+
+	var totalBytes int64
+	rotational := 0
+	diskModels := []string{}
+	for _, disk := range i.Disks {
+		totalBytes += disk.SizeBytes
+		if disk.Rotational {
+			rotational++
+		}
+		diskModels = append(diskModels, disk.Model)
+	}
+	f["disks.count"] = len(i.Disks)
+	f["disks.totalGB"] = int(totalBytes / (1000 * 1000 * 1000))
+	f["disks.rotational"] = rotational
+	f["disks.model"] = distinct(diskModels)
+
+	up := 0
+	nicModels, nicDrivers, nicVendors := []string{}, []string{}, []string{}
+	for _, nic := range i.NICs {
+		if nic.Link {
+			up++
+		}
+		nicModels = append(nicModels, nic.Model)
+		nicDrivers = append(nicDrivers, nic.Driver)
+		nicVendors = append(nicVendors, nic.Vendor)
+	}
+	f["nics.count"] = len(i.NICs)
+	f["nics.up"] = up
+	f["nics.model"] = distinct(nicModels)
+	f["nics.driver"] = distinct(nicDrivers)
+	f["nics.vendor"] = distinct(nicVendors)
+
+	pciVendors := []string{}
+	for _, dev := range i.PCI {
+		pciVendors = append(pciVendors, dev.Vendor)
+	}
+	f["pci.count"] = len(i.PCI)
+	f["pci.vendor"] = distinct(pciVendors)
+
+	f["bios.vendor"] = i.BIOS.Vendor
+	f["bios.version"] = i.BIOS.Version
+	f["bios.date"] = i.BIOS.Date
+	f["system.vendor"] = i.BIOS.SystemVendor
+	f["system.product"] = i.BIOS.SystemProduct
+	f["system.serial"] = i.BIOS.SystemSerial
+	f["system.uuid"] = i.BIOS.SystemUUID
+	f["bmc.address"] = i.BMC.Address
+	f["bmc.mac"] = i.BMC.MAC
+	f["bmc.firmware"] = i.BMC.Firmware
+	i.Facts = f
+}
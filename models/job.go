@@ -43,13 +43,35 @@ type Job struct {
 	// The stage that the task was created in.
 	// read only: true
 	Stage string
-	// The state the job is in.  Must be one of "created", "running", "failed", "finished", "incomplete"
+	// The state the job is in.  Must be one of "created", "running", "failed", "finished", "incomplete", "cancelled"
 	// required: true
 	State string
 	// The final disposition of the job.
-	// Can be one of "reboot","poweroff","stop", or "complete"
+	// Can be one of "reboot","poweroff","stop", or "complete".
+	// Jobs failed by dr-provision for running too long have an
+	// ExitState of "timeout".
 	// Other substates may be added as time goes on
 	ExitState string
+	// The exit code of the last script the job ran.
+	ExitCode int
+	// Which attempt at running the task at CurrentIndex this job is,
+	// starting at 1.  Jobs that are retried because of the Retry
+	// policy of their Task have higher attempt counts.
+	//
+	// read only: true
+	Attempt int
+	// RetryAt is when a failed job is due to be retried under the
+	// Retry policy of its Task.  It is zero once the retry has been
+	// created, or if the job will not be retried.
+	//
+	// read only: true
+	// swagger:strfmt date-time
+	RetryAt time.Time
+	// Result is the structured result the job produced.  The agent
+	// uploads it when the job ends, from the JSON object the task
+	// wrote to $RS_RESULT_FILE.  The ResultParams and ResultMeta of
+	// the Task decide which parts of it are saved on the machine.
+	Result map[string]interface{}
 	// The time the job entered running.
 	StartTime time.Time
 	// The time the job entered failed or finished.
@@ -95,13 +117,13 @@ func (j *Job) Validate() {
 	j.AddError(ValidName("Invalid Stage", j.Stage))
 	switch j.State {
 	case "created", "running", "incomplete":
-	case "failed", "finished":
+	case "failed", "finished", "cancelled":
 	default:
 		j.AddError(fmt.Errorf("Invalid State `%s`", j.State))
 	}
 	if j.ExitState != "" {
 		switch j.ExitState {
-		case "reboot", "poweroff", "stop", "complete", "failed":
+		case "reboot", "poweroff", "stop", "complete", "failed", "timeout":
 		default:
 			j.AddError(fmt.Errorf("Invalid ExitState `%s`", j.ExitState))
 		}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// KeyRotation tracks the progress of rotating the keys used to seal
+// the secure Params of every machine, profile, and plugin.
+//
+// swagger:model
+type KeyRotation struct {
+	// Running is true while the rotation is in progress.
+	Running bool
+
+	// Started is when the rotation started.
+	// swagger:strfmt date-time
+	Started time.Time
+
+	// Finished is when the rotation finished.  It is the zero time
+	// while the rotation is running.
+	// swagger:strfmt date-time
+	Finished time.Time
+
+	// Total is the number of objects whose keys will be rotated.
+	Total int
+
+	// Rotated is the number of objects whose keys have been rotated.
+	Rotated int
+
+	// Skipped is the number of objects that were removed before their
+	// keys could be rotated.
+	Skipped int
+
+	// Failed maps the objects that could not have their keys rotated
+	// (as prefix:key) to the reason why.  Objects that failed keep
+	// their old key and secure Params.
+	Failed map[string]string
+}
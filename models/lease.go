@@ -49,6 +49,17 @@ type Lease struct {
 	// read only: true
 	// required: true
 	State string
+	// Fingerprint is the list of DHCP options the client asked for
+	// in its last request, which identifies the kind of client.
+	//
+	// read only: true
+	Fingerprint string
+	// CircuitId is the circuit id the DHCP relay agent added to the
+	// last request, which identifies the switch port the client is
+	// on.
+	//
+	// read only: true
+	CircuitId string
 }
 
 func (l *Lease) GetMeta() Meta {
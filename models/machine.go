@@ -4,6 +4,7 @@ import (
 	"net"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/pborman/uuid"
 )
@@ -35,6 +36,13 @@ type Machine struct {
 	//
 	// swagger:strfmt uuid
 	CurrentJob uuid.UUID
+	// The UUIDs of the jobs that have been created for the members
+	// of the task group at CurrentTask, in the order the members
+	// are listed in the group.  Empty unless CurrentTask is a task
+	// group.
+	//
+	// read only: true
+	CurrentJobs []uuid.UUID
 	// The IPv4 address of the machine that should be used for PXE
 	// purposes.  Note that this field does not directly tie into DHCP
 	// leases or reservations -- the provisioner relies solely on this
@@ -44,6 +52,11 @@ type Machine struct {
 	Address net.IP
 	// An optional value to indicate tasks and profiles to apply.
 	Stage string
+	// The time the machine entered its current Stage, or was last
+	// made Runnable again in it.  Stage timeouts count from this time.
+	//
+	// read only: true
+	StageEntered time.Time
 	// The boot environment that the machine should boot into.  This
 	// must be the name of a boot environment present in the backend.
 	// If this field is not present or blank, the global default bootenv
@@ -52,6 +65,13 @@ type Machine struct {
 	// An array of profiles to apply to this machine in order when looking
 	// for a parameter during rendering.
 	Profiles []string
+	// The profiles whose Selector matches this machine.  They are
+	// applied after Profiles and before the profiles of the current
+	// Stage.  This is recomputed by the server whenever the machine
+	// or a profile changes.
+	//
+	// read only: true
+	SelectedProfiles []string
 	//
 	// The Machine specific Profile Data - only used for the map (name and other
 	// fields not used - THIS IS DEPRECATED AND WILL GO AWAY.
@@ -68,6 +88,27 @@ type Machine struct {
 	//
 	// required: true
 	Runnable bool
+	// Paused machines finish the Job they are running, and then hold
+	// until they are resumed.  No new Jobs are created for a paused
+	// machine.  Use the pause, resume, and cancel machine actions to
+	// change it.
+	//
+	// read only: true
+	Paused bool
+	// Locked machines cannot have their Stage, BootEnv, Workflow,
+	// Tasks, or Params changed, and no new Jobs are created for
+	// them.  Use the lock and unlock machine actions to change it.
+	//
+	// read only: true
+	Locked bool
+	// LockOwner is who locked the machine.
+	//
+	// read only: true
+	LockOwner string
+	// LockReason is why the machine was locked.
+	//
+	// read only: true
+	LockReason string
 
 	// Secret for machine token revocation.  Changing the secret will invalidate
 	// all existing tokens for this machine
@@ -83,6 +124,26 @@ type Machine struct {
 	//
 	// required: true
 	Workflow string
+	// Pool is the Pool the machine is allocated from.  It is empty
+	// if the machine is not allocated.
+	//
+	// read only: true
+	Pool string
+	// PoolOwner is who the machine is allocated to.
+	//
+	// read only: true
+	PoolOwner string
+	// PoolExpires is when the allocation of the machine runs out and
+	// the machine is released back to its Pool.
+	//
+	// read only: true
+	// swagger:strfmt date-time
+	PoolExpires time.Time
+	// Inventory is the most recent hardware inventory uploaded for
+	// the machine.
+	//
+	// read only: true
+	Inventory *Inventory
 }
 
 func (n *Machine) GetMeta() Meta {
@@ -104,7 +165,9 @@ func (n *Machine) Validate() {
 		n.AddError(ValidName("Invalid Profile", p))
 	}
 	for _, t := range n.Tasks {
-		if n.Workflow == "" {
+		if IsTaskGroup(t) {
+			n.AddError(ValidTaskGroup("Invalid Task Group", t))
+		} else if n.Workflow == "" {
 			n.AddError(ValidName("Invalid Task", t))
 		} else {
 			parts := strings.SplitN(t, ":", 2)
@@ -114,6 +177,9 @@ func (n *Machine) Validate() {
 					n.AddError(ValidName("Invalid Stage", parts[1]))
 				case "bootenv":
 					n.AddError(ValidName("Invalid BootEnv", parts[1]))
+				case "if", "goto":
+					_, err := ParseWorkflowStep(t)
+					n.AddError(err)
 				default:
 					n.Errorf("Invalid Task Step %s", t)
 				}
@@ -153,9 +219,15 @@ func (n *Machine) Fill() {
 	if n.Profiles == nil {
 		n.Profiles = []string{}
 	}
+	if n.SelectedProfiles == nil {
+		n.SelectedProfiles = []string{}
+	}
 	if n.Tasks == nil {
 		n.Tasks = []string{}
 	}
+	if n.CurrentJobs == nil {
+		n.CurrentJobs = []uuid.UUID{}
+	}
 	if n.Params == nil {
 		n.Params = map[string]interface{}{}
 	}
@@ -200,6 +272,14 @@ func (b *Machine) SetProfiles(p []string) {
 	b.Profiles = p
 }
 
+// EffectiveProfiles returns the profiles explicitly assigned to the
+// machine followed by the ones selected for it.
+func (b *Machine) EffectiveProfiles() []string {
+	res := make([]string, 0, len(b.Profiles)+len(b.SelectedProfiles))
+	res = append(res, b.Profiles...)
+	return append(res, b.SelectedProfiles...)
+}
+
 // match BootEnver interface
 func (b *Machine) GetBootEnv() string {
 	return b.BootEnv
@@ -240,7 +320,7 @@ func (b *Machine) SplitTasks() (thePast []string, thePresent []string, theFuture
 		thePresent = b.Tasks[b.CurrentTask+1:]
 	}
 	for i := 0; i < len(thePresent); i++ {
-		if strings.HasPrefix(thePresent[i], "stage:") {
+		if strings.HasPrefix(thePresent[i], "stage:") || IsWorkflowStep(thePresent[i]) {
 			theFuture = thePresent[i:]
 			thePresent = thePresent[:i]
 			break
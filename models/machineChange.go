@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// MachineChange records a single change to one of the lifecycle
+// fields of a Machine.  The lifecycle fields are Stage, BootEnv,
+// Workflow, Runnable, Address, and CurrentTask.  Together, the
+// changes make up the timeline of the Machine.
+//
+// swagger:model
+type MachineChange struct {
+	// Time the change was made.
+	// swagger:strfmt date-time
+	Time time.Time
+
+	// Field is the name of the Machine field that changed.
+	Field string
+
+	// OldValue is the value of the field before the change.
+	OldValue interface{}
+
+	// NewValue is the value of the field after the change.
+	NewValue interface{}
+
+	// Principal is who made the change.  Changes made by a user are
+	// recorded as the username, changes made by a machine token are
+	// recorded as machine:<uuid>.  Changes made internally by
+	// dr-provision have an empty Principal.
+	Principal string
+
+	// Jobs are the UUIDs of the current Jobs of the Machine after
+	// the change.
+	Jobs []uuid.UUID
+}
@@ -0,0 +1,18 @@
+package models
+
+import "github.com/pborman/uuid"
+
+// MachineDuplicate is a set of Machines that look like they are the
+// same system.  Machines are considered duplicates if their
+// inventories have the same system serial number or system UUID, or
+// if they share any HardwareAddrs.
+//
+// swagger:model
+type MachineDuplicate struct {
+	// Machines are the UUIDs of the duplicate Machines.
+	Machines []uuid.UUID
+
+	// Reasons are what the Machines have in common, in the form
+	// serial:<serial>, system-uuid:<uuid>, or mac:<address>.
+	Reasons []string
+}
@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// ParamChange records a single change to a Param on an object that
+// has Params.  Changes are recorded in the order they were made.
+//
+// swagger:model
+type ParamChange struct {
+	// Time the change was made.
+	// swagger:strfmt date-time
+	Time time.Time
+
+	// Key is the name of the Param that changed.
+	Key string
+
+	// OldValue is the value before the change.  It is nil if the
+	// Param was added by this change.
+	OldValue interface{}
+
+	// NewValue is the value after the change.  It is nil if the
+	// Param was removed by this change.
+	NewValue interface{}
+
+	// Secure is true if either value was a secure value.  The values
+	// of secure Params are never recorded, only that they changed.
+	Secure bool
+
+	// Principal is who made the change.  Changes made by a user are
+	// recorded as the username, changes made by a machine token are
+	// recorded as machine:<uuid>.  Changes made internally by
+	// dr-provision have an empty Principal.
+	Principal string
+}
+
+// ParamRevert is the result of reverting the Params of an object to
+// a point in time.
+//
+// swagger:model
+type ParamRevert struct {
+	// Params are the Params of the object after the revert.
+	Params map[string]interface{}
+
+	// Skipped are the names of the secure Params that changed since
+	// the revert time.  Their values are not recorded, so they were
+	// left as they are.
+	Skipped []string
+}
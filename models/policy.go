@@ -0,0 +1,108 @@
+package models
+
+import "github.com/xeipuuv/gojsonschema"
+
+// Policy is an admin-defined check that objects of a type must pass
+// to be created or changed.  An object passes if it matches the
+// Schema, if one is set, and the Expression, if one is set.
+//
+// swagger:model
+type Policy struct {
+	Validation
+	Access
+	Meta
+	// The name of the policy.  This must be unique across all
+	// policies.
+	//
+	// required: true
+	Name string
+	// A description of this policy.
+	Description string
+	// Documentation of this policy.  This should tell what the
+	// policy is for, any special considerations that should be
+	// taken into account when using it, etc. in rich structured text
+	// (rst).
+	Documentation string
+	// Type is the prefix of the objects the policy applies to, for
+	// example machines.
+	//
+	// required: true
+	Type string
+	// Schema is a JSON schema the object must match.
+	Schema interface{}
+	// Expression is a filter the object must match, in the query
+	// syntax of the list API of Type, for example "Meta.owner=Ne()"
+	// to require an owner.
+	Expression string
+	// Message is the error reported when an object does not pass
+	// the policy.  If it is empty, the error says what did not match.
+	Message string
+	// Disabled stops the policy from being checked.
+	Disabled bool
+}
+
+func (p *Policy) GetMeta() Meta {
+	return p.Meta
+}
+
+func (p *Policy) SetMeta(d Meta) {
+	p.Meta = d
+}
+
+func (p *Policy) GetDocumentation() string {
+	return p.Documentation
+}
+
+func (p *Policy) Prefix() string {
+	return "policies"
+}
+
+func (p *Policy) Key() string {
+	return p.Name
+}
+
+func (p *Policy) KeyName() string {
+	return "Name"
+}
+
+func (p *Policy) Fill() {
+	p.Validation.fill()
+	if p.Meta == nil {
+		p.Meta = Meta{}
+	}
+}
+
+func (p *Policy) AuthKey() string {
+	return p.Key()
+}
+
+func (p *Policy) SliceOf() interface{} {
+	ps := []*Policy{}
+	return &ps
+}
+
+func (p *Policy) ToModels(obj interface{}) []Model {
+	items := obj.(*[]*Policy)
+	res := make([]Model, len(*items))
+	for i, item := range *items {
+		res[i] = Model(item)
+	}
+	return res
+}
+
+func (p *Policy) Validate() {
+	p.AddError(ValidName("Invalid Name", p.Name))
+	if _, err := New(p.Type); err != nil {
+		p.Errorf("Invalid Type %q", p.Type)
+	} else if p.Type == p.Prefix() {
+		p.Errorf("Policies cannot apply to policies")
+	}
+	if p.Schema == nil && p.Expression == "" {
+		p.Errorf("Policy must have a Schema or an Expression")
+	}
+	if p.Schema != nil {
+		if _, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(p.Schema)); err != nil {
+			p.Errorf("Invalid Schema: %v", err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package models
+
+import "github.com/pborman/uuid"
+
+// Pool is a set of Machines that can be allocated to a user or a
+// token for a limited time, and then released back to the Pool.
+// Membership in the Pool is decided by the Selector and Profiles of
+// the Pool.  Allocation state is kept on the Machine in the Pool,
+// PoolOwner, and PoolExpires fields.
+//
+// swagger:model
+type Pool struct {
+	Validation
+	Access
+	Meta
+	// The name of the pool.  This must be unique across all pools.
+	//
+	// required: true
+	Name string
+	// A description of this pool.
+	Description string
+	// Documentation of this pool.  This should tell what the pool
+	// is for, any special considerations that should be taken into
+	// account when using it, etc. in rich structured text (rst).
+	Documentation string
+	// Selector picks the Machines that are members of this pool.
+	// It uses the same syntax as the query parameters of the machine
+	// list API, for example "Meta.site=Eq(dc2)&Workflow=discover".
+	// Params can be matched the same way.  An empty Selector matches
+	// every Machine.
+	Selector string
+	// Profiles that a Machine must have, either directly or through
+	// a Selector, to be a member of this pool.
+	Profiles []string
+	// ReleaseWorkflow is the Workflow that Machines are switched to
+	// when they are released, to wipe them back to a known state.
+	// The Workflow is restarted if the Machine is already in it.  If
+	// it is empty, released Machines are left alone.
+	ReleaseWorkflow string
+	// DefaultLease is how long in seconds an allocation lasts if the
+	// allocation request does not say.  0 means 3600.
+	DefaultLease int
+	// MaxLease is the longest lease in seconds that can be asked for.
+	// 0 means there is no limit.
+	MaxLease int
+}
+
+func (p *Pool) GetMeta() Meta {
+	return p.Meta
+}
+
+func (p *Pool) SetMeta(d Meta) {
+	p.Meta = d
+}
+
+func (p *Pool) GetDocumentation() string {
+	return p.Documentation
+}
+
+func (p *Pool) Prefix() string {
+	return "pools"
+}
+
+func (p *Pool) Key() string {
+	return p.Name
+}
+
+func (p *Pool) KeyName() string {
+	return "Name"
+}
+
+func (p *Pool) Fill() {
+	p.Validation.fill()
+	if p.Meta == nil {
+		p.Meta = Meta{}
+	}
+	if p.Profiles == nil {
+		p.Profiles = []string{}
+	}
+}
+
+func (p *Pool) AuthKey() string {
+	return p.Key()
+}
+
+func (p *Pool) SliceOf() interface{} {
+	ps := []*Pool{}
+	return &ps
+}
+
+func (p *Pool) ToModels(obj interface{}) []Model {
+	items := obj.(*[]*Pool)
+	res := make([]Model, len(*items))
+	for i, item := range *items {
+		res[i] = Model(item)
+	}
+	return res
+}
+
+func (p *Pool) Validate() {
+	p.AddError(ValidName("Invalid Name", p.Name))
+	for _, name := range p.Profiles {
+		p.AddError(ValidName("Invalid Profile", name))
+	}
+	if p.ReleaseWorkflow != "" {
+		p.AddError(ValidName("Invalid ReleaseWorkflow", p.ReleaseWorkflow))
+	}
+	if p.DefaultLease < 0 {
+		p.Errorf("Invalid DefaultLease %d", p.DefaultLease)
+	}
+	if p.MaxLease < 0 {
+		p.Errorf("Invalid MaxLease %d", p.MaxLease)
+	}
+	if p.MaxLease > 0 && p.DefaultLease > p.MaxLease {
+		p.Errorf("DefaultLease %d is longer than MaxLease %d", p.DefaultLease, p.MaxLease)
+	}
+}
+
+// PoolAllocation is a request to allocate Machines from a Pool.
+//
+// swagger:model
+type PoolAllocation struct {
+	// Count is how many Machines to allocate.  Either all of them
+	// are allocated, or none are.
+	//
+	// required: true
+	Count int
+	// Lease is how long in seconds the Machines are allocated for.
+	// 0 means the DefaultLease of the Pool.
+	Lease int
+}
+
+// Validate checks that a is a well formed PoolAllocation.
+func (a *PoolAllocation) Validate(e ErrorAdder) {
+	if a.Count < 1 {
+		e.Errorf("Invalid Count %d", a.Count)
+	}
+	if a.Lease < 0 {
+		e.Errorf("Invalid Lease %d", a.Lease)
+	}
+}
+
+// PoolRelease is a request to release Machines back to a Pool.
+//
+// swagger:model
+type PoolRelease struct {
+	// Machines are the UUIDs of the Machines to release.  If it is
+	// empty, every Machine in the Pool owned by the caller is
+	// released.
+	Machines []uuid.UUID
+	// Force allows releasing Machines that are owned by someone
+	// else.  It requires permission to update the Pool.
+	Force bool
+}
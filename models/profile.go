@@ -28,6 +28,16 @@ type Profile struct {
 	// for BootEnv, as documented by that boot environment's
 	// RequiredParams and OptionalParams.
 	Params map[string]interface{}
+	// An array of other profiles this profile includes.  When looking
+	// for a parameter, the profile's own Params are consulted first,
+	// followed by the included profiles in order.  Included profiles
+	// may include other profiles, but cycles are not allowed.
+	Profiles []string
+	// An optional selector that automatically applies this profile to
+	// every machine it matches.  It uses the same syntax as the query
+	// parameters of the machine list API, for example
+	// "Meta.site=Eq(dc2)&Workflow=discover".
+	Selector string
 }
 
 func (p *Profile) GetMeta() Meta {
@@ -43,6 +53,9 @@ func (p *Profile) Validate() {
 	for k := range p.Params {
 		p.AddError(ValidParamName("Invalid Param Name", k))
 	}
+	for _, name := range p.Profiles {
+		p.AddError(ValidName("Invalid Profile", name))
+	}
 }
 
 func (p *Profile) Prefix() string {
@@ -65,6 +78,9 @@ func (p *Profile) Fill() {
 	if p.Params == nil {
 		p.Params = map[string]interface{}{}
 	}
+	if p.Profiles == nil {
+		p.Profiles = []string{}
+	}
 }
 
 func (p *Profile) AuthKey() string {
@@ -94,6 +110,15 @@ func (p *Profile) SetParams(pl map[string]interface{}) {
 	p.Params = copyMap(pl)
 }
 
+// match Profiler interface
+func (p *Profile) GetProfiles() []string {
+	return p.Profiles
+}
+
+func (p *Profile) SetProfiles(pl []string) {
+	p.Profiles = pl
+}
+
 func (p *Profile) SetName(n string) {
 	p.Name = n
 }
@@ -24,19 +24,21 @@ var (
 	basicActions     = csm("list, get, create, delete, actions")
 
 	extraScopes = map[string]string{
-		"contents":   "list, get, create, update, delete",
-		"files":      "list, get, post, delete",
-		"interfaces": "list, get",
-		"info":       "get",
-		"isos":       "list, get, post, delete",
+		"contents":    "list, get, create, update, delete",
+		"files":       "list, get, post, delete",
+		"interfaces":  "list, get",
+		"info":        "get",
+		"isos":        "list, get, post, delete",
+		"keyrotation": "get, post",
 	}
 
 	addedActions = map[string]string{
 		"users":    "token, password",
 		"jobs":     "log",
-		"machines": "getSecure, updateSecure",
-		"plugins":  "getSecure, updateSecure",
-		"profiles": "getSecure, updateSecure",
+		"machines": "getSecure, updateSecure, rotateKey",
+		"plugins":  "getSecure, updateSecure, rotateKey",
+		"pools":    "allocate, release",
+		"profiles": "getSecure, updateSecure, rotateKey",
 	}
 
 	overriddenActions = map[string]string{
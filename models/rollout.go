@@ -0,0 +1,189 @@
+package models
+
+import "github.com/pborman/uuid"
+
+// RolloutMachine is the progress of one Machine in a Rollout.
+//
+// swagger:model
+type RolloutMachine struct {
+	// Machine is the UUID of the Machine.
+	Machine uuid.UUID
+	// Wave is the wave the Machine is in, or 0 if it has not been
+	// put in a wave yet.
+	Wave int
+	// State is one of waiting, running, succeeded, or failed.
+	State string
+	// Reason says why the Machine is still waiting, or why it
+	// failed.
+	Reason string
+}
+
+// Rollout moves a fleet of Machines to a Workflow in waves.  The
+// Machines are picked by the Selector when the Rollout starts.  Each
+// wave is at most BatchSize Machines, and the next wave only starts
+// once every Machine in the current one has succeeded or failed.
+// Within a wave, Machines are only started while the GroupPercent and
+// InstallLimit allow it.
+//
+// swagger:model
+type Rollout struct {
+	Validation
+	Access
+	Meta
+	// The name of the rollout.  This must be unique across all
+	// rollouts.
+	//
+	// required: true
+	Name string
+	// A description of this rollout.
+	Description string
+	// Documentation of this rollout.  This should tell what the
+	// rollout is for, any special considerations that should be
+	// taken into account when using it, etc. in rich structured text
+	// (rst).
+	Documentation string
+	// Selector picks the Machines the rollout applies to.  It uses
+	// the same syntax as the query parameters of the machine list
+	// API, for example "Meta.site=Eq(dc2)&Workflow=discover".  It is
+	// only evaluated when the rollout starts.
+	//
+	// required: true
+	Selector string
+	// Workflow is the Workflow the Machines are switched to.  The
+	// Workflow is restarted on Machines that are already in it.
+	//
+	// required: true
+	Workflow string
+	// BatchSize is the most Machines in a wave.  0 puts every
+	// Machine in a single wave.
+	BatchSize int
+	// GroupBy is the Param that groups the Machines, for example
+	// the rack they are in.  If it is empty, all the Machines are in
+	// one group.
+	GroupBy string
+	// GroupPercent is the largest percentage of the Machines of the
+	// rollout in a group that may be running at once.  At least one
+	// Machine per group may always run.  0 means no limit.
+	GroupPercent int
+	// InstallLimit is the most Machines that may be in, or about to
+	// go into, a BootEnv whose name ends in -install at once.  This
+	// counts every Machine, not just the ones in the rollout.  0
+	// means no limit.
+	InstallLimit int
+	// FailureBudget is the largest percentage of the Machines in a
+	// wave that may fail.  When more fail, the rollout halts.  0
+	// means any failure halts the rollout.
+	FailureBudget int
+	// Paused stops the rollout from starting more Machines.
+	// Machines that are already running carry on.
+	Paused bool
+	// State is one of pending, running, paused, halted, or done.
+	//
+	// read only: true
+	State string
+	// Reason says why the rollout halted.
+	//
+	// read only: true
+	Reason string
+	// Wave is the current wave, counting from 1.  It is 0 before the
+	// rollout starts.
+	//
+	// read only: true
+	Wave int
+	// Waived is the wave whose FailureBudget was waived by resuming
+	// the rollout after it halted.
+	//
+	// read only: true
+	Waived int
+	// Progress is the progress of each Machine in the rollout.
+	//
+	// read only: true
+	Progress []RolloutMachine
+}
+
+func (r *Rollout) GetMeta() Meta {
+	return r.Meta
+}
+
+func (r *Rollout) SetMeta(d Meta) {
+	r.Meta = d
+}
+
+func (r *Rollout) GetDocumentation() string {
+	return r.Documentation
+}
+
+func (r *Rollout) Prefix() string {
+	return "rollouts"
+}
+
+func (r *Rollout) Key() string {
+	return r.Name
+}
+
+func (r *Rollout) KeyName() string {
+	return "Name"
+}
+
+func (r *Rollout) Fill() {
+	r.Validation.fill()
+	if r.Meta == nil {
+		r.Meta = Meta{}
+	}
+	if r.State == "" {
+		r.State = "pending"
+	}
+	if r.Progress == nil {
+		r.Progress = []RolloutMachine{}
+	}
+}
+
+func (r *Rollout) AuthKey() string {
+	return r.Key()
+}
+
+func (r *Rollout) SliceOf() interface{} {
+	rs := []*Rollout{}
+	return &rs
+}
+
+func (r *Rollout) ToModels(obj interface{}) []Model {
+	items := obj.(*[]*Rollout)
+	res := make([]Model, len(*items))
+	for i, item := range *items {
+		res[i] = Model(item)
+	}
+	return res
+}
+
+func (r *Rollout) Validate() {
+	r.AddError(ValidName("Invalid Name", r.Name))
+	r.AddError(ValidName("Invalid Workflow", r.Workflow))
+	if r.Selector == "" {
+		r.Errorf("Rollout must have a Selector")
+	}
+	if r.GroupBy != "" {
+		r.AddError(ValidParamName("Invalid GroupBy", r.GroupBy))
+	}
+	if r.BatchSize < 0 {
+		r.Errorf("Invalid BatchSize %d", r.BatchSize)
+	}
+	if r.InstallLimit < 0 {
+		r.Errorf("Invalid InstallLimit %d", r.InstallLimit)
+	}
+	if r.GroupPercent < 0 || r.GroupPercent > 100 {
+		r.Errorf("Invalid GroupPercent %d, must be between 0 and 100", r.GroupPercent)
+	}
+	if r.FailureBudget < 0 || r.FailureBudget > 100 {
+		r.Errorf("Invalid FailureBudget %d, must be between 0 and 100", r.FailureBudget)
+	}
+}
+
+// Counts returns how many Machines of the rollout are in each state.
+func (r *Rollout) Counts() map[string]int {
+	res := map[string]int{"waiting": 0, "running": 0, "succeeded": 0, "failed": 0}
+	for _, p := range r.Progress {
+		res[p.State]++
+	}
+	return res
+}
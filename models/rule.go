@@ -0,0 +1,204 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/VictorLowther/jsonpatch2"
+)
+
+// RuleAction is something a Rule does when it fires.
+//
+// swagger:model
+type RuleAction struct {
+	// Kind is what the action does.  It is one of:
+	//
+	//   patch: apply Patch to the target.
+	//   stage: move the target Machine to the Stage Name.
+	//   workflow: move the target Machine to the Workflow Name.
+	//   profile: add the Profile Name to the target.
+	//   plugin: run the action Name of the Plugin on the target,
+	//     with Params.
+	//   event: publish an event with a Type of rules, an Action of
+	//     Name, and the Key of the Rule.
+	//
+	// required: true
+	Kind string
+	// Name is the Stage, Workflow, Profile, plugin action, or event
+	// action, depending on Kind.
+	Name string
+	// Plugin is the Plugin that runs a plugin action.
+	Plugin string
+	// Patch is the JSON patch applied by a patch action.
+	Patch jsonpatch2.Patch
+	// Params are passed to a plugin action, and are included in the
+	// event published by an event action.
+	Params map[string]interface{}
+}
+
+// Rule performs actions when an event matches.
+//
+// swagger:model
+type Rule struct {
+	Validation
+	Access
+	Meta
+	// The name of the rule.  This must be unique across all rules.
+	//
+	// required: true
+	Name string
+	// A description of this rule.
+	Description string
+	// Documentation of this rule.  This should tell what the rule is
+	// for, any special considerations that should be taken into
+	// account when using it, etc. in rich structured text (rst).
+	Documentation string
+	// Event is the pattern the events the rule fires on must match,
+	// in the form type.action.key.  Each part is matched as a shell
+	// pattern, so jobs.*.* matches every job event.
+	//
+	// required: true
+	Event string
+	// Condition is a filter the object of the event must match, in
+	// the query syntax of the list API of the type of the event, for
+	// example "State=Eq(failed)&Stage=Eq(burnin)".  It is empty to
+	// match every object.
+	Condition string
+	// Target is what the actions are performed on.  It is empty for
+	// the object of the event, or machine for the Machine the object
+	// of a jobs event is for.
+	Target string
+	// Actions are performed in order when the rule fires.  Actions
+	// that would not change anything are skipped.  If an action
+	// fails, the rest are not performed.
+	//
+	// required: true
+	Actions []RuleAction
+	// Disabled stops the rule from firing.
+	Disabled bool
+}
+
+func (r *Rule) GetMeta() Meta {
+	return r.Meta
+}
+
+func (r *Rule) SetMeta(d Meta) {
+	r.Meta = d
+}
+
+func (r *Rule) GetDocumentation() string {
+	return r.Documentation
+}
+
+func (r *Rule) Prefix() string {
+	return "rules"
+}
+
+func (r *Rule) Key() string {
+	return r.Name
+}
+
+func (r *Rule) KeyName() string {
+	return "Name"
+}
+
+func (r *Rule) Fill() {
+	r.Validation.fill()
+	if r.Meta == nil {
+		r.Meta = Meta{}
+	}
+	if r.Actions == nil {
+		r.Actions = []RuleAction{}
+	}
+}
+
+func (r *Rule) AuthKey() string {
+	return r.Key()
+}
+
+func (r *Rule) SliceOf() interface{} {
+	rs := []*Rule{}
+	return &rs
+}
+
+func (r *Rule) ToModels(obj interface{}) []Model {
+	items := obj.(*[]*Rule)
+	res := make([]Model, len(*items))
+	for i, item := range *items {
+		res[i] = Model(item)
+	}
+	return res
+}
+
+// EventParts splits the Event of the rule into its type, action, and
+// key patterns.
+func (r *Rule) EventParts() (string, string, string, error) {
+	parts := strings.SplitN(r.Event, ".", 3)
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("Invalid Event %q, must be type.action.key", r.Event)
+	}
+	for _, part := range parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return "", "", "", fmt.Errorf("Invalid Event %q: %v", r.Event, err)
+		}
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// Matches returns true if e matches the Event of the rule.
+func (r *Rule) Matches(e *Event) bool {
+	t, a, k, err := r.EventParts()
+	if err != nil {
+		return false
+	}
+	for _, p := range [][2]string{{t, e.Type}, {a, e.Action}, {k, e.Key}} {
+		if ok, _ := path.Match(p[0], p[1]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) Validate() {
+	r.AddError(ValidName("Invalid Name", r.Name))
+	t, _, _, err := r.EventParts()
+	r.AddError(err)
+	switch r.Target {
+	case "":
+	case "machine":
+		if err == nil && t != "jobs" && t != "machines" {
+			r.Errorf("Target machine can only be used with jobs and machines events")
+		}
+	default:
+		r.Errorf("Invalid Target %q, must be empty or machine", r.Target)
+	}
+	if len(r.Actions) == 0 {
+		r.Errorf("Rule must have Actions")
+	}
+	for i, a := range r.Actions {
+		switch a.Kind {
+		case "patch":
+			if len(a.Patch) == 0 {
+				r.Errorf("Action %d: patch must have a Patch", i)
+			}
+		case "stage", "workflow":
+			r.AddError(ValidName(fmt.Sprintf("Action %d: invalid %s", i, a.Kind), a.Name))
+			if t != "machines" && r.Target != "machine" {
+				r.Errorf("Action %d: %s can only be used when the target is a Machine", i, a.Kind)
+			}
+		case "profile":
+			r.AddError(ValidName(fmt.Sprintf("Action %d: invalid %s", i, a.Kind), a.Name))
+		case "plugin":
+			if a.Name == "" || a.Plugin == "" {
+				r.Errorf("Action %d: plugin must have a Name and a Plugin", i)
+			}
+		case "event":
+			if a.Name == "" {
+				r.Errorf("Action %d: event must have a Name", i)
+			}
+		default:
+			r.Errorf("Action %d: invalid Kind %q", i, a.Kind)
+		}
+	}
+}
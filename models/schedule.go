@@ -0,0 +1,238 @@
+package models
+
+import (
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Schedule moves Machines to a Workflow or a Stage at a set time,
+// and optionally again on a recurring basis.  The Machines are the
+// ones listed in Machines, plus the ones picked by the Selector.
+//
+// swagger:model
+type Schedule struct {
+	Validation
+	Access
+	Meta
+	// The name of the schedule.  This must be unique across all
+	// schedules.
+	//
+	// required: true
+	Name string
+	// A description of this schedule.
+	Description string
+	// Documentation of this schedule.  This should tell what the
+	// schedule is for, any special considerations that should be
+	// taken into account when using it, etc. in rich structured text
+	// (rst).
+	Documentation string
+	// Machines are the UUIDs of Machines the schedule applies to.
+	Machines []uuid.UUID
+	// Selector picks more Machines the schedule applies to.  It uses
+	// the same syntax as the query parameters of the machine list
+	// API, for example "Meta.site=Eq(dc2)&Workflow=discover".
+	Selector string
+	// Workflow is the Workflow the Machines are switched to.  The
+	// Workflow is restarted on Machines that are already in it.
+	Workflow string
+	// Stage is the Stage the Machines are switched to.  The Stage is
+	// restarted on Machines that are already in it.  Machines that
+	// are in a Workflow are skipped.
+	Stage string
+	// Start is the first time the schedule fires.
+	//
+	// required: true
+	// swagger:strfmt date-time
+	Start time.Time
+	// Every is how many Units there are between the times the
+	// schedule fires.  0 means the schedule only fires once.
+	Every int
+	// Unit is the unit of Every.  It must be one of hours, days,
+	// weeks, or months.  Months are calendar months, so a schedule
+	// that starts on the 15th fires on the 15th of every month.
+	Unit string
+	// Window is how long in seconds after the time the schedule
+	// fires that the Machines may still be moved, for example while
+	// dr-provision was down.  Past that, the firing is missed.  0
+	// means 3600.
+	Window int
+	// Disabled stops the schedule from firing.
+	Disabled bool
+	// NextRun is the next time the schedule will fire.  It is zero
+	// if the schedule is disabled or will not fire again.
+	//
+	// read only: true
+	// swagger:strfmt date-time
+	NextRun time.Time
+	// LastRun is the last time the schedule fired.
+	//
+	// read only: true
+	// swagger:strfmt date-time
+	LastRun time.Time
+}
+
+func (s *Schedule) GetMeta() Meta {
+	return s.Meta
+}
+
+func (s *Schedule) SetMeta(d Meta) {
+	s.Meta = d
+}
+
+func (s *Schedule) GetDocumentation() string {
+	return s.Documentation
+}
+
+func (s *Schedule) Prefix() string {
+	return "schedules"
+}
+
+func (s *Schedule) Key() string {
+	return s.Name
+}
+
+func (s *Schedule) KeyName() string {
+	return "Name"
+}
+
+func (s *Schedule) Fill() {
+	s.Validation.fill()
+	if s.Meta == nil {
+		s.Meta = Meta{}
+	}
+	if s.Machines == nil {
+		s.Machines = []uuid.UUID{}
+	}
+}
+
+func (s *Schedule) AuthKey() string {
+	return s.Key()
+}
+
+func (s *Schedule) SliceOf() interface{} {
+	ss := []*Schedule{}
+	return &ss
+}
+
+func (s *Schedule) ToModels(obj interface{}) []Model {
+	items := obj.(*[]*Schedule)
+	res := make([]Model, len(*items))
+	for i, item := range *items {
+		res[i] = Model(item)
+	}
+	return res
+}
+
+func (s *Schedule) Validate() {
+	s.AddError(ValidName("Invalid Name", s.Name))
+	switch {
+	case s.Workflow == "" && s.Stage == "":
+		s.Errorf("Schedule must have a Workflow or a Stage")
+	case s.Workflow != "" && s.Stage != "":
+		s.Errorf("Schedule cannot have both a Workflow and a Stage")
+	case s.Workflow != "":
+		s.AddError(ValidName("Invalid Workflow", s.Workflow))
+	default:
+		s.AddError(ValidName("Invalid Stage", s.Stage))
+	}
+	if len(s.Machines) == 0 && s.Selector == "" {
+		s.Errorf("Schedule must have Machines or a Selector")
+	}
+	if s.Start.IsZero() {
+		s.Errorf("Schedule must have a Start")
+	}
+	if s.Every < 0 {
+		s.Errorf("Invalid Every %d", s.Every)
+	}
+	if s.Every > 0 {
+		switch s.Unit {
+		case "hours", "days", "weeks", "months":
+		default:
+			s.Errorf("Invalid Unit %q, must be one of hours, days, weeks, or months", s.Unit)
+		}
+	}
+	if s.Window < 0 {
+		s.Errorf("Invalid Window %d", s.Window)
+	}
+}
+
+// WindowLength returns how long after the time the schedule fires
+// that Machines may still be moved.
+func (s *Schedule) WindowLength() time.Duration {
+	if s.Window == 0 {
+		return time.Hour
+	}
+	return time.Duration(s.Window) * time.Second
+}
+
+// fireTime returns the nth time the schedule fires.
+func (s *Schedule) fireTime(n int) time.Time {
+	switch s.Unit {
+	case "hours":
+		return s.Start.Add(time.Duration(n*s.Every) * time.Hour)
+	case "days":
+		return s.Start.AddDate(0, 0, n*s.Every)
+	case "weeks":
+		return s.Start.AddDate(0, 0, 7*n*s.Every)
+	default:
+		return s.Start.AddDate(0, n*s.Every, 0)
+	}
+}
+
+// Next returns the first time after t that the schedule fires, or
+// the zero time if it never fires after t.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.Start.After(t) {
+		return s.Start
+	}
+	if s.Every <= 0 {
+		return time.Time{}
+	}
+	// Guess low using the longest a Unit can be, and step forward.
+	// Times are counted from Start, so months do not drift.
+	unit := time.Hour
+	switch s.Unit {
+	case "days":
+		unit = 25 * time.Hour
+	case "weeks":
+		unit = 7*24*time.Hour + time.Hour
+	case "months":
+		unit = 31*24*time.Hour + time.Hour
+	}
+	n := int(t.Sub(s.Start)/(unit*time.Duration(s.Every))) - 1
+	if n < 0 {
+		n = 0
+	}
+	for !s.fireTime(n).After(t) {
+		n++
+	}
+	return s.fireTime(n)
+}
+
+// ScheduleSkip is a Machine that a Schedule did not move, and why.
+//
+// swagger:model
+type ScheduleSkip struct {
+	Machine uuid.UUID
+	Reason  string
+}
+
+// ScheduleRun is what happened when a Schedule fired.  It is the
+// object of the fire, skip, and miss events of the Schedule.
+//
+// swagger:model
+type ScheduleRun struct {
+	// Schedule is the name of the Schedule that fired.
+	Schedule string
+	// Time is when the Schedule was due to fire.
+	//
+	// swagger:strfmt date-time
+	Time time.Time
+	// Moved are the Machines that were switched to the Workflow or
+	// Stage of the Schedule.
+	Moved []uuid.UUID
+	// Skipped are the Machines that were left alone, because they
+	// were busy or could not be switched.
+	Skipped []ScheduleSkip
+}
@@ -0,0 +1,31 @@
+package models
+
+// SecretRef refers to a secret in an external secret store.  Wrapped
+// in a SecretValue, it is used in place of SecureData as the value
+// of a secure Param.  The reference is resolved whenever the Param
+// would otherwise be decrypted, so the secret is never stored by
+// dr-provision.
+//
+// swagger:model
+type SecretRef struct {
+	// Path is the path of the secret in the external secret store,
+	// such as secret/data/db for a KV version 2 mount.
+	//
+	// required: true
+	Path string
+	// Field is the field in the secret to use as the value of the
+	// Param.  If empty, all the fields of the secret are used as an
+	// object.
+	Field string
+}
+
+// SecretValue is how a SecretRef is stored as the value of a secure
+// Param.  The SecretRef key marks the value as a reference, so that
+// ordinary object values that happen to have a Path field are never
+// mistaken for one.
+//
+// swagger:model
+type SecretValue struct {
+	// required: true
+	SecretRef *SecretRef
+}
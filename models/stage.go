@@ -44,7 +44,9 @@ type Stage struct {
 	//
 	// required: true
 	BootEnv string
-	// The list of initial machine tasks that the stage should run
+	// The list of initial machine tasks that the stage should run.
+	// An entry of the form group:task1,task2 is a task group, whose
+	// Tasks are run at the same time.
 	Tasks []string
 	// The list of profiles a machine should use while in this stage.
 	// These are used after machine profiles, but before global.
@@ -55,6 +57,14 @@ type Stage struct {
 	Reboot bool
 	// This flag is deprecated and will always be TRUE.
 	RunnerWait bool
+	// Timeout is the number of seconds a Machine may stay in this
+	// Stage before dr-provision fails its current Job with an
+	// ExitState of timeout.  0 means there is no limit.
+	Timeout int
+	// TimeoutWorkflow is the Workflow a Machine is switched to when
+	// it times out in this Stage.  If it is empty, the Machine is
+	// left as it is.
+	TimeoutWorkflow string
 }
 
 func (s *Stage) GetMeta() Meta {
@@ -87,8 +97,18 @@ func (s *Stage) Validate() {
 	for _, p := range s.Profiles {
 		s.AddError(ValidName("Invalid Profile", p))
 	}
+	if s.Timeout < 0 {
+		s.Errorf("Invalid Timeout %d", s.Timeout)
+	}
+	if s.TimeoutWorkflow != "" {
+		s.AddError(ValidName("Invalid TimeoutWorkflow", s.TimeoutWorkflow))
+	}
 	for _, t := range s.Tasks {
-		s.AddError(ValidName("Invalid Task", t))
+		if IsTaskGroup(t) {
+			s.AddError(ValidTaskGroup("Invalid Task Group", t))
+		} else {
+			s.AddError(ValidName("Invalid Task", t))
+		}
 	}
 }
 
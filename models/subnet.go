@@ -3,6 +3,7 @@ package models
 import (
 	"math/big"
 	"net"
+	"text/template"
 )
 
 // Subnet represents a DHCP Subnet
@@ -124,6 +125,10 @@ type Subnet struct {
 	//
 	// required: true
 	Pickers []string
+	// NameTemplate is the template used to name Machines discovered
+	// on this subnet.  It overrides the machineNameTemplate
+	// preference.
+	NameTemplate string
 }
 
 func (s *Subnet) GetMeta() Meta {
@@ -179,6 +184,11 @@ func (s *Subnet) Validate() {
 	if s.ReservedLeaseTime < 7200 {
 		s.Errorf("ReservedLeaseTime must be greater than or equal to 7200 seconds, not %d", s.ReservedLeaseTime)
 	}
+	if s.NameTemplate != "" {
+		if _, err := template.New("NameTemplate").Parse(s.NameTemplate); err != nil {
+			s.Errorf("Invalid NameTemplate: %v", err)
+		}
+	}
 
 }
 
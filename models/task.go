@@ -29,6 +29,26 @@ type Task struct {
 	//
 	// required: true
 	OptionalParams []string
+	// ResultParams maps keys in the Result of a finished Job for
+	// this Task to the Params on the Machine they are saved in.
+	// Values are validated against the schema of the Param before
+	// they are saved.
+	ResultParams map[string]string
+	// ResultMeta maps keys in the Result of a finished Job for this
+	// Task to the Meta keys on the Machine they are saved in.
+	// Values that are not strings are saved as JSON.
+	ResultMeta map[string]string
+	// Retry controls whether failed Jobs for this Task are retried
+	// automatically.
+	Retry TaskRetry
+	// Timeout is the number of seconds a Job for this Task may be
+	// running for before dr-provision fails it with an ExitState of
+	// timeout.  0 means there is no limit.
+	Timeout int
+	// TimeoutWorkflow is the Workflow a Machine is switched to when a
+	// Job for this Task times out and is not going to be retried.
+	// If it is empty, the Machine is left as it is.
+	TimeoutWorkflow string
 }
 
 func (t *Task) GetMeta() Meta {
@@ -57,6 +77,24 @@ func (t *Task) Validate() {
 			t.AddError(ValidName("Invalid Template ID", tt.ID))
 		}
 	}
+	for k, p := range t.ResultParams {
+		if k == "" {
+			t.Errorf("Invalid empty ResultParams key")
+		}
+		t.AddError(ValidParamName("Invalid Result Param", p))
+	}
+	for k, m := range t.ResultMeta {
+		if k == "" || m == "" {
+			t.Errorf("Invalid ResultMeta mapping `%s` to `%s`", k, m)
+		}
+	}
+	t.Retry.validate(t)
+	if t.Timeout < 0 {
+		t.Errorf("Invalid Timeout %d", t.Timeout)
+	}
+	if t.TimeoutWorkflow != "" {
+		t.AddError(ValidName("Invalid TimeoutWorkflow", t.TimeoutWorkflow))
+	}
 }
 
 func (t *Task) Prefix() string {
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A task group is a Task list entry that names several Tasks whose
+// Jobs may run at the same time.  It is written as
+//
+//   group:task1,task2,task3
+//
+// The Jobs for the members of a task group all share the CurrentIndex
+// of the group entry.  The group is finished when every member has
+// finished, and has failed as soon as any member fails.
+
+// IsTaskGroup returns true if s is a task group.
+func IsTaskGroup(s string) bool {
+	return strings.HasPrefix(s, "group:")
+}
+
+// TaskGroupMembers returns the names of the Tasks in the task group
+// s, or nil if s is not a task group.
+func TaskGroupMembers(s string) []string {
+	if !IsTaskGroup(s) {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(s, "group:"), ",")
+}
+
+// ValidTaskGroup returns an error if s is not a well-formed task
+// group.
+func ValidTaskGroup(msg, s string) error {
+	members := TaskGroupMembers(s)
+	if members == nil {
+		return fmt.Errorf("%s `%s`: not a task group", msg, s)
+	}
+	seen := map[string]bool{}
+	for _, member := range members {
+		if err := ValidName(msg, member); err != nil {
+			return err
+		}
+		if seen[member] {
+			return fmt.Errorf("%s `%s`: %s is listed more than once", msg, s, member)
+		}
+		seen[member] = true
+	}
+	return nil
+}
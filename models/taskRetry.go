@@ -0,0 +1,102 @@
+package models
+
+import "time"
+
+// TaskRetry describes when a failed Job for a Task is automatically
+// retried by dr-provision, and how long it waits before doing so.
+//
+// swagger:model
+type TaskRetry struct {
+	// MaxAttempts is the most times a Job for the Task will be run
+	// at the same CurrentIndex, counting the first run.  0 or 1
+	// turns retries off.
+	MaxAttempts int
+	// Backoff is the number of seconds to wait before the first
+	// retry.  The wait doubles for each retry after that.
+	Backoff int
+	// MaxBackoff is the longest wait between retries in seconds.
+	// 0 means there is no limit.
+	MaxBackoff int
+	// ExitStates lists the ExitStates of failed Jobs that will be
+	// retried.  If it is empty, failed Jobs with an ExitState of
+	// failed are retried.
+	ExitStates []string
+	// ExitCodes lists the exit codes of failed Jobs that will be
+	// retried.  If it is empty, any exit code will be retried.
+	ExitCodes []int
+}
+
+func (r *TaskRetry) validate(e ErrorAdder) {
+	if r.MaxAttempts < 0 {
+		e.Errorf("Invalid Retry MaxAttempts %d", r.MaxAttempts)
+	}
+	if r.Backoff < 0 {
+		e.Errorf("Invalid Retry Backoff %d", r.Backoff)
+	}
+	if r.MaxBackoff < 0 {
+		e.Errorf("Invalid Retry MaxBackoff %d", r.MaxBackoff)
+	}
+	for _, s := range r.ExitStates {
+		switch s {
+		case "reboot", "poweroff", "stop", "complete", "failed", "timeout":
+		default:
+			e.Errorf("Invalid Retry ExitState `%s`", s)
+		}
+	}
+}
+
+// Retryable returns true if j has failed in a way that should be
+// retried, and it has attempts left.
+func (r *TaskRetry) Retryable(j *Job) bool {
+	attempt := j.Attempt
+	if attempt < 1 {
+		attempt = 1
+	}
+	if j.State != "failed" || attempt >= r.MaxAttempts {
+		return false
+	}
+	exitState := j.ExitState
+	if exitState == "" {
+		exitState = "failed"
+	}
+	states := r.ExitStates
+	if len(states) == 0 {
+		states = []string{"failed"}
+	}
+	stateOK := false
+	for _, s := range states {
+		if s == exitState {
+			stateOK = true
+			break
+		}
+	}
+	if !stateOK {
+		return false
+	}
+	if len(r.ExitCodes) == 0 {
+		return true
+	}
+	for _, c := range r.ExitCodes {
+		if c == j.ExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait before starting the retry that
+// follows the Job on its attempt-th attempt.
+func (r *TaskRetry) Delay(attempt int) time.Duration {
+	delay := time.Duration(r.Backoff) * time.Second
+	max := time.Duration(r.MaxBackoff) * time.Second
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if max > 0 && delay > max {
+			break
+		}
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
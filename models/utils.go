@@ -75,6 +75,11 @@ func All() []Model {
 		&User{},
 		&Workflow{},
 		&Tenant{},
+		&Pool{},
+		&Schedule{},
+		&Rollout{},
+		&Rule{},
+		&Policy{},
 	}
 }
 
@@ -7,7 +7,10 @@ type Workflow struct {
 	Name          string
 	Description   string
 	Documentation string
-	Stages        []string
+	// Stages is the list of Stages a Machine using this Workflow
+	// goes through, in order.  It can also contain flow control
+	// steps, which are described by WorkflowStep.
+	Stages []string
 }
 
 func (w *Workflow) GetMeta() Meta {
@@ -64,6 +67,11 @@ func (w *Workflow) ToModels(obj interface{}) []Model {
 func (w *Workflow) Validate() {
 	w.AddError(ValidName("Invalid Name", w.Name))
 	for _, stageName := range w.Stages {
+		if IsWorkflowStep(stageName) {
+			_, err := ParseWorkflowStep(stageName)
+			w.AddError(err)
+			continue
+		}
 		w.AddError(ValidName("Invalid Stage Name", stageName))
 	}
 }
@@ -0,0 +1,44 @@
+package models
+
+import "github.com/pborman/uuid"
+
+// WorkflowProblem is something that would stop a Workflow from
+// working on a Machine.
+//
+// swagger:model
+type WorkflowProblem struct {
+	// Kind is what the problem is with.  It is one of workflows,
+	// stages, bootenvs, tasks, params, or templates.
+	Kind string
+	// Name is the name of the object the problem is with.
+	Name string
+	// At is the index in Tasks of the entry the problem was found
+	// at, or -1 if it is not about a particular entry.
+	At int
+	// Message describes the problem.
+	Message string
+}
+
+// WorkflowCheck is the result of checking whether a Workflow will
+// work on a Machine, without changing the Machine.
+//
+// swagger:model
+type WorkflowCheck struct {
+	// Workflow is the name of the Workflow that was checked.
+	Workflow string
+	// Machine is the UUID of the Machine it was checked against.
+	Machine uuid.UUID
+	// Tasks is the task list the Machine would run in the
+	// Workflow.
+	Tasks []string
+	// Problems are the problems that were found.
+	Problems []WorkflowProblem
+	// OK is true if there are no Problems.
+	OK bool
+}
+
+// Problem adds a problem to the WorkflowCheck.
+func (w *WorkflowCheck) Problem(kind, name string, at int, msg string) {
+	w.Problems = append(w.Problems, WorkflowProblem{Kind: kind, Name: name, At: at, Message: msg})
+	w.OK = false
+}
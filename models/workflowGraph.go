@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WorkflowNode is one of the objects in a WorkflowGraph.
+//
+// swagger:model
+type WorkflowNode struct {
+	// Id is unique in the graph.  Stages, BootEnvs and Profiles
+	// appear once no matter how often they are used, so their Id is
+	// their Kind and Name.  Tasks are given an Id for each place they
+	// are used.
+	Id string
+	// Kind is one of workflow, step, stage, bootenv, profile, group,
+	// or task.
+	Kind string
+	// Name is the name of the object, or the flow control step or
+	// task group as written in the Workflow or Stage.
+	Name string
+	// Available is false if the object does not exist or is not
+	// available.
+	Available bool
+	// Errors are the validation errors of the object.
+	Errors []string
+	// Reboot is true if a Machine reboots when it reaches this Stage,
+	// either because the Stage has the Reboot flag or because it
+	// changes the BootEnv.
+	Reboot bool
+}
+
+// WorkflowEdge connects two WorkflowNodes in a WorkflowGraph.
+//
+// swagger:model
+type WorkflowEdge struct {
+	// From is the Id of the node the edge starts at.
+	From string
+	// To is the Id of the node the edge ends at.
+	To string
+	// Kind is one of next (the order Stages and steps are reached
+	// in), jump (a flow control step to its target), bootenv,
+	// profile, task (a Stage to the Tasks it runs), or member (a task
+	// group to its Tasks).
+	Kind string
+	// Label is the condition of a jump, or the index of a Task in its
+	// Stage.
+	Label string
+}
+
+// WorkflowGraph is the expanded structure of a Workflow.
+//
+// swagger:model
+type WorkflowGraph struct {
+	// Workflow is the name of the Workflow.
+	Workflow string
+	// Available is false if the Workflow or anything in it is not
+	// available.
+	Available bool
+	Nodes     []WorkflowNode
+	Edges     []WorkflowEdge
+}
+
+// Node adds a node to the graph if there is not one with the same Id
+// already, and returns the Id.
+func (g *WorkflowGraph) Node(id, kind, name string, available bool, errors []string) string {
+	for i := range g.Nodes {
+		if g.Nodes[i].Id == id {
+			return id
+		}
+	}
+	if errors == nil {
+		errors = []string{}
+	}
+	g.Nodes = append(g.Nodes, WorkflowNode{Id: id, Kind: kind, Name: name, Available: available, Errors: errors})
+	g.Available = g.Available && available
+	return id
+}
+
+// Edge adds an edge to the graph.
+func (g *WorkflowGraph) Edge(from, to, kind, label string) {
+	g.Edges = append(g.Edges, WorkflowEdge{From: from, To: to, Kind: kind, Label: label})
+}
+
+var workflowNodeShapes = map[string]string{
+	"workflow": "doubleoctagon",
+	"step":     "diamond",
+	"stage":    "box",
+	"bootenv":  "ellipse",
+	"profile":  "folder",
+	"group":    "component",
+	"task":     "note",
+}
+
+// Dot renders the graph in the Graphviz DOT language.  Nodes that are
+// not available are drawn in red with their errors as a tooltip, and
+// Stages that reboot the Machine are drawn bold.
+func (g *WorkflowGraph) Dot() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "digraph %s {\n", strconv.Quote(g.Workflow))
+	fmt.Fprintf(buf, "  rankdir=LR;\n")
+	for _, n := range g.Nodes {
+		attrs := []string{
+			"label=" + strconv.Quote(n.Name),
+			"shape=" + workflowNodeShapes[n.Kind],
+		}
+		if n.Reboot {
+			attrs = append(attrs, "style=bold")
+		}
+		if !n.Available {
+			attrs = append(attrs, "color=red", "fontcolor=red")
+		}
+		if len(n.Errors) > 0 {
+			attrs = append(attrs, "tooltip="+strconv.Quote(strings.Join(n.Errors, "\n")))
+		}
+		fmt.Fprintf(buf, "  %s [%s];\n", strconv.Quote(n.Id), strings.Join(attrs, ", "))
+	}
+	for _, e := range g.Edges {
+		attrs := []string{}
+		switch e.Kind {
+		case "jump":
+			attrs = append(attrs, "style=dashed")
+		case "bootenv", "profile", "member":
+			attrs = append(attrs, "style=dotted", "arrowhead=none")
+		}
+		if e.Label != "" {
+			attrs = append(attrs, "label="+strconv.Quote(e.Label))
+		}
+		fmt.Fprintf(buf, "  %s -> %s", strconv.Quote(e.From), strconv.Quote(e.To))
+		if len(attrs) > 0 {
+			fmt.Fprintf(buf, " [%s]", strings.Join(attrs, ", "))
+		}
+		fmt.Fprintf(buf, ";\n")
+	}
+	fmt.Fprintf(buf, "}\n")
+	return buf.String()
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// WorkflowStep is a flow control step in the Stages of a Workflow.
+// Flow control steps are copied into the Tasks of Machines using the
+// Workflow, and are evaluated by dr-provision as the Machine advances
+// through its Tasks.  There are two kinds of flow control step:
+//
+//   goto:target
+//
+// continues at the Stage named target, and
+//
+//   if:Param=value:target
+//   if:Param!=value:target
+//
+// continues at the Stage named target if the aggregated value of
+// Param on the Machine matches (or does not match) value, and with the
+// next step otherwise.  Values that are not strings are compared using
+// their JSON encoding.  The special Param name ExitState tests the
+// ExitState of the last Job the Machine ran, which allows a Workflow
+// to jump to a remediation Stage when a Job fails.
+//
+// The target of a flow control step must be one of the Stages in the
+// Workflow.
+type WorkflowStep struct {
+	// Kind is either if or goto
+	Kind string
+	// Param is the Param tested by an if step
+	Param string
+	// Negate is true if the if step tests for inequality.
+	Negate bool
+	// Value is what the Param is compared against.
+	Value string
+	// Target is the Stage to continue at.
+	Target string
+}
+
+// ParseWorkflowStep parses s as a flow control step.  If s is not a
+// flow control step at all, ParseWorkflowStep returns nil, nil.
+func ParseWorkflowStep(s string) (*WorkflowStep, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	res := &WorkflowStep{Kind: parts[0]}
+	switch parts[0] {
+	case "goto":
+		res.Target = parts[1]
+	case "if":
+		idx := strings.LastIndex(parts[1], ":")
+		if idx == -1 {
+			return nil, fmt.Errorf("Invalid if step %s: missing target", s)
+		}
+		cond := parts[1][:idx]
+		res.Target = parts[1][idx+1:]
+		if ci := strings.Index(cond, "!="); ci != -1 {
+			res.Param, res.Value, res.Negate = cond[:ci], cond[ci+2:], true
+		} else if ci := strings.Index(cond, "="); ci != -1 {
+			res.Param, res.Value = cond[:ci], cond[ci+1:]
+		} else {
+			return nil, fmt.Errorf("Invalid if step %s: missing condition", s)
+		}
+		if res.Param != "ExitState" {
+			if err := ValidParamName("Invalid Param", res.Param); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, nil
+	}
+	if err := ValidName("Invalid Stage", res.Target); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// IsWorkflowStep returns true if s is a flow control step.
+func IsWorkflowStep(s string) bool {
+	return strings.HasPrefix(s, "if:") || strings.HasPrefix(s, "goto:")
+}
+
+// Matches returns true if the step should jump to its Target when
+// its Param has the value val.  goto steps always match.
+func (s *WorkflowStep) Matches(val interface{}) bool {
+	if s.Kind == "goto" {
+		return true
+	}
+	var sv string
+	switch v := val.(type) {
+	case string:
+		sv = v
+	case nil:
+		sv = ""
+	default:
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return false
+		}
+		sv = string(buf)
+	}
+	return (sv == s.Value) != s.Negate
+}
@@ -62,6 +62,7 @@ type ProgOpts struct {
 	DisableProvisioner  bool   `long:"disable-provisioner" description:"Disable provisioner"`
 	DisableDHCP         bool   `long:"disable-dhcp" description:"Disable DHCP server"`
 	DisableBINL         bool   `long:"disable-pxe" description:"Disable PXE/BINL server"`
+	DisableRules        bool   `long:"disable-rules" description:"Disable the rule engine"`
 	StaticPort          int    `long:"static-port" description:"Port the static HTTP file server should listen on" default:"8091"`
 	TftpPort            int    `long:"tftp-port" description:"Port for the TFTP server to listen on" default:"69"`
 	ApiPort             int    `long:"api-port" description:"Port for the API server to listen on" default:"8092"`
@@ -77,6 +78,17 @@ type ProgOpts struct {
 	LocalContent   string `long:"local-content" description:"Storage to use for local overrides." default:"directory:///etc/dr-provision?codec=yaml"`
 	DefaultContent string `long:"default-content" description:"Store URL for local content" default:"file:///usr/share/dr-provision/default.yaml?codec=yaml"`
 
+	SecretStoreURL    string `long:"secret-store-url" description:"Base URL of an external Vault-style KV secret store for secure params, such as https://vault:8200/v1" default:""`
+	SecretStoreToken  string `long:"secret-store-token" description:"Token to use with the external secret store" default:""`
+	SecretStoreTTL    int    `long:"secret-store-ttl" description:"Time in seconds to cache secrets fetched from the external secret store" default:"300"`
+	SecretStorePrefix string `long:"secret-store-prefix" description:"Path in the external secret store that secure params can refer to secrets under" default:""`
+
+	TimeoutSweepInterval int `long:"timeout-sweep-interval" description:"Time in seconds between checks for timed out jobs and stages.  0 disables timeouts" default:"60"`
+	JobPruneInterval     int `long:"job-prune-interval" description:"Time in seconds between applying the job retention preferences.  0 disables job pruning" default:"3600"`
+	PoolExpireInterval   int `long:"pool-expire-interval" description:"Time in seconds between checks for expired machine pool allocations.  0 disables automatic release" default:"60"`
+	ScheduleInterval     int `long:"schedule-interval" description:"Time in seconds between checks for schedules that have come due.  0 disables schedules" default:"60"`
+	RolloutInterval      int `long:"rollout-interval" description:"Time in seconds between advancing rollouts.  0 disables rollouts" default:"15"`
+
 	BaseRoot        string `long:"base-root" description:"Base directory for other root dirs." default:"/var/lib/dr-provision"`
 	DataRoot        string `long:"data-root" description:"Location we should store runtime information in" default:"digitalrebar"`
 	SecretsRoot     string `long:"secrets-root" description:"Location we should store encrypted parameter private keys in" default:"secrets"`
@@ -319,6 +331,34 @@ func server(localLogger *log.Logger, cOpts *ProgOpts) string {
 		},
 		publishers)
 
+	if cOpts.SecretStoreURL != "" {
+		dt.ExternalSecrets = backend.NewSecretStore(cOpts.SecretStoreURL,
+			cOpts.SecretStoreToken,
+			time.Duration(cOpts.SecretStoreTTL)*time.Second)
+		dt.ExternalSecrets.Prefix = cOpts.SecretStorePrefix
+	}
+	dt.ResumeRetries(buf.Log("backend"))
+	if cOpts.TimeoutSweepInterval > 0 {
+		dt.StartTimeoutSweeper(buf.Log("backend"),
+			time.Duration(cOpts.TimeoutSweepInterval)*time.Second)
+	}
+	if cOpts.JobPruneInterval > 0 {
+		dt.StartJobPruner(buf.Log("backend"),
+			time.Duration(cOpts.JobPruneInterval)*time.Second)
+	}
+	if cOpts.PoolExpireInterval > 0 {
+		dt.StartPoolReaper(buf.Log("backend"),
+			time.Duration(cOpts.PoolExpireInterval)*time.Second)
+	}
+	if cOpts.ScheduleInterval > 0 {
+		dt.StartScheduler(buf.Log("backend"),
+			time.Duration(cOpts.ScheduleInterval)*time.Second)
+	}
+	if cOpts.RolloutInterval > 0 {
+		dt.StartRolloutController(buf.Log("backend"),
+			time.Duration(cOpts.RolloutInterval)*time.Second)
+	}
+
 	// No DrpId - get a mac address
 	if cOpts.DrpId == "" {
 		intfs, err := net.Interfaces()
@@ -346,6 +386,9 @@ func server(localLogger *log.Logger, cOpts *ProgOpts) string {
 		return fmt.Sprintf("Error starting plugin service: %v", err)
 	}
 	services = append(services, pc)
+	if !cOpts.DisableRules {
+		dt.StartRules(buf.Log("backend"), pc.Actions.Run)
+	}
 
 	fe := frontend.NewFrontend(dt, buf.Log("frontend"),
 		cOpts.OurAddress,